@@ -0,0 +1,50 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/task-schedulart/services"
+)
+
+// minJWTSecretLength is the shortest JWT_SECRET accepted, 32 bytes as produced by openssl rand
+const minJWTSecretLength = 32
+
+// LoadAuthConfig reads the authentication settings from environment variables.
+// It fails when JWT_SECRET is missing or too short, since tokens signed with a
+// guessable key could be forged.
+func LoadAuthConfig() (services.AuthConfig, error) {
+	cfg := services.DefaultAuthConfig()
+
+	cfg.JWTSecret = getEnv("JWT_SECRET", "")
+	if cfg.JWTSecret == "" {
+		return cfg, errors.New("JWT_SECRET is not set")
+	}
+	if len(cfg.JWTSecret) < minJWTSecretLength {
+		return cfg, fmt.Errorf("JWT_SECRET must be at least %d characters long", minJWTSecretLength)
+	}
+
+	if value, err := parseDuration(getEnv("JWT_EXPIRY", "")); err == nil && value > 0 {
+		cfg.TokenExpiry = value
+	}
+	if value, err := parseDuration(getEnv("REFRESH_TOKEN_EXPIRY", "")); err == nil && value > 0 {
+		cfg.RefreshExpiry = value
+	}
+
+	return cfg, nil
+}
+
+// parseDuration parses a Go duration, or a number of days such as 7d
+func parseDuration(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
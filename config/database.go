@@ -5,10 +5,14 @@ import (
 	"os"
 
 	"github.com/task-schedulart/models"
+	"github.com/task-schedulart/services"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// InitDB connects to the database configured through the DB_* environment
+// variables and migrates it
 func InitDB() (*gorm.DB, error) {
 	// Get database connection details from environment variables
 	dbHost := getEnv("DB_HOST", "localhost")
@@ -21,6 +25,12 @@ func InitDB() (*gorm.DB, error) {
 	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable TimeZone=UTC",
 		dbHost, dbUser, dbPassword, dbName, dbPort)
 
+	return OpenDB(dsn)
+}
+
+// OpenDB connects to the database of a connection string, migrates its schema
+// and enforces workspace isolation on the connection
+func OpenDB(dsn string) (*gorm.DB, error) {
 	// Connect to database
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
 	if err != nil {
@@ -28,14 +38,84 @@ func InitDB() (*gorm.DB, error) {
 	}
 
 	// Auto migrate the schema
-	err = db.AutoMigrate(&models.Task{})
+	err = db.AutoMigrate(&models.Task{}, &models.DeadLetter{}, &models.TaskExecution{}, &models.TaskDependency{},
+		&models.Workflow{}, &models.WorkflowRun{}, &models.Calendar{},
+		&services.User{}, &services.Session{}, &services.RefreshToken{}, &services.APIKey{},
+		&services.Team{}, &services.TeamMember{}, &services.Workspace{},
+		&services.NotificationTemplate{}, &services.NotificationChannel{}, &services.NotificationDelivery{},
+		&services.EventPayload{}, &services.OIDCNonce{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %v", err)
 	}
 
+	// AutoMigrate only creates missing check constraints, so refresh the status
+	// constraint to pick up statuses added since the table was created
+	if err := syncTaskStatusConstraint(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate task status constraint: %v", err)
+	}
+
+	if err := migrateWorkspaces(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate workspaces: %v", err)
+	}
+
+	// Every query on workspace data is limited to a workspace from here on
+	if err := services.RegisterWorkspaceScope(db); err != nil {
+		return nil, fmt.Errorf("failed to register workspace scope: %v", err)
+	}
+
 	return db, nil
 }
 
+// migrateWorkspaces creates the default workspace, which existing data belongs
+// to, and replaces the indexes that kept names unique across the deployment with
+// indexes per workspace
+func migrateWorkspaces(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		defaultWorkspace := services.Workspace{ID: services.DefaultWorkspaceID, Name: "default"}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&defaultWorkspace).Error; err != nil {
+			return err
+		}
+		// The default workspace was inserted with an explicit ID, move the sequence past it
+		if err := tx.Exec("SELECT setval(pg_get_serial_sequence('workspaces', 'id'), (SELECT MAX(id) FROM workspaces))").Error; err != nil {
+			return err
+		}
+
+		// Dependencies created before they had a workspace belong to the workspace of their task
+		if err := tx.Exec(`UPDATE task_dependencies d SET workspace_id = t.workspace_id FROM tasks t
+			WHERE t.id = d.task_id AND d.workspace_id <> t.workspace_id`).Error; err != nil {
+			return err
+		}
+
+		migrator := tx.Migrator()
+		for model, index := range map[interface{}]string{
+			&models.Calendar{}: "idx_calendars_name",
+			&models.Workflow{}: "idx_workflow_version",
+		} {
+			if migrator.HasIndex(model, index) {
+				if err := migrator.DropIndex(model, index); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// syncTaskStatusConstraint recreates the check constraint on tasks.status from the model definition
+func syncTaskStatusConstraint(db *gorm.DB) error {
+	const name = "chk_tasks_status"
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		migrator := tx.Migrator()
+		if migrator.HasConstraint(&models.Task{}, name) {
+			if err := migrator.DropConstraint(&models.Task{}, name); err != nil {
+				return err
+			}
+		}
+		return migrator.CreateConstraint(&models.Task{}, name)
+	})
+}
+
 func getEnv(key, fallback string) string {
 	if value, exists := os.LookupEnv(key); exists {
 		return value
@@ -0,0 +1,22 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/task-schedulart/services"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// InitEventBus creates the bus task events reach every replica through.
+// EVENT_BUS is "postgres", the default, or "memory" for a single replica.
+func InitEventBus(db *gorm.DB, logger *zap.Logger) (services.EventBus, error) {
+	switch bus := getEnv("EVENT_BUS", "postgres"); bus {
+	case "postgres":
+		return services.NewPostgresEventBus(db, logger), nil
+	case "memory":
+		return services.NewInProcessEventBus(logger), nil
+	default:
+		return nil, fmt.Errorf("unknown EVENT_BUS %q, expected postgres or memory", bus)
+	}
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/task-schedulart/services"
+)
+
+// LoadOIDCConfig reads the settings of login through an OpenID Connect provider
+// from environment variables. OIDC login stays disabled when OIDC_ISSUER_URL is
+// not set.
+//
+// OIDC_ROLE_GROUPS maps groups to roles, e.g. "sso-admins=admin,auditors=viewer".
+// OIDC_TEAM_GROUPS maps groups to team memberships, e.g. "platform=3:admin,ops=4:member".
+func LoadOIDCConfig() (services.OIDCConfig, error) {
+	cfg := services.DefaultOIDCConfig()
+
+	cfg.IssuerURL = getEnv("OIDC_ISSUER_URL", "")
+	if !cfg.Enabled() {
+		return cfg, nil
+	}
+	cfg.ClientID = getEnv("OIDC_CLIENT_ID", "")
+	cfg.ClientSecret = getEnv("OIDC_CLIENT_SECRET", "")
+	cfg.RedirectURL = getEnv("OIDC_REDIRECT_URL", "")
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return cfg, errors.New("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required when OIDC_ISSUER_URL is set")
+	}
+
+	if scopes := strings.Fields(getEnv("OIDC_SCOPES", "")); len(scopes) > 0 {
+		cfg.Scopes = scopes
+	}
+	cfg.GroupsClaim = getEnv("OIDC_GROUPS_CLAIM", cfg.GroupsClaim)
+	if value, err := time.ParseDuration(getEnv("OIDC_KEY_CACHE_TTL", "")); err == nil && value > 0 {
+		cfg.KeyCacheTTL = value
+	}
+
+	if value := getEnv("OIDC_WORKSPACE_ID", ""); value != "" {
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || id == 0 {
+			return cfg, errors.New("OIDC_WORKSPACE_ID must be a workspace ID")
+		}
+		cfg.WorkspaceID = uint(id)
+	}
+
+	cfg.DefaultRole = getEnv("OIDC_DEFAULT_ROLE", cfg.DefaultRole)
+	if !services.IsGlobalRole(cfg.DefaultRole) {
+		return cfg, errors.New("OIDC_DEFAULT_ROLE must be admin, user or viewer")
+	}
+
+	for group, role := range parseMapping(getEnv("OIDC_ROLE_GROUPS", "")) {
+		if !services.IsGlobalRole(role) {
+			return cfg, fmt.Errorf("OIDC_ROLE_GROUPS maps %s to unknown role %q", group, role)
+		}
+		cfg.RoleGroups[group] = role
+	}
+
+	for group, grant := range parseMapping(getEnv("OIDC_TEAM_GROUPS", "")) {
+		teamID, role, _ := strings.Cut(grant, ":")
+		id, err := strconv.ParseUint(teamID, 10, 32)
+		if err != nil || !services.IsTeamRole(role) {
+			return cfg, fmt.Errorf("OIDC_TEAM_GROUPS entry for %s must be <team id>:<admin|member|viewer>", group)
+		}
+		cfg.TeamGroups[group] = services.OIDCTeamGrant{TeamID: uint(id), Role: role}
+	}
+
+	return cfg, nil
+}
+
+// parseMapping parses comma separated key=value pairs
+func parseMapping(value string) map[string]string {
+	mapping := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && key != "" {
+			mapping[key] = val
+		}
+	}
+	return mapping
+}
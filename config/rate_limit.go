@@ -0,0 +1,26 @@
+package config
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/task-schedulart/middleware"
+)
+
+// LoadRateLimitConfig reads the request rate limits from environment variables.
+// RATE_LIMIT_WINDOW is in seconds.
+func LoadRateLimitConfig() middleware.RateLimitConfig {
+	cfg := middleware.DefaultRateLimitConfig()
+
+	if value, err := strconv.ParseFloat(getEnv("RATE_LIMIT_AUTHENTICATED", ""), 64); err == nil && value > 0 {
+		cfg.Authenticated = value
+	}
+	if value, err := strconv.ParseFloat(getEnv("RATE_LIMIT_ANONYMOUS", ""), 64); err == nil && value > 0 {
+		cfg.Anonymous = value
+	}
+	if value, err := strconv.Atoi(getEnv("RATE_LIMIT_WINDOW", "")); err == nil && value > 0 {
+		cfg.Window = time.Duration(value) * time.Second
+	}
+
+	return cfg
+}
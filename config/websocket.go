@@ -0,0 +1,32 @@
+package config
+
+import (
+	"strings"
+	"time"
+
+	"github.com/task-schedulart/services"
+)
+
+// LoadWebSocketConfig reads the WebSocket endpoint settings from environment
+// variables. WS_ALLOWED_ORIGINS is a comma separated list of origins, such as
+// "https://app.example.com".
+func LoadWebSocketConfig() services.WebSocketConfig {
+	cfg := services.DefaultWebSocketConfig()
+
+	for _, origin := range strings.Split(getEnv("WS_ALLOWED_ORIGINS", ""), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			cfg.AllowedOrigins = append(cfg.AllowedOrigins, origin)
+		}
+	}
+	if value, err := time.ParseDuration(getEnv("WS_PING_INTERVAL", "")); err == nil && value > 0 {
+		cfg.PingInterval = value
+	}
+	if value, err := time.ParseDuration(getEnv("WS_AUTH_TIMEOUT", "")); err == nil && value > 0 {
+		cfg.AuthTimeout = value
+	}
+	if value, err := time.ParseDuration(getEnv("WS_REVALIDATE_INTERVAL", "")); err == nil && value > 0 {
+		cfg.RevalidateInterval = value
+	}
+
+	return cfg
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/task-schedulart/services"
+)
+
+// LoadWorkerConfig reads the execution engine settings from environment variables
+func LoadWorkerConfig() services.WorkerConfig {
+	cfg := services.DefaultWorkerConfig()
+
+	if value, err := strconv.Atoi(getEnv("WORKER_CONCURRENCY", "")); err == nil && value > 0 {
+		cfg.Concurrency = value
+	}
+	if value, err := strconv.Atoi(getEnv("WORKER_BATCH_SIZE", "")); err == nil && value > 0 {
+		cfg.BatchSize = value
+	}
+	if value, err := time.ParseDuration(getEnv("WORKER_POLL_INTERVAL", "")); err == nil && value > 0 {
+		cfg.PollInterval = value
+	}
+	if value, err := time.ParseDuration(getEnv("WORKER_LEASE_DURATION", "")); err == nil && value > 0 {
+		cfg.LeaseDuration = value
+	}
+	if value, err := time.ParseDuration(getEnv("WORKER_TASK_TIMEOUT", "")); err == nil && value > 0 {
+		cfg.TaskTimeout = value
+	}
+
+	return cfg
+}
@@ -1,18 +1,37 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
+	_ "time/tzdata" // Recurring patterns need time zones on hosts without zoneinfo
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/task-schedulart/config"
+	"github.com/task-schedulart/middleware"
 	"github.com/task-schedulart/models"
 	"github.com/task-schedulart/services"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	// oidcStateCookie holds the state and nonce of an OIDC login until the callback
+	oidcStateCookie = "oidc_state"
+	// oidcLoginTimeout is how long a user has to complete a login at the identity provider
+	oidcLoginTimeout = 10 * time.Minute
+	// shutdownTimeout is how long requests in flight may take to finish on shutdown
+	shutdownTimeout = 20 * time.Second
 )
 
 // PaginationQuery represents query parameters for pagination
@@ -32,6 +51,58 @@ type TaskQuery struct {
 	PaginationQuery
 }
 
+// TaskRequest is the body for creating or updating a task. It only holds the
+// fields clients may set; status, retries, leases, ownership and workflow links
+// are managed by the scheduler.
+type TaskRequest struct {
+	Name              string              `json:"name"`
+	Type              string              `json:"type"`
+	Description       string              `json:"description"`
+	ScheduleTime      time.Time           `json:"scheduleTime"`
+	Priority          string              `json:"priority"`
+	RetryPolicy       *models.RetryPolicy `json:"retryPolicy"`
+	Timeout           int                 `json:"timeout"`
+	Tags              []string            `json:"tags"`
+	Metadata          string              `json:"metadata"`
+	DependsOn         []uint              `json:"dependsOn"` // Only used when creating a task
+	OnUpstreamFailure string              `json:"onUpstreamFailure"`
+	TeamID            *uint               `json:"teamId"`
+	CalendarID        *uint               `json:"calendarId"`
+	Assignee          string              `json:"assignee"`
+	DueDate           *time.Time          `json:"dueDate"`
+	EstimatedTime     int                 `json:"estimatedTime"`
+	Labels            []string            `json:"labels"`
+}
+
+// Task returns a task holding the fields of the request
+func (r TaskRequest) Task() models.Task {
+	return models.Task{
+		Name:              r.Name,
+		Type:              r.Type,
+		Description:       r.Description,
+		ScheduleTime:      r.ScheduleTime,
+		Priority:          r.Priority,
+		RetryPolicy:       r.RetryPolicy,
+		Timeout:           r.Timeout,
+		Tags:              r.Tags,
+		Metadata:          r.Metadata,
+		DependsOn:         r.DependsOn,
+		OnUpstreamFailure: r.OnUpstreamFailure,
+		TeamID:            r.TeamID,
+		CalendarID:        r.CalendarID,
+		Assignee:          r.Assignee,
+		DueDate:           r.DueDate,
+		EstimatedTime:     r.EstimatedTime,
+		Labels:            r.Labels,
+	}
+}
+
+// RecurringTaskRequest is the body for creating or updating a recurring task
+type RecurringTaskRequest struct {
+	Task    TaskRequest             `json:"task"`
+	Pattern models.RecurringPattern `json:"pattern"`
+}
+
 // convertToUint converts string ID to uint and handles errors
 func convertToUint(id string) (uint, error) {
 	num, err := strconv.ParseUint(id, 10, 32)
@@ -41,29 +112,200 @@ func convertToUint(id string) (uint, error) {
 	return uint(num), nil
 }
 
-func main() {
-	// Initialize logger
-	logger, _ := zap.NewProduction()
-	defer logger.Sync()
+// workspaceID returns the workspace a request was authenticated for
+func workspaceID(c *gin.Context) uint {
+	return c.GetUint("workspace_id")
+}
 
-	// Initialize database
-	db, err := config.InitDB()
+// currentActor returns the user a request was authenticated as
+func currentActor(c *gin.Context) services.Actor {
+	return middleware.CurrentActor(c)
+}
+
+// authorizeTask loads the task of the id parameter and checks that the current
+// user holds a permission on it. On failure it responds and returns nil.
+func authorizeTask(c *gin.Context, taskService *services.TaskService, logger *zap.Logger, permission services.Permission) *models.Task {
+	taskID, err := convertToUint(c.Param("id"))
 	if err != nil {
-		logger.Fatal("Failed to initialize database", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil
 	}
 
-	// Initialize services
-	taskService := services.NewTaskService(db)
-	metricsService := services.NewMetricsService()
-	wsService := services.NewWebSocketService(logger)
-	recurringService := services.NewRecurringTaskService(db)
+	task, err := taskService.ForWorkspace(workspaceID(c)).AuthorizeTask(currentActor(c), taskID, permission)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+		return nil
+	case errors.Is(err, services.ErrPermissionDenied):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return nil
+	case err != nil:
+		logger.Error("Failed to authorize task access", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil
+	}
+	return task
+}
 
-	// Start WebSocket service
-	go wsService.Start()
+// validateTask checks the execution settings of a task submitted through the API
+func validateTask(task *models.Task) error {
+	if task.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	switch task.OnUpstreamFailure {
+	case "", "skip", "fail":
+	default:
+		return errors.New("onUpstreamFailure must be skip or fail")
+	}
+	return services.ValidateRetryPolicy(task.RetryPolicy)
+}
 
-	// Start recurring task service
-	go recurringService.StartScheduler()
+// broadcastStatuses sends a status event for every task in tasks
+func broadcastStatuses(wsService *services.WebSocketService, tasks []models.Task) {
+	for _, task := range tasks {
+		wsService.BroadcastTaskUpdate(task, services.TaskStatusEvent, gin.H{
+			"id":     task.ID,
+			"status": task.Status,
+		})
+	}
+}
+
+// setRecurrencePaused handles the pause and resume endpoints of recurring tasks
+func setRecurrencePaused(c *gin.Context, taskService *services.TaskService, update func(uint) (*models.Task, error), wsService *services.WebSocketService, logger *zap.Logger) {
+	existing := authorizeTask(c, taskService, logger, services.PermTaskUpdate)
+	if existing == nil {
+		return
+	}
+
+	task, err := update(existing.ID)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+		return
+	case errors.Is(err, services.ErrNotRecurring):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		logger.Error("Failed to update recurring task", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Broadcast WebSocket update
+	wsService.BroadcastTaskUpdate(*task, services.TaskUpdatedEvent, task)
+
+	c.JSON(http.StatusOK, task)
+}
+
+// serveTimeline handles the schedule timeline endpoints, as JSON or as an iCalendar feed
+func serveTimeline(c *gin.Context, timelineService *services.TimelineService, logger *zap.Logger, ics bool) {
+	var query struct {
+		From   string `form:"from"`
+		To     string `form:"to"`
+		Format string `form:"format" binding:"omitempty,oneof=json ics"`
+	}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var err error
+	from := time.Now()
+	if query.From != "" {
+		if from, err = time.Parse(time.RFC3339, query.From); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be an RFC 3339 timestamp"})
+			return
+		}
+	}
+	to := from.AddDate(0, 0, 7)
+	if query.To != "" {
+		if to, err = time.Parse(time.RFC3339, query.To); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be an RFC 3339 timestamp"})
+			return
+		}
+	}
+	if to.Before(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must not be before from"})
+		return
+	}
+	if to.Sub(from) > services.MaxTimelineWindow {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("the timeline covers at most %d days", int(services.MaxTimelineWindow.Hours()/24))})
+		return
+	}
+
+	timeline, err := timelineService.ForWorkspace(workspaceID(c)).GetTimeline(currentActor(c), from, to)
+	if err != nil {
+		logger.Error("Failed to build schedule timeline", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if ics || query.Format == "ics" {
+		c.Header("Content-Disposition", `inline; filename="schedule.ics"`)
+		c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(services.TimelineICS(timeline, time.Now())))
+		return
+	}
+	c.JSON(http.StatusOK, timeline)
+}
+
+// server holds the services the HTTP routes depend on
+type server struct {
+	logger          *zap.Logger
+	oidcConfig      services.OIDCConfig
+	rateLimitConfig middleware.RateLimitConfig
+
+	authService         *services.AuthService
+	apiKeyService       *services.APIKeyService
+	oidcService         *services.OIDCService
+	workspaceService    *services.WorkspaceService
+	permissionService   *services.PermissionService
+	taskService         *services.TaskService
+	metricsService      *services.MetricsService
+	wsService           *services.WebSocketService
+	workflowService     *services.WorkflowService
+	recurringService    *services.RecurringTaskService
+	calendarService     *services.CalendarService
+	timelineService     *services.TimelineService
+	deadLetterService   *services.DeadLetterService
+	executionService    *services.ExecutionService
+	notificationService *services.NotificationService
+	handlerRegistry     *services.HandlerRegistry
+	workerService       *services.WorkerService
+}
+
+// newServer initializes the services on db. The worker executes tasks with the
+// handlers in registry. It does not start the background services; main starts
+// them once every handler is registered.
+func newServer(db *gorm.DB, eventBus services.EventBus, logger *zap.Logger, authConfig services.AuthConfig, oidcConfig services.OIDCConfig,
+	rateLimitConfig middleware.RateLimitConfig, wsConfig services.WebSocketConfig, workerConfig services.WorkerConfig,
+	registry *services.HandlerRegistry) *server {
+	s := &server{logger: logger, oidcConfig: oidcConfig, rateLimitConfig: rateLimitConfig}
+	s.authService = services.NewAuthService(db, authConfig)
+	s.apiKeyService = services.NewAPIKeyService(db)
+	s.oidcService = services.NewOIDCService(db, s.authService, oidcConfig)
+	s.workspaceService = services.NewWorkspaceService(db)
+	s.permissionService = services.NewPermissionService(db)
+	s.taskService = services.NewTaskService(db)
+	s.metricsService = services.NewMetricsService()
+	s.wsService = services.NewWebSocketService(db, eventBus, logger, wsConfig)
+	s.workflowService = services.NewWorkflowService(db)
+	s.recurringService = services.NewRecurringTaskService(db, s.workflowService, logger)
+	s.calendarService = services.NewCalendarService(db)
+	s.timelineService = services.NewTimelineService(db, s.recurringService)
+	s.deadLetterService = services.NewDeadLetterService(db)
+	s.executionService = services.NewExecutionService(db)
+	s.notificationService = services.NewNotificationService(db, logger)
+	s.handlerRegistry = registry
 
+	// The execution engine runs the tasks of every workspace
+	systemDB := services.SystemDB(db)
+	s.workerService = services.NewWorkerService(services.NewTaskService(systemDB), services.NewExecutionService(systemDB), s.metricsService,
+		s.wsService, services.NewCalendarService(systemDB), registry, logger, workerConfig)
+	return s
+}
+
+// router builds the routes of the web frontend and the API
+func (s *server) router() *gin.Engine {
 	// Create Gin router
 	r := gin.Default()
 
@@ -83,6 +325,12 @@ func main() {
 		c.HTML(http.StatusOK, "index.html", nil)
 	})
 
+	// Live task events, clients authenticate with an access token or API key
+	socketAuthenticator := middleware.SocketAuthenticator(s.authService, s.apiKeyService)
+	r.GET("/ws", func(c *gin.Context) {
+		s.wsService.HandleConnection(c.Writer, c.Request, socketAuthenticator)
+	})
+
 	// API Routes
 	api := r.Group("/api")
 	{
@@ -92,240 +340,1553 @@ func main() {
 		})
 
 		// Metrics endpoint
-		api.GET("/metrics", gin.WrapH(metricsService.Handler()))
+		api.GET("/metrics", gin.WrapH(s.metricsService.Handler()))
 
-		// Task routes
-		tasks := api.Group("/tasks")
+		// Routes other than health, metrics and authentication require a valid access token
+		authRequired := middleware.AuthMiddleware(s.authService, s.apiKeyService)
+
+		// Requests are limited per workspace once authenticated, per client IP before
+		rateLimited := middleware.RateLimitMiddleware(s.rateLimitConfig)
+
+		// Authentication routes
+		auth := api.Group("/auth", rateLimited)
 		{
-			// List tasks with filtering and pagination
-			tasks.GET("", func(c *gin.Context) {
-				var query TaskQuery
-				if err := c.ShouldBindQuery(&query); err != nil {
+			// Register a new user
+			auth.POST("/register", func(c *gin.Context) {
+				var req struct {
+					Username string `json:"username" binding:"required,min=3,max=50"`
+					Email    string `json:"email" binding:"required,email"`
+					Password string `json:"password" binding:"required,min=8,max=72"`
+				}
+				if err := c.ShouldBindJSON(&req); err != nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
 
-				tasks, total, err := taskService.GetTasksWithPagination(query.Status, query.Priority, query.Tags,
-					query.Search, query.SortBy, query.Order, query.Page, query.PageSize)
+				user, err := s.authService.Register(req.Username, req.Email, req.Password)
 				if err != nil {
-					logger.Error("Failed to fetch tasks", zap.Error(err))
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					if errors.Is(err, services.ErrUserExists) {
+						c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+						return
+					}
+					s.logger.Error("Failed to register user", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
 					return
 				}
 
-				c.JSON(http.StatusOK, gin.H{
-					"tasks": tasks,
-					"pagination": gin.H{
-						"current_page": query.Page,
-						"page_size":    query.PageSize,
-						"total_items":  total,
-						"total_pages":  (total + int64(query.PageSize) - 1) / int64(query.PageSize),
-					},
-				})
+				c.JSON(http.StatusCreated, user)
 			})
 
-			// Create new task
-			tasks.POST("", func(c *gin.Context) {
-				var task models.Task
-				if err := c.ShouldBindJSON(&task); err != nil {
+			// Log in and receive an access and a refresh token
+			auth.POST("/login", func(c *gin.Context) {
+				var req struct {
+					Username string `json:"username" binding:"required"`
+					Password string `json:"password" binding:"required"`
+				}
+				if err := c.ShouldBindJSON(&req); err != nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
 
-				// Set default values
-				task.Status = "pending"
-				task.CreatedAt = time.Now()
-				task.UpdatedAt = time.Now()
+				accessToken, refreshToken, err := s.authService.Login(req.Username, req.Password)
+				if err != nil {
+					if errors.Is(err, services.ErrInvalidCredentials) {
+						c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+						return
+					}
+					s.logger.Error("Failed to log in", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+					return
+				}
 
-				if err := taskService.CreateTask(&task); err != nil {
-					logger.Error("Failed to create task", zap.Error(err))
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				c.JSON(http.StatusOK, gin.H{
+					"access_token":  accessToken,
+					"refresh_token": refreshToken,
+					"token_type":    "Bearer",
+					"expires_in":    int(s.authService.TokenExpiry().Seconds()),
+				})
+			})
+
+			// Log in through the OIDC identity provider, when one is configured
+			if s.oidcConfig.Enabled() {
+				// Redirect to the identity provider
+				auth.GET("/oidc/login", func(c *gin.Context) {
+					authURL, state, nonce, err := s.oidcService.BeginLogin()
+					if err != nil {
+						s.logger.Error("Failed to start OIDC login", zap.Error(err))
+						c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider unavailable"})
+						return
+					}
+
+					// The callback must come from the browser that started the login
+					c.SetSameSite(http.SameSiteLaxMode)
+					c.SetCookie(oidcStateCookie, state+"."+nonce, int(oidcLoginTimeout.Seconds()), "/api/auth/oidc", "", c.Request.TLS != nil, true)
+					c.Redirect(http.StatusFound, authURL)
+				})
+
+				// Complete the login when the identity provider redirects back
+				auth.GET("/oidc/callback", func(c *gin.Context) {
+					cookie, err := c.Cookie(oidcStateCookie)
+					state, nonce, ok := strings.Cut(cookie, ".")
+					if err != nil || !ok || c.Query("state") != state {
+						c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired login state, start the login again"})
+						return
+					}
+					c.SetSameSite(http.SameSiteLaxMode)
+					c.SetCookie(oidcStateCookie, "", -1, "/api/auth/oidc", "", c.Request.TLS != nil, true)
+
+					if reason := c.Query("error"); reason != "" {
+						c.JSON(http.StatusUnauthorized, gin.H{"error": "Login rejected by the identity provider: " + reason})
+						return
+					}
+
+					user, accessToken, refreshToken, err := s.oidcService.Login(c.Query("code"), nonce)
+					switch {
+					case errors.Is(err, services.ErrOIDCLogin):
+						s.logger.Warn("Rejected OIDC login", zap.Error(err))
+						c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+						return
+					case errors.Is(err, services.ErrOIDCUserConflict):
+						c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+						return
+					case err != nil:
+						s.logger.Error("Failed to complete OIDC login", zap.Error(err))
+						c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+						return
+					}
+
+					s.logger.Info("OIDC login", zap.Uint("user_id", user.ID), zap.String("username", user.Username))
+					c.JSON(http.StatusOK, gin.H{
+						"access_token":  accessToken,
+						"refresh_token": refreshToken,
+						"token_type":    "Bearer",
+						"expires_in":    int(s.authService.TokenExpiry().Seconds()),
+					})
+				})
+			}
+
+			// Exchange a refresh token for a new access and refresh token
+			auth.POST("/refresh", func(c *gin.Context) {
+				refreshToken, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+				if !ok || refreshToken == "" {
+					c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization format. Use 'Bearer <refresh_token>'"})
 					return
 				}
 
-				// Record metrics
-				metricsService.RecordTaskCreation()
+				accessToken, newRefreshToken, err := s.authService.RefreshToken(refreshToken)
+				if err != nil {
+					if errors.Is(err, services.ErrTokenReused) {
+						s.logger.Warn("Refresh token reused, session revoked", zap.String("client_ip", c.ClientIP()))
+					}
+					c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+					return
+				}
 
-				// Broadcast WebSocket update
-				wsService.BroadcastTaskUpdate(services.TaskCreatedEvent, task)
+				c.JSON(http.StatusOK, gin.H{
+					"access_token":  accessToken,
+					"refresh_token": newRefreshToken,
+					"token_type":    "Bearer",
+					"expires_in":    int(s.authService.TokenExpiry().Seconds()),
+				})
+			})
 
-				c.JSON(http.StatusCreated, task)
+			// End the current session
+			auth.POST("/logout", authRequired, middleware.SessionMiddleware(), func(c *gin.Context) {
+				sessionID, _ := c.Get("session_id")
+				if err := s.authService.Logout(fmt.Sprint(sessionID)); err != nil {
+					s.logger.Error("Failed to log out", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+					return
+				}
+
+				c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
 			})
+		}
 
-			// Get task by ID
-			tasks.GET("/:id", func(c *gin.Context) {
-				taskID, err := convertToUint(c.Param("id"))
+		// Administration routes
+		admin := api.Group("/admin", authRequired, rateLimited, middleware.SessionMiddleware(),
+			middleware.PermissionMiddleware(s.permissionService, services.PermSessionRevoke))
+		{
+			// Revoke every session of a user, logging them out everywhere
+			admin.DELETE("/users/:id/sessions", func(c *gin.Context) {
+				userID, err := convertToUint(c.Param("id"))
 				if err != nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
 
-				task, err := taskService.GetTaskByID(taskID)
-				if err != nil {
-					logger.Error("Failed to get task", zap.Error(err))
-					c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+				revoked, err := s.authService.RevokeUserSessions(workspaceID(c), userID)
+				switch {
+				case errors.Is(err, gorm.ErrRecordNotFound):
+					c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+					return
+				case err != nil:
+					s.logger.Error("Failed to revoke sessions", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
 
-				c.JSON(http.StatusOK, task)
+				c.JSON(http.StatusOK, gin.H{"message": "Sessions revoked", "revoked": revoked})
 			})
+		}
 
-			// Update task
-			tasks.PUT("/:id", func(c *gin.Context) {
-				taskID, err := convertToUint(c.Param("id"))
+		// Workspace routes, workspaces are managed by the admins of the default workspace
+		workspaces := api.Group("/workspaces", authRequired, rateLimited, middleware.SessionMiddleware(),
+			middleware.PermissionMiddleware(s.permissionService, services.PermWorkspaceManage), middleware.WorkspaceMiddleware(services.DefaultWorkspaceID))
+		{
+			// List all workspaces
+			workspaces.GET("", func(c *gin.Context) {
+				list, err := s.workspaceService.ListWorkspaces()
 				if err != nil {
+					s.logger.Error("Failed to fetch workspaces", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusOK, gin.H{"workspaces": list})
+			})
+
+			// Create a workspace
+			workspaces.POST("", func(c *gin.Context) {
+				var workspace services.Workspace
+				if err := c.ShouldBindJSON(&workspace); err != nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
 
-				var task models.Task
-				if err := c.ShouldBindJSON(&task); err != nil {
+				err := s.workspaceService.CreateWorkspace(&workspace)
+				switch {
+				case errors.Is(err, services.ErrInvalidWorkspace):
 					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
+				case errors.Is(err, services.ErrWorkspaceExists):
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+					return
+				case err != nil:
+					s.logger.Error("Failed to create workspace", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
 				}
 
-				task.ID = taskID
-				task.UpdatedAt = time.Now()
+				c.JSON(http.StatusCreated, workspace)
+			})
+
+			// Move a user into a workspace, which logs the user out and revokes its API keys
+			workspaces.PUT("/:id/users/:userId", func(c *gin.Context) {
+				targetID, err := convertToUint(c.Param("id"))
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				userID, err := convertToUint(c.Param("userId"))
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
 
-				if err := taskService.UpdateTask(&task); err != nil {
-					logger.Error("Failed to update task", zap.Error(err))
+				user, err := s.workspaceService.MoveUser(userID, targetID)
+				switch {
+				case errors.Is(err, services.ErrUnknownWorkspace):
+					c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+					return
+				case errors.Is(err, gorm.ErrRecordNotFound):
+					c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+					return
+				case err != nil:
+					s.logger.Error("Failed to move user", zap.Error(err))
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
 
-				// Broadcast WebSocket update
-				wsService.BroadcastTaskUpdate(services.TaskUpdatedEvent, task)
+				c.JSON(http.StatusOK, user)
+			})
+		}
 
-				c.JSON(http.StatusOK, task)
+		// Routes about the current user
+		me := api.Group("/me", authRequired, rateLimited)
+		{
+			// Permissions of the current user, globally and per team
+			me.GET("/permissions", func(c *gin.Context) {
+				permissions, err := s.permissionService.ForWorkspace(workspaceID(c)).Permissions(currentActor(c))
+				if err != nil {
+					s.logger.Error("Failed to fetch permissions", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusOK, permissions)
 			})
+		}
 
-			// Update task status
-			tasks.PUT("/:id/status", func(c *gin.Context) {
-				taskID, err := convertToUint(c.Param("id"))
+		// API key routes, keys can only be managed by a logged in user
+		apiKeys := api.Group("/api-keys", authRequired, rateLimited, middleware.SessionMiddleware(),
+			middleware.PermissionMiddleware(s.permissionService, services.PermAPIKeyManage))
+		{
+			// List the API keys of the current user
+			apiKeys.GET("", func(c *gin.Context) {
+				keys, err := s.apiKeyService.ListAPIKeys(c.GetUint("user_id"))
 				if err != nil {
-					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					s.logger.Error("Failed to fetch API keys", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
 
+				c.JSON(http.StatusOK, gin.H{"apiKeys": keys})
+			})
+
+			// Create an API key, the key itself is only returned in this response
+			apiKeys.POST("", func(c *gin.Context) {
 				var req struct {
-					Status string `json:"status" binding:"required,oneof=pending running completed failed"`
+					Name      string     `json:"name" binding:"required,max=100"`
+					Scopes    []string   `json:"scopes" binding:"required"`
+					TeamID    *uint      `json:"teamId"`
+					ExpiresAt *time.Time `json:"expiresAt"`
 				}
-
 				if err := c.ShouldBindJSON(&req); err != nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
 
-				if err := taskService.UpdateTaskStatus(taskID, req.Status); err != nil {
-					logger.Error("Failed to update task status", zap.Error(err))
+				apiKey := services.APIKey{
+					Name:        req.Name,
+					Scopes:      req.Scopes,
+					UserID:      c.GetUint("user_id"),
+					WorkspaceID: workspaceID(c),
+					TeamID:      req.TeamID,
+					ExpiresAt:   req.ExpiresAt,
+				}
+				key, err := s.apiKeyService.CreateAPIKey(&apiKey)
+				switch {
+				case errors.Is(err, services.ErrInvalidAPIKey):
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				case errors.Is(err, services.ErrNotTeamAdmin):
+					c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+					return
+				case err != nil:
+					s.logger.Error("Failed to create API key", zap.Error(err))
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
 
-				// Update metrics based on status
-				switch req.Status {
-				case "completed":
-					metricsService.RecordTaskCompletion()
-				case "failed":
-					metricsService.RecordTaskFailure()
-				}
-
-				// Broadcast WebSocket update
-				wsService.BroadcastTaskUpdate(services.TaskStatusEvent, gin.H{
-					"id":     taskID,
-					"status": req.Status,
-				})
-
-				c.JSON(http.StatusOK, gin.H{"message": "Task status updated"})
+				c.JSON(http.StatusCreated, gin.H{"apiKey": apiKey, "key": key})
 			})
 
-			// Retry failed task
-			tasks.POST("/:id/retry", func(c *gin.Context) {
-				taskID, err := convertToUint(c.Param("id"))
+			// Replace the secret of an API key
+			apiKeys.POST("/:id/rotate", func(c *gin.Context) {
+				keyID, err := convertToUint(c.Param("id"))
 				if err != nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
 
-				if err := taskService.RetryFailedTask(taskID); err != nil {
-					logger.Error("Failed to retry task", zap.Error(err))
+				apiKey, key, err := s.apiKeyService.RotateAPIKey(keyID, c.GetUint("user_id"))
+				switch {
+				case errors.Is(err, gorm.ErrRecordNotFound):
+					c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+					return
+				case errors.Is(err, services.ErrInvalidAPIKey):
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+					return
+				case err != nil:
+					s.logger.Error("Failed to rotate API key", zap.Error(err))
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
 
-				// Broadcast WebSocket update
-				wsService.BroadcastTaskUpdate(services.TaskStatusEvent, gin.H{
-					"id":     taskID,
-					"status": "pending",
-				})
-
-				c.JSON(http.StatusOK, gin.H{"message": "Task scheduled for retry"})
+				c.JSON(http.StatusOK, gin.H{"apiKey": apiKey, "key": key})
 			})
 
-			// Delete task
-			tasks.DELETE("/:id", func(c *gin.Context) {
-				taskID, err := convertToUint(c.Param("id"))
+			// Revoke an API key
+			apiKeys.DELETE("/:id", func(c *gin.Context) {
+				keyID, err := convertToUint(c.Param("id"))
 				if err != nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
 
-				if err := taskService.DeleteTask(taskID); err != nil {
-					logger.Error("Failed to delete task", zap.Error(err))
+				apiKey, err := s.apiKeyService.RevokeAPIKey(keyID, c.GetUint("user_id"))
+				switch {
+				case errors.Is(err, gorm.ErrRecordNotFound):
+					c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+					return
+				case err != nil:
+					s.logger.Error("Failed to revoke API key", zap.Error(err))
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
 
-				// Broadcast WebSocket update
-				wsService.BroadcastTaskUpdate(services.TaskDeletedEvent, gin.H{"id": taskID})
-
-				c.JSON(http.StatusOK, gin.H{"message": "Task deleted"})
+				c.JSON(http.StatusOK, apiKey)
 			})
+		}
 
-			// Get tasks by tags
-			tasks.GET("/tags", func(c *gin.Context) {
-				tags := c.QueryArray("tags")
-				if len(tags) == 0 {
-					c.JSON(http.StatusBadRequest, gin.H{"error": "No tags provided"})
+		// Task routes
+		tasks := api.Group("/tasks", authRequired, rateLimited, middleware.ScopeMiddleware("tasks"),
+			middleware.PermissionMiddleware(s.permissionService, services.PermTaskRead))
+		{
+			// List tasks with filtering and pagination
+			tasks.GET("", func(c *gin.Context) {
+				var query TaskQuery
+				if err := c.ShouldBindQuery(&query); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
 
-				tasks, err := taskService.GetTasksByTags(tags)
+				tasks, total, err := s.taskService.ForWorkspace(workspaceID(c)).GetTasksWithPagination(currentActor(c), query.Status, query.Priority, query.Tags,
+					query.Search, query.SortBy, query.Order, query.Page, query.PageSize)
+				if errors.Is(err, services.ErrInvalidSort) {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
 				if err != nil {
-					logger.Error("Failed to fetch tasks by tags", zap.Error(err))
+					s.logger.Error("Failed to fetch tasks", zap.Error(err))
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
 
-				c.JSON(http.StatusOK, tasks)
+				c.JSON(http.StatusOK, gin.H{
+					"tasks": tasks,
+					"pagination": gin.H{
+						"current_page": query.Page,
+						"page_size":    query.PageSize,
+						"total_items":  total,
+						"total_pages":  (total + int64(query.PageSize) - 1) / int64(query.PageSize),
+					},
+				})
 			})
 
-			// Create recurring task
-			tasks.POST("/recurring", func(c *gin.Context) {
-				var task models.Task
-				if err := c.ShouldBindJSON(&task); err != nil {
+			// Create new task
+			tasks.POST("", func(c *gin.Context) {
+				var req TaskRequest
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				task := req.Task()
+				if err := validateTask(&task); err != nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
 
-				var pattern models.RecurringPattern
-				if err := c.ShouldBindJSON(&pattern); err != nil {
+				actor := currentActor(c)
+				err := s.taskService.ForWorkspace(workspaceID(c)).AssignOwner(actor, &task)
+				if err == nil {
+					err = s.taskService.ForWorkspace(workspaceID(c)).CheckUpstreamVisible(actor, task.DependsOn)
+				}
+				switch {
+				case errors.Is(err, services.ErrPermissionDenied):
+					c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+					return
+				case errors.Is(err, services.ErrUnknownUpstream):
 					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
+				case err != nil:
+					s.logger.Error("Failed to authorize task creation", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
 				}
 
-				if err := recurringService.CreateRecurringTask(&task, pattern); err != nil {
-					logger.Error("Failed to create recurring task", zap.Error(err))
+				// Set default values
+				task.Status = "pending"
+				task.CreatedAt = time.Now()
+				task.UpdatedAt = time.Now()
+
+				if err := s.taskService.ForWorkspace(workspaceID(c)).CreateTask(&task); err != nil {
+					if errors.Is(err, services.ErrUnknownUpstream) || errors.Is(err, services.ErrUnknownCalendar) {
+						c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+						return
+					}
+					s.logger.Error("Failed to create task", zap.Error(err))
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
 
+				// Record metrics
+				s.metricsService.RecordTaskCreation(workspaceID(c))
+
+				// Broadcast WebSocket update
+				s.wsService.BroadcastTaskUpdate(task, services.TaskCreatedEvent, task)
+
 				c.JSON(http.StatusCreated, task)
 			})
-		}
-	}
 
-	// Get port from environment variable
+			// Get task by ID
+			tasks.GET("/:id", func(c *gin.Context) {
+				task := authorizeTask(c, s.taskService, s.logger, services.PermTaskRead)
+				if task == nil {
+					return
+				}
+
+				c.JSON(http.StatusOK, task)
+			})
+
+			// Update task
+			tasks.PUT("/:id", func(c *gin.Context) {
+				existing := authorizeTask(c, s.taskService, s.logger, services.PermTaskUpdate)
+				if existing == nil {
+					return
+				}
+				taskID := existing.ID
+
+				// The fields present in the body are updated, including to empty values
+				var req TaskRequest
+				var present map[string]json.RawMessage
+				if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if err := c.ShouldBindBodyWith(&present, binding.JSON); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				fields := make([]string, 0, len(present))
+				for field := range present {
+					fields = append(fields, field)
+				}
+				task := req.Task()
+				if err := validateTask(&task); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				// Sharing the task with another team needs access to that team
+				if task.TeamID != nil && (existing.TeamID == nil || *existing.TeamID != *task.TeamID) {
+					if err := s.permissionService.ForWorkspace(workspaceID(c)).Authorize(currentActor(c), services.PermTaskCreate, task.TeamID); err != nil {
+						if errors.Is(err, services.ErrPermissionDenied) {
+							c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+							return
+						}
+						s.logger.Error("Failed to authorize task update", zap.Error(err))
+						c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+						return
+					}
+				}
+
+				task.ID = taskID
+				task.UpdatedAt = time.Now()
+
+				if err := s.taskService.ForWorkspace(workspaceID(c)).UpdateTask(&task, fields); err != nil {
+					if errors.Is(err, services.ErrUnknownCalendar) {
+						c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+						return
+					}
+					s.logger.Error("Failed to update task", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				// Broadcast WebSocket update
+				s.wsService.BroadcastTaskUpdate(task, services.TaskUpdatedEvent, task)
+
+				c.JSON(http.StatusOK, task)
+			})
+
+			// Update task status
+			tasks.PUT("/:id/status", func(c *gin.Context) {
+				task := authorizeTask(c, s.taskService, s.logger, services.PermTaskUpdate)
+				if task == nil {
+					return
+				}
+				taskID := task.ID
+
+				var req struct {
+					Status string `json:"status" binding:"required,oneof=pending completed failed cancelled skipped"`
+				}
+
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				if err := s.taskService.ForWorkspace(workspaceID(c)).UpdateTaskStatus(taskID, req.Status); err != nil {
+					s.logger.Error("Failed to update task status", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				// Update metrics based on status
+				switch req.Status {
+				case "completed":
+					s.metricsService.RecordTaskCompletion(workspaceID(c))
+				case "failed":
+					s.metricsService.RecordTaskFailure(workspaceID(c))
+				}
+
+				// Broadcast WebSocket update
+				s.wsService.BroadcastTaskUpdate(*task, services.TaskStatusEvent, gin.H{
+					"id":     taskID,
+					"status": req.Status,
+				})
+
+				// Downstream tasks can no longer run once their upstream task did not complete
+				switch req.Status {
+				case "failed", "cancelled", "skipped":
+					affected, err := s.taskService.ForWorkspace(workspaceID(c)).PropagateUpstreamFailure(taskID)
+					if err != nil {
+						s.logger.Error("Failed to update downstream tasks", zap.Error(err))
+					}
+					broadcastStatuses(s.wsService, affected)
+				}
+
+				c.JSON(http.StatusOK, gin.H{"message": "Task status updated"})
+			})
+
+			// List the execution attempts of a task
+			tasks.GET("/:id/executions", func(c *gin.Context) {
+				task := authorizeTask(c, s.taskService, s.logger, services.PermTaskRead)
+				if task == nil {
+					return
+				}
+				taskID := task.ID
+
+				var query PaginationQuery
+				if err := c.ShouldBindQuery(&query); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				executions, total, err := s.executionService.ForWorkspace(workspaceID(c)).GetTaskExecutions(taskID, query.Page, query.PageSize)
+				if err != nil {
+					s.logger.Error("Failed to fetch task executions", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusOK, gin.H{
+					"executions": executions,
+					"pagination": gin.H{
+						"current_page": query.Page,
+						"page_size":    query.PageSize,
+						"total_items":  total,
+						"total_pages":  (total + int64(query.PageSize) - 1) / int64(query.PageSize),
+					},
+				})
+			})
+
+			// Cancel a pending or running task
+			tasks.POST("/:id/cancel", func(c *gin.Context) {
+				task := authorizeTask(c, s.taskService, s.logger, services.PermTaskExecute)
+				if task == nil {
+					return
+				}
+				taskID := task.ID
+
+				previousStatus, err := s.taskService.ForWorkspace(workspaceID(c)).CancelTask(taskID)
+				switch {
+				case errors.Is(err, gorm.ErrRecordNotFound):
+					c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+					return
+				case errors.Is(err, services.ErrTaskNotCancellable):
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+					return
+				case err != nil:
+					s.logger.Error("Failed to cancel task", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				if previousStatus == "running" {
+					// Stop the task right away if it runs on this replica, otherwise the
+					// owning replica picks up the request on its next lease renewal
+					s.workerService.CancelTask(taskID)
+					c.JSON(http.StatusAccepted, gin.H{"message": "Task cancellation requested"})
+					return
+				}
+
+				// Broadcast WebSocket update
+				s.wsService.BroadcastTaskUpdate(*task, services.TaskStatusEvent, gin.H{
+					"id":     taskID,
+					"status": "cancelled",
+				})
+
+				affected, err := s.taskService.ForWorkspace(workspaceID(c)).PropagateUpstreamFailure(taskID)
+				if err != nil {
+					s.logger.Error("Failed to update downstream tasks", zap.Error(err))
+				}
+				broadcastStatuses(s.wsService, affected)
+
+				c.JSON(http.StatusOK, gin.H{"message": "Task cancelled"})
+			})
+
+			// Add upstream dependencies to a task
+			tasks.POST("/:id/dependencies", func(c *gin.Context) {
+				task := authorizeTask(c, s.taskService, s.logger, services.PermTaskUpdate)
+				if task == nil {
+					return
+				}
+				taskID := task.ID
+
+				var req struct {
+					DependsOn []uint `json:"dependsOn" binding:"required,min=1"`
+				}
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				var affected []models.Task
+				err := s.taskService.ForWorkspace(workspaceID(c)).CheckUpstreamVisible(currentActor(c), req.DependsOn)
+				if err == nil {
+					affected, err = s.taskService.ForWorkspace(workspaceID(c)).AddDependencies(taskID, req.DependsOn)
+				}
+				switch {
+				case errors.Is(err, services.ErrDependencyCycle):
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+					return
+				case errors.Is(err, services.ErrUnknownUpstream):
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				case err != nil:
+					s.logger.Error("Failed to add task dependencies", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				broadcastStatuses(s.wsService, affected)
+
+				c.JSON(http.StatusOK, gin.H{"message": "Task dependencies added"})
+			})
+
+			// Remove an upstream dependency from a task
+			tasks.DELETE("/:id/dependencies/:dependsOnId", func(c *gin.Context) {
+				task := authorizeTask(c, s.taskService, s.logger, services.PermTaskUpdate)
+				if task == nil {
+					return
+				}
+				taskID := task.ID
+				dependsOnID, err := convertToUint(c.Param("dependsOnId"))
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				if err := s.taskService.ForWorkspace(workspaceID(c)).RemoveDependency(taskID, dependsOnID); err != nil {
+					if errors.Is(err, gorm.ErrRecordNotFound) {
+						c.JSON(http.StatusNotFound, gin.H{"error": "Dependency not found"})
+						return
+					}
+					s.logger.Error("Failed to remove task dependency", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusOK, gin.H{"message": "Task dependency removed"})
+			})
+
+			// Get the dependency graph around a task
+			tasks.GET("/:id/graph", func(c *gin.Context) {
+				task := authorizeTask(c, s.taskService, s.logger, services.PermTaskRead)
+				if task == nil {
+					return
+				}
+				taskID := task.ID
+
+				graph, err := s.taskService.ForWorkspace(workspaceID(c)).GetTaskGraph(currentActor(c), taskID)
+				if err != nil {
+					s.logger.Error("Failed to fetch task graph", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusOK, graph)
+			})
+
+			// Retry failed task
+			tasks.POST("/:id/retry", func(c *gin.Context) {
+				task := authorizeTask(c, s.taskService, s.logger, services.PermTaskExecute)
+				if task == nil {
+					return
+				}
+				taskID := task.ID
+
+				err := s.taskService.ForWorkspace(workspaceID(c)).RetryFailedTask(taskID)
+				switch {
+				case errors.Is(err, gorm.ErrRecordNotFound):
+					c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+					return
+				case errors.Is(err, services.ErrTaskNotRetryable), errors.Is(err, services.ErrRetriesExhausted):
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+					return
+				case err != nil:
+					s.logger.Error("Failed to retry task", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				// Broadcast WebSocket update
+				s.wsService.BroadcastTaskUpdate(*task, services.TaskStatusEvent, gin.H{
+					"id":     taskID,
+					"status": "pending",
+				})
+
+				c.JSON(http.StatusOK, gin.H{"message": "Task scheduled for retry"})
+			})
+
+			// Delete task
+			tasks.DELETE("/:id", func(c *gin.Context) {
+				task := authorizeTask(c, s.taskService, s.logger, services.PermTaskDelete)
+				if task == nil {
+					return
+				}
+				taskID := task.ID
+
+				if err := s.taskService.ForWorkspace(workspaceID(c)).DeleteTask(taskID); err != nil {
+					s.logger.Error("Failed to delete task", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				s.recurringService.UnscheduleTask(taskID)
+
+				// Broadcast WebSocket update
+				s.wsService.BroadcastTaskUpdate(*task, services.TaskDeletedEvent, gin.H{"id": taskID})
+
+				c.JSON(http.StatusOK, gin.H{"message": "Task deleted"})
+			})
+
+			// Get tasks by tags
+			tasks.GET("/tags", func(c *gin.Context) {
+				tags := c.QueryArray("tags")
+				if len(tags) == 0 {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "No tags provided"})
+					return
+				}
+
+				tasks, err := s.taskService.ForWorkspace(workspaceID(c)).GetTasksByTags(currentActor(c), tags)
+				if err != nil {
+					s.logger.Error("Failed to fetch tasks by tags", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusOK, tasks)
+			})
+
+			// Create recurring task
+			tasks.POST("/recurring", func(c *gin.Context) {
+				var req RecurringTaskRequest
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				task := req.Task.Task()
+				if err := validateTask(&task); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				if err := s.taskService.ForWorkspace(workspaceID(c)).AssignOwner(currentActor(c), &task); err != nil {
+					if errors.Is(err, services.ErrPermissionDenied) {
+						c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+						return
+					}
+					s.logger.Error("Failed to authorize task creation", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				if err := s.recurringService.ForWorkspace(workspaceID(c)).CreateRecurringTask(&task, req.Pattern); err != nil {
+					if errors.Is(err, services.ErrInvalidPattern) || errors.Is(err, services.ErrInvalidParameters) ||
+						errors.Is(err, services.ErrUnknownCalendar) {
+						c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+						return
+					}
+					s.logger.Error("Failed to create recurring task", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusCreated, task)
+			})
+
+			// Update a recurring task and its pattern
+			tasks.PUT("/recurring/:id", func(c *gin.Context) {
+				existing := authorizeTask(c, s.taskService, s.logger, services.PermTaskUpdate)
+				if existing == nil {
+					return
+				}
+				taskID := existing.ID
+
+				var req RecurringTaskRequest
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				task := req.Task.Task()
+				if err := validateTask(&task); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				// Sharing the task with another team needs access to that team
+				if task.TeamID != nil && (existing.TeamID == nil || *existing.TeamID != *task.TeamID) {
+					if err := s.permissionService.ForWorkspace(workspaceID(c)).Authorize(currentActor(c), services.PermTaskCreate, task.TeamID); err != nil {
+						if errors.Is(err, services.ErrPermissionDenied) {
+							c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+							return
+						}
+						s.logger.Error("Failed to authorize task update", zap.Error(err))
+						c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+						return
+					}
+				}
+
+				err := s.recurringService.ForWorkspace(workspaceID(c)).UpdateRecurringTask(taskID, &task, req.Pattern)
+				switch {
+				case errors.Is(err, gorm.ErrRecordNotFound):
+					c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+					return
+				case errors.Is(err, services.ErrNotRecurring):
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+					return
+				case errors.Is(err, services.ErrInvalidPattern) || errors.Is(err, services.ErrInvalidParameters) ||
+					errors.Is(err, services.ErrUnknownCalendar):
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				case err != nil:
+					s.logger.Error("Failed to update recurring task", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				// Broadcast WebSocket update
+				s.wsService.BroadcastTaskUpdate(task, services.TaskUpdatedEvent, task)
+
+				c.JSON(http.StatusOK, task)
+			})
+
+			// Preview the upcoming occurrences of a recurring task
+			tasks.GET("/:id/occurrences", func(c *gin.Context) {
+				task := authorizeTask(c, s.taskService, s.logger, services.PermTaskRead)
+				if task == nil {
+					return
+				}
+				taskID := task.ID
+
+				var query struct {
+					From  string `form:"from"`
+					To    string `form:"to"`
+					Limit int    `form:"limit,default=100" binding:"min=1,max=1000"`
+				}
+				if err := c.ShouldBindQuery(&query); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				var err error
+				from := time.Now()
+				if query.From != "" {
+					if from, err = time.Parse(time.RFC3339, query.From); err != nil {
+						c.JSON(http.StatusBadRequest, gin.H{"error": "from must be an RFC 3339 timestamp"})
+						return
+					}
+				}
+				to := from.AddDate(0, 0, 30)
+				if query.To != "" {
+					if to, err = time.Parse(time.RFC3339, query.To); err != nil {
+						c.JSON(http.StatusBadRequest, gin.H{"error": "to must be an RFC 3339 timestamp"})
+						return
+					}
+				}
+				if to.Before(from) {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "to must not be before from"})
+					return
+				}
+
+				occurrences, err := s.recurringService.ForWorkspace(workspaceID(c)).Occurrences(taskID, from, to, query.Limit)
+				switch {
+				case errors.Is(err, gorm.ErrRecordNotFound):
+					c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+					return
+				case errors.Is(err, services.ErrNotRecurring):
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+					return
+				case err != nil:
+					s.logger.Error("Failed to compute task occurrences", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusOK, gin.H{"occurrences": occurrences})
+			})
+
+			// Pause a recurring task
+			tasks.POST("/:id/pause", func(c *gin.Context) {
+				setRecurrencePaused(c, s.taskService, s.recurringService.ForWorkspace(workspaceID(c)).PauseRecurringTask, s.wsService, s.logger)
+			})
+
+			// Resume a paused recurring task
+			tasks.POST("/:id/resume", func(c *gin.Context) {
+				setRecurrencePaused(c, s.taskService, s.recurringService.ForWorkspace(workspaceID(c)).ResumeRecurringTask, s.wsService, s.logger)
+			})
+		}
+
+		// Dead-letter queue routes
+		deadLetters := api.Group("/dead-letters", authRequired, rateLimited, middleware.ScopeMiddleware("tasks"),
+			middleware.PermissionMiddleware(s.permissionService, services.PermDeadLetterManage))
+		{
+			// List dead-lettered tasks
+			deadLetters.GET("", func(c *gin.Context) {
+				var query PaginationQuery
+				if err := c.ShouldBindQuery(&query); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				entries, total, err := s.deadLetterService.ForWorkspace(workspaceID(c)).ListDeadLetters(c.Query("type"), query.Page, query.PageSize)
+				if err != nil {
+					s.logger.Error("Failed to fetch dead letters", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusOK, gin.H{
+					"deadLetters": entries,
+					"pagination": gin.H{
+						"current_page": query.Page,
+						"page_size":    query.PageSize,
+						"total_items":  total,
+						"total_pages":  (total + int64(query.PageSize) - 1) / int64(query.PageSize),
+					},
+				})
+			})
+
+			// Get dead-letter entry by ID
+			deadLetters.GET("/:id", func(c *gin.Context) {
+				entryID, err := convertToUint(c.Param("id"))
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				entry, err := s.deadLetterService.ForWorkspace(workspaceID(c)).GetDeadLetter(entryID)
+				if err != nil {
+					c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+					return
+				}
+
+				c.JSON(http.StatusOK, entry)
+			})
+
+			// Requeue a dead-lettered task, optionally with an edited payload
+			deadLetters.POST("/:id/requeue", func(c *gin.Context) {
+				entryID, err := convertToUint(c.Param("id"))
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				var req struct {
+					Payload json.RawMessage `json:"payload"`
+				}
+				if c.Request.ContentLength != 0 {
+					if err := c.ShouldBindJSON(&req); err != nil {
+						c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+						return
+					}
+				}
+
+				var payload *string
+				if req.Payload != nil {
+					value := string(req.Payload)
+					payload = &value
+				}
+
+				task, err := s.deadLetterService.ForWorkspace(workspaceID(c)).RequeueDeadLetter(entryID, payload)
+				switch {
+				case errors.Is(err, gorm.ErrRecordNotFound):
+					c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+					return
+				case errors.Is(err, services.ErrInvalidPayload):
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				case errors.Is(err, services.ErrNotDeadLettered):
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+					return
+				case err != nil:
+					s.logger.Error("Failed to requeue dead letter", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				// Broadcast WebSocket update
+				s.wsService.BroadcastTaskUpdate(*task, services.TaskStatusEvent, gin.H{
+					"id":     task.ID,
+					"status": task.Status,
+				})
+
+				c.JSON(http.StatusOK, task)
+			})
+
+			// Purge a single dead-lettered task
+			deadLetters.DELETE("/:id", func(c *gin.Context) {
+				entryID, err := convertToUint(c.Param("id"))
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				if err := s.deadLetterService.ForWorkspace(workspaceID(c)).PurgeDeadLetter(entryID); err != nil {
+					if errors.Is(err, gorm.ErrRecordNotFound) {
+						c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+						return
+					}
+					s.logger.Error("Failed to purge dead letter", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusOK, gin.H{"message": "Dead letter purged"})
+			})
+
+			// Purge all dead-lettered tasks, optionally only those older than a timestamp
+			deadLetters.DELETE("", func(c *gin.Context) {
+				var before *time.Time
+				if value := c.Query("older_than"); value != "" {
+					parsed, err := time.Parse(time.RFC3339, value)
+					if err != nil {
+						c.JSON(http.StatusBadRequest, gin.H{"error": "older_than must be an RFC 3339 timestamp"})
+						return
+					}
+					before = &parsed
+				}
+
+				purged, err := s.deadLetterService.ForWorkspace(workspaceID(c)).PurgeDeadLetters(before)
+				if err != nil {
+					s.logger.Error("Failed to purge dead letters", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusOK, gin.H{"message": "Dead letters purged", "purged": purged})
+			})
+		}
+
+		// Workflow routes
+		workflows := api.Group("/workflows", authRequired, rateLimited, middleware.ScopeMiddleware("workflows"),
+			middleware.PermissionMiddleware(s.permissionService, services.PermWorkflowRead))
+		{
+			// List workflows, optionally only the versions of one name
+			workflows.GET("", func(c *gin.Context) {
+				var query PaginationQuery
+				if err := c.ShouldBindQuery(&query); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				list, total, err := s.workflowService.ForWorkspace(workspaceID(c)).ListWorkflows(c.Query("name"), query.Page, query.PageSize)
+				if err != nil {
+					s.logger.Error("Failed to fetch workflows", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusOK, gin.H{
+					"workflows": list,
+					"pagination": gin.H{
+						"current_page": query.Page,
+						"page_size":    query.PageSize,
+						"total_items":  total,
+						"total_pages":  (total + int64(query.PageSize) - 1) / int64(query.PageSize),
+					},
+				})
+			})
+
+			// Create a workflow, or a new version of an existing one
+			workflows.POST("", middleware.PermissionMiddleware(s.permissionService, services.PermWorkflowManage), func(c *gin.Context) {
+				var workflow models.Workflow
+				if err := c.ShouldBindJSON(&workflow); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				if err := s.workflowService.ForWorkspace(workspaceID(c)).CreateWorkflow(&workflow); err != nil {
+					if errors.Is(err, services.ErrInvalidWorkflow) {
+						c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+						return
+					}
+					s.logger.Error("Failed to create workflow", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusCreated, workflow)
+			})
+
+			// Get a workflow version
+			workflows.GET("/:id", func(c *gin.Context) {
+				workflowID, err := convertToUint(c.Param("id"))
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				workflow, err := s.workflowService.ForWorkspace(workspaceID(c)).GetWorkflow(workflowID)
+				if err != nil {
+					c.JSON(http.StatusNotFound, gin.H{"error": "Workflow not found"})
+					return
+				}
+
+				c.JSON(http.StatusOK, workflow)
+			})
+
+			// Start a run of a workflow
+			workflows.POST("/:id/runs", middleware.PermissionMiddleware(s.permissionService, services.PermWorkflowRun), func(c *gin.Context) {
+				workflowID, err := convertToUint(c.Param("id"))
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				var req struct {
+					Parameters map[string]string `json:"parameters"`
+				}
+				if c.Request.ContentLength != 0 {
+					if err := c.ShouldBindJSON(&req); err != nil {
+						c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+						return
+					}
+				}
+
+				run, err := s.workflowService.ForWorkspace(workspaceID(c)).StartRun(currentActor(c), workflowID, req.Parameters, "api")
+				switch {
+				case errors.Is(err, gorm.ErrRecordNotFound):
+					c.JSON(http.StatusNotFound, gin.H{"error": "Workflow not found"})
+					return
+				case errors.Is(err, services.ErrPermissionDenied):
+					c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+					return
+				case errors.Is(err, services.ErrInvalidParameters):
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				case err != nil:
+					s.logger.Error("Failed to start workflow run", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				for _, task := range run.Tasks {
+					s.metricsService.RecordTaskCreation(workspaceID(c))
+					s.wsService.BroadcastTaskUpdate(task, services.TaskCreatedEvent, task)
+				}
+
+				c.JSON(http.StatusCreated, run)
+			})
+
+			// List the runs of a workflow
+			workflows.GET("/:id/runs", func(c *gin.Context) {
+				workflowID, err := convertToUint(c.Param("id"))
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				var query PaginationQuery
+				if err := c.ShouldBindQuery(&query); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				runs, total, err := s.workflowService.ForWorkspace(workspaceID(c)).ListRuns(workflowID, query.Page, query.PageSize)
+				if err != nil {
+					s.logger.Error("Failed to fetch workflow runs", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusOK, gin.H{
+					"runs": runs,
+					"pagination": gin.H{
+						"current_page": query.Page,
+						"page_size":    query.PageSize,
+						"total_items":  total,
+						"total_pages":  (total + int64(query.PageSize) - 1) / int64(query.PageSize),
+					},
+				})
+			})
+		}
+
+		// Get a workflow run with its tasks
+		api.GET("/workflow-runs/:id", authRequired, rateLimited, middleware.ScopeMiddleware("workflows"), middleware.PermissionMiddleware(s.permissionService, services.PermWorkflowRead), func(c *gin.Context) {
+			runID, err := convertToUint(c.Param("id"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			run, err := s.workflowService.ForWorkspace(workspaceID(c)).GetRun(currentActor(c), runID)
+			if err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "Workflow run not found"})
+					return
+				}
+				s.logger.Error("Failed to fetch workflow run", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, run)
+		})
+
+		// Schedule timeline routes
+		schedule := api.Group("/schedule", authRequired, rateLimited, middleware.ScopeMiddleware("tasks"),
+			middleware.PermissionMiddleware(s.permissionService, services.PermTaskRead))
+		{
+			// Preview what the scheduler will run in a period
+			schedule.GET("/timeline", func(c *gin.Context) {
+				serveTimeline(c, s.timelineService, s.logger, false)
+			})
+
+			// The same timeline as an iCalendar feed for calendar apps
+			schedule.GET("/timeline.ics", func(c *gin.Context) {
+				serveTimeline(c, s.timelineService, s.logger, true)
+			})
+		}
+
+		// Business calendar routes
+		calendars := api.Group("/calendars", authRequired, rateLimited, middleware.ScopeMiddleware("calendars"),
+			middleware.PermissionMiddleware(s.permissionService, services.PermCalendarRead))
+		{
+			// List calendars
+			calendars.GET("", func(c *gin.Context) {
+				var query PaginationQuery
+				if err := c.ShouldBindQuery(&query); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				list, total, err := s.calendarService.ForWorkspace(workspaceID(c)).ListCalendars(query.Page, query.PageSize)
+				if err != nil {
+					s.logger.Error("Failed to fetch calendars", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusOK, gin.H{
+					"calendars": list,
+					"pagination": gin.H{
+						"current_page": query.Page,
+						"page_size":    query.PageSize,
+						"total_items":  total,
+						"total_pages":  (total + int64(query.PageSize) - 1) / int64(query.PageSize),
+					},
+				})
+			})
+
+			// Create a calendar
+			calendars.POST("", middleware.PermissionMiddleware(s.permissionService, services.PermCalendarManage), func(c *gin.Context) {
+				var calendar models.Calendar
+				if err := c.ShouldBindJSON(&calendar); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				err := s.calendarService.ForWorkspace(workspaceID(c)).CreateCalendar(&calendar)
+				switch {
+				case errors.Is(err, services.ErrInvalidCalendar):
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				case errors.Is(err, services.ErrDuplicateCalendar):
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+					return
+				case err != nil:
+					s.logger.Error("Failed to create calendar", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusCreated, calendar)
+			})
+
+			// Get a calendar
+			calendars.GET("/:id", func(c *gin.Context) {
+				calendarID, err := convertToUint(c.Param("id"))
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				calendar, err := s.calendarService.ForWorkspace(workspaceID(c)).GetCalendar(calendarID)
+				if err != nil {
+					c.JSON(http.StatusNotFound, gin.H{"error": "Calendar not found"})
+					return
+				}
+
+				c.JSON(http.StatusOK, calendar)
+			})
+
+			// Replace the definition of a calendar
+			calendars.PUT("/:id", middleware.PermissionMiddleware(s.permissionService, services.PermCalendarManage), func(c *gin.Context) {
+				calendarID, err := convertToUint(c.Param("id"))
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				var calendar models.Calendar
+				if err := c.ShouldBindJSON(&calendar); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				err = s.calendarService.ForWorkspace(workspaceID(c)).UpdateCalendar(calendarID, &calendar)
+				switch {
+				case errors.Is(err, gorm.ErrRecordNotFound):
+					c.JSON(http.StatusNotFound, gin.H{"error": "Calendar not found"})
+					return
+				case errors.Is(err, services.ErrInvalidCalendar):
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				case errors.Is(err, services.ErrDuplicateCalendar):
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+					return
+				case err != nil:
+					s.logger.Error("Failed to update calendar", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusOK, calendar)
+			})
+
+			// Delete a calendar that no task references
+			calendars.DELETE("/:id", middleware.PermissionMiddleware(s.permissionService, services.PermCalendarManage), func(c *gin.Context) {
+				calendarID, err := convertToUint(c.Param("id"))
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				err = s.calendarService.ForWorkspace(workspaceID(c)).DeleteCalendar(calendarID)
+				switch {
+				case errors.Is(err, gorm.ErrRecordNotFound):
+					c.JSON(http.StatusNotFound, gin.H{"error": "Calendar not found"})
+					return
+				case errors.Is(err, services.ErrCalendarInUse):
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+					return
+				case err != nil:
+					s.logger.Error("Failed to delete calendar", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusOK, gin.H{"message": "Calendar deleted"})
+			})
+		}
+
+		// Notification routes, configuring where the events of the workspace are sent
+		notifications := api.Group("/notifications", authRequired, rateLimited, middleware.SessionMiddleware(),
+			middleware.PermissionMiddleware(s.permissionService, services.PermNotificationConfigure))
+		{
+			// Create a channel, or change the channel with the given id
+			notifications.POST("/channels", func(c *gin.Context) {
+				var channel services.NotificationChannel
+				if err := c.ShouldBindJSON(&channel); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				err := s.notificationService.ForWorkspace(workspaceID(c)).ConfigureChannel(&channel)
+				switch {
+				case errors.Is(err, gorm.ErrRecordNotFound):
+					c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+					return
+				case errors.Is(err, services.ErrInvalidChannel):
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				case err != nil:
+					s.logger.Error("Failed to configure notification channel", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusOK, gin.H{"message": "Channel configured successfully", "id": channel.ID})
+			})
+
+			// Create a template
+			notifications.POST("/templates", func(c *gin.Context) {
+				var template services.NotificationTemplate
+				if err := c.ShouldBindJSON(&template); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				template.ID = 0
+
+				if err := s.notificationService.ForWorkspace(workspaceID(c)).CreateNotificationTemplate(&template); err != nil {
+					s.logger.Error("Failed to create notification template", zap.Error(err))
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusCreated, template)
+			})
+		}
+	}
+
+	return r
+}
+
+// newHandlerRegistry returns the handlers the worker executes tasks with, keyed
+// by task type. Handlers of deployment specific task types are registered here.
+func newHandlerRegistry(logger *zap.Logger) *services.HandlerRegistry {
+	registry := services.NewHandlerRegistry()
+	if err := registry.Register(services.HTTPTaskType, services.NewHTTPHandler(&http.Client{Timeout: time.Minute})); err != nil {
+		logger.Fatal("Failed to register task handler", zap.String("type", services.HTTPTaskType), zap.Error(err))
+	}
+	return registry
+}
+
+func main() {
+	// Initialize logger
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	// Tokens cannot be trusted without a configured signing key
+	authConfig, err := config.LoadAuthConfig()
+	if err != nil {
+		logger.Fatal("Invalid authentication configuration", zap.Error(err))
+	}
+	oidcConfig, err := config.LoadOIDCConfig()
+	if err != nil {
+		logger.Fatal("Invalid OIDC configuration", zap.Error(err))
+	}
+	rateLimitConfig := config.LoadRateLimitConfig()
+	wsConfig := config.LoadWebSocketConfig()
+
+	// Initialize database
+	db, err := config.InitDB()
+	if err != nil {
+		logger.Fatal("Failed to initialize database", zap.Error(err))
+	}
+
+	// Task events reach the WebSocket clients and notifications of every replica
+	eventBus, err := config.InitEventBus(db, logger)
+	if err != nil {
+		logger.Fatal("Failed to initialize event bus", zap.Error(err))
+	}
+
+	// Initialize services. Services on db only serve requests through ForWorkspace,
+	// queries on workspace data fail without a workspace.
+	s := newServer(db, eventBus, logger, authConfig, oidcConfig, rateLimitConfig, wsConfig, config.LoadWorkerConfig(),
+		newHandlerRegistry(logger))
+	eventBus.Subscribe("notifications", s.notificationService.HandleTaskEvent)
+
+	// Start WebSocket service
+	go s.wsService.Start()
+
+	// Start recurring task service
+	go func() {
+		if err := s.recurringService.StartScheduler(); err != nil {
+			logger.Error("Failed to start recurring task scheduler", zap.Error(err))
+		}
+	}()
+
+	// Start task execution engine
+	go s.workerService.Start()
+
+	r := s.router()
+
+	// Get port from environment variable
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -333,8 +1894,31 @@ func main() {
 	}
 
 	// Start the server
-	logger.Info(fmt.Sprintf("Starting server on port %s", port))
-	if err := r.Run(":" + port); err != nil {
-		logger.Fatal("Failed to start server", zap.Error(err))
+	srv := &http.Server{Addr: ":" + port, Handler: r}
+	go func() {
+		logger.Info(fmt.Sprintf("Starting server on port %s", port))
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatal("Failed to start server", zap.Error(err))
+		}
+	}()
+
+	// Shut down on SIGINT and SIGTERM, such as during a rolling deploy. Running
+	// tasks are handed back to the queue; a lease left to expire would count as
+	// a failed attempt.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	stop()
+	logger.Info("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Error("Failed to finish requests in flight", zap.Error(err))
+	}
+	s.workerService.Stop()
+	s.recurringService.StopScheduler()
+	if err := eventBus.Close(); err != nil {
+		logger.Error("Failed to close event bus", zap.Error(err))
 	}
 }
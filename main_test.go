@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/task-schedulart/internal/dbtest"
+	"github.com/task-schedulart/middleware"
+	"github.com/task-schedulart/models"
+	"github.com/task-schedulart/services"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// newTestServer returns the routes of a server on a test database
+func newTestServer(t *testing.T) (*gin.Engine, *gorm.DB, *server) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	db := dbtest.Open(t)
+
+	authConfig := services.DefaultAuthConfig()
+	authConfig.JWTSecret = "test-secret-with-enough-entropy"
+	eventBus := services.NewInProcessEventBus(zap.NewNop())
+	t.Cleanup(func() { eventBus.Close() })
+
+	s := newServer(db, eventBus, zap.NewNop(), authConfig, services.DefaultOIDCConfig(), middleware.DefaultRateLimitConfig(),
+		services.DefaultWebSocketConfig(), services.DefaultWorkerConfig(), services.NewHandlerRegistry())
+	return s.router(), db, s
+}
+
+// workspaceAdmin registers an admin of a workspace and returns its access token
+func workspaceAdmin(t *testing.T, db *gorm.DB, s *server, username string, workspaceID uint) string {
+	t.Helper()
+	user, err := s.authService.Register(username, username+"@example.com", "secret-password")
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if _, err := s.workspaceService.MoveUser(user.ID, workspaceID); err != nil {
+		t.Fatalf("MoveUser: %v", err)
+	}
+	if err := db.Model(&services.User{}).Where("id = ?", user.ID).Update("role", "admin").Error; err != nil {
+		t.Fatalf("make admin: %v", err)
+	}
+	accessToken, _, err := s.authService.Login(username, "secret-password")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	return accessToken
+}
+
+// call sends a request with an access token to the routes and decodes the
+// response into out, unless it is nil
+func call(t *testing.T, r *gin.Engine, token, method, path string, body interface{}, out interface{}) int {
+	t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatalf("encode request: %v", err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &payload)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if out != nil && w.Code < 300 {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decode response %q: %v", method, path, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+func TestTaskRoutesStayInTheirWorkspace(t *testing.T) {
+	r, db, s := newTestServer(t)
+	other := services.Workspace{Name: "other"}
+	if err := s.workspaceService.CreateWorkspace(&other); err != nil {
+		t.Fatalf("CreateWorkspace: %v", err)
+	}
+	home := workspaceAdmin(t, db, s, "alice", services.DefaultWorkspaceID)
+	away := workspaceAdmin(t, db, s, "bob", other.ID)
+
+	taskRequest := TaskRequest{Name: "backup", ScheduleTime: time.Now().Add(time.Hour), Priority: "high"}
+	var task models.Task
+	if code := call(t, r, home, http.MethodPost, "/api/tasks", taskRequest, &task); code != http.StatusCreated {
+		t.Fatalf("create task = %d, want %d", code, http.StatusCreated)
+	}
+	path := fmt.Sprintf("/api/tasks/%d", task.ID)
+
+	// listed returns the IDs of the tasks a workspace lists
+	listed := func(t *testing.T, token string) []uint {
+		t.Helper()
+		var page struct {
+			Tasks []models.Task `json:"tasks"`
+		}
+		if code := call(t, r, token, http.MethodGet, "/api/tasks", nil, &page); code != http.StatusOK {
+			t.Fatalf("list tasks = %d, want %d", code, http.StatusOK)
+		}
+		ids := []uint{}
+		for _, task := range page.Tasks {
+			ids = append(ids, task.ID)
+		}
+		return ids
+	}
+
+	t.Run("other workspace", func(t *testing.T) {
+		if ids := listed(t, away); len(ids) != 0 {
+			t.Errorf("other workspace lists tasks %v, want none", ids)
+		}
+
+		renamed := taskRequest
+		renamed.Name = "renamed"
+		tests := []struct {
+			method string
+			path   string
+			body   interface{}
+		}{
+			{http.MethodGet, path, nil},
+			{http.MethodPut, path, renamed},
+			{http.MethodPost, path + "/cancel", nil},
+			{http.MethodDelete, path, nil},
+		}
+		for _, tt := range tests {
+			if code := call(t, r, away, tt.method, tt.path, tt.body, nil); code != http.StatusNotFound {
+				t.Errorf("%s %s from another workspace = %d, want %d", tt.method, tt.path, code, http.StatusNotFound)
+			}
+		}
+
+		var stored models.Task
+		if code := call(t, r, home, http.MethodGet, path, nil, &stored); code != http.StatusOK {
+			t.Fatalf("get task = %d, want %d", code, http.StatusOK)
+		}
+		if stored.Name != "backup" || stored.Status != "pending" {
+			t.Errorf("task after requests of another workspace = %+v, want it untouched", stored)
+		}
+	})
+
+	t.Run("own workspace", func(t *testing.T) {
+		if ids := listed(t, home); len(ids) != 1 || ids[0] != task.ID {
+			t.Errorf("workspace lists tasks %v, want [%d]", ids, task.ID)
+		}
+
+		renamed := taskRequest
+		renamed.Name = "renamed"
+		var updated models.Task
+		if code := call(t, r, home, http.MethodPut, path, renamed, &updated); code != http.StatusOK || updated.Name != "renamed" {
+			t.Errorf("update task = %d, %q, want %d, renamed", code, updated.Name, http.StatusOK)
+		}
+		if code := call(t, r, home, http.MethodPost, path+"/cancel", nil, nil); code != http.StatusOK {
+			t.Errorf("cancel task = %d, want %d", code, http.StatusOK)
+		}
+		if code := call(t, r, home, http.MethodDelete, path, nil, nil); code != http.StatusOK {
+			t.Errorf("delete task = %d, want %d", code, http.StatusOK)
+		}
+		if code := call(t, r, home, http.MethodGet, path, nil, nil); code != http.StatusNotFound {
+			t.Errorf("get deleted task = %d, want %d", code, http.StatusNotFound)
+		}
+	})
+}
+
+func TestRetryTask(t *testing.T) {
+	r, db, s := newTestServer(t)
+	token := workspaceAdmin(t, db, s, "alice", services.DefaultWorkspaceID)
+	systemDB := services.SystemDB(db)
+
+	// task creates a task and moves it to a status
+	task := func(t *testing.T, status string, retryCount int) models.Task {
+		t.Helper()
+		var task models.Task
+		taskRequest := TaskRequest{Name: "backup", ScheduleTime: time.Now().Add(time.Hour), Priority: "high"}
+		if code := call(t, r, token, http.MethodPost, "/api/tasks", taskRequest, &task); code != http.StatusCreated {
+			t.Fatalf("create task = %d, want %d", code, http.StatusCreated)
+		}
+		if err := systemDB.Model(&models.Task{}).Where("id = ?", task.ID).
+			Updates(map[string]interface{}{"status": status, "retry_count": retryCount}).Error; err != nil {
+			t.Fatalf("set status: %v", err)
+		}
+		return task
+	}
+	retry := func(t *testing.T, task models.Task) (int, models.Task) {
+		t.Helper()
+		code := call(t, r, token, http.MethodPost, fmt.Sprintf("/api/tasks/%d/retry", task.ID), nil, nil)
+		var stored models.Task
+		if err := systemDB.First(&stored, task.ID).Error; err != nil {
+			t.Fatalf("load task: %v", err)
+		}
+		return code, stored
+	}
+
+	t.Run("failed", func(t *testing.T) {
+		code, stored := retry(t, task(t, "failed", 1))
+		if code != http.StatusOK || stored.Status != "pending" || stored.RetryCount != 2 {
+			t.Errorf("retry = %d, task %s with %d retries, want %d, pending with 2 retries", code, stored.Status, stored.RetryCount, http.StatusOK)
+		}
+	})
+
+	t.Run("failed without attempts left", func(t *testing.T) {
+		maxAttempts := services.DefaultRetryPolicy().MaxAttempts
+		if code, stored := retry(t, task(t, "failed", maxAttempts-1)); code != http.StatusConflict || stored.Status != "failed" {
+			t.Errorf("retry = %d, task %s, want %d, failed", code, stored.Status, http.StatusConflict)
+		}
+	})
+
+	t.Run("dead-lettered", func(t *testing.T) {
+		deadLettered := task(t, "dead_lettered", 3)
+		entry := models.DeadLetter{WorkspaceID: services.DefaultWorkspaceID, TaskID: deadLettered.ID, Attempts: 4}
+		if err := systemDB.Create(&entry).Error; err != nil {
+			t.Fatalf("create dead letter: %v", err)
+		}
+
+		code, stored := retry(t, deadLettered)
+		if code != http.StatusOK || stored.Status != "pending" || stored.RetryCount != 0 {
+			t.Errorf("retry = %d, task %s with %d retries, want %d, pending without retries", code, stored.Status, stored.RetryCount, http.StatusOK)
+		}
+		if err := systemDB.First(&models.DeadLetter{}, entry.ID).Error; err == nil {
+			t.Error("dead letter entry remains after the retry")
+		}
+	})
+
+	t.Run("not failed", func(t *testing.T) {
+		for _, status := range []string{"pending", "running", "completed", "cancelled"} {
+			if code, stored := retry(t, task(t, status, 0)); code != http.StatusConflict || stored.Status != status {
+				t.Errorf("retry of %s task = %d, task %s, want %d, unchanged", status, code, stored.Status, http.StatusConflict)
+			}
+		}
+	})
+
+	t.Run("unknown task", func(t *testing.T) {
+		if code := call(t, r, token, http.MethodPost, "/api/tasks/999999/retry", nil, nil); code != http.StatusNotFound {
+			t.Errorf("retry of an unknown task = %d, want %d", code, http.StatusNotFound)
+		}
+	})
+}
+
+func TestUpdateTaskSetsSentFields(t *testing.T) {
+	r, db, s := newTestServer(t)
+	token := workspaceAdmin(t, db, s, "alice", services.DefaultWorkspaceID)
+
+	policy := services.DefaultRetryPolicy()
+	taskRequest := TaskRequest{Name: "backup", Description: "nightly", ScheduleTime: time.Now().Add(time.Hour), Priority: "high",
+		Timeout: 30, RetryPolicy: &policy, Tags: []string{"ops"}, Metadata: `{"bucket": "logs"}`}
+	var task models.Task
+	if code := call(t, r, token, http.MethodPost, "/api/tasks", taskRequest, &task); code != http.StatusCreated {
+		t.Fatalf("create task = %d, want %d", code, http.StatusCreated)
+	}
+
+	update := map[string]interface{}{"description": "", "timeout": 0, "retryPolicy": nil, "metadata": ""}
+	var updated models.Task
+	if code := call(t, r, token, http.MethodPut, fmt.Sprintf("/api/tasks/%d", task.ID), update, &updated); code != http.StatusOK {
+		t.Fatalf("update task = %d, want %d", code, http.StatusOK)
+	}
+	if updated.Description != "" || updated.Timeout != 0 || updated.RetryPolicy != nil || updated.Metadata != "" {
+		t.Errorf("updated task = description %q, timeout %d, retry policy %+v, metadata %q, want them cleared",
+			updated.Description, updated.Timeout, updated.RetryPolicy, updated.Metadata)
+	}
+	if updated.Name != "backup" || updated.Priority != "high" || len(updated.Tags) != 1 {
+		t.Errorf("updated task = name %q, priority %q, tags %v, want the fields left out unchanged", updated.Name, updated.Priority, updated.Tags)
+	}
+}
+
+func TestNotificationRoutesRequirePermission(t *testing.T) {
+	r, db, s := newTestServer(t)
+	admin := workspaceAdmin(t, db, s, "alice", services.DefaultWorkspaceID)
+	if _, err := s.authService.Register("bob", "bob@example.com", "secret-password"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	user, _, err := s.authService.Login("bob", "secret-password")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	channel := map[string]interface{}{"type": "webhook", "config": map[string]string{"url": "https://example.com/hook", "method": "POST"}, "enabled": true}
+	template := map[string]string{"type": services.TaskStatusEvent, "template": "{{.event}}"}
+	tests := []struct {
+		path string
+		body interface{}
+		want int
+	}{
+		{"/api/notifications/channels", channel, http.StatusOK},
+		{"/api/notifications/templates", template, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		if code := call(t, r, user, http.MethodPost, tt.path, tt.body, nil); code != http.StatusForbidden {
+			t.Errorf("POST %s as user = %d, want %d", tt.path, code, http.StatusForbidden)
+		}
+		if code := call(t, r, admin, http.MethodPost, tt.path, tt.body, nil); code != tt.want {
+			t.Errorf("POST %s as admin = %d, want %d", tt.path, code, tt.want)
+		}
+	}
+
+	var channels int64
+	if err := services.WorkspaceDB(db, services.DefaultWorkspaceID).Model(&services.NotificationChannel{}).Count(&channels).Error; err != nil || channels != 1 {
+		t.Errorf("channels configured = %d, %v, want only the admin's", channels, err)
+	}
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 	"strings"
 
@@ -8,8 +9,15 @@ import (
 	"github.com/task-schedulart/services"
 )
 
-func AuthMiddleware(authService *services.AuthService) gin.HandlerFunc {
+// AuthMiddleware authenticates requests with a Bearer JWT access token or an API
+// key, sent as Bearer token or in the X-API-Key header
+func AuthMiddleware(authService *services.AuthService, apiKeyService *services.APIKeyService) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if apiKey := c.GetHeader("X-API-Key"); apiKey != "" {
+			authenticateAPIKey(c, apiKeyService, apiKey)
+			return
+		}
+
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
@@ -25,6 +33,11 @@ func AuthMiddleware(authService *services.AuthService) gin.HandlerFunc {
 			return
 		}
 
+		if strings.HasPrefix(parts[1], services.APIKeyPrefix) {
+			authenticateAPIKey(c, apiKeyService, parts[1])
+			return
+		}
+
 		// Validate the token
 		claims, err := authService.ValidateToken(parts[1])
 		if err != nil {
@@ -34,33 +47,156 @@ func AuthMiddleware(authService *services.AuthService) gin.HandlerFunc {
 		}
 
 		// Store user information in the context
-		c.Set("user_id", (*claims)["id"])
+		c.Set("user_id", uint((*claims)["id"].(float64)))
 		c.Set("username", (*claims)["username"])
 		c.Set("role", (*claims)["role"])
+		c.Set("workspace_id", uint((*claims)["wid"].(float64)))
+		c.Set("session_id", (*claims)["sid"])
 
 		c.Next()
 	}
 }
 
-// RoleMiddleware checks if the user has the required role
-func RoleMiddleware(roles ...string) gin.HandlerFunc {
+// authenticateAPIKey authenticates a request with an API key. The request acts as
+// the user that owns the key, limited to the scopes of the key.
+func authenticateAPIKey(c *gin.Context, apiKeyService *services.APIKeyService, apiKey string) {
+	key, user, err := apiKeyService.Authenticate(apiKey)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid, expired or revoked API key"})
+		c.Abort()
+		return
+	}
+
+	c.Set("user_id", user.ID)
+	c.Set("username", user.Username)
+	c.Set("role", user.Role)
+	c.Set("workspace_id", key.WorkspaceID)
+	c.Set("api_key_id", key.ID)
+	c.Set("scopes", key.Scopes)
+	if key.TeamID != nil {
+		c.Set("team_id", *key.TeamID)
+	}
+
+	c.Next()
+}
+
+// CurrentActor returns the user a request was authenticated as, limited to the
+// team of the API key for team keys
+func CurrentActor(c *gin.Context) services.Actor {
+	actor := services.Actor{
+		UserID:   c.GetUint("user_id"),
+		Username: c.GetString("username"),
+		Role:     c.GetString("role"),
+	}
+	if _, exists := c.Get("team_id"); exists {
+		teamID := c.GetUint("team_id")
+		actor.TeamID = &teamID
+	}
+	return actor
+}
+
+// SocketAuthenticator authenticates WebSocket clients with an access token or an
+// API key. API keys need the tasks:read scope, as events describe tasks. Access
+// tokens act with the current role of their user.
+func SocketAuthenticator(authService *services.AuthService, apiKeyService *services.APIKeyService) services.WebSocketAuthenticator {
+	return func(token string) (services.Actor, uint, error) {
+		if strings.HasPrefix(token, services.APIKeyPrefix) {
+			key, user, err := apiKeyService.Authenticate(token)
+			if err != nil {
+				return services.Actor{}, 0, err
+			}
+			for _, scope := range key.Scopes {
+				if scope == "tasks:read" {
+					actor := services.Actor{UserID: user.ID, Username: user.Username, Role: user.Role, TeamID: key.TeamID}
+					return actor, key.WorkspaceID, nil
+				}
+			}
+			return services.Actor{}, 0, errors.New("API key lacks the tasks:read scope")
+		}
+
+		claims, err := authService.ValidateToken(token)
+		if err != nil {
+			return services.Actor{}, 0, err
+		}
+		// Connections outlive the role in the token, so they act with the current one
+		user, err := authService.GetUser(uint((*claims)["id"].(float64)))
+		if err != nil {
+			return services.Actor{}, 0, err
+		}
+		actor := services.Actor{UserID: user.ID, Username: user.Username, Role: user.Role}
+		return actor, uint((*claims)["wid"].(float64)), nil
+	}
+}
+
+// ScopeMiddleware limits API keys to the routes of a resource their scopes cover.
+// GET and HEAD requests need the read scope of the resource, other methods its
+// write scope. Requests authenticated with a JWT are not limited.
+func ScopeMiddleware(resource string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userRole, exists := c.Get("role")
+		scopes, exists := c.Get("scopes")
 		if !exists {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "User role not found"})
-			c.Abort()
+			c.Next()
 			return
 		}
 
-		hasRole := false
-		for _, role := range roles {
-			if userRole == role {
-				hasRole = true
-				break
+		required := resource + ":write"
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+			required = resource + ":read"
+		}
+
+		granted, _ := scopes.([]string)
+		for _, scope := range granted {
+			if scope == required {
+				c.Next()
+				return
 			}
 		}
 
-		if !hasRole {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API key lacks the " + required + " scope"})
+		c.Abort()
+	}
+}
+
+// SessionMiddleware rejects requests authenticated with an API key, for routes
+// that only a logged in user may call
+func SessionMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, exists := c.Get("api_key_id"); exists {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This endpoint requires logging in, API keys are not accepted"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// PermissionMiddleware limits routes to users whose role in their workspace
+// grants a permission
+func PermissionMiddleware(permissionService *services.PermissionService, permission services.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		actor := CurrentActor(c)
+
+		err := permissionService.ForWorkspace(c.GetUint("workspace_id")).Authorize(actor, permission, nil)
+		if errors.Is(err, services.ErrPermissionDenied) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions", "required": permission})
+			c.Abort()
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// WorkspaceMiddleware limits routes to the users of a workspace
+func WorkspaceMiddleware(workspaceID uint) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetUint("workspace_id") != workspaceID {
 			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
 			c.Abort()
 			return
@@ -68,4 +204,4 @@ func RoleMiddleware(roles ...string) gin.HandlerFunc {
 
 		c.Next()
 	}
-} 
\ No newline at end of file
+}
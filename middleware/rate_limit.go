@@ -71,29 +71,42 @@ func min(a, b float64) float64 {
 	return b
 }
 
-// RateLimitMiddleware creates a rate limiting middleware
-// requestsPerMinute: number of requests allowed per minute
-func RateLimitMiddleware(requestsPerMinute float64) gin.HandlerFunc {
+// RateLimitConfig sets how many requests are allowed within a window
+type RateLimitConfig struct {
+	Authenticated float64       // Requests of one user or API key within its workspace
+	Anonymous     float64       // Requests without credentials from one client IP
+	Window        time.Duration // Period the limits apply to
+}
+
+// DefaultRateLimitConfig returns the limits used when nothing is configured
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Authenticated: 100,
+		Anonymous:     20,
+		Window:        time.Minute,
+	}
+}
+
+// RateLimitMiddleware creates a rate limiting middleware. Authenticated requests
+// are limited per workspace and principal, so neither one tenant nor one noisy
+// user or API key can use up the capacity of the others; anonymous requests are
+// limited by client IP. It must run after AuthMiddleware to tell them apart.
+func RateLimitMiddleware(config RateLimitConfig) gin.HandlerFunc {
 	limiter := NewRateLimiter()
 
 	return func(c *gin.Context) {
-		// Get client identifier (IP or user ID if authenticated)
 		clientID := c.ClientIP()
-		if userID, exists := c.Get("user_id"); exists {
-			clientID = userID.(string)
+		rateLimit := config.Anonymous
+		if workspaceID, exists := c.Get("workspace_id"); exists {
+			clientID = rateLimitKey(c, workspaceID)
+			rateLimit = config.Authenticated
 		}
 
-		// Higher rate limit for authenticated users
-		rateLimit := requestsPerMinute
-		if _, exists := c.Get("user_id"); exists {
-			rateLimit *= 5 // 5x higher limit for authenticated users
-		}
-
-		bucket := limiter.getBucket(clientID, rateLimit, rateLimit/60.0)
+		bucket := limiter.getBucket(clientID, rateLimit, rateLimit/config.Window.Seconds())
 		if !bucket.tryConsume(1.0) {
 			c.JSON(http.StatusTooManyRequests, gin.H{
 				"error":       "Rate limit exceeded",
-				"retry_after": "60s",
+				"retry_after": fmt.Sprintf("%.0fs", config.Window.Seconds()),
 			})
 			c.Abort()
 			return
@@ -102,8 +115,17 @@ func RateLimitMiddleware(requestsPerMinute float64) gin.HandlerFunc {
 		// Add rate limit headers
 		c.Header("X-RateLimit-Limit", fmt.Sprintf("%.0f", rateLimit))
 		c.Header("X-RateLimit-Remaining", fmt.Sprintf("%.0f", bucket.tokens))
-		c.Header("X-RateLimit-Reset", fmt.Sprintf("%d", bucket.lastRefillTime.Add(time.Minute).Unix()))
+		c.Header("X-RateLimit-Reset", fmt.Sprintf("%d", bucket.lastRefillTime.Add(config.Window).Unix()))
 
 		c.Next()
 	}
 }
+
+// rateLimitKey returns the bucket of an authenticated request. API keys get a
+// bucket of their own instead of sharing the one of the user that created them.
+func rateLimitKey(c *gin.Context, workspaceID interface{}) string {
+	if keyID, exists := c.Get("api_key_id"); exists {
+		return fmt.Sprintf("workspace:%v:key:%v", workspaceID, keyID)
+	}
+	return fmt.Sprintf("workspace:%v:user:%v", workspaceID, c.GetUint("user_id"))
+}
@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimitPerPrincipal(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		// Stands in for AuthMiddleware
+		c.Set("workspace_id", uint(1))
+		c.Set("user_id", uint(1))
+		if c.GetHeader("X-User") == "2" {
+			c.Set("user_id", uint(2))
+		}
+		if c.GetHeader("X-Key") != "" {
+			c.Set("api_key_id", uint(7))
+		}
+	})
+	r.Use(RateLimitMiddleware(RateLimitConfig{Authenticated: 2, Anonymous: 1, Window: time.Hour}))
+	r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	request := func(header, value string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := request("", ""); code != http.StatusOK {
+			t.Fatalf("request %d of user 1 = %d, want %d", i+1, code, http.StatusOK)
+		}
+	}
+	if code := request("", ""); code != http.StatusTooManyRequests {
+		t.Errorf("request over the limit = %d, want %d", code, http.StatusTooManyRequests)
+	}
+
+	// Other users and API keys of the workspace keep their own capacity
+	if code := request("X-User", "2"); code != http.StatusOK {
+		t.Errorf("request of user 2 = %d, want %d", code, http.StatusOK)
+	}
+	if code := request("X-Key", "7"); code != http.StatusOK {
+		t.Errorf("request with an API key of user 1 = %d, want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// WorkingHours is a daily time window on some weekdays, in the calendar's time zone
+type WorkingHours struct {
+	Weekdays []int  `json:"weekdays"` // 0-6 for Sunday-Saturday
+	Start    string `json:"start"`    // HH:MM
+	End      string `json:"end"`      // HH:MM, after Start; 24:00 for the end of the day
+}
+
+// BlackoutWindow is a period, such as a maintenance freeze, in which no task may run
+type BlackoutWindow struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Reason string    `json:"reason"`
+}
+
+// Calendar restricts when tasks that reference it may run: within its working
+// hours, if any are set, and never on a holiday or during a blackout
+type Calendar struct {
+	ID           uint             `json:"id" gorm:"primaryKey"`
+	WorkspaceID  uint             `json:"workspaceId" gorm:"<-:create;not null;default:1;uniqueIndex:idx_calendar_workspace_name"`
+	Name         string           `json:"name" gorm:"type:varchar(255);not null;uniqueIndex:idx_calendar_workspace_name"`
+	Description  string           `json:"description"`
+	Timezone     string           `json:"timezone"` // IANA time zone of working hours and holidays, UTC when empty
+	WorkingHours []WorkingHours   `json:"workingHours" gorm:"type:jsonb;serializer:json"`
+	Holidays     []string         `json:"holidays" gorm:"type:jsonb;serializer:json"` // YYYY-MM-DD dates
+	Blackouts    []BlackoutWindow `json:"blackouts" gorm:"type:jsonb;serializer:json"`
+	CreatedAt    time.Time        `json:"createdAt"`
+	UpdatedAt    time.Time        `json:"updatedAt"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// DeadLetter keeps a task that failed all of its attempts together with the
+// payload it was run with and the errors of every attempt
+type DeadLetter struct {
+	ID           uint          `json:"id" gorm:"primaryKey"`
+	WorkspaceID  uint          `json:"workspaceId" gorm:"<-:create;not null;default:1;index"`
+	TaskID       uint          `json:"taskId" gorm:"not null;index"`
+	TaskName     string        `json:"taskName"`
+	TaskType     string        `json:"taskType" gorm:"type:varchar(100);index"`
+	Payload      string        `json:"payload" gorm:"type:jsonb;default:null"` // Task metadata at the time of the final attempt
+	FinalError   string        `json:"finalError"`
+	ErrorClass   string        `json:"errorClass" gorm:"type:varchar(50)"`
+	ErrorHistory AttemptErrors `json:"errorHistory" gorm:"type:jsonb"`
+	Attempts     int           `json:"attempts"`
+	CreatedAt    time.Time     `json:"createdAt" gorm:"index"`
+}
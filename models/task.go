@@ -1,7 +1,9 @@
 package models
 
 import (
+	"database/sql/driver"
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"gorm.io/gorm"
@@ -9,11 +11,79 @@ import (
 
 // RecurringPattern defines how a task should recur
 type RecurringPattern struct {
-	Type     string `json:"type"`      // once, daily, weekly, monthly, custom
-	Interval int    `json:"interval"`  // Repeat every X days/weeks/months
-	Weekdays []int  `json:"weekdays"`  // 0-6 for Sunday-Saturday
-	EndDate  string `json:"end_date"`  // When to stop recurring
-	CronExpr string `json:"cron_expr"` // Custom cron expression
+	Type       string `json:"type"`         // once, daily, weekly, monthly, custom, rrule
+	Interval   int    `json:"interval"`     // Repeat every X days/weeks/months
+	Weekdays   []int  `json:"weekdays"`     // 0-6 for Sunday-Saturday
+	DayOfMonth int    `json:"day_of_month"` // 1-31 for monthly patterns, the last day is used in shorter months
+	TimeOfDay  string `json:"time_of_day"`  // HH:MM in Timezone
+	Timezone   string `json:"timezone"`     // IANA time zone, UTC when empty
+	StartDate  string `json:"start_date"`   // First day of the pattern, intervals are counted from it
+	EndDate    string `json:"end_date"`     // When to stop recurring
+	CronExpr   string `json:"cron_expr"`    // Custom cron expression
+
+	// RFC 5545 recurrence rule for rrule patterns, e.g. FREQ=MONTHLY;BYDAY=2TU, with
+	// extra (RDATE) and excluded (EXDATE) dates or date-times
+	RRule   string   `json:"rrule,omitempty"`
+	ExDates []string `json:"exdates,omitempty"`
+	RDates  []string `json:"rdates,omitempty"`
+
+	// What to do with occurrences missed while no replica was running: skip, run_once or run_all
+	MisfirePolicy string `json:"misfire_policy,omitempty"`
+
+	// Business calendar the occurrences must respect, overrides the calendar of the task
+	CalendarID uint `json:"calendar_id,omitempty"`
+
+	// Start a run of this workflow instead of copying the task on every occurrence
+	WorkflowID         uint              `json:"workflow_id,omitempty"`
+	WorkflowParameters map[string]string `json:"workflow_parameters,omitempty"`
+}
+
+// RetryPolicy controls how the execution engine retries a failed task
+type RetryPolicy struct {
+	MaxAttempts     int      `json:"maxAttempts"`     // Total attempts including the first run
+	InitialDelay    int      `json:"initialDelay"`    // Seconds to wait before the first retry
+	Multiplier      float64  `json:"multiplier"`      // Factor applied to the delay after every retry
+	MaxDelay        int      `json:"maxDelay"`        // Upper bound for the delay in seconds
+	Jitter          float64  `json:"jitter"`          // Random spread as a fraction of the delay (0-1)
+	RetryableErrors []string `json:"retryableErrors"` // Error classes to retry, everything but permanent errors when empty
+}
+
+// AttemptError records why a single execution attempt of a task failed
+type AttemptError struct {
+	Attempt int       `json:"attempt"`
+	Class   string    `json:"class"`
+	Error   string    `json:"error"`
+	At      time.Time `json:"at"`
+}
+
+// AttemptErrors is the error history of a task, stored as a JSON array
+type AttemptErrors []AttemptError
+
+// Value implements driver.Valuer
+func (a AttemptErrors) Value() (driver.Value, error) {
+	if a == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Scan implements sql.Scanner
+func (a *AttemptErrors) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*a = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, a)
+	case string:
+		return json.Unmarshal([]byte(v), a)
+	default:
+		return fmt.Errorf("unsupported type for AttemptErrors: %T", value)
+	}
 }
 
 // TaskProgress represents the progress of a task
@@ -27,32 +97,61 @@ type TaskProgress struct {
 type Task struct {
 	ID           uint           `json:"id" gorm:"primaryKey"`
 	Name         string         `json:"name" gorm:"not null"`
+	Type         string         `json:"type" gorm:"type:varchar(100);default:'noop';index"` // Selects the handler that executes the task
 	Description  string         `json:"description"`
 	ScheduleTime time.Time      `json:"scheduleTime" gorm:"not null;index"`
 	Priority     string         `json:"priority" gorm:"type:varchar(10);check:priority in ('low', 'medium', 'high')"`
-	Status       string         `json:"status" gorm:"type:varchar(20);default:'pending';check:status in ('pending', 'running', 'completed', 'failed')"`
+	Status       string         `json:"status" gorm:"type:varchar(20);default:'pending';check:status in ('pending', 'running', 'completed', 'failed', 'dead_lettered', 'cancelled', 'skipped')"`
 	CreatedAt    time.Time      `json:"createdAt"`
 	UpdatedAt    time.Time      `json:"updatedAt"`
 	DeletedAt    gorm.DeletedAt `json:"-" gorm:"index"`
 	RetryCount   int            `json:"retryCount" gorm:"default:0"`
+	RetryPolicy  *RetryPolicy   `json:"retryPolicy" gorm:"type:jsonb;serializer:json"`
+	Timeout      int            `json:"timeout" gorm:"default:0"` // Maximum run time in seconds, 0 uses the worker default
 	LastError    string         `json:"lastError"`
+	ErrorHistory AttemptErrors  `json:"errorHistory" gorm:"type:jsonb"`
 	Tags         []string       `json:"tags" gorm:"type:text[]"`
-	Metadata     string         `json:"metadata" gorm:"type:jsonb"`
+	Metadata     string         `json:"metadata" gorm:"type:jsonb;default:null"`
+
+	// Execution lease held by the worker currently running the task
+	LeaseOwner      string     `json:"leaseOwner" gorm:"type:varchar(255);index"`
+	LeaseExpiresAt  *time.Time `json:"leaseExpiresAt" gorm:"index"`
+	CancelRequested bool       `json:"cancelRequested" gorm:"default:false"`
+
+	// Dependency graph, see TaskDependency
+	DependsOn         []uint `json:"dependsOn,omitempty" gorm:"-"`                             // Upstream task IDs, only used when creating a task
+	OnUpstreamFailure string `json:"onUpstreamFailure" gorm:"type:varchar(10);default:'skip'"` // skip or fail this task when an upstream task does not complete
+
+	// Ownership, decides who may read and modify the task besides admins and the assignee
+	WorkspaceID uint  `json:"workspaceId" gorm:"<-:create;not null;default:1;index"` // Tenant the task belongs to, never changes
+	CreatedBy   uint  `json:"createdBy" gorm:"index"`                                // User that created the task, 0 for tasks created by the system
+	TeamID      *uint `json:"teamId,omitempty" gorm:"index"`                         // Team whose members share the task
+
+	// Business calendar that restricts when the task may run, see Calendar
+	CalendarID *uint `json:"calendarId,omitempty" gorm:"index"`
+
+	// Set on tasks created for a workflow step
+	WorkflowRunID *uint  `json:"workflowRunId,omitempty" gorm:"index"`
+	StepKey       string `json:"stepKey,omitempty" gorm:"type:varchar(100)"`
 
 	// New fields
-	ParentTaskID    *uint           `json:"parentTaskId" gorm:"index"` // For task dependencies
-	DependentTasks  []Task          `json:"dependentTasks" gorm:"foreignKey:ParentTaskID"`
-	IsRecurring     bool            `json:"isRecurring" gorm:"default:false"`
-	RecurringConfig json.RawMessage `json:"recurringConfig" gorm:"type:jsonb"` // Stores RecurringPattern
-	Progress        TaskProgress    `json:"progress" gorm:"embedded"`
-	Assignee        string          `json:"assignee"` // User assigned to the task
-	DueDate         *time.Time      `json:"dueDate"`
-	EstimatedTime   int             `json:"estimatedTime"`                  // In minutes
-	ActualTime      int             `json:"actualTime"`                     // In minutes
-	Labels          []string        `json:"labels" gorm:"type:text[]"`      // For better organization
-	Priority_Score  float64         `json:"priorityScore" gorm:"default:0"` // Calculated priority score
-	Comments        []TaskComment   `json:"comments" gorm:"foreignKey:TaskID"`
-	Attachments     []Attachment    `json:"attachments" gorm:"foreignKey:TaskID"`
+	ParentTaskID     *uint           `json:"parentTaskId" gorm:"index"` // For task dependencies
+	DependentTasks   []Task          `json:"dependentTasks" gorm:"foreignKey:ParentTaskID"`
+	IsRecurring      bool            `json:"isRecurring" gorm:"default:false"`
+	RecurrencePaused bool            `json:"recurrencePaused" gorm:"default:false"`  // Paused recurring templates create no instances
+	RecurringConfig  json.RawMessage `json:"recurringConfig" gorm:"type:jsonb"`      // Stores RecurringPattern
+	LastOccurrenceAt *time.Time      `json:"lastOccurrenceAt"`                       // Latest occurrence of a recurring template that was processed
+	TemplateID       *uint           `json:"templateId,omitempty" gorm:"index"`      // Recurring template an instance was created from
+	OccurrenceKey    *string         `json:"-" gorm:"type:varchar(100);uniqueIndex"` // Ensures each occurrence is created once
+	Progress         TaskProgress    `json:"progress" gorm:"embedded"`
+	Assignee         string          `json:"assignee"` // User assigned to the task
+	DueDate          *time.Time      `json:"dueDate"`
+	EstimatedTime    int             `json:"estimatedTime"`                  // In minutes
+	ActualTime       int             `json:"actualTime"`                     // In minutes
+	Labels           []string        `json:"labels" gorm:"type:text[]"`      // For better organization
+	Priority_Score   float64         `json:"priorityScore" gorm:"default:0"` // Calculated priority score
+	Comments         []TaskComment   `json:"comments" gorm:"foreignKey:TaskID"`
+	Attachments      []Attachment    `json:"attachments" gorm:"foreignKey:TaskID"`
 }
 
 type TaskComment struct {
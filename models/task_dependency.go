@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// TaskDependency is an edge in the task graph: TaskID may only run once DependsOnID has completed
+type TaskDependency struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	TaskID      uint      `json:"taskId" gorm:"not null;uniqueIndex:idx_task_dependency"`
+	DependsOnID uint      `json:"dependsOnId" gorm:"not null;uniqueIndex:idx_task_dependency;index"`
+	WorkspaceID uint      `json:"workspaceId" gorm:"<-:create;not null;default:1;index"` // Workspace of both tasks
+	CreatedAt   time.Time `json:"createdAt"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// TaskExecution records a single attempt at running a task
+type TaskExecution struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	WorkspaceID uint       `json:"workspaceId" gorm:"<-:create;not null;default:1;index"`
+	TaskID      uint       `json:"taskId" gorm:"not null;index"`
+	Attempt     int        `json:"attempt"`
+	WorkerID    string     `json:"workerId" gorm:"type:varchar(255)"`
+	Outcome     string     `json:"outcome" gorm:"type:varchar(20);index"` // running, completed, failed, timeout, cancelled, released, abandoned
+	ErrorClass  string     `json:"errorClass" gorm:"type:varchar(50)"`
+	Error       string     `json:"error"`
+	Output      string     `json:"output"`
+	StartedAt   time.Time  `json:"startedAt" gorm:"index"`
+	FinishedAt  *time.Time `json:"finishedAt"`
+	DurationMs  int64      `json:"durationMs"`
+}
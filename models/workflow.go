@@ -0,0 +1,60 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// WorkflowStep is a task template within a workflow
+type WorkflowStep struct {
+	Key               string          `json:"key"`  // Unique within the workflow, referenced by dependsOn
+	Name              string          `json:"name"` // Defaults to the key
+	Type              string          `json:"type"`
+	Description       string          `json:"description"`
+	Priority          string          `json:"priority"`
+	Payload           json.RawMessage `json:"payload"`   // Becomes the task metadata, {{param}} placeholders are replaced
+	DependsOn         []string        `json:"dependsOn"` // Keys of upstream steps
+	OnUpstreamFailure string          `json:"onUpstreamFailure"`
+	RetryPolicy       *RetryPolicy    `json:"retryPolicy"`
+	Timeout           int             `json:"timeout"`
+	Tags              []string        `json:"tags"`
+}
+
+// WorkflowParameter declares a value that is supplied when a workflow is run
+type WorkflowParameter struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Required    bool   `json:"required"`
+	Default     string `json:"default"`
+}
+
+// Workflow is a named, versioned template of dependent steps. Workflows are
+// never changed in place, saving a workflow under an existing name adds a new version.
+type Workflow struct {
+	ID          uint                `json:"id" gorm:"primaryKey"`
+	WorkspaceID uint                `json:"workspaceId" gorm:"<-:create;not null;default:1;uniqueIndex:idx_workflow_workspace_version"`
+	Name        string              `json:"name" gorm:"type:varchar(255);not null;uniqueIndex:idx_workflow_workspace_version"`
+	Version     int                 `json:"version" gorm:"not null;uniqueIndex:idx_workflow_workspace_version"`
+	Description string              `json:"description"`
+	Steps       []WorkflowStep      `json:"steps" gorm:"type:jsonb;serializer:json"`
+	Parameters  []WorkflowParameter `json:"parameters" gorm:"type:jsonb;serializer:json"`
+	CreatedAt   time.Time           `json:"createdAt"`
+}
+
+// WorkflowRun is one instantiation of a workflow. Its status is derived from the
+// tasks created for the steps: pending, running, completed, failed or cancelled.
+type WorkflowRun struct {
+	ID              uint              `json:"id" gorm:"primaryKey"`
+	WorkspaceID     uint              `json:"workspaceId" gorm:"<-:create;not null;default:1;index"`
+	WorkflowID      uint              `json:"workflowId" gorm:"not null;index"`
+	WorkflowName    string            `json:"workflowName" gorm:"type:varchar(255)"`
+	WorkflowVersion int               `json:"workflowVersion"`
+	Status          string            `json:"status" gorm:"type:varchar(20);default:'pending';index"`
+	Parameters      map[string]string `json:"parameters" gorm:"type:jsonb;serializer:json"`
+	TriggeredBy     string            `json:"triggeredBy" gorm:"type:varchar(20)"`    // api or schedule
+	OccurrenceKey   *string           `json:"-" gorm:"type:varchar(100);uniqueIndex"` // Set for runs started by a recurring schedule
+	FinishedAt      *time.Time        `json:"finishedAt"`
+	CreatedAt       time.Time         `json:"createdAt"`
+	UpdatedAt       time.Time         `json:"updatedAt"`
+	Tasks           []Task            `json:"tasks,omitempty" gorm:"foreignKey:WorkflowRunID"`
+}
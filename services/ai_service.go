@@ -1,6 +1,7 @@
 package services
 
 import (
+	"errors"
 	"math"
 	"sort"
 	"time"
@@ -17,6 +18,23 @@ func NewAIService(db *gorm.DB) *AIService {
 	return &AIService{db: db}
 }
 
+// ForWorkspace returns a copy of the service limited to the data of a workspace
+func (s *AIService) ForWorkspace(workspaceID uint) *AIService {
+	return &AIService{db: WorkspaceDB(s.db, workspaceID)}
+}
+
+// ErrNoOptimalSlot is returned when no optimal time slot is found within maxOptimalTimeSteps
+var ErrNoOptimalSlot = errors.New("no optimal time slot within a year")
+
+// maxOptimalTimeSteps bounds the search for an optimal time slot to a year of 30 minute steps
+const maxOptimalTimeSteps = 365 * 48
+
+// defaultSchedulingCalendar applies to tasks without a calendar: every day from 05:00 to midnight UTC
+var defaultSchedulingCalendar, _ = compileCalendar(&models.Calendar{
+	Name:         "default",
+	WorkingHours: []models.WorkingHours{{Weekdays: []int{0, 1, 2, 3, 4, 5, 6}, Start: "05:00", End: "24:00"}},
+})
+
 // TaskAnalytics represents analytics data for tasks
 type TaskAnalytics struct {
 	CompletionRate       float64            `json:"completionRate"`
@@ -32,7 +50,8 @@ type TrendPoint struct {
 	Value float64   `json:"value"`
 }
 
-// OptimizeTaskSchedule uses AI to optimize task scheduling
+// OptimizeTaskSchedule uses AI to optimize task scheduling. Tasks without an
+// optimal time slot within a year keep their schedule time.
 func (s *AIService) OptimizeTaskSchedule() error {
 	var tasks []models.Task
 	if err := s.db.Where("status = ?", "pending").Find(&tasks).Error; err != nil {
@@ -58,8 +77,13 @@ func (s *AIService) OptimizeTaskSchedule() error {
 
 	// Update task schedule times based on optimization
 	for i, st := range scoredTasks {
-		optimalTime := s.calculateOptimalTime(st.Task, i)
-		st.Task.ScheduleTime = optimalTime
+		optimalTime, err := s.calculateOptimalTime(st.Task, i)
+		if err != nil && !errors.Is(err, ErrNoOptimalSlot) {
+			return err
+		}
+		if err == nil {
+			st.Task.ScheduleTime = optimalTime
+		}
 		st.Task.Priority_Score = st.Score
 		if err := s.db.Save(&st.Task).Error; err != nil {
 			return err
@@ -101,41 +125,56 @@ func (s *AIService) calculateTaskScore(task models.Task) float64 {
 }
 
 // calculateOptimalTime determines the best time to schedule a task
-func (s *AIService) calculateOptimalTime(task models.Task, position int) time.Time {
+func (s *AIService) calculateOptimalTime(task models.Task, position int) (time.Time, error) {
 	baseTime := time.Now()
 
 	// Consider user's productive hours
 	productiveHours := s.analyzeProductiveHours()
 
+	// Only consider times the task's calendar allows
+	calendar := defaultSchedulingCalendar
+	if task.CalendarID != nil {
+		if taskCalendar, err := loadBusinessCalendar(s.db, *task.CalendarID); err == nil && taskCalendar != nil {
+			calendar = taskCalendar
+		}
+	}
+
 	// Add delay based on position and available resources
 	delay := time.Duration(position*30) * time.Minute
 
 	// Find next optimal time slot
 	optimalTime := baseTime.Add(delay)
-	for !s.isOptimalTimeSlot(optimalTime, productiveHours) {
+	for step := 0; step < maxOptimalTimeSteps; step++ {
+		if s.isOptimalTimeSlot(calendar, optimalTime, productiveHours) {
+			return optimalTime, nil
+		}
 		optimalTime = optimalTime.Add(30 * time.Minute)
 	}
 
-	return optimalTime
+	return time.Time{}, ErrNoOptimalSlot
 }
 
-// analyzeHistoricalPerformance analyzes past task performance
+// analyzeHistoricalPerformance returns the share of past attempts at similar
+// tasks that completed within the estimated time
 func (s *AIService) analyzeHistoricalPerformance(task models.Task) float64 {
-	var similarTasks []models.Task
-	s.db.Where("tags && ? AND status = ?", task.Tags, "completed").Find(&similarTasks)
-
-	if len(similarTasks) == 0 {
-		return 0.5 // Default score for new task types
+	var stats struct {
+		Total          int64
+		WithinEstimate int64
 	}
-
-	var successRate float64
-	for _, t := range similarTasks {
-		if t.ActualTime <= t.EstimatedTime {
-			successRate += 1.0
-		}
+	s.db.Table("task_executions").
+		Joins("JOIN tasks ON tasks.id = task_executions.task_id").
+		Where("tasks.tags && ? AND tasks.id <> ? AND tasks.deleted_at IS NULL", task.Tags, task.ID).
+		Where("task_executions.outcome <> ?", ExecutionRunning).
+		Select("COUNT(*) AS total, " +
+			"COUNT(*) FILTER (WHERE task_executions.outcome = 'completed' AND " +
+			"(tasks.estimated_time = 0 OR task_executions.duration_ms <= tasks.estimated_time * 60000)) AS within_estimate").
+		Scan(&stats)
+
+	if stats.Total == 0 {
+		return 0.5 // Default score for new task types
 	}
 
-	return successRate / float64(len(similarTasks))
+	return float64(stats.WithinEstimate) / float64(stats.Total)
 }
 
 // analyzeProductiveHours determines the most productive hours based on task completion history
@@ -169,15 +208,15 @@ func (s *AIService) analyzeProductiveHours() map[int]float64 {
 }
 
 // isOptimalTimeSlot checks if a given time is optimal for task scheduling
-func (s *AIService) isOptimalTimeSlot(t time.Time, productiveHours map[int]float64) bool {
+func (s *AIService) isOptimalTimeSlot(calendar *businessCalendar, t time.Time, productiveHours map[int]float64) bool {
 	hour := t.Hour()
 	score := productiveHours[hour]
 
 	// Consider it optimal if:
 	// 1. It's during productive hours (score > 0.7)
 	// 2. Not too many tasks are already scheduled
-	// 3. Not during typical off-hours (11 PM - 5 AM)
-	if score > 0.7 && hour >= 5 && hour <= 23 {
+	// 3. The calendar allows tasks to run at that time
+	if score > 0.7 && calendar.Allowed(t) {
 		var conflictingTasks int64
 		s.db.Model(&models.Task{}).
 			Where("schedule_time BETWEEN ? AND ?",
@@ -0,0 +1,256 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// APIKeyPrefix starts every API key, which tells them apart from JWTs
+const APIKeyPrefix = "tsk_"
+
+const (
+	// apiKeyDisplayLength is the number of leading characters of a key kept for display
+	apiKeyDisplayLength = 12
+	// apiKeyUsageInterval is how often the last use of a key is written at most
+	apiKeyUsageInterval = time.Minute
+)
+
+// Scopes that API keys can be granted. Read scopes allow GET requests, write
+// scopes every other method.
+var APIKeyScopes = []string{
+	"tasks:read", "tasks:write",
+	"workflows:read", "workflows:write",
+	"calendars:read", "calendars:write",
+}
+
+var (
+	// ErrInvalidAPIKey is returned when an API key request is rejected
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	// ErrNotTeamAdmin is returned when creating a team key without being an admin of the team
+	ErrNotTeamAdmin = errors.New("only team admins can create team API keys")
+)
+
+// APIKey is a long-lived credential for scripts and services. Only a hash of the
+// key is stored; the key itself is shown once when it is created or rotated.
+type APIKey struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	Name        string     `json:"name" gorm:"type:varchar(100);not null"`
+	Prefix      string     `json:"prefix" gorm:"type:varchar(20)"` // Leading characters of the key, to recognize it
+	Hash        string     `json:"-" gorm:"type:varchar(64);not null;uniqueIndex"`
+	UserID      uint       `json:"userId" gorm:"not null;index"`          // User the key acts as
+	WorkspaceID uint       `json:"workspaceId" gorm:"not null;default:1"` // Workspace of the user when the key was created
+	TeamID      *uint      `json:"teamId,omitempty" gorm:"index"`         // Set for keys that belong to a team
+	Scopes      []string   `json:"scopes" gorm:"type:jsonb;serializer:json"`
+	ExpiresAt   *time.Time `json:"expiresAt"`
+	LastUsedAt  *time.Time `json:"lastUsedAt"`
+	RevokedAt   *time.Time `json:"revokedAt"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+}
+
+type APIKeyService struct {
+	db *gorm.DB
+}
+
+func NewAPIKeyService(db *gorm.DB) *APIKeyService {
+	return &APIKeyService{db: db}
+}
+
+// CreateAPIKey stores a new key for a user and returns it together with the plain key
+func (s *APIKeyService) CreateAPIKey(key *APIKey) (string, error) {
+	if err := validateAPIKey(key); err != nil {
+		return "", err
+	}
+	if key.TeamID != nil {
+		// Teams of other workspaces are reported like teams the user is no admin of
+		if err := WorkspaceDB(s.db, key.WorkspaceID).First(&Team{}, *key.TeamID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return "", ErrNotTeamAdmin
+			}
+			return "", err
+		}
+
+		var admins int64
+		if err := s.db.Model(&TeamMember{}).
+			Where("team_id = ? AND user_id = ? AND role = ?", *key.TeamID, key.UserID, "admin").
+			Count(&admins).Error; err != nil {
+			return "", err
+		}
+		if admins == 0 {
+			return "", ErrNotTeamAdmin
+		}
+	}
+
+	plain := newAPIKey()
+	key.ID = 0
+	key.Prefix = plain[:apiKeyDisplayLength]
+	key.Hash = hashAPIKey(plain)
+	key.LastUsedAt = nil
+	key.RevokedAt = nil
+	if err := s.db.Create(key).Error; err != nil {
+		return "", err
+	}
+	return plain, nil
+}
+
+// ListAPIKeys returns the keys of a user, newest first
+func (s *APIKeyService) ListAPIKeys(userID uint) ([]APIKey, error) {
+	var keys []APIKey
+	err := s.db.Where("user_id = ?", userID).Order("created_at desc").Find(&keys).Error
+	return keys, err
+}
+
+// RotateAPIKey replaces the secret of an active key. The previous key stops working immediately.
+func (s *APIKeyService) RotateAPIKey(id, userID uint) (*APIKey, string, error) {
+	key, err := s.getOwnKey(id, userID)
+	if err != nil {
+		return nil, "", err
+	}
+	if key.RevokedAt != nil {
+		return nil, "", fmt.Errorf("%w: key is revoked", ErrInvalidAPIKey)
+	}
+
+	plain := newAPIKey()
+	if err := s.db.Model(key).Updates(map[string]interface{}{
+		"prefix":       plain[:apiKeyDisplayLength],
+		"hash":         hashAPIKey(plain),
+		"last_used_at": nil,
+	}).Error; err != nil {
+		return nil, "", err
+	}
+	return key, plain, nil
+}
+
+// RevokeAPIKey permanently disables a key
+func (s *APIKeyService) RevokeAPIKey(id, userID uint) (*APIKey, error) {
+	key, err := s.getOwnKey(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if key.RevokedAt == nil {
+		if err := s.db.Model(key).Update("revoked_at", time.Now()).Error; err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// Authenticate returns the active key matching a plain key and the user it acts
+// as, and records that the key was used
+func (s *APIKeyService) Authenticate(plain string) (*APIKey, *User, error) {
+	var key APIKey
+	if err := s.db.Where("hash = ? AND revoked_at IS NULL", hashAPIKey(plain)).First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrInvalidAPIKey
+		}
+		return nil, nil, err
+	}
+	now := time.Now()
+	if key.ExpiresAt != nil && now.After(*key.ExpiresAt) {
+		return nil, nil, fmt.Errorf("%w: key expired", ErrInvalidAPIKey)
+	}
+
+	var user User
+	if err := s.db.First(&user, key.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrInvalidAPIKey
+		}
+		return nil, nil, err
+	}
+	if user.WorkspaceID != key.WorkspaceID {
+		return nil, nil, fmt.Errorf("%w: user moved to another workspace", ErrInvalidAPIKey)
+	}
+	if key.TeamID != nil {
+		// Leaving the team revokes the key; this catches memberships removed otherwise
+		var members int64
+		if err := s.db.Model(&TeamMember{}).Where("team_id = ? AND user_id = ?", *key.TeamID, key.UserID).
+			Count(&members).Error; err != nil {
+			return nil, nil, err
+		}
+		if members == 0 {
+			if err := revokeTeamKeys(s.db, *key.TeamID, key.UserID); err != nil {
+				return nil, nil, err
+			}
+			return nil, nil, fmt.Errorf("%w: creator left the team", ErrInvalidAPIKey)
+		}
+	}
+
+	// Writing on every request would turn reads into writes, so usage is recorded at most once a minute
+	if err := s.db.Model(&APIKey{}).
+		Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", key.ID, now.Add(-apiKeyUsageInterval)).
+		UpdateColumn("last_used_at", now).Error; err != nil {
+		return nil, nil, err
+	}
+
+	return &key, &user, nil
+}
+
+// revokeTeamKeys revokes the keys a user created for a team, once the user is no
+// longer a member of it
+func revokeTeamKeys(db *gorm.DB, teamID, userID uint) error {
+	return db.Model(&APIKey{}).
+		Where("team_id = ? AND user_id = ? AND revoked_at IS NULL", teamID, userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// getOwnKey loads a key that belongs to a user
+func (s *APIKeyService) getOwnKey(id, userID uint) (*APIKey, error) {
+	var key APIKey
+	if err := s.db.Where("id = ? AND user_id = ?", id, userID).First(&key).Error; err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// validateAPIKey checks the name, scopes and expiry of a new key
+func validateAPIKey(key *APIKey) error {
+	key.Name = strings.TrimSpace(key.Name)
+	if key.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidAPIKey)
+	}
+	if len(key.Scopes) == 0 {
+		return fmt.Errorf("%w: at least one scope is required", ErrInvalidAPIKey)
+	}
+	for _, scope := range key.Scopes {
+		if !containsString(APIKeyScopes, scope) {
+			return fmt.Errorf("%w: unknown scope %q, use one of %s", ErrInvalidAPIKey, scope, strings.Join(APIKeyScopes, ", "))
+		}
+	}
+	if key.ExpiresAt != nil && !key.ExpiresAt.After(time.Now()) {
+		return fmt.Errorf("%w: expiresAt must be in the future", ErrInvalidAPIKey)
+	}
+	return nil
+}
+
+// newAPIKey generates a random key
+func newAPIKey() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	return APIKeyPrefix + hex.EncodeToString(b)
+}
+
+// hashAPIKey returns the SHA-256 hash a key is stored and looked up by. Keys are
+// random, so unlike passwords they need no salt or slow hash.
+func hashAPIKey(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
+
+// containsString reports whether values contains value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
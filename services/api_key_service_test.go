@@ -0,0 +1,95 @@
+package services_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/task-schedulart/internal/dbtest"
+	"github.com/task-schedulart/models"
+	"github.com/task-schedulart/services"
+	"gorm.io/gorm"
+)
+
+func TestTeamAPIKeyActsForItsTeam(t *testing.T) {
+	db := dbtest.Open(t)
+	authService := services.NewAuthService(db, services.DefaultAuthConfig())
+	apiKeyService := services.NewAPIKeyService(db)
+	collaborationService := services.NewCollaborationService(db).ForWorkspace(services.DefaultWorkspaceID)
+	taskService := services.NewTaskService(db).ForWorkspace(services.DefaultWorkspaceID)
+
+	alice, err := authService.Register("alice", "alice@example.com", "secret-password")
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	team := services.Team{Name: "ops"}
+	if err := collaborationService.CreateTeam(&team, alice.ID); err != nil {
+		t.Fatalf("CreateTeam: %v", err)
+	}
+
+	teamTask := models.Task{Name: "team", ScheduleTime: time.Now(), Priority: "medium", CreatedBy: alice.ID, TeamID: &team.ID}
+	ownTask := models.Task{Name: "own", ScheduleTime: time.Now(), Priority: "medium", CreatedBy: alice.ID}
+	for _, task := range []*models.Task{&teamTask, &ownTask} {
+		if err := taskService.CreateTask(task); err != nil {
+			t.Fatalf("CreateTask: %v", err)
+		}
+	}
+
+	plain, err := apiKeyService.CreateAPIKey(&services.APIKey{
+		Name: "ci", UserID: alice.ID, WorkspaceID: services.DefaultWorkspaceID, TeamID: &team.ID,
+		Scopes: []string{"tasks:read", "tasks:write"},
+	})
+	if err != nil {
+		t.Fatalf("CreateAPIKey: %v", err)
+	}
+	key, user, err := apiKeyService.Authenticate(plain)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+
+	// Even the key of a workspace admin only reaches the team
+	actor := services.Actor{UserID: user.ID, Username: user.Username, Role: "admin", TeamID: key.TeamID}
+
+	tasks, _, err := taskService.GetTasksWithPagination(actor, "", "", nil, "", "created_at", "asc", 1, 10)
+	if err != nil {
+		t.Fatalf("GetTasksWithPagination: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].ID != teamTask.ID {
+		t.Errorf("team key lists %+v, want only the team task", tasks)
+	}
+	if _, err := taskService.AuthorizeTask(actor, teamTask.ID, services.PermTaskUpdate); err != nil {
+		t.Errorf("AuthorizeTask(team task) error = %v", err)
+	}
+	if _, err := taskService.AuthorizeTask(actor, ownTask.ID, services.PermTaskRead); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("AuthorizeTask(own task) error = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+
+	created := models.Task{Name: "new"}
+	if err := taskService.AssignOwner(actor, &created); err != nil {
+		t.Fatalf("AssignOwner: %v", err)
+	}
+	if created.TeamID == nil || *created.TeamID != team.ID {
+		t.Errorf("task created with the team key has team %v, want %d", created.TeamID, team.ID)
+	}
+	other := team.ID + 1000
+	created = models.Task{Name: "elsewhere", TeamID: &other}
+	if err := taskService.AssignOwner(actor, &created); !errors.Is(err, services.ErrPermissionDenied) {
+		t.Errorf("AssignOwner(other team) error = %v, want %v", err, services.ErrPermissionDenied)
+	}
+
+	// Leaving the team revokes the key
+	remover := services.Actor{UserID: alice.ID, Username: alice.Username, Role: "admin"}
+	if err := collaborationService.RemoveFromTeam(team.ID, alice.ID, remover); err != nil {
+		t.Fatalf("RemoveFromTeam: %v", err)
+	}
+	if _, _, err := apiKeyService.Authenticate(plain); !errors.Is(err, services.ErrInvalidAPIKey) {
+		t.Errorf("Authenticate after leaving the team error = %v, want %v", err, services.ErrInvalidAPIKey)
+	}
+	keys, err := apiKeyService.ListAPIKeys(alice.ID)
+	if err != nil {
+		t.Fatalf("ListAPIKeys: %v", err)
+	}
+	if len(keys) != 1 || keys[0].RevokedAt == nil {
+		t.Errorf("keys = %+v, want the team key revoked", keys)
+	}
+}
@@ -1,6 +1,8 @@
 package services
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"time"
@@ -8,6 +10,7 @@ import (
 	"github.com/dgrijalva/jwt-go"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type User struct {
@@ -18,6 +21,66 @@ type User struct {
 	Role      string    `json:"role" gorm:"type:varchar(20);default:'user'"`
 	CreatedAt time.Time `json:"createdAt"`
 	UpdatedAt time.Time `json:"updatedAt"`
+
+	// Workspace the user works in, carried in its tokens and API keys
+	WorkspaceID uint `json:"workspaceId" gorm:"not null;default:1;index"`
+
+	// Subject of users provisioned through OIDC login, they have no password
+	OIDCSubject *string `json:"-" gorm:"column:oidc_subject;type:varchar(255);uniqueIndex"`
+}
+
+var (
+	// ErrInvalidCredentials is returned when a login does not match a user
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrUserExists is returned when registering a username or email that is already taken
+	ErrUserExists = errors.New("username or email already registered")
+	// ErrInvalidToken is returned for tokens that are malformed, of the wrong type or unknown
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrSessionRevoked is returned for tokens of a session that was logged out or revoked
+	ErrSessionRevoked = errors.New("session revoked")
+	// ErrTokenReused is returned when a refresh token is used a second time
+	ErrTokenReused = errors.New("refresh token reused")
+)
+
+// Token types, stored in the typ claim
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+)
+
+// Session is a login of a user. Its access and refresh tokens stop working once it is revoked.
+type Session struct {
+	ID        string     `json:"id" gorm:"primaryKey;type:varchar(32)"`
+	UserID    uint       `json:"userId" gorm:"not null;index"`
+	RevokedAt *time.Time `json:"revokedAt"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// RefreshToken is an issued refresh token. Each is used once and replaced by a new one.
+type RefreshToken struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	JTI       string     `json:"-" gorm:"type:varchar(32);not null;uniqueIndex"`
+	SessionID string     `json:"sessionId" gorm:"type:varchar(32);not null;index"`
+	UserID    uint       `json:"userId" gorm:"not null;index"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// AuthConfig controls how tokens are signed and how long they are valid
+type AuthConfig struct {
+	JWTSecret     string        // HMAC key the tokens are signed with
+	TokenExpiry   time.Duration // Lifetime of access tokens
+	RefreshExpiry time.Duration // Lifetime of refresh tokens
+}
+
+// DefaultAuthConfig returns the token lifetimes used when nothing is configured.
+// There is no default secret.
+func DefaultAuthConfig() AuthConfig {
+	return AuthConfig{
+		TokenExpiry:   time.Hour * 24,     // 24 hours
+		RefreshExpiry: time.Hour * 24 * 7, // 7 days
+	}
 }
 
 type AuthService struct {
@@ -27,73 +90,160 @@ type AuthService struct {
 	refreshExp time.Duration
 }
 
-func NewAuthService(db *gorm.DB, jwtSecret string) *AuthService {
+func NewAuthService(db *gorm.DB, config AuthConfig) *AuthService {
 	return &AuthService{
 		db:         db,
-		jwtSecret:  []byte(jwtSecret),
-		tokenExp:   time.Hour * 24,     // 24 hours
-		refreshExp: time.Hour * 24 * 7, // 7 days
+		jwtSecret:  []byte(config.JWTSecret),
+		tokenExp:   config.TokenExpiry,
+		refreshExp: config.RefreshExpiry,
 	}
 }
 
-func (s *AuthService) Register(username, email, password string) error {
+// TokenExpiry returns how long access tokens are valid
+func (s *AuthService) TokenExpiry() time.Duration {
+	return s.tokenExp
+}
+
+// Register creates a user with the default role in the default workspace
+func (s *AuthService) Register(username, email, password string) (*User, error) {
+	var taken int64
+	if err := s.db.Model(&User{}).Where("username = ? OR email = ?", username, email).Count(&taken).Error; err != nil {
+		return nil, fmt.Errorf("failed to check existing users: %v", err)
+	}
+	if taken > 0 {
+		return nil, ErrUserExists
+	}
+
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return fmt.Errorf("failed to hash password: %v", err)
+		return nil, fmt.Errorf("failed to hash password: %v", err)
 	}
 
 	user := User{
-		Username: username,
-		Email:    email,
-		Password: string(hashedPassword),
-		Role:     "user",
+		Username:    username,
+		Email:       email,
+		Password:    string(hashedPassword),
+		Role:        "user",
+		WorkspaceID: DefaultWorkspaceID,
 	}
 
 	if err := s.db.Create(&user).Error; err != nil {
-		return fmt.Errorf("failed to create user: %v", err)
+		return nil, fmt.Errorf("failed to create user: %v", err)
 	}
 
-	return nil
+	return &user, nil
 }
 
+// Login checks the credentials of a user and starts a session with an access and a refresh token
 func (s *AuthService) Login(username, password string) (string, string, error) {
 	var user User
 	if err := s.db.Where("username = ?", username).First(&user).Error; err != nil {
-		return "", "", errors.New("invalid credentials")
+		return "", "", ErrInvalidCredentials
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
-		return "", "", errors.New("invalid credentials")
+		return "", "", ErrInvalidCredentials
+	}
+
+	return s.startSession(user)
+}
+
+// startSession creates a session for a user that logged in and issues its first tokens
+func (s *AuthService) startSession(user User) (string, string, error) {
+	var accessToken, refreshToken string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		session := Session{ID: newTokenID(), UserID: user.ID}
+		if err := tx.Create(&session).Error; err != nil {
+			return err
+		}
+
+		var err error
+		accessToken, refreshToken, err = s.issueTokens(tx, user, session.ID)
+		return err
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to start session: %v", err)
 	}
 
-	// Generate access token
-	accessToken, err := s.generateToken(user.ID, user.Username, user.Role, s.tokenExp)
+	return accessToken, refreshToken, nil
+}
+
+// issueTokens creates an access and a refresh token for a session and stores the refresh token
+func (s *AuthService) issueTokens(tx *gorm.DB, user User, sessionID string) (string, string, error) {
+	accessToken, _, err := s.generateToken(user, sessionID, TokenTypeAccess, s.tokenExp)
 	if err != nil {
 		return "", "", fmt.Errorf("failed to generate access token: %v", err)
 	}
 
-	// Generate refresh token
-	refreshToken, err := s.generateToken(user.ID, user.Username, user.Role, s.refreshExp)
+	refreshToken, jti, err := s.generateToken(user, sessionID, TokenTypeRefresh, s.refreshExp)
 	if err != nil {
 		return "", "", fmt.Errorf("failed to generate refresh token: %v", err)
 	}
+	stored := RefreshToken{
+		JTI:       jti,
+		SessionID: sessionID,
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(s.refreshExp),
+	}
+	if err := tx.Create(&stored).Error; err != nil {
+		return "", "", err
+	}
 
 	return accessToken, refreshToken, nil
 }
 
-func (s *AuthService) generateToken(userID uint, username, role string, exp time.Duration) (string, error) {
+// generateToken signs a token of the given type and returns it with its ID
+func (s *AuthService) generateToken(user User, sessionID, tokenType string, exp time.Duration) (string, string, error) {
+	now := time.Now()
+	jti := newTokenID()
 	claims := jwt.MapClaims{
-		"id":       userID,
-		"username": username,
-		"role":     role,
-		"exp":      time.Now().Add(exp).Unix(),
+		"id":       user.ID,
+		"username": user.Username,
+		"role":     user.Role,
+		"wid":      user.WorkspaceID,
+		"typ":      tokenType,
+		"jti":      jti,
+		"sid":      sessionID,
+		"iat":      now.Unix(),
+		"exp":      now.Add(exp).Unix(),
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(s.jwtSecret)
+	signed, err := token.SignedString(s.jwtSecret)
+	return signed, jti, err
 }
 
+// ValidateToken checks an access token and that its session has not been revoked
 func (s *AuthService) ValidateToken(tokenString string) (*jwt.MapClaims, error) {
+	claims, err := s.parseToken(tokenString, TokenTypeAccess)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionID, _ := (*claims)["sid"].(string)
+	var session Session
+	if err := s.db.Where("id = ? AND revoked_at IS NULL", sessionID).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSessionRevoked
+		}
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// GetUser returns a user as it is now, for checks that must not rely on the
+// claims of a token issued earlier
+func (s *AuthService) GetUser(id uint) (*User, error) {
+	var user User
+	if err := s.db.First(&user, id).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// parseToken verifies the signature and expiry of a token and that it has the expected type
+func (s *AuthService) parseToken(tokenString, tokenType string) (*jwt.MapClaims, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
@@ -105,27 +255,116 @@ func (s *AuthService) ValidateToken(tokenString string) (*jwt.MapClaims, error)
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return &claims, nil
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	if typ, _ := claims["typ"].(string); typ != tokenType {
+		return nil, fmt.Errorf("%w: %s token required", ErrInvalidToken, tokenType)
+	}
+	for _, claim := range []string{"jti", "sid"} {
+		if value, _ := claims[claim].(string); value == "" {
+			return nil, fmt.Errorf("%w: missing %s claim", ErrInvalidToken, claim)
+		}
+	}
+	// Tokens issued before workspaces existed have no wid claim and must not fall back to any workspace
+	for _, claim := range []string{"id", "wid"} {
+		if _, ok := claims[claim].(float64); !ok {
+			return nil, fmt.Errorf("%w: missing %s claim", ErrInvalidToken, claim)
+		}
 	}
 
-	return nil, errors.New("invalid token")
+	return &claims, nil
 }
 
-func (s *AuthService) RefreshToken(refreshToken string) (string, error) {
-	claims, err := s.ValidateToken(refreshToken)
+// RefreshToken exchanges a refresh token for a new access and refresh token.
+// Every refresh token can be used once; presenting one a second time means it
+// was stolen, so the whole session is revoked and ErrTokenReused is returned.
+func (s *AuthService) RefreshToken(refreshToken string) (string, string, error) {
+	claims, err := s.parseToken(refreshToken, TokenTypeRefresh)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
+	jti := (*claims)["jti"].(string)
 
-	userID := uint((*claims)["id"].(float64))
-	username := (*claims)["username"].(string)
-	role := (*claims)["role"].(string)
+	var accessToken, newRefreshToken string
+	reused := false
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var stored RefreshToken
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("jti = ?", jti).First(&stored).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidToken
+			}
+			return err
+		}
 
-	newToken, err := s.generateToken(userID, username, role, s.tokenExp)
+		var session Session
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&session, "id = ?", stored.SessionID).Error; err != nil {
+			return err
+		}
+		if session.RevokedAt != nil {
+			return ErrSessionRevoked
+		}
+
+		now := time.Now()
+		if stored.UsedAt != nil {
+			reused = true
+			return tx.Model(&session).Update("revoked_at", now).Error
+		}
+		if now.After(stored.ExpiresAt) {
+			return ErrInvalidToken
+		}
+		if err := tx.Model(&stored).Update("used_at", now).Error; err != nil {
+			return err
+		}
+
+		// Pick up changes to the user, such as a new role
+		var user User
+		if err := tx.First(&user, stored.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidToken
+			}
+			return err
+		}
+
+		accessToken, newRefreshToken, err = s.issueTokens(tx, user, session.ID)
+		return err
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to generate new token: %v", err)
+		return "", "", err
+	}
+	if reused {
+		return "", "", ErrTokenReused
 	}
 
-	return newToken, nil
+	return accessToken, newRefreshToken, nil
+}
+
+// Logout revokes a session, invalidating its access and refresh tokens
+func (s *AuthService) Logout(sessionID string) error {
+	return s.db.Model(&Session{}).
+		Where("id = ? AND revoked_at IS NULL", sessionID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeUserSessions revokes every active session of a user of a workspace and
+// returns how many there were
+func (s *AuthService) RevokeUserSessions(workspaceID, userID uint) (int64, error) {
+	if err := s.db.Where("workspace_id = ?", workspaceID).First(&User{}, userID).Error; err != nil {
+		return 0, err
+	}
+
+	result := s.db.Model(&Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now())
+	return result.RowsAffected, result.Error
+}
+
+// newTokenID returns a random identifier for sessions, token IDs and events
+func newTokenID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	return hex.EncodeToString(b)
 }
@@ -0,0 +1,87 @@
+package services_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/task-schedulart/internal/dbtest"
+	"github.com/task-schedulart/services"
+)
+
+func TestRefreshTokenRotation(t *testing.T) {
+	db := dbtest.Open(t)
+	config := services.DefaultAuthConfig()
+	config.JWTSecret = "test-secret-with-enough-entropy"
+	authService := services.NewAuthService(db, config)
+
+	if _, err := authService.Register("alice", "alice@example.com", "secret-password"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	login := func(t *testing.T) (string, string) {
+		t.Helper()
+		accessToken, refreshToken, err := authService.Login("alice", "secret-password")
+		if err != nil {
+			t.Fatalf("Login: %v", err)
+		}
+		return accessToken, refreshToken
+	}
+
+	t.Run("rotated token is not reused", func(t *testing.T) {
+		_, refreshToken := login(t)
+		accessToken, rotated, err := authService.RefreshToken(refreshToken)
+		if err != nil {
+			t.Fatalf("RefreshToken: %v", err)
+		}
+		if _, err := authService.ValidateToken(accessToken); err != nil {
+			t.Fatalf("ValidateToken of the new access token: %v", err)
+		}
+
+		if _, _, err := authService.RefreshToken(refreshToken); !errors.Is(err, services.ErrTokenReused) {
+			t.Fatalf("RefreshToken with a used token error = %v, want %v", err, services.ErrTokenReused)
+		}
+
+		// Reuse revokes the session with every token issued for it
+		if _, err := authService.ValidateToken(accessToken); !errors.Is(err, services.ErrSessionRevoked) {
+			t.Errorf("ValidateToken after reuse error = %v, want %v", err, services.ErrSessionRevoked)
+		}
+		if _, _, err := authService.RefreshToken(rotated); !errors.Is(err, services.ErrSessionRevoked) {
+			t.Errorf("RefreshToken with the rotated token after reuse error = %v, want %v", err, services.ErrSessionRevoked)
+		}
+	})
+
+	t.Run("reuse leaves other sessions alone", func(t *testing.T) {
+		otherAccess, otherRefresh := login(t)
+		_, refreshToken := login(t)
+		if _, _, err := authService.RefreshToken(refreshToken); err != nil {
+			t.Fatalf("RefreshToken: %v", err)
+		}
+		if _, _, err := authService.RefreshToken(refreshToken); !errors.Is(err, services.ErrTokenReused) {
+			t.Fatalf("RefreshToken with a used token error = %v, want %v", err, services.ErrTokenReused)
+		}
+
+		if _, err := authService.ValidateToken(otherAccess); err != nil {
+			t.Errorf("ValidateToken of another session: %v", err)
+		}
+		if _, _, err := authService.RefreshToken(otherRefresh); err != nil {
+			t.Errorf("RefreshToken of another session: %v", err)
+		}
+	})
+
+	t.Run("logout", func(t *testing.T) {
+		accessToken, refreshToken := login(t)
+		claims, err := authService.ValidateToken(accessToken)
+		if err != nil {
+			t.Fatalf("ValidateToken: %v", err)
+		}
+		if err := authService.Logout((*claims)["sid"].(string)); err != nil {
+			t.Fatalf("Logout: %v", err)
+		}
+
+		if _, _, err := authService.RefreshToken(refreshToken); !errors.Is(err, services.ErrSessionRevoked) {
+			t.Errorf("RefreshToken after logout error = %v, want %v", err, services.ErrSessionRevoked)
+		}
+		if _, err := authService.ValidateToken(accessToken); !errors.Is(err, services.ErrSessionRevoked) {
+			t.Errorf("ValidateToken after logout error = %v, want %v", err, services.ErrSessionRevoked)
+		}
+	})
+}
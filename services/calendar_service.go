@@ -0,0 +1,319 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/task-schedulart/models"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvalidCalendar is returned when a calendar definition is rejected
+	ErrInvalidCalendar = errors.New("invalid calendar")
+	// ErrDuplicateCalendar is returned when a calendar name is already taken
+	ErrDuplicateCalendar = errors.New("calendar name already exists")
+	// ErrCalendarInUse is returned when deleting a calendar that tasks or recurring patterns reference
+	ErrCalendarInUse = errors.New("calendar is referenced by tasks")
+	// ErrUnknownCalendar is returned when a task or pattern references a calendar that does not exist
+	ErrUnknownCalendar = errors.New("calendar not found")
+	// ErrNoAllowedSlot is returned when a calendar has no allowed time within its search horizon
+	ErrNoAllowedSlot = errors.New("calendar has no allowed time slot")
+)
+
+// maxCalendarSteps bounds the search for the next allowed time. Every step
+// skips at least a blackout, a holiday or the rest of a day.
+const maxCalendarSteps = 10000
+
+type CalendarService struct {
+	db *gorm.DB
+}
+
+func NewCalendarService(db *gorm.DB) *CalendarService {
+	return &CalendarService{db: db}
+}
+
+// ForWorkspace returns a copy of the service limited to the data of a workspace
+func (s *CalendarService) ForWorkspace(workspaceID uint) *CalendarService {
+	return &CalendarService{db: WorkspaceDB(s.db, workspaceID)}
+}
+
+// CreateCalendar validates and stores a new calendar
+func (s *CalendarService) CreateCalendar(calendar *models.Calendar) error {
+	if _, err := compileCalendar(calendar); err != nil {
+		return err
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := checkCalendarName(tx, calendar.Name, 0); err != nil {
+			return err
+		}
+		calendar.ID = 0
+		return tx.Create(calendar).Error
+	})
+}
+
+// ListCalendars returns calendars ordered by name
+func (s *CalendarService) ListCalendars(page, pageSize int) ([]models.Calendar, int64, error) {
+	var calendars []models.Calendar
+	var total int64
+
+	query := s.db.Model(&models.Calendar{})
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	err := query.Order("name asc").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&calendars).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return calendars, total, nil
+}
+
+// GetCalendar retrieves a calendar by its ID
+func (s *CalendarService) GetCalendar(id uint) (*models.Calendar, error) {
+	var calendar models.Calendar
+	if err := s.db.First(&calendar, id).Error; err != nil {
+		return nil, err
+	}
+	return &calendar, nil
+}
+
+// UpdateCalendar replaces the definition of a calendar. Tasks that reference it
+// follow the new definition from their next run on.
+func (s *CalendarService) UpdateCalendar(id uint, calendar *models.Calendar) error {
+	if _, err := compileCalendar(calendar); err != nil {
+		return err
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var existing models.Calendar
+		if err := tx.First(&existing, id).Error; err != nil {
+			return err
+		}
+		if err := checkCalendarName(tx, calendar.Name, id); err != nil {
+			return err
+		}
+
+		calendar.ID = existing.ID
+		calendar.WorkspaceID = existing.WorkspaceID
+		calendar.CreatedAt = existing.CreatedAt
+		return tx.Save(calendar).Error
+	})
+}
+
+// DeleteCalendar removes a calendar that no task or recurring pattern references
+func (s *CalendarService) DeleteCalendar(id uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var calendar models.Calendar
+		if err := tx.First(&calendar, id).Error; err != nil {
+			return err
+		}
+
+		var references int64
+		if err := tx.Model(&models.Task{}).
+			Where("calendar_id = ? OR (is_recurring AND (recurring_config->>'calendar_id')::bigint = ?)", id, id).
+			Count(&references).Error; err != nil {
+			return err
+		}
+		if references > 0 {
+			return fmt.Errorf("%w: %d tasks reference it", ErrCalendarInUse, references)
+		}
+
+		return tx.Delete(&calendar).Error
+	})
+}
+
+// NextAllowed returns the earliest time at or after t at which a calendar allows
+// tasks to run. A calendar that no longer exists does not restrict anything.
+func (s *CalendarService) NextAllowed(calendarID uint, t time.Time) (time.Time, error) {
+	calendar, err := loadBusinessCalendar(s.db, calendarID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if calendar == nil {
+		return t, nil
+	}
+	return calendar.NextAllowed(t)
+}
+
+// checkCalendarName ensures no other calendar uses a name
+func checkCalendarName(tx *gorm.DB, name string, id uint) error {
+	var count int64
+	if err := tx.Model(&models.Calendar{}).Where("name = ? AND id <> ?", name, id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: %s", ErrDuplicateCalendar, name)
+	}
+	return nil
+}
+
+// checkCalendarExists returns ErrUnknownCalendar if a referenced calendar does not exist
+func checkCalendarExists(db *gorm.DB, calendarID uint) error {
+	var count int64
+	if err := db.Model(&models.Calendar{}).Where("id = ?", calendarID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("%w: %d", ErrUnknownCalendar, calendarID)
+	}
+	return nil
+}
+
+// loadBusinessCalendar loads and compiles a calendar, nil if it does not exist
+func loadBusinessCalendar(db *gorm.DB, calendarID uint) (*businessCalendar, error) {
+	var calendar models.Calendar
+	err := db.First(&calendar, calendarID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return compileCalendar(&calendar)
+}
+
+// timeWindow is a part of a day in seconds since local midnight, end exclusive
+type timeWindow struct {
+	start, end int
+}
+
+// businessCalendar is the validated form of a calendar used to check times
+type businessCalendar struct {
+	loc       *time.Location
+	hours     [7][]timeWindow // Sorted by start, only used when hasHours is set
+	hasHours  bool
+	holidays  map[string]bool
+	blackouts []models.BlackoutWindow
+}
+
+// compileCalendar validates a calendar and converts it into a businessCalendar
+func compileCalendar(calendar *models.Calendar) (*businessCalendar, error) {
+	if calendar.Name == "" {
+		return nil, fmt.Errorf("%w: name is required", ErrInvalidCalendar)
+	}
+
+	compiled := &businessCalendar{loc: time.UTC, holidays: make(map[string]bool)}
+	if calendar.Timezone != "" {
+		loc, err := time.LoadLocation(calendar.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unknown timezone %q, use an IANA name such as Europe/Berlin", ErrInvalidCalendar, calendar.Timezone)
+		}
+		compiled.loc = loc
+	}
+
+	for _, hours := range calendar.WorkingHours {
+		start, err := parseClock(hours.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(hours.End)
+		if err != nil {
+			return nil, err
+		}
+		if end <= start {
+			return nil, fmt.Errorf("%w: working hours must end after they start, split windows that span midnight", ErrInvalidCalendar)
+		}
+		if len(hours.Weekdays) == 0 {
+			return nil, fmt.Errorf("%w: working hours need at least one weekday", ErrInvalidCalendar)
+		}
+		for _, day := range hours.Weekdays {
+			if day < 0 || day > 6 {
+				return nil, fmt.Errorf("%w: weekdays must be between 0 (Sunday) and 6 (Saturday)", ErrInvalidCalendar)
+			}
+			compiled.hours[day] = append(compiled.hours[day], timeWindow{start: start, end: end})
+		}
+		compiled.hasHours = true
+	}
+	for day := range compiled.hours {
+		windows := compiled.hours[day]
+		sort.Slice(windows, func(i, j int) bool { return windows[i].start < windows[j].start })
+	}
+
+	for _, holiday := range calendar.Holidays {
+		if _, err := time.Parse("2006-01-02", holiday); err != nil {
+			return nil, fmt.Errorf("%w: holidays must be YYYY-MM-DD dates", ErrInvalidCalendar)
+		}
+		compiled.holidays[holiday] = true
+	}
+
+	for _, blackout := range calendar.Blackouts {
+		if blackout.Start.IsZero() || !blackout.End.After(blackout.Start) {
+			return nil, fmt.Errorf("%w: blackouts need a start and an end after it", ErrInvalidCalendar)
+		}
+	}
+	compiled.blackouts = calendar.Blackouts
+
+	return compiled, nil
+}
+
+// parseClock parses an HH:MM time of a working hours window into seconds since midnight
+func parseClock(value string) (int, error) {
+	if value == "24:00" {
+		return 24 * 60 * 60, nil
+	}
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: working hours must be HH:MM times", ErrInvalidCalendar)
+	}
+	return (parsed.Hour()*60 + parsed.Minute()) * 60, nil
+}
+
+// Allowed reports whether tasks may run at t
+func (c *businessCalendar) Allowed(t time.Time) bool {
+	next, err := c.NextAllowed(t)
+	return err == nil && next.Equal(t)
+}
+
+// NextAllowed returns the earliest time at or after t that lies within the
+// working hours and outside holidays and blackouts
+func (c *businessCalendar) NextAllowed(t time.Time) (time.Time, error) {
+	for step := 0; step < maxCalendarSteps; step++ {
+		if end, ok := c.blackoutEnd(t); ok {
+			t = end
+			continue
+		}
+
+		local := t.In(c.loc)
+		day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+		nextDay := wallClock(day.AddDate(0, 0, 1), 0, 0, 0, c.loc)
+		if c.holidays[local.Format("2006-01-02")] {
+			t = nextDay
+			continue
+		}
+		if !c.hasHours {
+			return t, nil
+		}
+
+		second := local.Hour()*3600 + local.Minute()*60 + local.Second()
+		next := nextDay
+		for _, window := range c.hours[local.Weekday()] {
+			if second >= window.start && second < window.end {
+				return t, nil
+			}
+			if window.start > second {
+				next = wallClock(day, window.start/3600, window.start%3600/60, 0, c.loc)
+				break
+			}
+		}
+		t = next
+	}
+	return time.Time{}, ErrNoAllowedSlot
+}
+
+// blackoutEnd returns the end of a blackout that contains t
+func (c *businessCalendar) blackoutEnd(t time.Time) (time.Time, bool) {
+	for _, blackout := range c.blackouts {
+		if !t.Before(blackout.Start) && t.Before(blackout.End) {
+			return blackout.End, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,164 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/task-schedulart/models"
+)
+
+// weekdays are the working days Monday to Friday
+var weekdays = []int{1, 2, 3, 4, 5}
+
+// consecutiveDays returns n dates starting at from, as YYYY-MM-DD
+func consecutiveDays(from string, n int) []string {
+	day, _ := time.Parse("2006-01-02", from)
+	days := make([]string, n)
+	for i := range days {
+		days[i] = day.AddDate(0, 0, i).Format("2006-01-02")
+	}
+	return days
+}
+
+func TestBusinessCalendarNextAllowed(t *testing.T) {
+	officeHours := []models.WorkingHours{{Weekdays: weekdays, Start: "09:00", End: "17:00"}}
+	blackout := func(start, end string) models.BlackoutWindow {
+		s, _ := time.Parse(time.RFC3339, start)
+		e, _ := time.Parse(time.RFC3339, end)
+		return models.BlackoutWindow{Start: s, End: e}
+	}
+
+	tests := []struct {
+		name     string
+		calendar models.Calendar
+		at       string
+		want     string // Empty when no time is allowed
+	}{
+		{
+			name:     "unrestricted",
+			calendar: models.Calendar{},
+			at:       "2024-01-06T03:00:00Z", want: "2024-01-06T03:00:00Z",
+		},
+		{
+			name:     "within working hours",
+			calendar: models.Calendar{Timezone: "Europe/Berlin", WorkingHours: officeHours},
+			at:       "2024-01-08T10:30:00+01:00", want: "2024-01-08T10:30:00+01:00",
+		},
+		{
+			name:     "before working hours",
+			calendar: models.Calendar{Timezone: "Europe/Berlin", WorkingHours: officeHours},
+			at:       "2024-01-08T07:00:00+01:00", want: "2024-01-08T09:00:00+01:00",
+		},
+		{
+			name:     "end of working hours is exclusive",
+			calendar: models.Calendar{Timezone: "Europe/Berlin", WorkingHours: officeHours},
+			at:       "2024-01-08T17:00:00+01:00", want: "2024-01-09T09:00:00+01:00",
+		},
+		{
+			name:     "after hours on friday",
+			calendar: models.Calendar{Timezone: "Europe/Berlin", WorkingHours: officeHours},
+			at:       "2024-01-12T18:00:00+01:00", want: "2024-01-15T09:00:00+01:00",
+		},
+		{
+			name: "gap between windows",
+			calendar: models.Calendar{WorkingHours: []models.WorkingHours{
+				{Weekdays: weekdays, Start: "13:00", End: "17:00"},
+				{Weekdays: weekdays, Start: "09:00", End: "12:00"},
+			}},
+			at: "2024-01-08T12:30:00Z", want: "2024-01-08T13:00:00Z",
+		},
+		{
+			name:     "window until midnight",
+			calendar: models.Calendar{WorkingHours: []models.WorkingHours{{Weekdays: []int{1}, Start: "22:00", End: "24:00"}}},
+			at:       "2024-01-08T23:59:00Z", want: "2024-01-08T23:59:00Z",
+		},
+		{
+			name:     "holiday",
+			calendar: models.Calendar{Timezone: "Europe/Berlin", WorkingHours: officeHours, Holidays: []string{"2024-01-08"}},
+			at:       "2024-01-08T10:00:00+01:00", want: "2024-01-09T09:00:00+01:00",
+		},
+		{
+			name:     "holidays next to a weekend",
+			calendar: models.Calendar{Timezone: "Europe/Berlin", WorkingHours: officeHours, Holidays: []string{"2023-12-25", "2023-12-26"}},
+			at:       "2023-12-22T17:30:00+01:00", want: "2023-12-27T09:00:00+01:00",
+		},
+		{
+			name:     "holiday without working hours ends at local midnight",
+			calendar: models.Calendar{Timezone: "Asia/Tokyo", Holidays: []string{"2024-01-02"}},
+			at:       "2024-01-01T16:00:00Z", want: "2024-01-03T00:00:00+09:00",
+		},
+		{
+			name:     "holiday is a date in the calendar time zone",
+			calendar: models.Calendar{Timezone: "America/Los_Angeles", Holidays: []string{"2024-01-08"}},
+			at:       "2024-01-09T05:00:00Z", want: "2024-01-09T00:00:00-08:00",
+		},
+		{
+			name:     "working hours in the calendar time zone",
+			calendar: models.Calendar{Timezone: "America/New_York", WorkingHours: officeHours},
+			at:       "2024-01-08T09:00:00Z", want: "2024-01-08T09:00:00-05:00",
+		},
+		{
+			name:     "weekend across a DST change",
+			calendar: models.Calendar{Timezone: "America/New_York", WorkingHours: officeHours},
+			at:       "2024-03-08T17:00:00-05:00", want: "2024-03-11T09:00:00-04:00",
+		},
+		{
+			name:     "window starting in a DST gap",
+			calendar: models.Calendar{Timezone: "America/New_York", WorkingHours: []models.WorkingHours{{Weekdays: []int{0}, Start: "02:30", End: "04:00"}}},
+			at:       "2024-03-10T00:00:00-05:00", want: "2024-03-10T03:30:00-04:00",
+		},
+		{
+			name:     "blackout",
+			calendar: models.Calendar{WorkingHours: officeHours, Blackouts: []models.BlackoutWindow{blackout("2024-01-08T08:00:00Z", "2024-01-08T11:00:00Z")}},
+			at:       "2024-01-08T09:00:00Z", want: "2024-01-08T11:00:00Z",
+		},
+		{
+			name:     "blackout ending after hours",
+			calendar: models.Calendar{WorkingHours: officeHours, Blackouts: []models.BlackoutWindow{blackout("2024-01-08T15:00:00Z", "2024-01-08T20:00:00Z")}},
+			at:       "2024-01-08T16:00:00Z", want: "2024-01-09T09:00:00Z",
+		},
+		{
+			name:     "blackout ending on a holiday",
+			calendar: models.Calendar{WorkingHours: officeHours, Holidays: []string{"2024-01-09"}, Blackouts: []models.BlackoutWindow{blackout("2024-01-08T15:00:00Z", "2024-01-09T10:00:00Z")}},
+			at:       "2024-01-08T16:00:00Z", want: "2024-01-10T09:00:00Z",
+		},
+		{
+			name:     "holidays beyond the search horizon",
+			calendar: models.Calendar{Holidays: consecutiveDays("2024-01-01", maxCalendarSteps+1)},
+			at:       "2024-01-01T00:00:00Z", want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.calendar.Name = "test"
+			calendar, err := compileCalendar(&tt.calendar)
+			if err != nil {
+				t.Fatalf("compileCalendar: %v", err)
+			}
+			at, err := time.Parse(time.RFC3339, tt.at)
+			if err != nil {
+				t.Fatalf("parse at: %v", err)
+			}
+
+			got, err := calendar.NextAllowed(at)
+			if tt.want == "" {
+				if !errors.Is(err, ErrNoAllowedSlot) {
+					t.Fatalf("NextAllowed() = %v, %v, want %v", got, err, ErrNoAllowedSlot)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NextAllowed: %v", err)
+			}
+			want, _ := time.Parse(time.RFC3339, tt.want)
+			if !got.Equal(want) {
+				t.Errorf("NextAllowed() = %v, want %v", got.In(calendar.loc), want)
+			}
+			if !calendar.Allowed(got) {
+				t.Errorf("Allowed(%v) = false for the time NextAllowed returned", got)
+			}
+		})
+	}
+}
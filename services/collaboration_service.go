@@ -2,6 +2,7 @@ package services
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -9,12 +10,16 @@ import (
 	"gorm.io/gorm"
 )
 
+// ErrInvalidTeamRole is returned when a team member is given a role teams do not have
+var ErrInvalidTeamRole = errors.New("team role must be admin, member or viewer")
+
 type CollaborationService struct {
 	db *gorm.DB
 }
 
 type Team struct {
 	ID          uint         `json:"id" gorm:"primaryKey"`
+	WorkspaceID uint         `json:"workspaceId" gorm:"<-:create;not null;default:1;index"`
 	Name        string       `json:"name"`
 	Description string       `json:"description"`
 	CreatedAt   time.Time    `json:"createdAt"`
@@ -26,7 +31,7 @@ type TeamMember struct {
 	ID        uint      `json:"id" gorm:"primaryKey"`
 	TeamID    uint      `json:"teamId"`
 	UserID    uint      `json:"userId"`
-	Role      string    `json:"role"` // admin, member, viewer
+	Role      string    `json:"role"` // admin, member or viewer, see teamRoles
 	JoinedAt  time.Time `json:"joinedAt"`
 	InvitedBy uint      `json:"invitedBy"`
 }
@@ -54,6 +59,11 @@ func NewCollaborationService(db *gorm.DB) *CollaborationService {
 	return &CollaborationService{db: db}
 }
 
+// ForWorkspace returns a copy of the service limited to the data of a workspace
+func (s *CollaborationService) ForWorkspace(workspaceID uint) *CollaborationService {
+	return &CollaborationService{db: WorkspaceDB(s.db, workspaceID)}
+}
+
 // CreateTeam creates a new team
 func (s *CollaborationService) CreateTeam(team *Team, creatorID uint) error {
 	// Start transaction
@@ -86,12 +96,23 @@ func (s *CollaborationService) CreateTeam(team *Team, creatorID uint) error {
 }
 
 // InviteToTeam invites a user to join a team
-func (s *CollaborationService) InviteToTeam(teamID, inviterID, inviteeID uint, role string) error {
+func (s *CollaborationService) InviteToTeam(teamID uint, inviter Actor, inviteeID uint, role string) error {
+	if !IsTeamRole(role) {
+		return ErrInvalidTeamRole
+	}
 	// Verify inviter has permission
-	var inviter TeamMember
-	if err := s.db.Where("team_id = ? AND user_id = ? AND role = ?", teamID, inviterID, "admin").
-		First(&inviter).Error; err != nil {
-		return fmt.Errorf("unauthorized: only admins can invite members")
+	if err := s.permissions().Authorize(inviter, PermTeamInvite, &teamID); err != nil {
+		return err
+	}
+
+	// Only users of the workspace of the team can join it
+	var team Team
+	if err := s.db.First(&team, teamID).Error; err != nil {
+		return err
+	}
+	var invitee User
+	if err := s.db.Where("workspace_id = ?", team.WorkspaceID).First(&invitee, inviteeID).Error; err != nil {
+		return err
 	}
 
 	// Create new member
@@ -100,7 +121,7 @@ func (s *CollaborationService) InviteToTeam(teamID, inviterID, inviteeID uint, r
 		UserID:    inviteeID,
 		Role:      role,
 		JoinedAt:  time.Now(),
-		InvitedBy: inviterID,
+		InvitedBy: inviter.UserID,
 	}
 
 	return s.db.Create(&member).Error
@@ -194,12 +215,13 @@ func (s *CollaborationService) GetTeamMembers(teamID uint) ([]TeamMember, error)
 }
 
 // UpdateMemberRole updates a team member's role
-func (s *CollaborationService) UpdateMemberRole(teamID, userID uint, newRole string, updaterID uint) error {
-	// Verify updater has admin permission
-	var updater TeamMember
-	if err := s.db.Where("team_id = ? AND user_id = ? AND role = ?", teamID, updaterID, "admin").
-		First(&updater).Error; err != nil {
-		return fmt.Errorf("unauthorized: only admins can update roles")
+func (s *CollaborationService) UpdateMemberRole(teamID, userID uint, newRole string, updater Actor) error {
+	if !IsTeamRole(newRole) {
+		return ErrInvalidTeamRole
+	}
+	// Verify updater has permission
+	if err := s.permissions().Authorize(updater, PermTeamManage, &teamID); err != nil {
+		return err
 	}
 
 	return s.db.Model(&TeamMember{}).
@@ -207,20 +229,29 @@ func (s *CollaborationService) UpdateMemberRole(teamID, userID uint, newRole str
 		Update("role", newRole).Error
 }
 
-// RemoveFromTeam removes a member from a team
-func (s *CollaborationService) RemoveFromTeam(teamID, userID, removerID uint) error {
-	// Verify remover has admin permission
-	var remover TeamMember
-	if err := s.db.Where("team_id = ? AND user_id = ? AND role = ?", teamID, removerID, "admin").
-		First(&remover).Error; err != nil {
-		return fmt.Errorf("unauthorized: only admins can remove members")
+// RemoveFromTeam removes a member from a team and revokes the team API keys the
+// member created
+func (s *CollaborationService) RemoveFromTeam(teamID, userID uint, remover Actor) error {
+	// Verify remover has permission
+	if err := s.permissions().Authorize(remover, PermTeamManage, &teamID); err != nil {
+		return err
 	}
 
-	return s.db.Where("team_id = ? AND user_id = ?", teamID, userID).
-		Delete(&TeamMember{}).Error
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("team_id = ? AND user_id = ?", teamID, userID).
+			Delete(&TeamMember{}).Error; err != nil {
+			return err
+		}
+		return revokeTeamKeys(tx, teamID, userID)
+	})
 }
 
 // LogActivity logs an activity
 func (s *CollaborationService) LogActivity(activity *ActivityLog) error {
 	return s.db.Create(activity).Error
 }
+
+// permissions returns a permission service on the database of the service
+func (s *CollaborationService) permissions() *PermissionService {
+	return &PermissionService{db: s.db}
+}
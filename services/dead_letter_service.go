@@ -0,0 +1,170 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/task-schedulart/models"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvalidPayload is returned when a requeue payload is not valid JSON
+	ErrInvalidPayload = errors.New("payload must be valid JSON")
+	// ErrNotDeadLettered is returned when the task of an entry was already requeued or changed
+	ErrNotDeadLettered = errors.New("task is no longer dead-lettered")
+)
+
+type DeadLetterService struct {
+	db *gorm.DB
+}
+
+func NewDeadLetterService(db *gorm.DB) *DeadLetterService {
+	return &DeadLetterService{db: db}
+}
+
+// ForWorkspace returns a copy of the service limited to the data of a workspace
+func (s *DeadLetterService) ForWorkspace(workspaceID uint) *DeadLetterService {
+	return &DeadLetterService{db: WorkspaceDB(s.db, workspaceID)}
+}
+
+// ListDeadLetters returns dead-lettered tasks, newest first, optionally filtered by task type
+func (s *DeadLetterService) ListDeadLetters(taskType string, page, pageSize int) ([]models.DeadLetter, int64, error) {
+	var deadLetters []models.DeadLetter
+	var total int64
+
+	query := s.db.Model(&models.DeadLetter{})
+	if taskType != "" {
+		query = query.Where("task_type = ?", taskType)
+	}
+
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	err := query.Order("created_at desc").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&deadLetters).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return deadLetters, total, nil
+}
+
+// GetDeadLetter retrieves a dead-letter entry by its ID
+func (s *DeadLetterService) GetDeadLetter(id uint) (*models.DeadLetter, error) {
+	var deadLetter models.DeadLetter
+	if err := s.db.First(&deadLetter, id).Error; err != nil {
+		return nil, err
+	}
+	return &deadLetter, nil
+}
+
+// RequeueDeadLetter puts a dead-lettered task back into the queue with a fresh
+// set of attempts. A non-nil payload replaces the task metadata.
+func (s *DeadLetterService) RequeueDeadLetter(id uint, payload *string) (*models.Task, error) {
+	if payload != nil && *payload != "" && !json.Valid([]byte(*payload)) {
+		return nil, ErrInvalidPayload
+	}
+
+	var task models.Task
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var deadLetter models.DeadLetter
+		if err := tx.First(&deadLetter, id).Error; err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{
+			"status":           "pending",
+			"retry_count":      0,
+			"last_error":       "",
+			"schedule_time":    time.Now(),
+			"lease_owner":      "",
+			"lease_expires_at": nil,
+			"updated_at":       time.Now(),
+		}
+		if payload != nil {
+			if *payload == "" {
+				updates["metadata"] = nil
+			} else {
+				updates["metadata"] = *payload
+			}
+		}
+
+		result := tx.Model(&models.Task{}).
+			Where("id = ? AND status = ?", deadLetter.TaskID, "dead_lettered").
+			Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotDeadLettered
+		}
+
+		if err := tx.Delete(&deadLetter).Error; err != nil {
+			return err
+		}
+		if err := syncWorkflowRuns(tx, []uint{deadLetter.TaskID}); err != nil {
+			return err
+		}
+		return tx.First(&task, deadLetter.TaskID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &task, nil
+}
+
+// PurgeDeadLetter deletes a dead-letter entry together with its task
+func (s *DeadLetterService) PurgeDeadLetter(id uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var deadLetter models.DeadLetter
+		if err := tx.First(&deadLetter, id).Error; err != nil {
+			return err
+		}
+		return purgeDeadLetters(tx, []models.DeadLetter{deadLetter})
+	})
+}
+
+// PurgeDeadLetters deletes all dead-letter entries, or only those created before
+// the given time, together with their tasks
+func (s *DeadLetterService) PurgeDeadLetters(before *time.Time) (int64, error) {
+	var purged int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var deadLetters []models.DeadLetter
+		query := tx.Model(&models.DeadLetter{})
+		if before != nil {
+			query = query.Where("created_at < ?", *before)
+		}
+		if err := query.Find(&deadLetters).Error; err != nil {
+			return err
+		}
+
+		purged = int64(len(deadLetters))
+		return purgeDeadLetters(tx, deadLetters)
+	})
+	return purged, err
+}
+
+// purgeDeadLetters removes the given entries and soft deletes their tasks
+func purgeDeadLetters(tx *gorm.DB, deadLetters []models.DeadLetter) error {
+	if len(deadLetters) == 0 {
+		return nil
+	}
+
+	ids := make([]uint, len(deadLetters))
+	taskIDs := make([]uint, len(deadLetters))
+	for i, deadLetter := range deadLetters {
+		ids[i] = deadLetter.ID
+		taskIDs[i] = deadLetter.TaskID
+	}
+
+	if err := tx.Where("id IN ? AND status = ?", taskIDs, "dead_lettered").Delete(&models.Task{}).Error; err != nil {
+		return err
+	}
+	return tx.Delete(&models.DeadLetter{}, ids).Error
+}
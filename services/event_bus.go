@@ -0,0 +1,286 @@
+package services
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/stdlib"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	// eventChannel is the Postgres notification channel task events are sent on
+	eventChannel = "task_events"
+	// maxNotifyPayload keeps notifications below the 8000 byte limit of Postgres.
+	// Larger events are stored in event_payloads and sent by reference.
+	maxNotifyPayload = 7900
+	// eventPayloadRetention is how long stored events stay readable for the replicas
+	eventPayloadRetention = time.Hour
+	// eventConsumerBuffer is how many events may wait for a consumer before new
+	// events are dropped for it
+	eventConsumerBuffer = 1024
+	// maxListenBackoff caps the wait between attempts to listen again
+	maxListenBackoff = 30 * time.Second
+)
+
+// EventHandler consumes a task event
+type EventHandler func(event TaskEvent) error
+
+// EventBus carries task events to the consumers of every replica, so clients
+// and notifications see the events of requests another replica handled.
+// Delivery is at most once: events are not stored for redelivery, so a consumer
+// misses the events published while its replica reconnects to the event source
+// and those it falls too far behind on. Consumers that must not miss anything
+// have to recover from the database.
+type EventBus interface {
+	// Publish sends an event to the consumers of every replica
+	Publish(event TaskEvent) error
+	// Subscribe registers a consumer on this replica. Each consumer receives the
+	// events in order on a goroutine of its own.
+	Subscribe(name string, handler EventHandler)
+	// Close stops delivering events
+	Close() error
+}
+
+// eventDispatcher hands the events a replica receives to its consumers
+type eventDispatcher struct {
+	mu        sync.RWMutex
+	consumers []*eventConsumer
+	logger    *zap.Logger
+}
+
+// eventConsumer is a subscribed handler and the events waiting for it
+type eventConsumer struct {
+	name    string
+	handler EventHandler
+	events  chan TaskEvent
+}
+
+func (d *eventDispatcher) Subscribe(name string, handler EventHandler) {
+	consumer := &eventConsumer{name: name, handler: handler, events: make(chan TaskEvent, eventConsumerBuffer)}
+	d.mu.Lock()
+	d.consumers = append(d.consumers, consumer)
+	d.mu.Unlock()
+
+	go func() {
+		for event := range consumer.events {
+			if err := consumer.handler(event); err != nil {
+				d.logger.Error("Failed to consume task event",
+					zap.String("consumer", consumer.name), zap.String("event_id", event.ID), zap.Error(err))
+			}
+		}
+	}()
+}
+
+// dispatch queues an event for every consumer. A consumer that is too far behind
+// misses the event rather than holding up the others.
+func (d *eventDispatcher) dispatch(event TaskEvent) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, consumer := range d.consumers {
+		select {
+		case consumer.events <- event:
+		default:
+			d.logger.Warn("Dropping task event, consumer is behind",
+				zap.String("consumer", consumer.name), zap.String("event_id", event.ID))
+		}
+	}
+}
+
+// stop ends the goroutines of the consumers
+func (d *eventDispatcher) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, consumer := range d.consumers {
+		close(consumer.events)
+	}
+	d.consumers = nil
+}
+
+// InProcessEventBus delivers events to the consumers of its own process. It
+// suits a single replica and tests.
+type InProcessEventBus struct {
+	eventDispatcher
+}
+
+func NewInProcessEventBus(logger *zap.Logger) *InProcessEventBus {
+	return &InProcessEventBus{eventDispatcher{logger: logger}}
+}
+
+// Publish hands an event to the consumers of this process
+func (b *InProcessEventBus) Publish(event TaskEvent) error {
+	if event.ID == "" {
+		event.ID = newTokenID()
+	}
+	b.dispatch(event)
+	return nil
+}
+
+// Close stops delivering events
+func (b *InProcessEventBus) Close() error {
+	b.stop()
+	return nil
+}
+
+// EventPayload holds an event too large for a notification until the replicas
+// have read it
+type EventPayload struct {
+	ID        uint      `gorm:"primaryKey"`
+	Payload   string    `gorm:"type:text;not null"`
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// eventNotification is the payload of a notification: the event itself, or the
+// ID of the stored event when it is too large
+type eventNotification struct {
+	Event *TaskEvent `json:"event,omitempty"`
+	Ref   uint       `json:"ref,omitempty"`
+}
+
+// PostgresEventBus sends events to every replica with Postgres LISTEN/NOTIFY.
+// Each replica listens on one pooled connection; events sent while it
+// reconnects are missed.
+type PostgresEventBus struct {
+	eventDispatcher
+	db     *gorm.DB
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewPostgresEventBus starts listening for the events of every replica
+func NewPostgresEventBus(db *gorm.DB, logger *zap.Logger) *PostgresEventBus {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &PostgresEventBus{
+		eventDispatcher: eventDispatcher{logger: logger},
+		db:              db,
+		cancel:          cancel,
+		done:            make(chan struct{}),
+	}
+	go b.listen(ctx)
+	return b
+}
+
+// Publish notifies every replica, this one included, of an event
+func (b *PostgresEventBus) Publish(event TaskEvent) error {
+	if event.ID == "" {
+		event.ID = newTokenID()
+	}
+
+	payload, err := json.Marshal(eventNotification{Event: &event})
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxNotifyPayload {
+		encoded, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		stored := EventPayload{Payload: string(encoded)}
+		if err := b.db.Create(&stored).Error; err != nil {
+			return err
+		}
+		// Stored events are only needed until the replicas have read them
+		if err := b.db.Where("created_at < ?", time.Now().Add(-eventPayloadRetention)).Delete(&EventPayload{}).Error; err != nil {
+			b.logger.Warn("Failed to prune stored events", zap.Error(err))
+		}
+		if payload, err = json.Marshal(eventNotification{Ref: stored.ID}); err != nil {
+			return err
+		}
+	}
+
+	return b.db.Exec("SELECT pg_notify(?, ?)", eventChannel, string(payload)).Error
+}
+
+// Close stops listening and delivering events
+func (b *PostgresEventBus) Close() error {
+	b.cancel()
+	<-b.done
+	b.stop()
+	return nil
+}
+
+// listen receives the events of every replica until the bus is closed, listening
+// again after connection failures
+func (b *PostgresEventBus) listen(ctx context.Context) {
+	defer close(b.done)
+
+	backoff := time.Second
+	for {
+		err := b.listenOnce(ctx, func() { backoff = time.Second })
+		if ctx.Err() != nil {
+			return
+		}
+
+		b.logger.Error("Lost the task event connection, listening again",
+			zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxListenBackoff {
+			backoff = maxListenBackoff
+		}
+	}
+}
+
+// listenOnce listens on a connection of the pool until it fails. The connection
+// is discarded afterwards, so no pooled connection keeps listening.
+func (b *PostgresEventBus) listenOnce(ctx context.Context, listening func()) error {
+	sqlDB, err := b.db.DB()
+	if err != nil {
+		return err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		pgConn := driverConn.(*stdlib.Conn).Conn()
+		if _, err := pgConn.Exec(ctx, "LISTEN "+eventChannel); err != nil {
+			return fmt.Errorf("%w: %w", err, driver.ErrBadConn)
+		}
+		listening()
+
+		for {
+			notification, err := pgConn.WaitForNotification(ctx)
+			if err != nil {
+				return fmt.Errorf("%w: %w", err, driver.ErrBadConn)
+			}
+			event, err := b.decode(notification.Payload)
+			if err != nil {
+				b.logger.Error("Failed to read task event", zap.Error(err))
+				continue
+			}
+			b.dispatch(*event)
+		}
+	})
+}
+
+// decode reads the event of a notification, loading stored events
+func (b *PostgresEventBus) decode(payload string) (*TaskEvent, error) {
+	var notification eventNotification
+	if err := json.Unmarshal([]byte(payload), &notification); err != nil {
+		return nil, err
+	}
+	if notification.Event != nil {
+		return notification.Event, nil
+	}
+
+	var stored EventPayload
+	if err := b.db.First(&stored, notification.Ref).Error; err != nil {
+		return nil, fmt.Errorf("stored event %d: %w", notification.Ref, err)
+	}
+	var event TaskEvent
+	if err := json.Unmarshal([]byte(stored.Payload), &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
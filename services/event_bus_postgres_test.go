@@ -0,0 +1,85 @@
+package services_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/task-schedulart/internal/dbtest"
+	"github.com/task-schedulart/services"
+	"go.uber.org/zap"
+)
+
+func TestPostgresEventBusStoresLargeEvents(t *testing.T) {
+	db := dbtest.Open(t)
+	bus := services.NewPostgresEventBus(db, zap.NewNop())
+	t.Cleanup(func() { bus.Close() })
+
+	received := make(chan services.TaskEvent, 16)
+	bus.Subscribe("test", func(event services.TaskEvent) error {
+		received <- event
+		return nil
+	})
+
+	// receive publishes an event and waits for it to come back
+	receive := func(t *testing.T, event services.TaskEvent) services.TaskEvent {
+		t.Helper()
+		if err := bus.Publish(event); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+		for {
+			select {
+			case got := <-received:
+				if got.ID == event.ID {
+					return got
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("event %s was not delivered", event.ID)
+			}
+		}
+	}
+
+	// Events published before the bus listens are missed, so wait until it does
+	deadline := time.Now().Add(5 * time.Second)
+	for listening := false; !listening; {
+		if time.Now().After(deadline) {
+			t.Fatal("the bus does not listen")
+		}
+		if err := bus.Publish(services.TaskEvent{ID: "ping"}); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+		select {
+		case <-received:
+			listening = true
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	storedEvents := func(t *testing.T) int64 {
+		t.Helper()
+		var count int64
+		if err := db.Model(&services.EventPayload{}).Count(&count).Error; err != nil {
+			t.Fatalf("count stored events: %v", err)
+		}
+		return count
+	}
+
+	small := receive(t, services.TaskEvent{ID: "small", Event: services.TaskUpdatedEvent, TaskID: 1, Data: "short"})
+	if small.Data != "short" {
+		t.Errorf("small event data = %v, want short", small.Data)
+	}
+	if count := storedEvents(t); count != 0 {
+		t.Errorf("%d events stored for a small event, want none", count)
+	}
+
+	// A payload beyond the 8000 byte limit of notifications is sent by reference
+	data := strings.Repeat("x", 10000)
+	large := receive(t, services.TaskEvent{ID: "large", Event: services.TaskUpdatedEvent, TaskID: 2, Tags: []string{"etl"}, Data: data})
+	if large.Data != data || large.TaskID != 2 || len(large.Tags) != 1 {
+		t.Errorf("large event = task %d, tags %v, %d bytes of data, want the published event", large.TaskID, large.Tags, len(fmt.Sprint(large.Data)))
+	}
+	if count := storedEvents(t); count != 1 {
+		t.Errorf("%d events stored for a large event, want 1", count)
+	}
+}
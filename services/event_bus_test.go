@@ -0,0 +1,132 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// waitFor polls a condition until it holds or a second has passed
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEventBusDeliversInOrder(t *testing.T) {
+	bus := NewInProcessEventBus(zap.NewNop())
+	defer bus.Close()
+
+	const consumers, events = 3, 200
+	var mu sync.Mutex
+	received := make([][]string, consumers)
+	for i := 0; i < consumers; i++ {
+		i := i
+		bus.Subscribe(fmt.Sprintf("consumer-%d", i), func(event TaskEvent) error {
+			mu.Lock()
+			defer mu.Unlock()
+			received[i] = append(received[i], event.ID)
+			return nil
+		})
+	}
+
+	for i := 0; i < events; i++ {
+		bus.Publish(TaskEvent{ID: fmt.Sprintf("event-%d", i)})
+	}
+	waitFor(t, "every event", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, ids := range received {
+			if len(ids) < events {
+				return false
+			}
+		}
+		return true
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, ids := range received {
+		for j, id := range ids {
+			if want := fmt.Sprintf("event-%d", j); id != want {
+				t.Fatalf("consumer %d received %s as event %d, want %s", i, id, j, want)
+			}
+		}
+	}
+}
+
+func TestEventBusDropsEventsForSlowConsumers(t *testing.T) {
+	bus := NewInProcessEventBus(zap.NewNop())
+	defer bus.Close()
+
+	// The fast consumer reports every event, so events are published no faster
+	// than it consumes them
+	fast := make(chan string, 1)
+	bus.Subscribe("fast", func(event TaskEvent) error {
+		fast <- event.ID
+		return nil
+	})
+	var mu sync.Mutex
+	var slow []string
+	started, release := make(chan struct{}), make(chan struct{})
+	bus.Subscribe("slow", func(event TaskEvent) error {
+		if event.ID == "first" {
+			close(started)
+			<-release
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		slow = append(slow, event.ID)
+		return nil
+	})
+	publish := func(id string) {
+		t.Helper()
+		bus.Publish(TaskEvent{ID: id})
+		select {
+		case got := <-fast:
+			if got != id {
+				t.Fatalf("fast consumer received %s, want %s", got, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("fast consumer did not receive %s", id)
+		}
+	}
+
+	// The slow consumer holds the first event while the next ones fill its
+	// buffer; it misses the events after that, the fast consumer does not
+	publish("first")
+	<-started
+	for i := 0; i < eventConsumerBuffer; i++ {
+		publish(fmt.Sprintf("buffered-%d", i))
+	}
+	for i := 0; i < 10; i++ {
+		publish(fmt.Sprintf("dropped-%d", i))
+	}
+	close(release)
+	waitFor(t, "the buffered events", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(slow) == eventConsumerBuffer+1
+	})
+
+	// Having caught up, the slow consumer receives events again
+	publish("after")
+	waitFor(t, "the event after catching up", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(slow) == eventConsumerBuffer+2
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if slow[0] != "first" || slow[eventConsumerBuffer] != fmt.Sprintf("buffered-%d", eventConsumerBuffer-1) || slow[eventConsumerBuffer+1] != "after" {
+		t.Errorf("slow consumer received %v ... %v, want the first, the buffered and the last event", slow[:2], slow[eventConsumerBuffer:])
+	}
+}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/task-schedulart/models"
+	"gorm.io/gorm"
+)
+
+// Outcomes recorded for a task execution
+const (
+	ExecutionRunning   = "running"
+	ExecutionCompleted = "completed"
+	ExecutionFailed    = "failed"
+	ExecutionTimeout   = "timeout"
+	ExecutionCancelled = "cancelled"
+	ExecutionReleased  = "released"  // Handed back to the queue, e.g. on shutdown
+	ExecutionAbandoned = "abandoned" // The worker stopped renewing its lease
+)
+
+// maxOutputLength caps the handler output stored per execution
+const maxOutputLength = 64 * 1024
+
+type ExecutionService struct {
+	db *gorm.DB
+}
+
+func NewExecutionService(db *gorm.DB) *ExecutionService {
+	return &ExecutionService{db: db}
+}
+
+// ForWorkspace returns a copy of the service limited to the data of a workspace
+func (s *ExecutionService) ForWorkspace(workspaceID uint) *ExecutionService {
+	return &ExecutionService{db: WorkspaceDB(s.db, workspaceID)}
+}
+
+// StartExecution records the start of an attempt
+func (s *ExecutionService) StartExecution(task *models.Task, workerID string) (*models.TaskExecution, error) {
+	execution := models.TaskExecution{
+		WorkspaceID: task.WorkspaceID,
+		TaskID:      task.ID,
+		Attempt:     task.RetryCount + 1,
+		WorkerID:    workerID,
+		Outcome:     ExecutionRunning,
+		StartedAt:   time.Now(),
+	}
+	if err := s.db.Create(&execution).Error; err != nil {
+		return nil, err
+	}
+	return &execution, nil
+}
+
+// FinishExecution records the outcome of an attempt
+func (s *ExecutionService) FinishExecution(execution *models.TaskExecution, outcome string, err error, output string) error {
+	finishedAt := time.Now()
+	execution.Outcome = outcome
+	execution.Output = output
+	execution.FinishedAt = &finishedAt
+	execution.DurationMs = finishedAt.Sub(execution.StartedAt).Milliseconds()
+	if err != nil {
+		execution.Error = err.Error()
+		execution.ErrorClass = ErrorClass(err)
+	}
+
+	return s.db.Model(execution).Select("outcome", "output", "finished_at", "duration_ms", "error", "error_class").
+		Updates(execution).Error
+}
+
+// GetTaskExecutions returns the attempts of a task, most recent first
+func (s *ExecutionService) GetTaskExecutions(taskID uint, page, pageSize int) ([]models.TaskExecution, int64, error) {
+	var executions []models.TaskExecution
+	var total int64
+
+	query := s.db.Model(&models.TaskExecution{}).Where("task_id = ?", taskID)
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	err := query.Order("started_at desc").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&executions).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return executions, total, nil
+}
+
+type outputKey struct{}
+
+// outputRecorder holds the output a handler reports for the current attempt
+type outputRecorder struct {
+	mu     sync.Mutex
+	output string
+}
+
+// withOutputRecorder returns a context that handlers can report output through
+func withOutputRecorder(ctx context.Context) (context.Context, *outputRecorder) {
+	recorder := &outputRecorder{}
+	return context.WithValue(ctx, outputKey{}, recorder), recorder
+}
+
+// String returns the recorded output
+func (r *outputRecorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.output
+}
+
+// SetTaskOutput stores the output of the running attempt in its execution record.
+// Handlers call it with the context they were given; it returns false for any other context.
+func SetTaskOutput(ctx context.Context, output string) bool {
+	recorder, ok := ctx.Value(outputKey{}).(*outputRecorder)
+	if !ok {
+		return false
+	}
+	if len(output) > maxOutputLength {
+		output = output[:maxOutputLength]
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.output = output
+	return true
+}
@@ -0,0 +1,11 @@
+package services
+
+import "time"
+
+// BackdateKeyFetch makes the signing keys of an OIDC service look fetched d
+// earlier, so tests need not wait for the refresh interval
+func (s *OIDCService) BackdateKeyFetch(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keysFetched = s.keysFetched.Add(-d)
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// DefaultTaskType is used for tasks created without a type. Its handler does nothing.
+const DefaultTaskType = "noop"
+
+// Handler executes tasks of a given type. The payload is the task's Metadata.
+type Handler interface {
+	Handle(ctx context.Context, payload json.RawMessage) error
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface
+type HandlerFunc func(ctx context.Context, payload json.RawMessage) error
+
+// Handle calls f(ctx, payload)
+func (f HandlerFunc) Handle(ctx context.Context, payload json.RawMessage) error {
+	return f(ctx, payload)
+}
+
+// HandlerRegistry maps task types to the handlers that execute them
+type HandlerRegistry struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+func NewHandlerRegistry() *HandlerRegistry {
+	registry := &HandlerRegistry{
+		handlers: make(map[string]Handler),
+	}
+	registry.handlers[DefaultTaskType] = HandlerFunc(func(ctx context.Context, payload json.RawMessage) error {
+		return nil
+	})
+	return registry
+}
+
+// Register adds a handler for a task type, replacing any existing one
+func (r *HandlerRegistry) Register(taskType string, handler Handler) error {
+	if taskType == "" {
+		return errors.New("task type is required")
+	}
+	if handler == nil {
+		return fmt.Errorf("handler for task type %q is nil", taskType)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[taskType] = handler
+	return nil
+}
+
+// RegisterFunc adds a function as the handler for a task type
+func (r *HandlerRegistry) RegisterFunc(taskType string, fn func(ctx context.Context, payload json.RawMessage) error) error {
+	if fn == nil {
+		return fmt.Errorf("handler for task type %q is nil", taskType)
+	}
+	return r.Register(taskType, HandlerFunc(fn))
+}
+
+// Get returns the handler registered for a task type
+func (r *HandlerRegistry) Get(taskType string) (Handler, bool) {
+	if taskType == "" {
+		taskType = DefaultTaskType
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	handler, ok := r.handlers[taskType]
+	return handler, ok
+}
+
+// Types returns the registered task types in alphabetical order
+func (r *HandlerRegistry) Types() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	types := make([]string, 0, len(r.handlers))
+	for taskType := range r.handlers {
+		types = append(types, taskType)
+	}
+	sort.Strings(types)
+	return types
+}
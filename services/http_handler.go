@@ -0,0 +1,74 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// HTTPTaskType is the task type of the built-in handler that calls a URL
+const HTTPTaskType = "http"
+
+// maxHTTPTaskOutput is how much of a response body is kept as the task output
+const maxHTTPTaskOutput = 4096
+
+// httpTaskPayload is the metadata of an http task
+type httpTaskPayload struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// NewHTTPHandler returns a handler that sends the request described by the task
+// metadata, such as {"url": "https://example.com/hook", "method": "POST",
+// "headers": {"Content-Type": "application/json"}, "body": "{}"}. Server errors
+// and 429 responses fail as transient, other 4xx responses and invalid payloads
+// as permanent, for retry policies to tell apart. The response body is stored
+// as the task output.
+func NewHTTPHandler(client *http.Client) Handler {
+	return HandlerFunc(func(ctx context.Context, payload json.RawMessage) error {
+		var req httpTaskPayload
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return Permanent(fmt.Errorf("invalid http task payload: %w", err))
+		}
+		if req.URL == "" {
+			return Permanent(errors.New("invalid http task payload: url is required"))
+		}
+		if req.Method == "" {
+			req.Method = http.MethodGet
+		}
+
+		request, err := http.NewRequestWithContext(ctx, strings.ToUpper(req.Method), req.URL, strings.NewReader(req.Body))
+		if err != nil {
+			return Permanent(err)
+		}
+		for key, value := range req.Headers {
+			request.Header.Set(key, value)
+		}
+
+		resp, err := client.Do(request)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return Transient(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxHTTPTaskOutput))
+		SetTaskOutput(ctx, string(body))
+
+		switch {
+		case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+			return Transient(fmt.Errorf("%s %s returned status %d", request.Method, req.URL, resp.StatusCode))
+		case resp.StatusCode >= 400:
+			return Permanent(fmt.Errorf("%s %s returned status %d", request.Method, req.URL, resp.StatusCode))
+		}
+		return nil
+	})
+}
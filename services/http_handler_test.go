@@ -0,0 +1,60 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/ok":
+			if r.Method != http.MethodPost || r.Header.Get("X-Token") != "secret" || string(body) != `{"report":"daily"}` {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte("accepted"))
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/throttled":
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		payload   string
+		wantClass string // Empty when the request succeeds
+	}{
+		{"success", `{"url": "` + server.URL + `/ok", "method": "post", "headers": {"X-Token": "secret"}, "body": "{\"report\":\"daily\"}"}`, ""},
+		{"server error", `{"url": "` + server.URL + `/unavailable"}`, ErrorClassTransient},
+		{"throttled", `{"url": "` + server.URL + `/throttled"}`, ErrorClassTransient},
+		{"client error", `{"url": "` + server.URL + `/missing"}`, ErrorClassPermanent},
+		{"no url", `{"method": "GET"}`, ErrorClassPermanent},
+		{"invalid payload", `"not an object"`, ErrorClassPermanent},
+	}
+
+	handler := NewHTTPHandler(server.Client())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := handler.Handle(context.Background(), json.RawMessage(tt.payload))
+			if tt.wantClass == "" {
+				if err != nil {
+					t.Fatalf("Handle: %v", err)
+				}
+				return
+			}
+			if err == nil || ErrorClass(err) != tt.wantClass {
+				t.Fatalf("Handle() error = %v of class %q, want class %q", err, ErrorClass(err), tt.wantClass)
+			}
+		})
+	}
+}
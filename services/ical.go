@@ -0,0 +1,121 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// icalTimeFormat is the UTC date-time format of iCalendar
+	icalTimeFormat = "20060102T150405Z"
+	// icalDefaultDuration is the length of events for tasks without an estimated time
+	icalDefaultDuration = 30 * time.Minute
+	// icalLineLimit is the maximum length of a content line in octets, excluding the line break
+	icalLineLimit = 75
+)
+
+// TimelineICS renders a timeline as an iCalendar (RFC 5545) feed with one event per item
+func TimelineICS(timeline *Timeline, now time.Time) string {
+	var b strings.Builder
+	writeICalLine(&b, "BEGIN:VCALENDAR")
+	writeICalLine(&b, "VERSION:2.0")
+	writeICalLine(&b, "PRODID:-//Task Schedulart//Schedule Timeline//EN")
+	writeICalLine(&b, "CALSCALE:GREGORIAN")
+	writeICalLine(&b, "METHOD:PUBLISH")
+	writeICalLine(&b, "X-WR-CALNAME:Task Schedulart")
+
+	stamp := now.UTC().Format(icalTimeFormat)
+	for _, item := range timeline.Items {
+		duration := icalDefaultDuration
+		if item.EstimatedTime > 0 {
+			duration = time.Duration(item.EstimatedTime) * time.Minute
+		}
+		status := "CONFIRMED"
+		if len(item.BlockedBy) > 0 {
+			status = "TENTATIVE"
+		}
+
+		writeICalLine(&b, "BEGIN:VEVENT")
+		writeICalLine(&b, "UID:"+timelineItemUID(item))
+		writeICalLine(&b, "DTSTAMP:"+stamp)
+		writeICalLine(&b, "DTSTART:"+item.ScheduledAt.UTC().Format(icalTimeFormat))
+		writeICalLine(&b, fmt.Sprintf("DURATION:PT%dM", int(duration.Minutes())))
+		writeICalLine(&b, "SUMMARY:"+escapeICalText(item.Name))
+		writeICalLine(&b, "DESCRIPTION:"+escapeICalText(timelineItemDescription(item)))
+		writeICalLine(&b, "CATEGORIES:"+strings.ToUpper(item.Kind))
+		writeICalLine(&b, "STATUS:"+status)
+		writeICalLine(&b, "END:VEVENT")
+	}
+
+	writeICalLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+// timelineItemUID identifies an item across refreshes of the feed. Occurrences are
+// identified by their template and original time, like their instances.
+func timelineItemUID(item TimelineItem) string {
+	if item.Kind == TimelineOccurrence {
+		at := item.ScheduledAt
+		if item.OriginalTime != nil {
+			at = *item.OriginalTime
+		}
+		return fmt.Sprintf("occurrence-%d-%d@task-schedulart", item.TemplateID, at.Unix())
+	}
+	return fmt.Sprintf("task-%d@task-schedulart", item.TaskID)
+}
+
+// timelineItemDescription summarizes the details of an item for calendar apps
+func timelineItemDescription(item TimelineItem) string {
+	var lines []string
+	if item.Kind == TimelineOccurrence {
+		lines = append(lines, fmt.Sprintf("Occurrence of recurring task %d", item.TemplateID))
+	} else {
+		lines = append(lines, fmt.Sprintf("Task %d", item.TaskID))
+	}
+	if item.WorkflowID != 0 {
+		lines = append(lines, fmt.Sprintf("Starts a run of workflow %d", item.WorkflowID))
+	}
+	if item.Type != "" {
+		lines = append(lines, "Type: "+item.Type)
+	}
+	if item.Priority != "" {
+		lines = append(lines, "Priority: "+item.Priority)
+	}
+	if item.OriginalTime != nil {
+		lines = append(lines, fmt.Sprintf("Moved by calendar %d from %s", *item.CalendarID, item.OriginalTime.UTC().Format(time.RFC3339)))
+	}
+	if len(item.BlockedBy) > 0 {
+		ids := make([]string, len(item.BlockedBy))
+		for i, id := range item.BlockedBy {
+			ids[i] = fmt.Sprint(id)
+		}
+		lines = append(lines, "Waiting for tasks "+strings.Join(ids, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// escapeICalText escapes a TEXT property value
+func escapeICalText(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace(value)
+}
+
+// writeICalLine writes a content line, folded after icalLineLimit octets without
+// splitting UTF-8 sequences
+func writeICalLine(b *strings.Builder, line string) {
+	limit := icalLineLimit
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		// Continuation lines start with a space that counts towards the limit
+		limit = icalLineLimit - 1
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
@@ -2,75 +2,88 @@ package services
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// MetricsService exposes Prometheus metrics. Task metrics carry a workspace
+// label, the processing gauge counts the tasks of every workspace on this replica.
 type MetricsService struct {
-	TasksCreated    prometheus.Counter
-	TasksCompleted  prometheus.Counter
-	TasksFailed     prometheus.Counter
+	TasksCreated    *prometheus.CounterVec
+	TasksCompleted  *prometheus.CounterVec
+	TasksFailed     *prometheus.CounterVec
+	TasksDeadLetter *prometheus.CounterVec
 	TasksProcessing prometheus.Gauge
-	TaskDuration    prometheus.Histogram
+	TaskDuration    *prometheus.HistogramVec
 	TasksByStatus   *prometheus.GaugeVec
 	TasksByPriority *prometheus.GaugeVec
 }
 
 func NewMetricsService() *MetricsService {
 	return &MetricsService{
-		TasksCreated: promauto.NewCounter(prometheus.CounterOpts{
+		TasksCreated: promauto.NewCounterVec(prometheus.CounterOpts{
 			Name: "task_schedulart_tasks_created_total",
 			Help: "The total number of created tasks",
-		}),
-		TasksCompleted: promauto.NewCounter(prometheus.CounterOpts{
+		}, []string{"workspace"}),
+		TasksCompleted: promauto.NewCounterVec(prometheus.CounterOpts{
 			Name: "task_schedulart_tasks_completed_total",
 			Help: "The total number of completed tasks",
-		}),
-		TasksFailed: promauto.NewCounter(prometheus.CounterOpts{
+		}, []string{"workspace"}),
+		TasksFailed: promauto.NewCounterVec(prometheus.CounterOpts{
 			Name: "task_schedulart_tasks_failed_total",
 			Help: "The total number of failed tasks",
-		}),
+		}, []string{"workspace"}),
+		TasksDeadLetter: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "task_schedulart_tasks_dead_lettered_total",
+			Help: "The total number of tasks moved to the dead-letter queue",
+		}, []string{"workspace"}),
 		TasksProcessing: promauto.NewGauge(prometheus.GaugeOpts{
 			Name: "task_schedulart_tasks_processing",
 			Help: "The number of tasks currently being processed",
 		}),
-		TaskDuration: promauto.NewHistogram(prometheus.HistogramOpts{
+		TaskDuration: promauto.NewHistogramVec(prometheus.HistogramOpts{
 			Name:    "task_schedulart_task_duration_seconds",
 			Help:    "Task execution duration in seconds",
 			Buckets: prometheus.DefBuckets,
-		}),
+		}, []string{"workspace"}),
 		TasksByStatus: promauto.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "task_schedulart_tasks_by_status",
 				Help: "Number of tasks by status",
 			},
-			[]string{"status"},
+			[]string{"workspace", "status"},
 		),
 		TasksByPriority: promauto.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "task_schedulart_tasks_by_priority",
 				Help: "Number of tasks by priority",
 			},
-			[]string{"priority"},
+			[]string{"workspace", "priority"},
 		),
 	}
 }
 
-// RecordTaskCreation increments the tasks created counter
-func (m *MetricsService) RecordTaskCreation() {
-	m.TasksCreated.Inc()
+// RecordTaskCreation increments the tasks created counter of a workspace
+func (m *MetricsService) RecordTaskCreation(workspaceID uint) {
+	m.TasksCreated.WithLabelValues(workspaceLabel(workspaceID)).Inc()
 }
 
-// RecordTaskCompletion increments the tasks completed counter
-func (m *MetricsService) RecordTaskCompletion() {
-	m.TasksCompleted.Inc()
+// RecordTaskCompletion increments the tasks completed counter of a workspace
+func (m *MetricsService) RecordTaskCompletion(workspaceID uint) {
+	m.TasksCompleted.WithLabelValues(workspaceLabel(workspaceID)).Inc()
 }
 
-// RecordTaskFailure increments the tasks failed counter
-func (m *MetricsService) RecordTaskFailure() {
-	m.TasksFailed.Inc()
+// RecordTaskFailure increments the tasks failed counter of a workspace
+func (m *MetricsService) RecordTaskFailure(workspaceID uint) {
+	m.TasksFailed.WithLabelValues(workspaceLabel(workspaceID)).Inc()
+}
+
+// RecordTaskDeadLetter increments the dead-lettered tasks counter of a workspace
+func (m *MetricsService) RecordTaskDeadLetter(workspaceID uint) {
+	m.TasksDeadLetter.WithLabelValues(workspaceLabel(workspaceID)).Inc()
 }
 
 // UpdateTasksProcessing sets the number of tasks currently being processed
@@ -78,22 +91,27 @@ func (m *MetricsService) UpdateTasksProcessing(count float64) {
 	m.TasksProcessing.Set(count)
 }
 
-// ObserveTaskDuration records the duration of a task execution
-func (m *MetricsService) ObserveTaskDuration(durationSeconds float64) {
-	m.TaskDuration.Observe(durationSeconds)
+// ObserveTaskDuration records the duration of a task execution in a workspace
+func (m *MetricsService) ObserveTaskDuration(workspaceID uint, durationSeconds float64) {
+	m.TaskDuration.WithLabelValues(workspaceLabel(workspaceID)).Observe(durationSeconds)
 }
 
-// UpdateTaskStatusMetric updates the count for a specific task status
-func (m *MetricsService) UpdateTaskStatusMetric(status string, count float64) {
-	m.TasksByStatus.WithLabelValues(status).Set(count)
+// UpdateTaskStatusMetric updates the count for a specific task status in a workspace
+func (m *MetricsService) UpdateTaskStatusMetric(workspaceID uint, status string, count float64) {
+	m.TasksByStatus.WithLabelValues(workspaceLabel(workspaceID), status).Set(count)
 }
 
-// UpdateTaskPriorityMetric updates the count for a specific task priority
-func (m *MetricsService) UpdateTaskPriorityMetric(priority string, count float64) {
-	m.TasksByPriority.WithLabelValues(priority).Set(count)
+// UpdateTaskPriorityMetric updates the count for a specific task priority in a workspace
+func (m *MetricsService) UpdateTaskPriorityMetric(workspaceID uint, priority string, count float64) {
+	m.TasksByPriority.WithLabelValues(workspaceLabel(workspaceID), priority).Set(count)
 }
 
 // Handler returns an HTTP handler for exposing Prometheus metrics
 func (s *MetricsService) Handler() http.Handler {
 	return promhttp.Handler()
 }
+
+// workspaceLabel returns the value of the workspace label of a workspace
+func workspaceLabel(workspaceID uint) string {
+	return strconv.FormatUint(uint64(workspaceID), 10)
+}
@@ -3,30 +3,69 @@ package services
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
 	"time"
 
 	"github.com/task-schedulart/models"
+	"go.uber.org/zap"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// notificationDeliveryRetention is how long claimed events are remembered. Every
+// replica receives an event within moments, so this only has to outlast the
+// consumers falling behind.
+const notificationDeliveryRetention = 24 * time.Hour
+
+// notificationTimeout bounds a request to Slack or a webhook
+const notificationTimeout = 10 * time.Second
+
+// notificationClaimWait is how long a replica waits for another replica that
+// claimed a channel to send through it, and notificationClaimPoll how often it
+// looks. The wait outlasts a request, so a claim is only given up on when the
+// replica holding it stopped.
+const (
+	notificationClaimWait = 3 * notificationTimeout
+	notificationClaimPoll = 100 * time.Millisecond
+)
+
+// ErrInvalidChannel is returned when a notification channel has an unknown type
+// or a configuration that does not fit its type
+var ErrInvalidChannel = errors.New("invalid notification channel")
+
 type NotificationService struct {
-	db *gorm.DB
+	db     *gorm.DB
+	logger *zap.Logger
+	client *http.Client
 }
 
 type NotificationTemplate struct {
-	ID       uint   `json:"id" gorm:"primaryKey"`
-	Type     string `json:"type"`
-	Subject  string `json:"subject"`
-	Template string `json:"template"`
+	ID          uint   `json:"id" gorm:"primaryKey"`
+	WorkspaceID uint   `json:"workspaceId" gorm:"<-:create;not null;default:1;index"`
+	Type        string `json:"type"`
+	Subject     string `json:"subject"`
+	Template    string `json:"template"`
 }
 
 type NotificationChannel struct {
-	Type    string          `json:"type"` // email, slack, webhook, push
-	Config  json.RawMessage `json:"config"`
-	Enabled bool            `json:"enabled"`
+	ID          uint            `json:"id" gorm:"primaryKey"`
+	WorkspaceID uint            `json:"workspaceId" gorm:"<-:create;not null;default:1;index"`
+	Type        string          `json:"type"` // email, slack, webhook, push
+	Config      json.RawMessage `json:"config"`
+	Enabled     bool            `json:"enabled"`
+}
+
+// NotificationDelivery records that a replica claimed an event for a channel, and
+// when it sent it, so every channel gets the event once however many replicas
+// receive it
+type NotificationDelivery struct {
+	EventID   string `gorm:"primaryKey;type:varchar(32)"`
+	ChannelID uint   `gorm:"primaryKey"`
+	SentAt    *time.Time
+	CreatedAt time.Time `gorm:"index"`
 }
 
 type EmailConfig struct {
@@ -47,12 +86,25 @@ type WebhookConfig struct {
 	Headers map[string]string `json:"headers"`
 }
 
-func NewNotificationService(db *gorm.DB) *NotificationService {
-	return &NotificationService{db: db}
+func NewNotificationService(db *gorm.DB, logger *zap.Logger) *NotificationService {
+	return &NotificationService{db: db, logger: logger, client: &http.Client{Timeout: notificationTimeout}}
 }
 
-// SendTaskNotification sends notifications for task events
+// ForWorkspace returns a copy of the service limited to the templates and
+// channels of a workspace
+func (s *NotificationService) ForWorkspace(workspaceID uint) *NotificationService {
+	return &NotificationService{db: WorkspaceDB(s.db, workspaceID), logger: s.logger, client: s.client}
+}
+
+// SendTaskNotification sends notifications for task events. It tries every
+// channel and fails when any of them failed.
 func (s *NotificationService) SendTaskNotification(task *models.Task, event string) error {
+	return s.send(task, event, "")
+}
+
+// send sends the notifications for a task event. With an event ID each channel
+// is claimed for the event first, and skipped when another replica sent it.
+func (s *NotificationService) send(task *models.Task, event, eventID string) error {
 	// Get notification template
 	var template NotificationTemplate
 	if err := s.db.Where("type = ?", event).First(&template).Error; err != nil {
@@ -72,17 +124,109 @@ func (s *NotificationService) SendTaskNotification(task *models.Task, event stri
 		"event":     event,
 	}
 
-	// Send to each channel
+	// Send to each channel, continuing with the others when one fails
+	var errs []error
 	for _, channel := range channels {
-		if err := s.sendToChannel(channel, template, data); err != nil {
-			// Log error but continue with other channels
-			fmt.Printf("Failed to send to channel %s: %v\n", channel.Type, err)
+		sendToChannel := func() error { return s.sendToChannel(channel, template, data) }
+		var err error
+		if eventID == "" {
+			err = sendToChannel()
+		} else {
+			err = s.deliverOnce(eventID, channel.ID, sendToChannel)
 		}
+		if err != nil {
+			s.logger.Error("Failed to send notification", zap.String("channel", channel.Type),
+				zap.String("event", event), zap.Uint("task_id", task.ID), zap.Error(err))
+			errs = append(errs, fmt.Errorf("%s: %w", channel.Type, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// HandleTaskEvent sends the notifications for an event from the event bus
+// through the channels of the event's workspace. Each replica receives the event
+// and claims it per channel before sending, so a channel gets it once. The claims
+// are committed before anything is sent. When a channel fails its claim is
+// released and the next replica that received the event sends it again through
+// that channel only.
+func (s *NotificationService) HandleTaskEvent(event TaskEvent) error {
+	scoped := s.ForWorkspace(event.WorkspaceID)
+	var templates int64
+	if err := scoped.db.Model(&NotificationTemplate{}).Where("type = ?", event.Event).Count(&templates).Error; err != nil {
+		return err
+	}
+	if templates == 0 {
+		return nil
+	}
+
+	// Deleted tasks are described by the attributes the event carries
+	var task models.Task
+	err := scoped.db.First(&task, event.TaskID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		task = models.Task{
+			ID:          event.TaskID,
+			WorkspaceID: event.WorkspaceID,
+			CreatedBy:   event.CreatedBy,
+			Assignee:    event.Assignee,
+			TeamID:      event.TeamID,
+			Tags:        event.Tags,
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if err := scoped.send(&task, event.Event, event.ID); err != nil {
+		return err
 	}
 
+	if err := s.db.Where("created_at < ?", time.Now().Add(-notificationDeliveryRetention)).
+		Delete(&NotificationDelivery{}).Error; err != nil {
+		s.logger.Warn("Failed to prune notification deliveries", zap.Error(err))
+	}
 	return nil
 }
 
+// deliverOnce calls send when this replica claims the event for the channel. A
+// replica that finds the channel claimed waits until it was sent, or until the
+// claim is released and it can claim the channel itself.
+func (s *NotificationService) deliverOnce(eventID string, channelID uint, send func() error) error {
+	key := NotificationDelivery{EventID: eventID, ChannelID: channelID}
+	deadline := time.Now().Add(notificationClaimWait)
+	for {
+		claim := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&NotificationDelivery{EventID: eventID, ChannelID: channelID})
+		if claim.Error != nil {
+			return claim.Error
+		}
+		if claim.RowsAffected == 1 {
+			if err := send(); err != nil {
+				if releaseErr := s.db.Where(&key).Delete(&NotificationDelivery{}).Error; releaseErr != nil {
+					s.logger.Error("Failed to release notification claim", zap.String("event_id", eventID),
+						zap.Uint("channel_id", channelID), zap.Error(releaseErr))
+				}
+				return err
+			}
+			return s.db.Model(&NotificationDelivery{}).Where(&key).Update("sent_at", time.Now()).Error
+		}
+
+		var delivery NotificationDelivery
+		err := s.db.Where(&key).First(&delivery).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue // Released, claim it again
+		}
+		if err != nil {
+			return err
+		}
+		if delivery.SentAt != nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("channel %d is still claimed by another replica", channelID)
+		}
+		time.Sleep(notificationClaimPoll)
+	}
+}
+
 // sendToChannel sends a notification through a specific channel
 func (s *NotificationService) sendToChannel(channel NotificationChannel, tmpl NotificationTemplate, data map[string]interface{}) error {
 	// Parse and execute template
@@ -137,7 +281,7 @@ func (s *NotificationService) sendSlack(configData json.RawMessage, content stri
 		return err
 	}
 
-	resp, err := http.Post(config.WebhookURL, "application/json", bytes.NewBuffer(jsonData))
+	resp, err := s.client.Post(config.WebhookURL, "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return err
 	}
@@ -169,8 +313,7 @@ func (s *NotificationService) sendWebhook(configData json.RawMessage, content st
 	}
 
 	// Send request
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := s.client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -188,33 +331,54 @@ func (s *NotificationService) CreateNotificationTemplate(template *NotificationT
 	return s.db.Create(template).Error
 }
 
-// UpdateNotificationTemplate updates an existing notification template
+// UpdateNotificationTemplate updates an existing notification template. Templates
+// of other workspaces are reported as gorm.ErrRecordNotFound.
 func (s *NotificationService) UpdateNotificationTemplate(template *NotificationTemplate) error {
-	return s.db.Save(template).Error
+	result := s.db.Model(&NotificationTemplate{}).Where("id = ?", template.ID).
+		Select("type", "subject", "template").Updates(template)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
 }
 
-// ConfigureChannel configures a notification channel
+// ConfigureChannel creates a notification channel, or updates it when it has an
+// ID. Channels of other workspaces are reported as gorm.ErrRecordNotFound.
 func (s *NotificationService) ConfigureChannel(channel *NotificationChannel) error {
 	// Validate channel configuration
 	switch channel.Type {
 	case "email":
 		var config EmailConfig
 		if err := json.Unmarshal(channel.Config, &config); err != nil {
-			return fmt.Errorf("invalid email configuration: %v", err)
+			return fmt.Errorf("%w: invalid email configuration: %v", ErrInvalidChannel, err)
 		}
 	case "slack":
 		var config SlackConfig
 		if err := json.Unmarshal(channel.Config, &config); err != nil {
-			return fmt.Errorf("invalid slack configuration: %v", err)
+			return fmt.Errorf("%w: invalid slack configuration: %v", ErrInvalidChannel, err)
 		}
 	case "webhook":
 		var config WebhookConfig
 		if err := json.Unmarshal(channel.Config, &config); err != nil {
-			return fmt.Errorf("invalid webhook configuration: %v", err)
+			return fmt.Errorf("%w: invalid webhook configuration: %v", ErrInvalidChannel, err)
 		}
 	default:
-		return fmt.Errorf("unsupported channel type: %s", channel.Type)
+		return fmt.Errorf("%w: unsupported channel type: %s", ErrInvalidChannel, channel.Type)
 	}
 
-	return s.db.Save(channel).Error
+	if channel.ID == 0 {
+		return s.db.Create(channel).Error
+	}
+	result := s.db.Model(&NotificationChannel{}).Where("id = ?", channel.ID).
+		Select("type", "config", "enabled").Updates(channel)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
 }
@@ -0,0 +1,127 @@
+package services_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/task-schedulart/internal/dbtest"
+	"github.com/task-schedulart/services"
+	"go.uber.org/zap"
+)
+
+func TestHandleTaskEventNotifiesOnce(t *testing.T) {
+	db := dbtest.Open(t)
+
+	setup := services.NewNotificationService(db, zap.NewNop()).ForWorkspace(services.DefaultWorkspaceID)
+
+	// webhook returns a webhook that fails the requests it is told to and counts
+	// the others
+	type webhook struct {
+		mu                            sync.Mutex
+		failures, requests, delivered int
+	}
+	newWebhook := func(t *testing.T) *webhook {
+		t.Helper()
+		hook := &webhook{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hook.mu.Lock()
+			defer hook.mu.Unlock()
+			hook.requests++
+			if hook.failures > 0 {
+				hook.failures--
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			hook.delivered++
+		}))
+		t.Cleanup(server.Close)
+
+		config, _ := json.Marshal(services.WebhookConfig{URL: server.URL, Method: http.MethodPost})
+		if err := setup.ConfigureChannel(&services.NotificationChannel{Type: "webhook", Config: config, Enabled: true}); err != nil {
+			t.Fatalf("ConfigureChannel: %v", err)
+		}
+		return hook
+	}
+	counts := func(hook *webhook) (int, int) {
+		hook.mu.Lock()
+		defer hook.mu.Unlock()
+		return hook.requests, hook.delivered
+	}
+
+	if err := setup.CreateNotificationTemplate(&services.NotificationTemplate{Type: services.TaskStatusEvent, Template: "{{.event}}"}); err != nil {
+		t.Fatalf("CreateNotificationTemplate: %v", err)
+	}
+	steady, flaky := newWebhook(t), newWebhook(t)
+
+	// Two replicas receive every event
+	bus := services.NewInProcessEventBus(zap.NewNop())
+	t.Cleanup(func() { bus.Close() })
+	handled := make(chan error, 2)
+	for _, replica := range []string{"replica-1", "replica-2"} {
+		notificationService := services.NewNotificationService(db, zap.NewNop())
+		bus.Subscribe(replica, func(event services.TaskEvent) error {
+			err := notificationService.HandleTaskEvent(event)
+			handled <- err
+			return err
+		})
+	}
+	// publish sends an event and returns how many replicas failed to handle it
+	publish := func(t *testing.T, id string) int {
+		t.Helper()
+		bus.Publish(services.TaskEvent{ID: id, Event: services.TaskStatusEvent, WorkspaceID: services.DefaultWorkspaceID, TaskID: 404})
+		failed := 0
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-handled:
+				if err != nil {
+					failed++
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("event %s was not handled by both replicas", id)
+			}
+		}
+		return failed
+	}
+
+	t.Run("sent once", func(t *testing.T) {
+		if failed := publish(t, "event-1"); failed != 0 {
+			t.Fatalf("%d replicas failed to handle the event", failed)
+		}
+		for name, hook := range map[string]*webhook{"steady": steady, "flaky": flaky} {
+			if requests, delivered := counts(hook); requests != 1 || delivered != 1 {
+				t.Errorf("%s webhook got %d requests, %d delivered, want 1", name, requests, delivered)
+			}
+		}
+	})
+
+	t.Run("failed channel is sent again", func(t *testing.T) {
+		flaky.mu.Lock()
+		flaky.failures = 1
+		flaky.mu.Unlock()
+		steadyBefore, _ := counts(steady)
+		flakyBefore, flakyDelivered := counts(flaky)
+
+		if failed := publish(t, "event-2"); failed != 1 {
+			t.Fatalf("%d replicas failed to handle the event, want 1", failed)
+		}
+		// Only the channel that failed gets the event again
+		if requests, _ := counts(steady); requests-steadyBefore != 1 {
+			t.Errorf("steady webhook got %d requests, want 1", requests-steadyBefore)
+		}
+		requests, delivered := counts(flaky)
+		if requests-flakyBefore != 2 || delivered-flakyDelivered != 1 {
+			t.Errorf("flaky webhook got %d requests, %d delivered, want 2 requests and 1 delivered",
+				requests-flakyBefore, delivered-flakyDelivered)
+		}
+
+		var sent int64
+		if err := db.Model(&services.NotificationDelivery{}).Where("event_id = ? AND sent_at IS NOT NULL", "event-2").
+			Count(&sent).Error; err != nil || sent != 2 {
+			t.Errorf("channels recorded as sent = %d, %v, want 2", sent, err)
+		}
+	})
+}
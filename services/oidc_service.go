@@ -0,0 +1,552 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrOIDCLogin is returned when a login through the identity provider is rejected
+	ErrOIDCLogin = errors.New("OIDC login failed")
+	// ErrOIDCUserConflict is returned when the username or email of a new OIDC user belongs to a local account
+	ErrOIDCUserConflict = errors.New("username or email already belongs to a local account")
+)
+
+const (
+	// oidcKeyRefreshInterval is how often the signing keys are fetched at most when a token uses an unknown key
+	oidcKeyRefreshInterval = time.Minute
+	// oidcResponseLimit bounds the size of responses read from the identity provider
+	oidcResponseLimit = 1 << 20
+	// oidcNonceRetention is how long used nonces are remembered, longer than ID tokens are valid
+	oidcNonceRetention = 24 * time.Hour
+)
+
+// OIDCTeamGrant is the team membership given to the members of an identity provider group
+type OIDCTeamGrant struct {
+	TeamID uint
+	Role   string // admin, member or viewer
+}
+
+// OIDCConfig configures login through an external OpenID Connect provider
+type OIDCConfig struct {
+	IssuerURL    string   // Issuer of the provider, its discovery document is read from IssuerURL/.well-known/openid-configuration
+	ClientID     string   // Client registered at the provider
+	ClientSecret string   // Secret of the client
+	RedirectURL  string   // Callback URL registered for the client
+	Scopes       []string // Scopes requested at login
+	GroupsClaim  string   // ID token claim that lists the groups of a user
+
+	DefaultRole string                   // Role of users that are in no group of RoleGroups
+	RoleGroups  map[string]string        // Role given to the members of a group
+	TeamGroups  map[string]OIDCTeamGrant // Team membership given to the members of a group
+
+	KeyCacheTTL time.Duration // How long the signing keys of the provider are cached
+	WorkspaceID uint          // Workspace users are created in on their first login
+}
+
+// DefaultOIDCConfig returns the settings used when nothing is configured. OIDC
+// login is disabled until an issuer is set.
+func DefaultOIDCConfig() OIDCConfig {
+	return OIDCConfig{
+		Scopes:      []string{"openid", "profile", "email", "groups"},
+		GroupsClaim: "groups",
+		DefaultRole: "user",
+		RoleGroups:  map[string]string{},
+		TeamGroups:  map[string]OIDCTeamGrant{},
+		KeyCacheTTL: time.Hour,
+		WorkspaceID: DefaultWorkspaceID,
+	}
+}
+
+// Enabled reports whether OIDC login is configured
+func (c OIDCConfig) Enabled() bool {
+	return c.IssuerURL != ""
+}
+
+// OIDCNonce records the nonce of a completed login, so the ID token of a login
+// cannot be used for another one
+type OIDCNonce struct {
+	Nonce     string    `gorm:"primaryKey;type:text"`
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// oidcProvider is the part of the discovery document of a provider that is used
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcIdentity is a user as described by the ID token of the provider
+type oidcIdentity struct {
+	Subject  string
+	Username string
+	Email    string
+	Groups   []string
+}
+
+// OIDCService logs users in with the authorization code flow of an external
+// OpenID Connect provider. Users are created on their first login, and their
+// role and the memberships of mapped teams follow their groups at the provider.
+type OIDCService struct {
+	db          *gorm.DB
+	authService *AuthService
+	config      OIDCConfig
+	client      *http.Client
+
+	mu          sync.Mutex
+	provider    *oidcProvider
+	keys        map[string]interface{} // Signing keys of the provider by key ID
+	keysFetched time.Time
+}
+
+func NewOIDCService(db *gorm.DB, authService *AuthService, config OIDCConfig) *OIDCService {
+	return &OIDCService{
+		db:          db,
+		authService: authService,
+		config:      config,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// BeginLogin returns the URL that sends a user to the provider, with the state
+// and nonce the callback has to be checked against
+func (s *OIDCService) BeginLogin() (string, string, string, error) {
+	provider, err := s.discover()
+	if err != nil {
+		return "", "", "", err
+	}
+
+	state, nonce := newTokenID(), newTokenID()
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {s.config.ClientID},
+		"redirect_uri":  {s.config.RedirectURL},
+		"scope":         {strings.Join(s.config.Scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return provider.AuthorizationEndpoint + separator + query.Encode(), state, nonce, nil
+}
+
+// Login exchanges an authorization code for an ID token, provisions the user it
+// describes and starts a session with an access and a refresh token
+func (s *OIDCService) Login(code, nonce string) (*User, string, string, error) {
+	provider, err := s.discover()
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	rawIDToken, err := s.exchangeCode(provider, code)
+	if err != nil {
+		return nil, "", "", err
+	}
+	identity, err := s.verifyIDToken(provider, rawIDToken, nonce)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if err := s.useNonce(nonce); err != nil {
+		return nil, "", "", err
+	}
+
+	user, err := s.provisionUser(identity)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	accessToken, refreshToken, err := s.authService.startSession(*user)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return user, accessToken, refreshToken, nil
+}
+
+// useNonce records the nonce of a login. A nonce that was used before means the
+// ID token is replayed, which is rejected.
+func (s *OIDCService) useNonce(nonce string) error {
+	claim := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&OIDCNonce{Nonce: nonce})
+	if claim.Error != nil {
+		return claim.Error
+	}
+	if claim.RowsAffected == 0 {
+		return fmt.Errorf("%w: ID token nonce was already used", ErrOIDCLogin)
+	}
+	return s.db.Where("created_at < ?", time.Now().Add(-oidcNonceRetention)).Delete(&OIDCNonce{}).Error
+}
+
+// discover reads the discovery document of the provider once and caches it
+func (s *OIDCService) discover() (*oidcProvider, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.provider != nil {
+		return s.provider, nil
+	}
+
+	var provider oidcProvider
+	if err := s.getJSON(strings.TrimSuffix(s.config.IssuerURL, "/")+"/.well-known/openid-configuration", &provider); err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC provider: %v", err)
+	}
+	// The issuer in the document must match the configured one, otherwise tokens of another issuer would be accepted
+	if strings.TrimSuffix(provider.Issuer, "/") != strings.TrimSuffix(s.config.IssuerURL, "/") {
+		return nil, fmt.Errorf("OIDC discovery returned issuer %q instead of %q", provider.Issuer, s.config.IssuerURL)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery document lacks an endpoint")
+	}
+
+	s.provider = &provider
+	return s.provider, nil
+}
+
+// exchangeCode redeems an authorization code at the token endpoint and returns the ID token
+func (s *OIDCService) exchangeCode(provider *oidcProvider, code string) (string, error) {
+	if code == "" {
+		return "", fmt.Errorf("%w: missing authorization code", ErrOIDCLogin)
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {s.config.RedirectURL},
+	}
+	req, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(s.config.ClientID), url.QueryEscape(s.config.ClientSecret))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach OIDC token endpoint: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, oidcResponseLimit)).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to read OIDC token response: %v", err)
+	}
+	if body.Error != "" {
+		// invalid_grant and the like mean the code was wrong or already used
+		return "", fmt.Errorf("%w: %s %s", ErrOIDCLogin, body.Error, body.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("OIDC token endpoint returned status %d", resp.StatusCode)
+	}
+	if body.IDToken == "" {
+		return "", fmt.Errorf("%w: token response contains no ID token", ErrOIDCLogin)
+	}
+	return body.IDToken, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of an
+// ID token and returns the identity it describes
+func (s *OIDCService) verifyIDToken(provider *oidcProvider, rawIDToken, nonce string) (*oidcIdentity, error) {
+	token, err := jwt.Parse(rawIDToken, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return s.signingKey(provider, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid ID token: %v", ErrOIDCLogin, err)
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("%w: invalid ID token", ErrOIDCLogin)
+	}
+
+	if iss, _ := claims["iss"].(string); iss != provider.Issuer {
+		return nil, fmt.Errorf("%w: ID token issued by %q", ErrOIDCLogin, iss)
+	}
+	if !containsString(stringsClaim(claims["aud"]), s.config.ClientID) {
+		return nil, fmt.Errorf("%w: ID token is not meant for this client", ErrOIDCLogin)
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, fmt.Errorf("%w: ID token does not expire", ErrOIDCLogin)
+	}
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce == "" || tokenNonce != nonce {
+		return nil, fmt.Errorf("%w: ID token nonce does not match", ErrOIDCLogin)
+	}
+
+	identity := &oidcIdentity{}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.Username, _ = claims["preferred_username"].(string)
+	identity.Groups = stringsClaim(claims[s.config.GroupsClaim])
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("%w: ID token has no subject", ErrOIDCLogin)
+	}
+	if identity.Email == "" {
+		return nil, fmt.Errorf("%w: ID token has no email, request the email scope", ErrOIDCLogin)
+	}
+	if identity.Username == "" {
+		identity.Username = identity.Email
+	}
+	return identity, nil
+}
+
+// signingKey returns the key of the provider with the given ID. The keys are
+// cached and fetched again when they expire or when a token uses an unknown key,
+// which happens after the provider rotated its keys.
+func (s *OIDCService) signingKey(provider *oidcProvider, kid string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stale := time.Since(s.keysFetched) > s.config.KeyCacheTTL
+	_, known := s.keys[kid]
+	if stale || (!known && time.Since(s.keysFetched) > oidcKeyRefreshInterval) {
+		keys, err := s.fetchKeys(provider)
+		if err != nil {
+			return nil, err
+		}
+		s.keys = keys
+		s.keysFetched = time.Now()
+	}
+
+	if key, ok := s.keys[kid]; ok {
+		return key, nil
+	}
+	// Providers with a single key may leave out the key ID
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// fetchKeys reads the JSON Web Key Set of the provider. Keys that are not RSA or
+// EC signing keys are ignored.
+func (s *OIDCService) fetchKeys(provider *oidcProvider) (map[string]interface{}, error) {
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := s.getJSON(provider.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC signing keys: %v", err)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		switch jwk.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+				continue
+			}
+			keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch jwk.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !curve.IsOnCurve(key.X, key.Y) {
+				continue
+			}
+			keys[jwk.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("OIDC provider published no usable signing keys")
+	}
+	return keys, nil
+}
+
+// getJSON fetches a JSON document from the provider
+func (s *OIDCService) getJSON(target string, v interface{}) error {
+	resp, err := s.client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", target, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, oidcResponseLimit)).Decode(v)
+}
+
+// provisionUser creates the user of an identity on its first login, or updates
+// it, and syncs its role and team memberships with its groups
+func (s *OIDCService) provisionUser(identity *oidcIdentity) (*User, error) {
+	role := s.roleFor(identity.Groups)
+
+	var user User
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("oidc_subject = ?", identity.Subject).First(&user).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			// Local accounts are never taken over, an admin has to rename or remove them first
+			var taken int64
+			if err := tx.Model(&User{}).Where("username = ? OR email = ?", identity.Username, identity.Email).
+				Count(&taken).Error; err != nil {
+				return err
+			}
+			if taken > 0 {
+				return fmt.Errorf("%w: %s", ErrOIDCUserConflict, identity.Username)
+			}
+
+			subject := identity.Subject
+			user = User{Username: identity.Username, Email: identity.Email, Role: role, OIDCSubject: &subject, WorkspaceID: s.config.WorkspaceID}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case user.Role != role:
+			if err := tx.Model(&user).Update("role", role).Error; err != nil {
+				return err
+			}
+		}
+
+		return s.syncTeams(tx, user, identity.Groups)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// roleFor returns the most privileged role any of the groups maps to, or the
+// default role when no group is mapped
+func (s *OIDCService) roleFor(groups []string) string {
+	rank := map[string]int{"viewer": 1, "user": 2, "admin": 3}
+	role := ""
+	for _, group := range groups {
+		if mapped, ok := s.config.RoleGroups[group]; ok && rank[mapped] > rank[role] {
+			role = mapped
+		}
+	}
+	if role == "" {
+		return s.config.DefaultRole
+	}
+	return role
+}
+
+// syncTeams makes the memberships of a user in the mapped teams of its workspace
+// match its groups. Teams that no group maps to are left alone, so memberships
+// managed through invitations are kept.
+func (s *OIDCService) syncTeams(tx *gorm.DB, user User, groups []string) error {
+	if len(s.config.TeamGroups) == 0 {
+		return nil
+	}
+
+	rank := map[string]int{"viewer": 1, "member": 2, "admin": 3}
+	managed := make([]uint, 0, len(s.config.TeamGroups))
+	wanted := make(map[uint]string)
+	for group, grant := range s.config.TeamGroups {
+		managed = append(managed, grant.TeamID)
+		if containsString(groups, group) && rank[grant.Role] > rank[wanted[grant.TeamID]] {
+			wanted[grant.TeamID] = grant.Role
+		}
+	}
+
+	var existing []uint
+	if err := WorkspaceDB(tx, user.WorkspaceID).Model(&Team{}).Where("id IN ?", managed).Pluck("id", &existing).Error; err != nil {
+		return err
+	}
+	var memberships []TeamMember
+	if err := tx.Where("user_id = ? AND team_id IN ?", user.ID, managed).Find(&memberships).Error; err != nil {
+		return err
+	}
+	current := make(map[uint]TeamMember, len(memberships))
+	for _, membership := range memberships {
+		current[membership.TeamID] = membership
+	}
+
+	for _, teamID := range existing {
+		role, want := wanted[teamID]
+		membership, has := current[teamID]
+		switch {
+		case want && !has:
+			if err := tx.Create(&TeamMember{TeamID: teamID, UserID: user.ID, Role: role, JoinedAt: time.Now()}).Error; err != nil {
+				return err
+			}
+		case want && membership.Role != role:
+			if err := tx.Model(&membership).Update("role", role).Error; err != nil {
+				return err
+			}
+		case !want && has:
+			if err := tx.Delete(&membership).Error; err != nil {
+				return err
+			}
+			if err := revokeTeamKeys(tx, teamID, user.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// stringsClaim reads a claim that is either a string or a list of strings
+func stringsClaim(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,303 @@
+package services_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/task-schedulart/internal/dbtest"
+	"github.com/task-schedulart/services"
+)
+
+const oidcClientID = "task-schedulart"
+
+// stubIdP is an OpenID Connect provider serving discovery, signing keys and a
+// token endpoint that answers every code with the next ID token
+type stubIdP struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	published    map[string]*rsa.PrivateKey // Signing keys in the key set, by key ID
+	idToken      string
+	jwksRequests int
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	t.Helper()
+	idp := &stubIdP{published: map[string]*rsa.PrivateKey{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		idp.jwksRequests++
+
+		keys := []map[string]string{}
+		for kid, key := range idp.published {
+			keys = append(keys, map[string]string{
+				"kid": kid, "kty": "RSA", "use": "sig", "alg": "RS256",
+				"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if user, _, ok := r.BasicAuth(); !ok || user != oidcClientID || r.FormValue("code") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.idToken, "token_type": "Bearer"})
+	})
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// publish adds a signing key to the key set
+func (idp *stubIdP) publish(kid string, key *rsa.PrivateKey) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.published[kid] = key
+}
+
+// issue makes the token endpoint return an ID token with the given claims,
+// signed with key under kid
+func (idp *stubIdP) issue(t *testing.T, kid string, key *rsa.PrivateKey, claims jwt.MapClaims) {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign ID token: %v", err)
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.idToken = signed
+}
+
+// claims returns valid ID token claims for a user of the provider
+func (idp *stubIdP) claims(subject, nonce string, groups ...string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":                idp.URL,
+		"aud":                oidcClientID,
+		"sub":                subject,
+		"email":              subject + "@example.com",
+		"preferred_username": subject,
+		"groups":             groups,
+		"nonce":              nonce,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+// keyRequests returns how often the key set was fetched
+func (idp *stubIdP) keyRequests() int {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	return idp.jwksRequests
+}
+
+// oidcConfig configures a client of the provider
+func oidcConfig(idp *stubIdP) services.OIDCConfig {
+	config := services.DefaultOIDCConfig()
+	config.IssuerURL = idp.URL
+	config.ClientID = oidcClientID
+	config.ClientSecret = "secret"
+	config.RedirectURL = "http://localhost:8080/api/auth/oidc/callback"
+	return config
+}
+
+func generateKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key
+}
+
+func TestOIDCLoginRejectsInvalidIDTokens(t *testing.T) {
+	idp := newStubIdP(t)
+	signingKey, otherKey := generateKey(t), generateKey(t)
+	idp.publish("k1", signingKey)
+
+	tests := []struct {
+		name   string
+		key    *rsa.PrivateKey
+		kid    string
+		modify func(claims jwt.MapClaims)
+	}{
+		{"bad signature", otherKey, "k1", nil},
+		{"unknown key", otherKey, "k9", nil},
+		{"wrong audience", signingKey, "k1", func(claims jwt.MapClaims) { claims["aud"] = "another-client" }},
+		{"wrong issuer", signingKey, "k1", func(claims jwt.MapClaims) { claims["iss"] = "https://evil.example.com" }},
+		{"expired", signingKey, "k1", func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Minute).Unix() }},
+		{"no expiry", signingKey, "k1", func(claims jwt.MapClaims) { delete(claims, "exp") }},
+		{"nonce of another login", signingKey, "k1", func(claims jwt.MapClaims) { claims["nonce"] = "earlier-nonce" }},
+		{"no nonce", signingKey, "k1", func(claims jwt.MapClaims) { delete(claims, "nonce") }},
+		{"no subject", signingKey, "k1", func(claims jwt.MapClaims) { delete(claims, "sub") }},
+	}
+
+	// Rejected tokens never reach the database
+	oidcService := services.NewOIDCService(nil, nil, oidcConfig(idp))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := idp.claims("alice", "nonce-1")
+			if tt.modify != nil {
+				tt.modify(claims)
+			}
+			idp.issue(t, tt.kid, tt.key, claims)
+
+			if _, _, _, err := oidcService.Login("code", "nonce-1"); !errors.Is(err, services.ErrOIDCLogin) {
+				t.Fatalf("Login error = %v, want %v", err, services.ErrOIDCLogin)
+			}
+		})
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	db := dbtest.Open(t)
+	authService := services.NewAuthService(db, services.DefaultAuthConfig())
+	collaborationService := services.NewCollaborationService(db).ForWorkspace(services.DefaultWorkspaceID)
+
+	owner, err := authService.Register("owner", "owner@example.com", "secret-password")
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	team := services.Team{Name: "platform"}
+	if err := collaborationService.CreateTeam(&team, owner.ID); err != nil {
+		t.Fatalf("CreateTeam: %v", err)
+	}
+
+	idp := newStubIdP(t)
+	key := generateKey(t)
+	idp.publish("k1", key)
+
+	config := oidcConfig(idp)
+	config.RoleGroups = map[string]string{"sso-admins": "admin", "auditors": "viewer"}
+	config.TeamGroups = map[string]services.OIDCTeamGrant{"platform": {TeamID: team.ID, Role: "admin"}}
+	oidcService := services.NewOIDCService(db, authService, config)
+
+	// login runs the callback of a login with a fresh nonce
+	nonces := 0
+	login := func(t *testing.T, kid string, key *rsa.PrivateKey, groups ...string) (*services.User, error) {
+		t.Helper()
+		nonces++
+		nonce := fmt.Sprintf("nonce-%d", nonces)
+		idp.issue(t, kid, key, idp.claims("alice", nonce, groups...))
+		user, accessToken, refreshToken, err := oidcService.Login("code", nonce)
+		if err == nil && (accessToken == "" || refreshToken == "") {
+			t.Fatalf("Login returned no tokens")
+		}
+		return user, err
+	}
+	// membership returns the role of a user in the team, empty if it is no member
+	membership := func(t *testing.T, userID uint) string {
+		t.Helper()
+		members, err := collaborationService.GetTeamMembers(team.ID)
+		if err != nil {
+			t.Fatalf("GetTeamMembers: %v", err)
+		}
+		for _, member := range members {
+			if member.UserID == userID {
+				return member.Role
+			}
+		}
+		return ""
+	}
+
+	user, err := login(t, "k1", key, "sso-admins", "platform")
+	if err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+	if user.Username != "alice" || user.Role != "admin" {
+		t.Fatalf("provisioned user = %+v, want alice as admin", user)
+	}
+	if role := membership(t, user.ID); role != "admin" {
+		t.Fatalf("team role = %q, want admin", role)
+	}
+
+	t.Run("replayed nonce", func(t *testing.T) {
+		idp.issue(t, "k1", key, idp.claims("alice", "nonce-replayed", "sso-admins"))
+		if _, _, _, err := oidcService.Login("code", "nonce-replayed"); err != nil {
+			t.Fatalf("Login: %v", err)
+		}
+		if _, _, _, err := oidcService.Login("code", "nonce-replayed"); !errors.Is(err, services.ErrOIDCLogin) {
+			t.Fatalf("replayed Login error = %v, want %v", err, services.ErrOIDCLogin)
+		}
+	})
+
+	t.Run("unknown key refreshes the key set", func(t *testing.T) {
+		rotated := generateKey(t)
+		idp.publish("k2", rotated)
+		before := idp.keyRequests()
+
+		// Keys are not fetched again for every unknown key ID
+		if _, err := login(t, "k2", rotated, "sso-admins", "platform"); !errors.Is(err, services.ErrOIDCLogin) {
+			t.Fatalf("Login right after a fetch error = %v, want %v", err, services.ErrOIDCLogin)
+		}
+		if got := idp.keyRequests(); got != before {
+			t.Fatalf("key set fetched %d times right after a fetch, want 0", got-before)
+		}
+
+		oidcService.BackdateKeyFetch(2 * time.Minute)
+		if _, err := login(t, "k2", rotated, "sso-admins", "platform"); err != nil {
+			t.Fatalf("Login with a rotated key: %v", err)
+		}
+		if got := idp.keyRequests(); got != before+1 {
+			t.Fatalf("key set fetched %d times, want 1", got-before)
+		}
+	})
+
+	t.Run("groups demote and remove from teams", func(t *testing.T) {
+		apiKeyService := services.NewAPIKeyService(db)
+		plain, err := apiKeyService.CreateAPIKey(&services.APIKey{
+			Name: "deploy", UserID: user.ID, WorkspaceID: services.DefaultWorkspaceID, TeamID: &team.ID,
+			Scopes: []string{"tasks:read"},
+		})
+		if err != nil {
+			t.Fatalf("CreateAPIKey: %v", err)
+		}
+
+		demoted, err := login(t, "k1", key, "auditors")
+		if err != nil {
+			t.Fatalf("Login: %v", err)
+		}
+		if demoted.ID != user.ID || demoted.Role != "viewer" {
+			t.Fatalf("user after losing the admin group = %+v, want the same user as viewer", demoted)
+		}
+		if role := membership(t, user.ID); role != "" {
+			t.Fatalf("team role = %q after leaving the group, want no membership", role)
+		}
+		if role := membership(t, owner.ID); role != "admin" {
+			t.Errorf("membership of the local owner = %q, want it kept", role)
+		}
+		if _, _, err := apiKeyService.Authenticate(plain); !errors.Is(err, services.ErrInvalidAPIKey) {
+			t.Errorf("team key after leaving the team error = %v, want %v", err, services.ErrInvalidAPIKey)
+		}
+
+	})
+}
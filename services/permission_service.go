@@ -0,0 +1,194 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// ErrPermissionDenied is returned when an actor lacks the permission an operation needs
+var ErrPermissionDenied = errors.New("permission denied")
+
+// Permission names an operation that roles grant
+type Permission string
+
+const (
+	PermTaskRead              Permission = "task.read"              // Read tasks and their history
+	PermTaskCreate            Permission = "task.create"            // Create tasks and add tasks to a team
+	PermTaskUpdate            Permission = "task.update"            // Edit tasks, their status and dependencies, pause and resume them
+	PermTaskExecute           Permission = "task.execute"           // Cancel and retry tasks
+	PermTaskDelete            Permission = "task.delete"            // Delete tasks
+	PermDeadLetterManage      Permission = "deadletter.manage"      // Inspect, requeue and discard dead letters
+	PermWorkflowRead          Permission = "workflow.read"          // Read workflows and their runs
+	PermWorkflowManage        Permission = "workflow.manage"        // Create workflow versions
+	PermWorkflowRun           Permission = "workflow.run"           // Start workflow runs
+	PermCalendarRead          Permission = "calendar.read"          // Read calendars and the schedule
+	PermCalendarManage        Permission = "calendar.manage"        // Create, change and delete calendars
+	PermTeamInvite            Permission = "team.invite"            // Invite users to a team
+	PermTeamManage            Permission = "team.manage"            // Change the roles of team members and remove them
+	PermAPIKeyManage          Permission = "apikey.manage"          // Create, rotate and revoke own API keys
+	PermNotificationConfigure Permission = "notification.configure" // Configure notification templates and channels
+	PermSessionRevoke         Permission = "session.revoke"         // Revoke the sessions of other users
+	PermWorkspaceManage       Permission = "workspace.manage"       // Create workspaces and move users between them
+)
+
+var allPermissions = []Permission{
+	PermTaskRead, PermTaskCreate, PermTaskUpdate, PermTaskExecute, PermTaskDelete,
+	PermDeadLetterManage,
+	PermWorkflowRead, PermWorkflowManage, PermWorkflowRun,
+	PermCalendarRead, PermCalendarManage,
+	PermTeamInvite, PermTeamManage,
+	PermAPIKeyManage, PermNotificationConfigure, PermSessionRevoke, PermWorkspaceManage,
+}
+
+// globalRoles are the roles of users in their workspace. Apart from admins, who
+// hold every permission on everything, users act on the tasks they can see.
+var globalRoles = map[string][]Permission{
+	"admin": allPermissions,
+	"user": {
+		PermTaskRead, PermTaskCreate, PermTaskUpdate, PermTaskExecute, PermTaskDelete,
+		PermWorkflowRead, PermWorkflowManage, PermWorkflowRun,
+		PermCalendarRead, PermCalendarManage,
+		PermTeamInvite, PermTeamManage,
+		PermAPIKeyManage,
+	},
+	"viewer": {PermTaskRead, PermWorkflowRead, PermCalendarRead, PermAPIKeyManage},
+}
+
+// teamRoles are the roles of team members, granting permissions on the tasks and
+// members of their team
+var teamRoles = map[string][]Permission{
+	"admin": {
+		PermTaskRead, PermTaskCreate, PermTaskUpdate, PermTaskExecute, PermTaskDelete,
+		PermTeamInvite, PermTeamManage,
+	},
+	"member": {PermTaskRead, PermTaskCreate, PermTaskUpdate, PermTaskExecute, PermTaskDelete},
+	"viewer": {PermTaskRead},
+}
+
+// IsGlobalRole reports whether role can be granted to a user
+func IsGlobalRole(role string) bool {
+	_, ok := globalRoles[role]
+	return ok
+}
+
+// IsTeamRole reports whether role can be granted to a team member
+func IsTeamRole(role string) bool {
+	_, ok := teamRoles[role]
+	return ok
+}
+
+// grants reports whether role grants permission in roles
+func grants(roles map[string][]Permission, role string, permission Permission) bool {
+	for _, granted := range roles[role] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// TeamPermissions are the permissions of an actor on the tasks and members of a team
+type TeamPermissions struct {
+	TeamID      uint         `json:"teamId"`
+	Role        string       `json:"role"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// ActorPermissions are the permissions of an actor, granted by its role in the
+// workspace and by its roles in teams
+type ActorPermissions struct {
+	Role        string            `json:"role"`
+	Permissions []Permission      `json:"permissions"`
+	Teams       []TeamPermissions `json:"teams"`
+}
+
+type PermissionService struct {
+	db *gorm.DB
+}
+
+func NewPermissionService(db *gorm.DB) *PermissionService {
+	return &PermissionService{db: db}
+}
+
+// ForWorkspace returns a copy of the service limited to the data of a workspace
+func (s *PermissionService) ForWorkspace(workspaceID uint) *PermissionService {
+	return &PermissionService{db: WorkspaceDB(s.db, workspaceID)}
+}
+
+// Authorize returns ErrPermissionDenied unless an actor holds a permission. For
+// the resources of a team, the permission must be granted by the actor's role in
+// the team as well as by its role in the workspace, so a viewer stays read-only
+// in every team. Admins hold every permission, in every team of their workspace.
+// Team API keys only reach their own team, with the team role of their creator.
+func (s *PermissionService) Authorize(actor Actor, permission Permission, teamID *uint) error {
+	if !grants(globalRoles, actor.Role, permission) {
+		return fmt.Errorf("%w: %s role lacks %s", ErrPermissionDenied, actor.Role, permission)
+	}
+	if actor.TeamID != nil && teamID != nil && *teamID != *actor.TeamID {
+		return fmt.Errorf("%w: API key belongs to team %d", ErrPermissionDenied, *actor.TeamID)
+	}
+	if teamID == nil {
+		return nil
+	}
+
+	// Teams of other workspaces do not exist for the actor, not even for admins
+	var teams int64
+	if err := s.db.Model(&Team{}).Where("id = ?", *teamID).Count(&teams).Error; err != nil {
+		return err
+	}
+	if teams == 0 {
+		return fmt.Errorf("%w: team %d not found", ErrPermissionDenied, *teamID)
+	}
+	if actor.IsAdmin() {
+		return nil
+	}
+
+	var member TeamMember
+	err := s.db.Where("team_id = ? AND user_id = ?", *teamID, actor.UserID).First(&member).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("%w: not a member of team %d", ErrPermissionDenied, *teamID)
+	}
+	if err != nil {
+		return err
+	}
+	if !grants(teamRoles, member.Role, permission) {
+		return fmt.Errorf("%w: %s role in team %d lacks %s", ErrPermissionDenied, member.Role, *teamID, permission)
+	}
+	return nil
+}
+
+// Permissions returns the permissions of an actor in its workspace and in each
+// of its teams
+func (s *PermissionService) Permissions(actor Actor) (*ActorPermissions, error) {
+	result := &ActorPermissions{
+		Role:        actor.Role,
+		Permissions: append([]Permission{}, globalRoles[actor.Role]...),
+		Teams:       []TeamPermissions{},
+	}
+
+	var teamIDs []uint
+	if err := s.db.Model(&Team{}).Pluck("id", &teamIDs).Error; err != nil {
+		return nil, err
+	}
+	var memberships []TeamMember
+	if err := s.db.Where("user_id = ? AND team_id IN ?", actor.UserID, teamIDs).
+		Order("team_id").
+		Find(&memberships).Error; err != nil {
+		return nil, err
+	}
+
+	// Team admins hold every permission that applies to a team
+	for _, membership := range memberships {
+		team := TeamPermissions{TeamID: membership.TeamID, Role: membership.Role, Permissions: []Permission{}}
+		for _, permission := range teamRoles["admin"] {
+			if grants(globalRoles, actor.Role, permission) &&
+				(actor.IsAdmin() || grants(teamRoles, membership.Role, permission)) {
+				team.Permissions = append(team.Permissions, permission)
+			}
+		}
+		result.Teams = append(result.Teams, team)
+	}
+	return result, nil
+}
@@ -0,0 +1,298 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/task-schedulart/models"
+)
+
+// Recurring pattern types
+const (
+	PatternOnce    = "once"
+	PatternDaily   = "daily"
+	PatternWeekly  = "weekly"
+	PatternMonthly = "monthly"
+	PatternCustom  = "custom"
+	PatternRRule   = "rrule"
+)
+
+// maxPatternInterval bounds the interval of daily, weekly and monthly patterns
+const maxPatternInterval = 1000
+
+// cronParser parses the six field expressions used by the scheduler
+var cronParser = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// parsePattern decodes and validates the recurring config of a task
+func parsePattern(config json.RawMessage) (models.RecurringPattern, error) {
+	var pattern models.RecurringPattern
+	if err := json.Unmarshal(config, &pattern); err != nil {
+		return pattern, fmt.Errorf("%w: %v", ErrInvalidPattern, err)
+	}
+	if err := validatePattern(pattern); err != nil {
+		return pattern, err
+	}
+	return pattern, nil
+}
+
+// normalizePattern anchors interval patterns without a start date at the current day
+func normalizePattern(pattern models.RecurringPattern, now time.Time) models.RecurringPattern {
+	if pattern.StartDate != "" {
+		return pattern
+	}
+	switch pattern.Type {
+	case PatternDaily, PatternWeekly, PatternMonthly, PatternRRule:
+		if loc, err := patternLocation(pattern); err == nil {
+			pattern.StartDate = now.In(loc).Format("2006-01-02")
+		}
+	}
+	return pattern
+}
+
+// validatePattern checks the fields of a recurring pattern
+func validatePattern(pattern models.RecurringPattern) error {
+	if _, err := patternEndDate(pattern); err != nil {
+		return err
+	}
+	switch pattern.MisfirePolicy {
+	case "", MisfireSkip, MisfireRunOnce, MisfireRunAll:
+	default:
+		return fmt.Errorf("%w: misfire_policy must be skip, run_once or run_all", ErrInvalidPattern)
+	}
+	_, err := patternSchedule(pattern)
+	return err
+}
+
+// patternLocation returns the time zone of a pattern, UTC when none is set
+func patternLocation(pattern models.RecurringPattern) (*time.Location, error) {
+	if pattern.Timezone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(pattern.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unknown timezone %q, use an IANA name such as Europe/Berlin", ErrInvalidPattern, pattern.Timezone)
+	}
+	return loc, nil
+}
+
+// patternEndDate parses the end date of a pattern. A plain date ends the pattern
+// after that day in the pattern's time zone. The zero time means the pattern never ends.
+func patternEndDate(pattern models.RecurringPattern) (time.Time, error) {
+	if pattern.EndDate == "" {
+		return time.Time{}, nil
+	}
+	loc, err := patternLocation(pattern)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endDate, err := time.Parse(time.RFC3339, pattern.EndDate); err == nil {
+		return endDate, nil
+	}
+	if day, err := time.ParseInLocation("2006-01-02", pattern.EndDate, loc); err == nil {
+		return day.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	return time.Time{}, fmt.Errorf("%w: end_date must be an RFC 3339 timestamp or a YYYY-MM-DD date", ErrInvalidPattern)
+}
+
+// patternEnded reports whether a pattern has no occurrences left after now
+func patternEnded(pattern models.RecurringPattern, now time.Time) bool {
+	endDate, err := patternEndDate(pattern)
+	return err == nil && !endDate.IsZero() && now.After(endDate)
+}
+
+// patternSchedule returns the schedule of a pattern
+func patternSchedule(pattern models.RecurringPattern) (cron.Schedule, error) {
+	loc, err := patternLocation(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if pattern.Type == PatternCustom {
+		return customSchedule(pattern)
+	}
+	if pattern.Type == PatternRRule {
+		return rruleFromPattern(pattern, loc)
+	}
+
+	schedule := &calendarSchedule{kind: pattern.Type, loc: loc, interval: pattern.Interval}
+	switch pattern.Type {
+	case PatternOnce, PatternDaily, PatternWeekly, PatternMonthly:
+	case "":
+		return nil, fmt.Errorf("%w: type is required", ErrInvalidPattern)
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q, use once, daily, weekly, monthly, custom or rrule", ErrInvalidPattern, pattern.Type)
+	}
+
+	if schedule.interval == 0 {
+		schedule.interval = 1
+	}
+	if schedule.interval < 0 || schedule.interval > maxPatternInterval {
+		return nil, fmt.Errorf("%w: interval must be between 1 and %d", ErrInvalidPattern, maxPatternInterval)
+	}
+
+	if schedule.hour, schedule.minute, err = parseTimeOfDay(pattern.TimeOfDay); err != nil {
+		return nil, err
+	}
+
+	// Patterns saved before start dates existed count their intervals from the epoch
+	schedule.start = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	if pattern.StartDate != "" {
+		start, err := time.Parse("2006-01-02", pattern.StartDate)
+		if err != nil {
+			return nil, fmt.Errorf("%w: start_date must be a YYYY-MM-DD date", ErrInvalidPattern)
+		}
+		schedule.start = start
+	} else if pattern.Type == PatternOnce {
+		return nil, fmt.Errorf("%w: start_date is required for once patterns", ErrInvalidPattern)
+	}
+
+	if pattern.Type == PatternWeekly {
+		if len(pattern.Weekdays) == 0 {
+			schedule.weekdays[schedule.start.Weekday()] = true
+		}
+		for _, day := range pattern.Weekdays {
+			if day < 0 || day > 6 {
+				return nil, fmt.Errorf("%w: weekdays must be between 0 (Sunday) and 6 (Saturday)", ErrInvalidPattern)
+			}
+			schedule.weekdays[day] = true
+		}
+	}
+
+	if pattern.Type == PatternMonthly {
+		schedule.dayOfMonth = pattern.DayOfMonth
+		if schedule.dayOfMonth == 0 {
+			schedule.dayOfMonth = schedule.start.Day()
+		}
+		if schedule.dayOfMonth < 1 || schedule.dayOfMonth > 31 {
+			return nil, fmt.Errorf("%w: day_of_month must be between 1 and 31", ErrInvalidPattern)
+		}
+	}
+
+	return schedule, nil
+}
+
+// customSchedule parses the cron expression of a custom pattern in the pattern's time zone
+func customSchedule(pattern models.RecurringPattern) (cron.Schedule, error) {
+	expr := strings.TrimSpace(pattern.CronExpr)
+	if expr == "" {
+		return nil, fmt.Errorf("%w: cron_expr is required for custom patterns", ErrInvalidPattern)
+	}
+	if strings.HasPrefix(expr, "TZ=") || strings.HasPrefix(expr, "CRON_TZ=") {
+		return nil, fmt.Errorf("%w: set the time zone through timezone instead of cron_expr", ErrInvalidPattern)
+	}
+	if !strings.HasPrefix(expr, "@") && len(strings.Fields(expr)) != 6 {
+		return nil, fmt.Errorf("%w: cron_expr must have six fields: second minute hour day-of-month month day-of-week", ErrInvalidPattern)
+	}
+	if pattern.Timezone != "" {
+		expr = "CRON_TZ=" + pattern.Timezone + " " + expr
+	}
+
+	schedule, err := cronParser.Parse(expr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPattern, err)
+	}
+	return schedule, nil
+}
+
+// rruleFromPattern parses the RRULE of a pattern. DTSTART is the time of day on the start date.
+func rruleFromPattern(pattern models.RecurringPattern, loc *time.Location) (cron.Schedule, error) {
+	if pattern.StartDate == "" {
+		return nil, fmt.Errorf("%w: start_date is required for rrule patterns", ErrInvalidPattern)
+	}
+	start, err := time.Parse("2006-01-02", pattern.StartDate)
+	if err != nil {
+		return nil, fmt.Errorf("%w: start_date must be a YYYY-MM-DD date", ErrInvalidPattern)
+	}
+	hour, minute, err := parseTimeOfDay(pattern.TimeOfDay)
+	if err != nil {
+		return nil, err
+	}
+
+	dtstart := wallClock(start, hour, minute, 0, loc)
+	return parseRRule(pattern.RRule, dtstart, loc, pattern.ExDates, pattern.RDates)
+}
+
+// parseTimeOfDay parses an HH:MM time, midnight when empty
+func parseTimeOfDay(value string) (hour, minute int, err error) {
+	if value == "" {
+		return 0, 0, nil
+	}
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: time_of_day must be an HH:MM time", ErrInvalidPattern)
+	}
+	return parsed.Hour(), parsed.Minute(), nil
+}
+
+// calendarSchedule fires at a local time of day on the days selected by a once,
+// daily, weekly or monthly pattern. Occurrences are computed on calendar days in
+// the pattern's time zone, so they keep their wall clock time across DST changes.
+type calendarSchedule struct {
+	kind         string
+	loc          *time.Location
+	interval     int
+	hour, minute int
+	start        time.Time // First day of the pattern, as a UTC date
+	weekdays     [7]bool
+	dayOfMonth   int
+}
+
+// Next returns the first occurrence after t, or the zero time if there is none
+func (s *calendarSchedule) Next(t time.Time) time.Time {
+	local := t.In(s.loc)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+	if day.Before(s.start) {
+		day = s.start
+	}
+
+	// Any interval contains a matching day within this many days
+	limit := 366*s.interval + 62
+	for i := 0; i < limit; i++ {
+		if s.matches(day) {
+			at := wallClock(day, s.hour, s.minute, 0, s.loc)
+			if at.After(t) {
+				return at
+			}
+		}
+		if s.kind == PatternOnce && day.After(s.start) {
+			break
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return time.Time{}
+}
+
+// matches reports whether the pattern has an occurrence on a day
+func (s *calendarSchedule) matches(day time.Time) bool {
+	switch s.kind {
+	case PatternOnce:
+		return day.Equal(s.start)
+	case PatternDaily:
+		return daysBetween(s.start, day)%s.interval == 0
+	case PatternWeekly:
+		weekStart := func(d time.Time) time.Time { return d.AddDate(0, 0, -int(d.Weekday())) }
+		weeks := daysBetween(weekStart(s.start), weekStart(day)) / 7
+		return s.weekdays[day.Weekday()] && weeks%s.interval == 0
+	case PatternMonthly:
+		months := (day.Year()-s.start.Year())*12 + int(day.Month()) - int(s.start.Month())
+		if months%s.interval != 0 {
+			return false
+		}
+		// Months shorter than dayOfMonth use their last day
+		lastDay := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+		target := s.dayOfMonth
+		if target > lastDay {
+			target = lastDay
+		}
+		return day.Day() == target
+	}
+	return false
+}
+
+// daysBetween returns the number of days from one UTC date to another
+func daysBetween(from, to time.Time) int {
+	return int(to.Sub(from).Hours() / 24)
+}
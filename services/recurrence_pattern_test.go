@@ -0,0 +1,170 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/task-schedulart/models"
+)
+
+func TestPatternScheduleOccurrences(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern models.RecurringPattern // In America/New_York
+		from    string                  // Wall clock time, the first occurrence is after it
+		want    []string                // The first 4 occurrences, or every one when fewer
+	}{
+		{
+			name:    "once",
+			pattern: models.RecurringPattern{Type: PatternOnce, StartDate: "2024-03-05", TimeOfDay: "09:00"},
+			from:    "2024-03-01 00:00",
+			want:    []string{"2024-03-05T09:00:00-05:00"},
+		},
+		{
+			name:    "once in the past",
+			pattern: models.RecurringPattern{Type: PatternOnce, StartDate: "2024-03-05", TimeOfDay: "09:00"},
+			from:    "2024-03-05 09:00",
+			want:    nil,
+		},
+		{
+			name:    "daily starts on the start date",
+			pattern: models.RecurringPattern{Type: PatternDaily, StartDate: "2024-01-10", TimeOfDay: "09:00"},
+			from:    "2024-01-01 00:00",
+			want:    []string{"2024-01-10T09:00:00-05:00", "2024-01-11T09:00:00-05:00", "2024-01-12T09:00:00-05:00", "2024-01-13T09:00:00-05:00"},
+		},
+		{
+			name:    "daily after the time of day starts tomorrow",
+			pattern: models.RecurringPattern{Type: PatternDaily, StartDate: "2024-01-01", TimeOfDay: "09:00"},
+			from:    "2024-01-05 09:00",
+			want:    []string{"2024-01-06T09:00:00-05:00", "2024-01-07T09:00:00-05:00", "2024-01-08T09:00:00-05:00", "2024-01-09T09:00:00-05:00"},
+		},
+		{
+			name:    "daily interval counts from the start date",
+			pattern: models.RecurringPattern{Type: PatternDaily, Interval: 3, StartDate: "2024-01-01", TimeOfDay: "09:00"},
+			from:    "2024-01-02 00:00",
+			want:    []string{"2024-01-04T09:00:00-05:00", "2024-01-07T09:00:00-05:00", "2024-01-10T09:00:00-05:00", "2024-01-13T09:00:00-05:00"},
+		},
+		{
+			name:    "spring forward gap moves the time forward",
+			pattern: models.RecurringPattern{Type: PatternDaily, StartDate: "2024-03-09", TimeOfDay: "02:30"},
+			from:    "2024-03-09 00:00",
+			want:    []string{"2024-03-09T02:30:00-05:00", "2024-03-10T03:30:00-04:00", "2024-03-11T02:30:00-04:00", "2024-03-12T02:30:00-04:00"},
+		},
+		{
+			name:    "fall back repeat runs once",
+			pattern: models.RecurringPattern{Type: PatternDaily, StartDate: "2024-11-02", TimeOfDay: "01:30"},
+			from:    "2024-11-02 00:00",
+			want:    []string{"2024-11-02T01:30:00-04:00", "2024-11-03T01:30:00-04:00", "2024-11-04T01:30:00-05:00", "2024-11-05T01:30:00-05:00"},
+		},
+		{
+			name:    "daily keeps the wall clock time across DST",
+			pattern: models.RecurringPattern{Type: PatternDaily, StartDate: "2024-11-02", TimeOfDay: "09:00"},
+			from:    "2024-11-02 00:00",
+			want:    []string{"2024-11-02T09:00:00-04:00", "2024-11-03T09:00:00-05:00", "2024-11-04T09:00:00-05:00", "2024-11-05T09:00:00-05:00"},
+		},
+		{
+			name:    "weekly on several weekdays",
+			pattern: models.RecurringPattern{Type: PatternWeekly, Weekdays: []int{1, 3}, StartDate: "2024-01-01", TimeOfDay: "09:00"},
+			from:    "2024-01-01 00:00",
+			want:    []string{"2024-01-01T09:00:00-05:00", "2024-01-03T09:00:00-05:00", "2024-01-08T09:00:00-05:00", "2024-01-10T09:00:00-05:00"},
+		},
+		{
+			name:    "weekly defaults to the weekday of the start date",
+			pattern: models.RecurringPattern{Type: PatternWeekly, StartDate: "2024-01-04", TimeOfDay: "09:00"},
+			from:    "2024-01-01 00:00",
+			want:    []string{"2024-01-04T09:00:00-05:00", "2024-01-11T09:00:00-05:00", "2024-01-18T09:00:00-05:00", "2024-01-25T09:00:00-05:00"},
+		},
+		{
+			name:    "every other week",
+			pattern: models.RecurringPattern{Type: PatternWeekly, Interval: 2, Weekdays: []int{1, 5}, StartDate: "2024-01-01", TimeOfDay: "09:00"},
+			from:    "2024-01-01 00:00",
+			want:    []string{"2024-01-01T09:00:00-05:00", "2024-01-05T09:00:00-05:00", "2024-01-15T09:00:00-05:00", "2024-01-19T09:00:00-05:00"},
+		},
+		{
+			name:    "weekly across spring forward",
+			pattern: models.RecurringPattern{Type: PatternWeekly, Weekdays: []int{0}, StartDate: "2024-03-03", TimeOfDay: "10:00"},
+			from:    "2024-03-03 00:00",
+			want:    []string{"2024-03-03T10:00:00-05:00", "2024-03-10T10:00:00-04:00", "2024-03-17T10:00:00-04:00", "2024-03-24T10:00:00-04:00"},
+		},
+		{
+			name:    "monthly on the 31st uses the last day of short months",
+			pattern: models.RecurringPattern{Type: PatternMonthly, DayOfMonth: 31, StartDate: "2024-01-01", TimeOfDay: "09:00"},
+			from:    "2024-01-01 00:00",
+			want:    []string{"2024-01-31T09:00:00-05:00", "2024-02-29T09:00:00-05:00", "2024-03-31T09:00:00-04:00", "2024-04-30T09:00:00-04:00"},
+		},
+		{
+			name:    "monthly defaults to the day of the start date",
+			pattern: models.RecurringPattern{Type: PatternMonthly, StartDate: "2024-01-15", TimeOfDay: "09:00"},
+			from:    "2024-01-16 00:00",
+			want:    []string{"2024-02-15T09:00:00-05:00", "2024-03-15T09:00:00-04:00", "2024-04-15T09:00:00-04:00", "2024-05-15T09:00:00-04:00"},
+		},
+		{
+			name:    "quarterly",
+			pattern: models.RecurringPattern{Type: PatternMonthly, Interval: 3, DayOfMonth: 30, StartDate: "2023-11-01", TimeOfDay: "09:00"},
+			from:    "2023-11-01 00:00",
+			want:    []string{"2023-11-30T09:00:00-05:00", "2024-02-29T09:00:00-05:00", "2024-05-30T09:00:00-04:00", "2024-08-30T09:00:00-04:00"},
+		},
+	}
+
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("load location: %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.pattern.Timezone = loc.String()
+			schedule, err := patternSchedule(tt.pattern)
+			if err != nil {
+				t.Fatalf("patternSchedule: %v", err)
+			}
+			at, err := time.ParseInLocation("2006-01-02 15:04", tt.from, loc)
+			if err != nil {
+				t.Fatalf("parse from: %v", err)
+			}
+
+			var got []string
+			for len(got) < 4 {
+				at = schedule.Next(at)
+				if at.IsZero() {
+					break
+				}
+				got = append(got, at.In(loc).Format(time.RFC3339))
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("occurrences = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("occurrences = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPatternScheduleRejectsInvalidPatterns(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern models.RecurringPattern
+	}{
+		{"no type", models.RecurringPattern{}},
+		{"unknown type", models.RecurringPattern{Type: "yearly"}},
+		{"unknown timezone", models.RecurringPattern{Type: PatternDaily, Timezone: "Mars/Olympus"}},
+		{"negative interval", models.RecurringPattern{Type: PatternDaily, Interval: -1}},
+		{"interval too large", models.RecurringPattern{Type: PatternDaily, Interval: maxPatternInterval + 1}},
+		{"invalid time of day", models.RecurringPattern{Type: PatternDaily, TimeOfDay: "25:00"}},
+		{"invalid start date", models.RecurringPattern{Type: PatternDaily, StartDate: "01/02/2024"}},
+		{"once without start date", models.RecurringPattern{Type: PatternOnce}},
+		{"weekday out of range", models.RecurringPattern{Type: PatternWeekly, Weekdays: []int{7}}},
+		{"day of month out of range", models.RecurringPattern{Type: PatternMonthly, DayOfMonth: 32}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := patternSchedule(tt.pattern); !errors.Is(err, ErrInvalidPattern) {
+				t.Fatalf("patternSchedule(%+v) error = %v, want %v", tt.pattern, err, ErrInvalidPattern)
+			}
+		})
+	}
+}
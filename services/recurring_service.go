@@ -2,114 +2,373 @@ package services
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/robfig/cron/v3"
 	"github.com/task-schedulart/models"
+	"go.uber.org/zap"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// Misfire policies decide what happens to occurrences that were missed, e.g.
+// because no replica was running at the time
+const (
+	MisfireSkip    = "skip"     // Drop missed occurrences
+	MisfireRunOnce = "run_once" // Create a single instance for all missed occurrences
+	MisfireRunAll  = "run_all"  // Create an instance for every missed occurrence
+)
+
+const (
+	// misfireThreshold is how late an occurrence may be processed before it counts as missed
+	misfireThreshold = time.Minute
+	// maxCatchUpOccurrences bounds the occurrences processed for a template in one pass
+	maxCatchUpOccurrences = 1000
+	// resyncInterval is how often the schedule is reconciled with the database
+	resyncInterval = time.Minute
+)
+
+var (
+	// ErrInvalidPattern is returned when a recurring pattern is rejected
+	ErrInvalidPattern = errors.New("invalid recurring pattern")
+	// ErrNotRecurring is returned when a recurring task operation targets a regular task
+	ErrNotRecurring = errors.New("task is not recurring")
+)
+
+// RecurringTaskService creates the instances of recurring task templates. Every
+// replica runs the scheduler; each occurrence carries a unique key in the database
+// so that it is created exactly once across the cluster.
 type RecurringTaskService struct {
-	db   *gorm.DB
-	cron *cron.Cron
+	db              *gorm.DB
+	cron            *cron.Cron
+	workflowService *WorkflowService
+	logger          *zap.Logger
+
+	// Cron entries of the scheduled recurring tasks by task ID, shared by the
+	// copies of the service for each workspace
+	entries   map[uint]scheduledTemplate
+	entriesMu *sync.Mutex
+}
+
+// scheduledTemplate is the cron entry of a template and the template version it was built from
+type scheduledTemplate struct {
+	entryID   cron.EntryID
+	updatedAt time.Time
 }
 
-func NewRecurringTaskService(db *gorm.DB) *RecurringTaskService {
+func NewRecurringTaskService(db *gorm.DB, workflowService *WorkflowService, logger *zap.Logger) *RecurringTaskService {
 	return &RecurringTaskService{
-		db:   db,
-		cron: cron.New(cron.WithSeconds()),
+		db:              db,
+		cron:            cron.New(cron.WithSeconds()),
+		workflowService: workflowService,
+		logger:          logger,
+		entries:         make(map[uint]scheduledTemplate),
+		entriesMu:       &sync.Mutex{},
 	}
 }
 
-// StartScheduler starts the recurring task scheduler
+// ForWorkspace returns a copy of the service limited to the recurring tasks of a
+// workspace. The copy shares the schedule of the service.
+func (s *RecurringTaskService) ForWorkspace(workspaceID uint) *RecurringTaskService {
+	scoped := *s
+	scoped.db = WorkspaceDB(s.db, workspaceID)
+	scoped.workflowService = s.workflowService.ForWorkspace(workspaceID)
+	return &scoped
+}
+
+// StartScheduler starts the recurring task scheduler. Occurrences missed while
+// no replica was running are handled right away according to their misfire policy.
 func (s *RecurringTaskService) StartScheduler() error {
+	// The scheduler serves the recurring tasks of every workspace
+	system := *s
+	system.db = SystemDB(s.db)
+	system.workflowService = &WorkflowService{db: SystemDB(s.workflowService.db)}
+	s = &system
+
 	// Start the cron scheduler
 	s.cron.Start()
 
-	// Load all recurring tasks from database
-	var tasks []models.Task
-	if err := s.db.Where("is_recurring = ?", true).Find(&tasks).Error; err != nil {
+	if err := s.resync(); err != nil {
+		return err
+	}
+
+	// Pick up templates changed through other replicas
+	s.cron.Schedule(cron.Every(resyncInterval), cron.FuncJob(func() {
+		if err := s.resync(); err != nil {
+			s.logger.Error("Failed to sync recurring tasks", zap.Error(err))
+		}
+	}))
+	return nil
+}
+
+// resync reconciles the cron entries with the recurring templates in the database
+// and processes any occurrences that are due
+func (s *RecurringTaskService) resync() error {
+	var templates []models.Task
+	if err := s.db.Where("is_recurring = ?", true).Find(&templates).Error; err != nil {
 		return fmt.Errorf("failed to load recurring tasks: %v", err)
 	}
 
-	// Schedule each task
-	for _, task := range tasks {
-		if err := s.scheduleTask(task); err != nil {
-			return fmt.Errorf("failed to schedule task %d: %v", task.ID, err)
+	active := make(map[uint]bool, len(templates))
+	for _, template := range templates {
+		active[template.ID] = true
+
+		s.entriesMu.Lock()
+		entry, scheduled := s.entries[template.ID]
+		s.entriesMu.Unlock()
+
+		if !scheduled || !entry.updatedAt.Equal(template.UpdatedAt) {
+			if err := s.scheduleTask(template); err != nil {
+				s.logger.Error("Failed to schedule recurring task", zap.Uint("task_id", template.ID), zap.Error(err))
+				continue
+			}
+		}
+		s.processDue(template)
+	}
+
+	s.entriesMu.Lock()
+	var removed []uint
+	for taskID := range s.entries {
+		if !active[taskID] {
+			removed = append(removed, taskID)
 		}
 	}
+	s.entriesMu.Unlock()
+	for _, taskID := range removed {
+		s.UnscheduleTask(taskID)
+	}
 
 	return nil
 }
 
-// scheduleTask adds a task to the cron scheduler
+// scheduleTask adds a task to the cron scheduler, replacing any entry it already has.
+// Paused tasks and tasks past their end date are only unscheduled.
 func (s *RecurringTaskService) scheduleTask(task models.Task) error {
-	var pattern models.RecurringPattern
-	if err := json.Unmarshal(task.RecurringConfig, &pattern); err != nil {
-		return fmt.Errorf("invalid recurring config: %v", err)
+	s.UnscheduleTask(task.ID)
+
+	pattern, err := parsePattern(task.RecurringConfig)
+	if err != nil {
+		return err
+	}
+	if task.RecurrencePaused || patternEnded(pattern, time.Now()) {
+		return nil
 	}
 
-	// Get cron expression based on pattern
-	cronExpr := s.getCronExpression(pattern)
+	schedule, err := patternSchedule(pattern)
+	if err != nil {
+		return err
+	}
 
-	// Add to cron scheduler
-	_, err := s.cron.AddFunc(cronExpr, func() {
-		s.executeRecurringTask(task)
-	})
+	taskID := task.ID
+	entryID := s.cron.Schedule(schedule, cron.FuncJob(func() {
+		s.executeRecurringTask(taskID)
+	}))
 
-	return err
+	s.entriesMu.Lock()
+	s.entries[taskID] = scheduledTemplate{entryID: entryID, updatedAt: task.UpdatedAt}
+	s.entriesMu.Unlock()
+	return nil
+}
+
+// UnscheduleTask removes the cron entry of a task, if it has one
+func (s *RecurringTaskService) UnscheduleTask(taskID uint) {
+	s.entriesMu.Lock()
+	defer s.entriesMu.Unlock()
+
+	if entry, ok := s.entries[taskID]; ok {
+		s.cron.Remove(entry.entryID)
+		delete(s.entries, taskID)
+	}
 }
 
-// getCronExpression converts RecurringPattern to cron expression
-func (s *RecurringTaskService) getCronExpression(pattern models.RecurringPattern) string {
-	switch pattern.Type {
-	case "daily":
-		return fmt.Sprintf("0 0 */%d * * *", pattern.Interval)
-	case "weekly":
-		weekdays := ""
-		for _, day := range pattern.Weekdays {
-			weekdays += fmt.Sprintf(",%d", day)
+// executeRecurringTask runs when the cron entry of a template fires. The template is
+// loaded at that point so that changes made since it was scheduled apply.
+func (s *RecurringTaskService) executeRecurringTask(taskID uint) {
+	var template models.Task
+	if err := s.db.First(&template, taskID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// The template was deleted, possibly through another replica
+			s.UnscheduleTask(taskID)
+			return
 		}
-		return fmt.Sprintf("0 0 * * %s", weekdays[1:])
-	case "monthly":
-		return fmt.Sprintf("0 0 1 */%d * *", pattern.Interval)
-	case "custom":
-		return pattern.CronExpr
-	default:
-		return "0 0 * * * *" // Default to daily
+		s.logger.Error("Failed to load recurring task", zap.Uint("task_id", taskID), zap.Error(err))
+		return
 	}
+	if !template.IsRecurring {
+		s.UnscheduleTask(taskID)
+		return
+	}
+
+	s.processDue(template)
 }
 
-// executeRecurringTask creates a new instance of the recurring task
-func (s *RecurringTaskService) executeRecurringTask(template models.Task) {
-	newTask := models.Task{
-		Name:         template.Name,
-		Description:  template.Description,
-		ScheduleTime: time.Now(),
-		Priority:     template.Priority,
-		Status:       "pending",
-		Tags:         template.Tags,
-		Metadata:     template.Metadata,
-		Assignee:     template.Assignee,
-		Labels:       template.Labels,
-	}
-
-	if err := s.db.Create(&newTask).Error; err != nil {
-		// Log error
+// processDue creates the instances for the occurrences of a template that are due
+// since its last processed occurrence, applying the misfire policy to missed ones
+func (s *RecurringTaskService) processDue(template models.Task) {
+	if template.RecurrencePaused {
 		return
 	}
 
-	// Create task dependencies if any
-	if len(template.DependentTasks) > 0 {
-		for _, depTask := range template.DependentTasks {
-			depTask.ParentTaskID = &newTask.ID
-			if err := s.db.Create(&depTask).Error; err != nil {
-				// Log error
-				continue
+	pattern, err := parsePattern(template.RecurringConfig)
+	if err != nil {
+		s.logger.Error("Invalid recurring config", zap.Uint("task_id", template.ID), zap.Error(err))
+		return
+	}
+	schedule, err := patternSchedule(pattern)
+	if err != nil {
+		s.logger.Error("Invalid recurring config", zap.Uint("task_id", template.ID), zap.Error(err))
+		return
+	}
+	endDate, _ := patternEndDate(pattern)
+
+	since := template.CreatedAt
+	if template.LastOccurrenceAt != nil {
+		since = *template.LastOccurrenceAt
+	}
+
+	now := time.Now()
+	var due []time.Time
+	for next := schedule.Next(since); !next.IsZero() && !next.After(now); next = schedule.Next(next) {
+		if !endDate.IsZero() && next.After(endDate) {
+			break
+		}
+		due = append(due, next)
+		if len(due) == maxCatchUpOccurrences {
+			break
+		}
+	}
+	if len(due) == 0 {
+		if patternEnded(pattern, now) {
+			s.UnscheduleTask(template.ID)
+		}
+		return
+	}
+
+	run := applyMisfirePolicy(pattern.MisfirePolicy, due, now)
+	if missed := len(due) - len(run); missed > 0 {
+		s.logger.Warn("Skipped missed occurrences of recurring task",
+			zap.Uint("task_id", template.ID), zap.Int("count", missed), zap.String("misfire_policy", pattern.MisfirePolicy))
+	}
+
+	// Instances are created in the workspace of the template and only see its calendars and workflows
+	scoped := s.ForWorkspace(template.WorkspaceID)
+	for _, occurrence := range run {
+		if err := scoped.createOccurrence(template, pattern, occurrence); err != nil {
+			s.logger.Error("Failed to create recurring task instance",
+				zap.Uint("task_id", template.ID), zap.Time("occurrence", occurrence), zap.Error(err))
+			return
+		}
+	}
+
+	// Only ever move forward, another replica may have processed later occurrences already
+	last := due[len(due)-1]
+	if err := s.db.Model(&models.Task{}).
+		Where("id = ? AND (last_occurrence_at IS NULL OR last_occurrence_at < ?)", template.ID, last).
+		UpdateColumn("last_occurrence_at", last).Error; err != nil {
+		s.logger.Error("Failed to record last occurrence", zap.Uint("task_id", template.ID), zap.Error(err))
+	}
+}
+
+// applyMisfirePolicy selects which due occurrences get an instance. Occurrences
+// within misfireThreshold of now are on time and always run.
+func applyMisfirePolicy(policy string, due []time.Time, now time.Time) []time.Time {
+	if len(due) == 0 {
+		return nil
+	}
+	switch policy {
+	case MisfireRunAll:
+		return due
+	case MisfireSkip:
+		var onTime []time.Time
+		for _, occurrence := range due {
+			if now.Sub(occurrence) <= misfireThreshold {
+				onTime = append(onTime, occurrence)
 			}
 		}
+		return onTime
+	default:
+		return due[len(due)-1:]
+	}
+}
+
+// occurrenceKey identifies an occurrence of a template across all replicas
+func occurrenceKey(templateID uint, occurrence time.Time) string {
+	return fmt.Sprintf("%d:%d", templateID, occurrence.Unix())
+}
+
+// occurrenceCalendar returns the calendar the instances of a template follow, if any
+func occurrenceCalendar(template models.Task, pattern models.RecurringPattern) *uint {
+	if pattern.CalendarID != 0 {
+		return &pattern.CalendarID
+	}
+	return template.CalendarID
+}
+
+// loadCalendar loads the calendar with the given ID, nil if there is none
+func (s *RecurringTaskService) loadCalendar(calendarID *uint) (*businessCalendar, error) {
+	if calendarID == nil {
+		return nil, nil
+	}
+	return loadBusinessCalendar(s.db, *calendarID)
+}
+
+// runTime returns when the instance for an occurrence runs: the occurrence itself,
+// or the next time after it that the calendar allows
+func runTime(calendar *businessCalendar, occurrence time.Time) (time.Time, error) {
+	if calendar == nil {
+		return occurrence, nil
+	}
+	return calendar.NextAllowed(occurrence)
+}
+
+// createOccurrence creates the instance of a template for one occurrence. An
+// occurrence that another replica already created is left alone.
+func (s *RecurringTaskService) createOccurrence(template models.Task, pattern models.RecurringPattern, occurrence time.Time) error {
+	key := occurrenceKey(template.ID, occurrence)
+	calendarID := occurrenceCalendar(template, pattern)
+
+	if pattern.WorkflowID != 0 {
+		_, err := s.workflowService.startRun(pattern.WorkflowID, pattern.WorkflowParameters, "schedule", key, calendarID,
+			template.CreatedBy, template.TeamID)
+		return err
+	}
+
+	calendar, err := s.loadCalendar(calendarID)
+	if err != nil {
+		return err
+	}
+	runAt, err := runTime(calendar, occurrence)
+	if err != nil {
+		return err
 	}
+
+	templateID := template.ID
+	newTask := models.Task{
+		Name:              template.Name,
+		Type:              template.Type,
+		Description:       template.Description,
+		ScheduleTime:      runAt,
+		Priority:          template.Priority,
+		Status:            "pending",
+		RetryPolicy:       template.RetryPolicy,
+		Timeout:           template.Timeout,
+		OnUpstreamFailure: template.OnUpstreamFailure,
+		Tags:              template.Tags,
+		Metadata:          template.Metadata,
+		Assignee:          template.Assignee,
+		CreatedBy:         template.CreatedBy,
+		TeamID:            template.TeamID,
+		EstimatedTime:     template.EstimatedTime,
+		Labels:            template.Labels,
+		CalendarID:        calendarID,
+		TemplateID:        &templateID,
+		OccurrenceKey:     &key,
+	}
+
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&newTask).Error
 }
 
 // StopScheduler stops the cron scheduler
@@ -119,8 +378,22 @@ func (s *RecurringTaskService) StopScheduler() {
 
 // CreateRecurringTask creates a new recurring task
 func (s *RecurringTaskService) CreateRecurringTask(task *models.Task, pattern models.RecurringPattern) error {
-	// Set recurring fields
+	pattern = normalizePattern(pattern, time.Now())
+	if err := validatePattern(pattern); err != nil {
+		return err
+	}
+	if err := s.validateWorkflowTrigger(pattern); err != nil {
+		return err
+	}
+	if err := s.validateCalendars(task, pattern); err != nil {
+		return err
+	}
+
+	// Set recurring fields, occurrences are counted from now on
+	now := time.Now()
 	task.IsRecurring = true
+	task.RecurrencePaused = false
+	task.LastOccurrenceAt = &now
 	configBytes, err := json.Marshal(pattern)
 	if err != nil {
 		return fmt.Errorf("failed to marshal recurring config: %v", err)
@@ -136,20 +409,199 @@ func (s *RecurringTaskService) CreateRecurringTask(task *models.Task, pattern mo
 	return s.scheduleTask(*task)
 }
 
-// UpdateRecurringTask updates an existing recurring task
+// UpdateRecurringTask updates an existing recurring task and replaces its schedule
 func (s *RecurringTaskService) UpdateRecurringTask(taskID uint, task *models.Task, pattern models.RecurringPattern) error {
+	pattern = normalizePattern(pattern, time.Now())
+	if err := validatePattern(pattern); err != nil {
+		return err
+	}
+	if err := s.validateWorkflowTrigger(pattern); err != nil {
+		return err
+	}
+	if err := s.validateCalendars(task, pattern); err != nil {
+		return err
+	}
+
+	existing, err := s.getRecurringTask(taskID)
+	if err != nil {
+		return err
+	}
+
 	// Update recurring config
 	configBytes, err := json.Marshal(pattern)
 	if err != nil {
 		return fmt.Errorf("failed to marshal recurring config: %v", err)
 	}
+	task.ID = existing.ID
+	task.WorkspaceID = existing.WorkspaceID
+	task.CreatedBy = existing.CreatedBy
+	task.IsRecurring = true
+	task.RecurrencePaused = existing.RecurrencePaused
 	task.RecurringConfig = configBytes
+	task.UpdatedAt = time.Now()
+
+	// The new pattern applies from now on, earlier occurrences of it do not count as missed
+	task.LastOccurrenceAt = &task.UpdatedAt
 
 	// Update in database
 	if err := s.db.Model(&models.Task{}).Where("id = ?", taskID).Updates(task).Error; err != nil {
 		return fmt.Errorf("failed to update recurring task: %v", err)
 	}
+	if err := s.db.First(task, taskID).Error; err != nil {
+		return err
+	}
 
 	// Reschedule the task
 	return s.scheduleTask(*task)
 }
+
+// PauseRecurringTask stops creating instances of a recurring task until it is resumed
+func (s *RecurringTaskService) PauseRecurringTask(taskID uint) (*models.Task, error) {
+	return s.setPaused(taskID, true)
+}
+
+// ResumeRecurringTask schedules a paused recurring task again. Occurrences that
+// fell within the pause are not made up.
+func (s *RecurringTaskService) ResumeRecurringTask(taskID uint) (*models.Task, error) {
+	return s.setPaused(taskID, false)
+}
+
+// setPaused updates the paused flag of a recurring task and reschedules it
+func (s *RecurringTaskService) setPaused(taskID uint, paused bool) (*models.Task, error) {
+	task, err := s.getRecurringTask(taskID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{
+		"recurrence_paused": paused,
+		"updated_at":        now,
+	}
+	if !paused {
+		updates["last_occurrence_at"] = now
+	}
+	if err := s.db.Model(task).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.First(task, taskID).Error; err != nil {
+		return nil, err
+	}
+
+	if err := s.scheduleTask(*task); err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+// getRecurringTask loads a task and checks that it is a recurring template
+func (s *RecurringTaskService) getRecurringTask(taskID uint) (*models.Task, error) {
+	var task models.Task
+	if err := s.db.First(&task, taskID).Error; err != nil {
+		return nil, err
+	}
+	if !task.IsRecurring {
+		return nil, ErrNotRecurring
+	}
+	return &task, nil
+}
+
+// validateWorkflowTrigger checks that the workflow of a pattern exists and accepts its parameters
+func (s *RecurringTaskService) validateWorkflowTrigger(pattern models.RecurringPattern) error {
+	if pattern.WorkflowID == 0 {
+		return nil
+	}
+
+	workflow, err := s.workflowService.GetWorkflow(pattern.WorkflowID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("%w: workflow %d not found", ErrInvalidPattern, pattern.WorkflowID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load workflow %d: %v", pattern.WorkflowID, err)
+	}
+	_, err = resolveParameters(workflow.Parameters, pattern.WorkflowParameters)
+	return err
+}
+
+// validateCalendars checks that the calendars of a template and its pattern exist
+func (s *RecurringTaskService) validateCalendars(task *models.Task, pattern models.RecurringPattern) error {
+	if pattern.CalendarID != 0 {
+		if err := checkCalendarExists(s.db, pattern.CalendarID); err != nil {
+			return err
+		}
+	}
+	if task.CalendarID != nil {
+		return checkCalendarExists(s.db, *task.CalendarID)
+	}
+	return nil
+}
+
+// Occurrences returns the occurrences of a recurring task between from and to, at
+// most limit of them, in the time zone of its pattern. Occurrences that the
+// calendar of the task does not allow are moved to the time they will run at.
+func (s *RecurringTaskService) Occurrences(taskID uint, from, to time.Time, limit int) ([]time.Time, error) {
+	task, err := s.getRecurringTask(taskID)
+	if err != nil {
+		return nil, err
+	}
+
+	planned, err := s.planOccurrences(*task, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	occurrences := make([]time.Time, len(planned))
+	for i, occurrence := range planned {
+		occurrences[i] = occurrence.runAt
+	}
+	return occurrences, nil
+}
+
+// plannedOccurrence is an occurrence of a recurring template and the time its
+// instance runs at, which differs when the calendar moved it
+type plannedOccurrence struct {
+	at         time.Time
+	runAt      time.Time
+	calendarID *uint
+}
+
+// planOccurrences expands the occurrences of a template between from and to, at
+// most limit of them, in the time zone of its pattern
+func (s *RecurringTaskService) planOccurrences(task models.Task, from, to time.Time, limit int) ([]plannedOccurrence, error) {
+	pattern, err := parsePattern(task.RecurringConfig)
+	if err != nil {
+		return nil, err
+	}
+	schedule, err := patternSchedule(pattern)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := patternLocation(pattern)
+	if err != nil {
+		return nil, err
+	}
+	endDate, _ := patternEndDate(pattern)
+	if !endDate.IsZero() && endDate.Before(to) {
+		to = endDate
+	}
+
+	calendarID := occurrenceCalendar(task, pattern)
+	calendar, err := s.loadCalendar(calendarID)
+	if err != nil {
+		return nil, err
+	}
+
+	planned := []plannedOccurrence{}
+	// Next returns occurrences strictly after its argument, so start just before from
+	for next := schedule.Next(from.Add(-time.Nanosecond)); !next.IsZero() && !next.After(to); next = schedule.Next(next) {
+		runAt, err := runTime(calendar, next)
+		if err != nil {
+			return nil, err
+		}
+		planned = append(planned, plannedOccurrence{at: next.In(loc), runAt: runAt.In(loc), calendarID: calendarID})
+		if len(planned) == limit {
+			break
+		}
+	}
+	return planned, nil
+}
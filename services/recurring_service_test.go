@@ -0,0 +1,52 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApplyMisfirePolicy(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	hoursAgo := func(hours ...int) []time.Time {
+		var times []time.Time
+		for _, h := range hours {
+			times = append(times, now.Add(-time.Duration(h)*time.Hour))
+		}
+		return times
+	}
+	onTime := now.Add(-misfireThreshold / 2)
+	late := now.Add(-2 * misfireThreshold)
+
+	tests := []struct {
+		name   string
+		policy string
+		due    []time.Time
+		want   []time.Time
+	}{
+		{"skip drops missed occurrences", MisfireSkip, append(hoursAgo(3, 2, 1), onTime), []time.Time{onTime}},
+		{"skip drops an occurrence just past the threshold", MisfireSkip, []time.Time{late}, nil},
+		{"skip runs everything on time", MisfireSkip, []time.Time{onTime, now}, []time.Time{onTime, now}},
+		{"skip with every occurrence missed", MisfireSkip, hoursAgo(3, 2, 1), nil},
+		{"run once keeps the latest occurrence", MisfireRunOnce, hoursAgo(3, 2, 1), hoursAgo(1)},
+		{"run once with one occurrence", MisfireRunOnce, []time.Time{onTime}, []time.Time{onTime}},
+		{"run once is the default", "", hoursAgo(3, 2, 1), hoursAgo(1)},
+		{"run all keeps every occurrence", MisfireRunAll, hoursAgo(3, 2, 1), hoursAgo(3, 2, 1)},
+		{"skip with nothing due", MisfireSkip, nil, nil},
+		{"run once with nothing due", MisfireRunOnce, nil, nil},
+		{"run all with nothing due", MisfireRunAll, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := applyMisfirePolicy(tt.policy, tt.due, now)
+			if len(got) != len(tt.want) {
+				t.Fatalf("applyMisfirePolicy(%q) = %v, want %v", tt.policy, got, tt.want)
+			}
+			for i := range got {
+				if !got[i].Equal(tt.want[i]) {
+					t.Fatalf("applyMisfirePolicy(%q) = %v, want %v", tt.policy, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/task-schedulart/models"
+)
+
+// Error classes used by retry policies to decide whether a failure is retried
+const (
+	ErrorClassError        = "error"         // Any error that was not classified by the handler
+	ErrorClassTransient    = "transient"     // Temporary failures such as network errors
+	ErrorClassPermanent    = "permanent"     // Failures that will not go away on retry
+	ErrorClassTimeout      = "timeout"       // The handler ran past its deadline
+	ErrorClassPanic        = "panic"         // The handler panicked
+	ErrorClassUnknownType  = "unknown_type"  // No handler is registered for the task type
+	ErrorClassLeaseExpired = "lease_expired" // The worker stopped renewing its lease, for example because it crashed
+)
+
+var errorClasses = map[string]bool{
+	ErrorClassError:        true,
+	ErrorClassTransient:    true,
+	ErrorClassPermanent:    true,
+	ErrorClassTimeout:      true,
+	ErrorClassPanic:        true,
+	ErrorClassUnknownType:  true,
+	ErrorClassLeaseExpired: true,
+}
+
+// TaskError attaches an error class to an error returned by a handler
+type TaskError struct {
+	Class string
+	Err   error
+}
+
+func (e *TaskError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TaskError) Unwrap() error {
+	return e.Err
+}
+
+// NewTaskError wraps err with the given error class
+func NewTaskError(class string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &TaskError{Class: class, Err: err}
+}
+
+// Permanent marks a handler error as not worth retrying
+func Permanent(err error) error {
+	return NewTaskError(ErrorClassPermanent, err)
+}
+
+// Transient marks a handler error as temporary
+func Transient(err error) error {
+	return NewTaskError(ErrorClassTransient, err)
+}
+
+// ErrorClass returns the class of an error returned by a handler
+func ErrorClass(err error) string {
+	var taskErr *TaskError
+	if errors.As(err, &taskErr) {
+		return taskErr.Class
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassTimeout
+	}
+	return ErrorClassError
+}
+
+// DefaultRetryPolicy is applied to tasks without their own policy. It keeps the
+// previous behaviour of allowing three retries after the first run.
+func DefaultRetryPolicy() models.RetryPolicy {
+	return models.RetryPolicy{
+		MaxAttempts:  4,
+		InitialDelay: 30,
+		Multiplier:   2,
+		MaxDelay:     3600,
+		Jitter:       0.1,
+	}
+}
+
+// ValidateRetryPolicy checks the values of a user supplied retry policy
+func ValidateRetryPolicy(policy *models.RetryPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	if policy.MaxAttempts < 0 {
+		return errors.New("retryPolicy.maxAttempts must not be negative")
+	}
+	if policy.InitialDelay < 0 || policy.MaxDelay < 0 {
+		return errors.New("retryPolicy delays must not be negative")
+	}
+	if policy.MaxDelay > 0 && policy.InitialDelay > policy.MaxDelay {
+		return errors.New("retryPolicy.initialDelay must not exceed retryPolicy.maxDelay")
+	}
+	if policy.Multiplier != 0 && policy.Multiplier < 1 {
+		return errors.New("retryPolicy.multiplier must be at least 1")
+	}
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		return errors.New("retryPolicy.jitter must be between 0 and 1")
+	}
+	for _, class := range policy.RetryableErrors {
+		if !errorClasses[class] {
+			return fmt.Errorf("retryPolicy.retryableErrors contains unknown error class %q", class)
+		}
+	}
+	return nil
+}
+
+// effectiveRetryPolicy fills the unset fields of a task policy with the defaults
+func effectiveRetryPolicy(policy *models.RetryPolicy) models.RetryPolicy {
+	result := DefaultRetryPolicy()
+	if policy == nil {
+		return result
+	}
+
+	if policy.MaxAttempts > 0 {
+		result.MaxAttempts = policy.MaxAttempts
+	}
+	if policy.InitialDelay > 0 {
+		result.InitialDelay = policy.InitialDelay
+	}
+	if policy.Multiplier > 0 {
+		result.Multiplier = policy.Multiplier
+	}
+	if policy.MaxDelay > 0 {
+		result.MaxDelay = policy.MaxDelay
+	}
+	result.Jitter = policy.Jitter
+	result.RetryableErrors = policy.RetryableErrors
+	return result
+}
+
+// isRetryable reports whether the policy retries errors of the given class
+func isRetryable(policy models.RetryPolicy, class string) bool {
+	if len(policy.RetryableErrors) == 0 {
+		return class != ErrorClassPermanent && class != ErrorClassUnknownType
+	}
+	for _, retryable := range policy.RetryableErrors {
+		if retryable == class {
+			return true
+		}
+	}
+	return false
+}
+
+// ShouldRetry reports whether a task that failed with err after retryCount
+// previous retries gets another attempt
+func ShouldRetry(task *models.Task, err error) bool {
+	policy := effectiveRetryPolicy(task.RetryPolicy)
+	if task.RetryCount+1 >= policy.MaxAttempts {
+		return false
+	}
+	return isRetryable(policy, ErrorClass(err))
+}
+
+// RetryDelay returns how long to wait before the next attempt of a task,
+// using exponential backoff capped at the policy maximum plus random jitter
+func RetryDelay(task *models.Task) time.Duration {
+	policy := effectiveRetryPolicy(task.RetryPolicy)
+
+	delay := float64(policy.InitialDelay) * math.Pow(policy.Multiplier, float64(task.RetryCount))
+	if delay > float64(policy.MaxDelay) {
+		delay = float64(policy.MaxDelay)
+	}
+	if policy.Jitter > 0 {
+		delay += delay * policy.Jitter * (2*rand.Float64() - 1)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+
+	return time.Duration(delay * float64(time.Second))
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/task-schedulart/models"
+)
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"plain error", errors.New("boom"), ErrorClassError},
+		{"transient", Transient(errors.New("connection reset")), ErrorClassTransient},
+		{"permanent", Permanent(errors.New("bad payload")), ErrorClassPermanent},
+		{"wrapped task error", fmt.Errorf("step 2: %w", Permanent(errors.New("bad payload"))), ErrorClassPermanent},
+		{"deadline exceeded", fmt.Errorf("query: %w", context.DeadlineExceeded), ErrorClassTimeout},
+		{"lease expired", errLeaseExpired, ErrorClassLeaseExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ErrorClass(tt.err); got != tt.want {
+				t.Errorf("ErrorClass() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	transient := Transient(errors.New("connection reset"))
+
+	tests := []struct {
+		name       string
+		policy     *models.RetryPolicy
+		retryCount int
+		err        error
+		want       bool
+	}{
+		{"default policy first failure", nil, 0, errors.New("boom"), true},
+		{"default policy last retry", nil, 2, errors.New("boom"), true},
+		{"default policy exhausted", nil, 3, errors.New("boom"), false},
+		{"default policy permanent", nil, 0, Permanent(errors.New("bad payload")), false},
+		{"default policy unknown type", nil, 0, NewTaskError(ErrorClassUnknownType, errors.New("no handler")), false},
+		{"default policy timeout", nil, 0, NewTaskError(ErrorClassTimeout, errors.New("too slow")), true},
+		{"default policy lease expired", nil, 0, errLeaseExpired, true},
+		{"default policy lease expired exhausted", nil, 3, errLeaseExpired, false},
+		{"single attempt", &models.RetryPolicy{MaxAttempts: 1}, 0, transient, false},
+		{"custom max attempts", &models.RetryPolicy{MaxAttempts: 6}, 4, transient, true},
+		{"custom max attempts exhausted", &models.RetryPolicy{MaxAttempts: 6}, 5, transient, false},
+		{"listed class", &models.RetryPolicy{RetryableErrors: []string{ErrorClassTransient}}, 0, transient, true},
+		{"unlisted class", &models.RetryPolicy{RetryableErrors: []string{ErrorClassTransient}}, 0, errors.New("boom"), false},
+		{"listed permanent class", &models.RetryPolicy{RetryableErrors: []string{ErrorClassPermanent}}, 0, Permanent(errors.New("bad payload")), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := &models.Task{RetryPolicy: tt.policy, RetryCount: tt.retryCount}
+			if got := ShouldRetry(task, tt.err); got != tt.want {
+				t.Errorf("ShouldRetry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     *models.RetryPolicy
+		retryCount int
+		min, max   time.Duration
+	}{
+		{"default first retry", &models.RetryPolicy{InitialDelay: 30, Multiplier: 2, MaxDelay: 3600}, 0, 30 * time.Second, 30 * time.Second},
+		{"exponential growth", &models.RetryPolicy{InitialDelay: 10, Multiplier: 3, MaxDelay: 3600}, 2, 90 * time.Second, 90 * time.Second},
+		{"capped at max delay", &models.RetryPolicy{InitialDelay: 30, Multiplier: 2, MaxDelay: 100}, 5, 100 * time.Second, 100 * time.Second},
+		{"cap before jitter", &models.RetryPolicy{InitialDelay: 30, Multiplier: 2, MaxDelay: 100, Jitter: 0.5}, 10, 50 * time.Second, 150 * time.Second},
+		{"jitter spread", &models.RetryPolicy{InitialDelay: 60, Multiplier: 1, MaxDelay: 3600, Jitter: 0.25}, 3, 45 * time.Second, 75 * time.Second},
+		{"full jitter", &models.RetryPolicy{InitialDelay: 10, Multiplier: 2, MaxDelay: 3600, Jitter: 1}, 1, 0, 40 * time.Second},
+		{"unset fields use defaults", &models.RetryPolicy{}, 1, 60 * time.Second, 60 * time.Second},
+		{"no policy uses default jitter", nil, 0, 27 * time.Second, 33 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := &models.Task{RetryPolicy: tt.policy, RetryCount: tt.retryCount}
+			// Jitter is random, so sample enough delays to notice values out of range
+			for i := 0; i < 200; i++ {
+				got := RetryDelay(task)
+				if got < tt.min || got > tt.max {
+					t.Fatalf("RetryDelay() = %v, want between %v and %v", got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  *models.RetryPolicy
+		wantErr bool
+	}{
+		{"no policy", nil, false},
+		{"empty policy", &models.RetryPolicy{}, false},
+		{"full policy", &models.RetryPolicy{MaxAttempts: 5, InitialDelay: 10, Multiplier: 2, MaxDelay: 600, Jitter: 0.2,
+			RetryableErrors: []string{ErrorClassTransient, ErrorClassTimeout, ErrorClassLeaseExpired}}, false},
+		{"negative attempts", &models.RetryPolicy{MaxAttempts: -1}, true},
+		{"negative delay", &models.RetryPolicy{InitialDelay: -5}, true},
+		{"initial delay above max", &models.RetryPolicy{InitialDelay: 600, MaxDelay: 60}, true},
+		{"shrinking multiplier", &models.RetryPolicy{Multiplier: 0.5}, true},
+		{"jitter above one", &models.RetryPolicy{Jitter: 1.5}, true},
+		{"unknown error class", &models.RetryPolicy{RetryableErrors: []string{"flaky"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateRetryPolicy(tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateRetryPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,493 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxEmptyPeriods bounds how many consecutive periods without an occurrence are
+// examined before a rule is considered exhausted, e.g. for BYMONTHDAY=30;BYMONTH=2
+const maxEmptyPeriods = 2000
+
+var rruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// rruleDay is a BYDAY entry such as MO, 2TU or -1FR
+type rruleDay struct {
+	weekday time.Weekday
+	ordinal int // 0 matches every such weekday in the period
+}
+
+// rruleSchedule evaluates an RFC 5545 recurrence rule together with its EXDATE and
+// RDATE lists. It supports FREQ=DAILY, WEEKLY, MONTHLY and YEARLY with INTERVAL,
+// COUNT, UNTIL, WKST, BYMONTH, BYMONTHDAY, BYDAY, BYHOUR, BYMINUTE, BYSECOND and BYSETPOS.
+type rruleSchedule struct {
+	loc     *time.Location
+	dtstart time.Time
+
+	freq     string
+	interval int
+	count    int
+	until    time.Time
+	wkst     time.Weekday
+
+	byMonth    []int
+	byMonthDay []int
+	byDay      []rruleDay
+	byHour     []int
+	byMinute   []int
+	bySecond   []int
+	bySetPos   []int
+
+	exdates map[int64]bool
+	exdays  map[string]bool // Dates excluded as a whole, as YYYY-MM-DD
+	rdates  []time.Time
+}
+
+// parseRRule parses a recurrence rule that starts at dtstart in loc
+func parseRRule(rule string, dtstart time.Time, loc *time.Location, exdates, rdates []string) (*rruleSchedule, error) {
+	rule = strings.TrimSpace(rule)
+	rule = strings.TrimPrefix(rule, "RRULE:")
+	if rule == "" {
+		return nil, fmt.Errorf("%w: rrule is required for rrule patterns", ErrInvalidPattern)
+	}
+
+	s := &rruleSchedule{
+		loc:      loc,
+		dtstart:  dtstart,
+		interval: 1,
+		wkst:     time.Monday,
+		exdates:  make(map[int64]bool),
+		exdays:   make(map[string]bool),
+	}
+
+	for _, part := range strings.Split(rule, ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("%w: malformed rrule part %q", ErrInvalidPattern, part)
+		}
+
+		var err error
+		switch strings.ToUpper(name) {
+		case "FREQ":
+			s.freq = strings.ToUpper(value)
+			switch s.freq {
+			case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+			default:
+				return nil, fmt.Errorf("%w: FREQ must be DAILY, WEEKLY, MONTHLY or YEARLY", ErrInvalidPattern)
+			}
+		case "INTERVAL":
+			s.interval, err = strconv.Atoi(value)
+			if err != nil || s.interval < 1 || s.interval > maxPatternInterval {
+				return nil, fmt.Errorf("%w: INTERVAL must be between 1 and %d", ErrInvalidPattern, maxPatternInterval)
+			}
+		case "COUNT":
+			s.count, err = strconv.Atoi(value)
+			if err != nil || s.count < 1 {
+				return nil, fmt.Errorf("%w: COUNT must be a positive number", ErrInvalidPattern)
+			}
+		case "UNTIL":
+			s.until, err = parseICalTime(value, loc, true)
+			if err != nil {
+				return nil, fmt.Errorf("%w: UNTIL %v", ErrInvalidPattern, err)
+			}
+		case "WKST":
+			weekday, ok := rruleWeekdays[strings.ToUpper(value)]
+			if !ok {
+				return nil, fmt.Errorf("%w: WKST must be a weekday such as MO", ErrInvalidPattern)
+			}
+			s.wkst = weekday
+		case "BYMONTH":
+			s.byMonth, err = parseRRuleInts("BYMONTH", value, 1, 12, false)
+		case "BYMONTHDAY":
+			s.byMonthDay, err = parseRRuleInts("BYMONTHDAY", value, 1, 31, true)
+		case "BYHOUR":
+			s.byHour, err = parseRRuleInts("BYHOUR", value, 0, 23, false)
+		case "BYMINUTE":
+			s.byMinute, err = parseRRuleInts("BYMINUTE", value, 0, 59, false)
+		case "BYSECOND":
+			s.bySecond, err = parseRRuleInts("BYSECOND", value, 0, 59, false)
+		case "BYSETPOS":
+			s.bySetPos, err = parseRRuleInts("BYSETPOS", value, 1, 366, true)
+		case "BYDAY":
+			s.byDay, err = parseRRuleDays(value)
+		default:
+			return nil, fmt.Errorf("%w: unsupported rrule part %s", ErrInvalidPattern, name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.freq == "" {
+		return nil, fmt.Errorf("%w: rrule needs a FREQ", ErrInvalidPattern)
+	}
+	if s.count > 0 && !s.until.IsZero() {
+		return nil, fmt.Errorf("%w: rrule must not contain both COUNT and UNTIL", ErrInvalidPattern)
+	}
+	for _, day := range s.byDay {
+		if day.ordinal != 0 && s.freq != "MONTHLY" && s.freq != "YEARLY" {
+			return nil, fmt.Errorf("%w: BYDAY ordinals such as 2TU need FREQ=MONTHLY or FREQ=YEARLY", ErrInvalidPattern)
+		}
+	}
+
+	for _, value := range exdates {
+		if day, err := time.ParseInLocation("20060102", value, loc); err == nil {
+			s.exdays[day.Format("2006-01-02")] = true
+			continue
+		}
+		if day, err := time.ParseInLocation("2006-01-02", value, loc); err == nil {
+			s.exdays[day.Format("2006-01-02")] = true
+			continue
+		}
+		at, err := parseICalTime(value, loc, false)
+		if err != nil {
+			return nil, fmt.Errorf("%w: EXDATE %v", ErrInvalidPattern, err)
+		}
+		s.exdates[at.Unix()] = true
+	}
+	for _, value := range rdates {
+		at, err := parseICalTime(value, loc, false)
+		if err != nil {
+			return nil, fmt.Errorf("%w: RDATE %v", ErrInvalidPattern, err)
+		}
+		s.rdates = append(s.rdates, at)
+	}
+	sort.Slice(s.rdates, func(i, j int) bool { return s.rdates[i].Before(s.rdates[j]) })
+
+	return s, nil
+}
+
+// parseRRuleInts parses a comma separated list of numbers between min and max,
+// or between -max and -min as well when negative values are allowed
+func parseRRuleInts(name, value string, min, max int, negative bool) ([]int, error) {
+	var result []int
+	for _, item := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(item)
+		abs := n
+		if abs < 0 && negative {
+			abs = -abs
+		}
+		if err != nil || abs < min || abs > max {
+			return nil, fmt.Errorf("%w: invalid %s value %q", ErrInvalidPattern, name, item)
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
+
+// parseRRuleDays parses a BYDAY list such as MO,WE or 2TU,-1FR
+func parseRRuleDays(value string) ([]rruleDay, error) {
+	var result []rruleDay
+	for _, item := range strings.Split(strings.ToUpper(value), ",") {
+		if len(item) < 2 {
+			return nil, fmt.Errorf("%w: invalid BYDAY value %q", ErrInvalidPattern, item)
+		}
+		weekday, ok := rruleWeekdays[item[len(item)-2:]]
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid BYDAY value %q", ErrInvalidPattern, item)
+		}
+
+		day := rruleDay{weekday: weekday}
+		if prefix := item[:len(item)-2]; prefix != "" {
+			ordinal, err := strconv.Atoi(prefix)
+			if err != nil || ordinal == 0 || ordinal < -53 || ordinal > 53 {
+				return nil, fmt.Errorf("%w: invalid BYDAY value %q", ErrInvalidPattern, item)
+			}
+			day.ordinal = ordinal
+		}
+		result = append(result, day)
+	}
+	return result, nil
+}
+
+// parseICalTime parses an iCalendar date-time (20240102T150405Z or a floating
+// 20240102T150405 in loc), a date (20240102) or an RFC 3339 timestamp. A date
+// means the start of the day, or its end when endOfDay is set.
+func parseICalTime(value string, loc *time.Location, endOfDay bool) (time.Time, error) {
+	if at, err := time.Parse("20060102T150405Z", value); err == nil {
+		return at, nil
+	}
+	if at, err := time.ParseInLocation("20060102T150405", value, loc); err == nil {
+		return at, nil
+	}
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		return at, nil
+	}
+	if day, err := time.ParseInLocation("20060102", value, loc); err == nil {
+		if endOfDay {
+			return day.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+		}
+		return day, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date or date-time", value)
+}
+
+// Next returns the first occurrence after t, or the zero time if there is none
+func (s *rruleSchedule) Next(t time.Time) time.Time {
+	next := s.nextRuleOccurrence(t)
+	for _, rdate := range s.rdates {
+		if rdate.After(t) && !s.excluded(rdate) {
+			if next.IsZero() || rdate.Before(next) {
+				next = rdate
+			}
+			break
+		}
+	}
+	return next
+}
+
+// excluded reports whether an occurrence is removed by EXDATE
+func (s *rruleSchedule) excluded(at time.Time) bool {
+	return s.exdates[at.Unix()] || s.exdays[at.In(s.loc).Format("2006-01-02")]
+}
+
+// nextRuleOccurrence returns the first occurrence generated by the rule after t
+func (s *rruleSchedule) nextRuleOccurrence(t time.Time) time.Time {
+	period := 0
+	if s.count == 0 {
+		// Without COUNT earlier periods do not matter, so start close to t
+		period = s.periodIndex(t) - 1
+		if period < 0 {
+			period = 0
+		}
+	}
+
+	generated := 0
+	for empty := 0; empty < maxEmptyPeriods; period++ {
+		occurrences := s.expandPeriod(period)
+		if len(occurrences) == 0 {
+			empty++
+			continue
+		}
+		empty = 0
+
+		for _, at := range occurrences {
+			if !s.until.IsZero() && at.After(s.until) {
+				return time.Time{}
+			}
+			generated++
+			if s.count > 0 && generated > s.count {
+				return time.Time{}
+			}
+			if at.After(t) && !s.excluded(at) {
+				return at
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// periodStart returns the first day of a period as a UTC date
+func (s *rruleSchedule) periodStart(period int) time.Time {
+	local := s.dtstart.In(s.loc)
+	start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+	steps := period * s.interval
+
+	switch s.freq {
+	case "DAILY":
+		return start.AddDate(0, 0, steps)
+	case "WEEKLY":
+		offset := (int(start.Weekday()) - int(s.wkst) + 7) % 7
+		return start.AddDate(0, 0, 7*steps-offset)
+	case "MONTHLY":
+		return time.Date(start.Year(), start.Month()+time.Month(steps), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(start.Year()+steps, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// periodIndex returns the index of the period that contains t
+func (s *rruleSchedule) periodIndex(t time.Time) int {
+	local := t.In(s.loc)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+	first := s.periodStart(0)
+
+	var units int
+	switch s.freq {
+	case "DAILY":
+		units = daysBetween(first, day)
+	case "WEEKLY":
+		units = daysBetween(first, day) / 7
+	case "MONTHLY":
+		units = (day.Year()-first.Year())*12 + int(day.Month()) - int(first.Month())
+	default:
+		units = day.Year() - first.Year()
+	}
+	return units / s.interval
+}
+
+// expandPeriod returns the occurrences of a period in chronological order
+func (s *rruleSchedule) expandPeriod(period int) []time.Time {
+	start := s.periodStart(period)
+	var end time.Time
+	switch s.freq {
+	case "DAILY":
+		end = start.AddDate(0, 0, 1)
+	case "WEEKLY":
+		end = start.AddDate(0, 0, 7)
+	case "MONTHLY":
+		end = start.AddDate(0, 1, 0)
+	default:
+		end = start.AddDate(1, 0, 0)
+	}
+
+	local := s.dtstart.In(s.loc)
+	hours := s.byHour
+	if len(hours) == 0 {
+		hours = []int{local.Hour()}
+	}
+	minutes := s.byMinute
+	if len(minutes) == 0 {
+		minutes = []int{local.Minute()}
+	}
+	seconds := s.bySecond
+	if len(seconds) == 0 {
+		seconds = []int{local.Second()}
+	}
+
+	var candidates []time.Time
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		if !s.matchesDay(day) {
+			continue
+		}
+		for _, hour := range hours {
+			for _, minute := range minutes {
+				for _, second := range seconds {
+					candidates = append(candidates, wallClock(day, hour, minute, second, s.loc))
+				}
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+
+	if len(s.bySetPos) > 0 {
+		var selected []time.Time
+		for _, pos := range s.bySetPos {
+			index := pos - 1
+			if pos < 0 {
+				index = len(candidates) + pos
+			}
+			if index >= 0 && index < len(candidates) {
+				selected = append(selected, candidates[index])
+			}
+		}
+		sort.Slice(selected, func(i, j int) bool { return selected[i].Before(selected[j]) })
+		candidates = selected
+	}
+
+	// Occurrences before DTSTART do not exist
+	result := candidates[:0]
+	for _, at := range candidates {
+		if !at.Before(s.dtstart) {
+			result = append(result, at)
+		}
+	}
+	return result
+}
+
+// matchesDay reports whether the BY rules select a day. Rules that are not given
+// default to the matching part of DTSTART as RFC 5545 describes.
+func (s *rruleSchedule) matchesDay(day time.Time) bool {
+	local := s.dtstart.In(s.loc)
+
+	if len(s.byMonth) > 0 && !containsInt(s.byMonth, int(day.Month())) {
+		return false
+	}
+	if s.freq == "YEARLY" && len(s.byMonth) == 0 && len(s.byMonthDay) == 0 && len(s.byDay) == 0 &&
+		day.Month() != local.Month() {
+		return false
+	}
+
+	if len(s.byMonthDay) > 0 {
+		lastDay := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+		matched := false
+		for _, monthDay := range s.byMonthDay {
+			if monthDay == day.Day() || (monthDay < 0 && lastDay+monthDay+1 == day.Day()) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(s.byDay) > 0 {
+		return s.matchesByDay(day)
+	}
+
+	if len(s.byMonthDay) > 0 {
+		return true
+	}
+	switch s.freq {
+	case "WEEKLY":
+		return day.Weekday() == local.Weekday()
+	case "MONTHLY", "YEARLY":
+		return day.Day() == local.Day()
+	}
+	return true
+}
+
+// matchesByDay checks a day against BYDAY. Ordinals count within the month for
+// monthly rules and yearly rules with BYMONTH, and within the year otherwise.
+func (s *rruleSchedule) matchesByDay(day time.Time) bool {
+	for _, entry := range s.byDay {
+		if entry.weekday != day.Weekday() {
+			continue
+		}
+		if entry.ordinal == 0 {
+			return true
+		}
+
+		var first, last time.Time
+		if s.freq == "MONTHLY" || len(s.byMonth) > 0 {
+			first = time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+			last = first.AddDate(0, 1, -1)
+		} else {
+			first = time.Date(day.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+			last = first.AddDate(1, 0, -1)
+		}
+
+		if entry.ordinal > 0 && daysBetween(first, day)/7+1 == entry.ordinal {
+			return true
+		}
+		if entry.ordinal < 0 && -(daysBetween(day, last)/7+1) == entry.ordinal {
+			return true
+		}
+	}
+	return false
+}
+
+// wallClock returns the given local time on a day. A time that does not exist
+// because it falls into a DST gap is moved forward by the length of the gap.
+func wallClock(day time.Time, hour, minute, second int, loc *time.Location) time.Time {
+	at := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, second, 0, loc)
+	if at.Hour() == hour && at.Minute() == minute {
+		return at
+	}
+
+	// Interpret the wall clock time with the offset in effect before the gap
+	_, offset := at.Add(-24 * time.Hour).Zone()
+	return time.Date(day.Year(), day.Month(), day.Day(), hour, minute, second, 0, time.FixedZone("", offset)).In(loc)
+}
+
+// containsInt reports whether values contains value
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// occurrences returns up to limit occurrences of a schedule, starting with the
+// first one at or after from
+func occurrences(s *rruleSchedule, from time.Time, limit int) []string {
+	var result []string
+	at := from.Add(-time.Nanosecond)
+	for len(result) < limit {
+		at = s.Next(at)
+		if at.IsZero() {
+			break
+		}
+		result = append(result, at.In(s.loc).Format(time.RFC3339))
+	}
+	return result
+}
+
+func TestRRuleExpansion(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     string
+		location string
+		dtstart  string // Wall clock time in location
+		exdates  []string
+		rdates   []string
+		want     []string // Every occurrence when fewer than 10, else the first 10
+	}{
+		{
+			name: "daily count", rule: "FREQ=DAILY;COUNT=3", location: "UTC", dtstart: "2024-01-01 09:00",
+			want: []string{"2024-01-01T09:00:00Z", "2024-01-02T09:00:00Z", "2024-01-03T09:00:00Z"},
+		},
+		{
+			name: "weekly until a date includes that day", rule: "FREQ=WEEKLY;BYDAY=MO,WE,FR;UNTIL=20240110", location: "UTC", dtstart: "2024-01-01 09:00",
+			want: []string{"2024-01-01T09:00:00Z", "2024-01-03T09:00:00Z", "2024-01-05T09:00:00Z", "2024-01-08T09:00:00Z", "2024-01-10T09:00:00Z"},
+		},
+		{
+			name: "until in UTC is inclusive", rule: "FREQ=DAILY;UNTIL=20240103T140000Z", location: "America/New_York", dtstart: "2024-01-01 09:00",
+			want: []string{"2024-01-01T09:00:00-05:00", "2024-01-02T09:00:00-05:00", "2024-01-03T09:00:00-05:00"},
+		},
+		{
+			name: "interval", rule: "FREQ=WEEKLY;INTERVAL=2;COUNT=3", location: "UTC", dtstart: "2024-01-01 09:00",
+			want: []string{"2024-01-01T09:00:00Z", "2024-01-15T09:00:00Z", "2024-01-29T09:00:00Z"},
+		},
+		{
+			name: "last weekday of the month", rule: "FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1;COUNT=3", location: "UTC", dtstart: "2024-01-01 09:00",
+			want: []string{"2024-01-31T09:00:00Z", "2024-02-29T09:00:00Z", "2024-03-29T09:00:00Z"},
+		},
+		{
+			name: "first and last monday", rule: "FREQ=MONTHLY;BYDAY=MO;BYSETPOS=1,-1;COUNT=4", location: "UTC", dtstart: "2024-01-01 09:00",
+			want: []string{"2024-01-01T09:00:00Z", "2024-01-29T09:00:00Z", "2024-02-05T09:00:00Z", "2024-02-26T09:00:00Z"},
+		},
+		{
+			name: "set position among hours", rule: "FREQ=DAILY;BYHOUR=9,12,17;BYMINUTE=0;BYSETPOS=2;COUNT=2", location: "UTC", dtstart: "2024-01-01 08:00",
+			want: []string{"2024-01-01T12:00:00Z", "2024-01-02T12:00:00Z"},
+		},
+		{
+			name: "set position before dtstart is dropped", rule: "FREQ=MONTHLY;BYDAY=FR;BYSETPOS=1;COUNT=2", location: "UTC", dtstart: "2024-01-10 09:00",
+			want: []string{"2024-02-02T09:00:00Z", "2024-03-01T09:00:00Z"},
+		},
+		{
+			name: "ordinal weekday", rule: "FREQ=MONTHLY;BYDAY=2TU;COUNT=2", location: "UTC", dtstart: "2024-01-01 09:00",
+			want: []string{"2024-01-09T09:00:00Z", "2024-02-13T09:00:00Z"},
+		},
+		{
+			name: "month day skips short months", rule: "FREQ=MONTHLY;BYMONTHDAY=31;COUNT=3", location: "UTC", dtstart: "2024-01-31 09:00",
+			want: []string{"2024-01-31T09:00:00Z", "2024-03-31T09:00:00Z", "2024-05-31T09:00:00Z"},
+		},
+		{
+			name: "leap day", rule: "FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=29;COUNT=2", location: "UTC", dtstart: "2024-02-29 09:00",
+			want: []string{"2024-02-29T09:00:00Z", "2028-02-29T09:00:00Z"},
+		},
+		{
+			name: "excluded occurrences count towards COUNT", rule: "FREQ=DAILY;COUNT=4", location: "UTC", dtstart: "2024-01-01 09:00",
+			exdates: []string{"20240102T090000"},
+			want:    []string{"2024-01-01T09:00:00Z", "2024-01-03T09:00:00Z", "2024-01-04T09:00:00Z"},
+		},
+		{
+			name: "excluded date", rule: "FREQ=DAILY;BYHOUR=9,17;BYMINUTE=0;COUNT=6", location: "UTC", dtstart: "2024-01-01 09:00",
+			exdates: []string{"2024-01-02"},
+			want:    []string{"2024-01-01T09:00:00Z", "2024-01-01T17:00:00Z", "2024-01-03T09:00:00Z", "2024-01-03T17:00:00Z"},
+		},
+		{
+			name: "exdate in UTC matches local occurrence", rule: "FREQ=DAILY;COUNT=3", location: "Europe/Berlin", dtstart: "2024-01-01 09:00",
+			exdates: []string{"20240102T080000Z"},
+			want:    []string{"2024-01-01T09:00:00+01:00", "2024-01-03T09:00:00+01:00"},
+		},
+		{
+			name: "rdate adds an occurrence", rule: "FREQ=WEEKLY;COUNT=2", location: "UTC", dtstart: "2024-01-01 09:00",
+			rdates: []string{"20240103T150000"},
+			want:   []string{"2024-01-01T09:00:00Z", "2024-01-03T15:00:00Z", "2024-01-08T09:00:00Z"},
+		},
+		{
+			name: "spring forward gap moves the time forward", rule: "FREQ=DAILY;COUNT=3", location: "America/New_York", dtstart: "2024-03-09 02:30",
+			want: []string{"2024-03-09T02:30:00-05:00", "2024-03-10T03:30:00-04:00", "2024-03-11T02:30:00-04:00"},
+		},
+		{
+			name: "fall back keeps the wall clock time", rule: "FREQ=DAILY;COUNT=3", location: "America/New_York", dtstart: "2024-11-02 09:00",
+			want: []string{"2024-11-02T09:00:00-04:00", "2024-11-03T09:00:00-05:00", "2024-11-04T09:00:00-05:00"},
+		},
+		{
+			name: "weekly across a DST change", rule: "FREQ=WEEKLY;BYDAY=SU;COUNT=2", location: "Europe/Berlin", dtstart: "2024-03-24 10:00",
+			want: []string{"2024-03-24T10:00:00+01:00", "2024-03-31T10:00:00+02:00"},
+		},
+		{
+			name: "unbounded rule", rule: "FREQ=MONTHLY;BYMONTHDAY=-1", location: "UTC", dtstart: "2024-01-31 00:00",
+			want: []string{"2024-01-31T00:00:00Z", "2024-02-29T00:00:00Z", "2024-03-31T00:00:00Z", "2024-04-30T00:00:00Z", "2024-05-31T00:00:00Z",
+				"2024-06-30T00:00:00Z", "2024-07-31T00:00:00Z", "2024-08-31T00:00:00Z", "2024-09-30T00:00:00Z", "2024-10-31T00:00:00Z"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, err := time.LoadLocation(tt.location)
+			if err != nil {
+				t.Fatalf("load location: %v", err)
+			}
+			dtstart, err := time.ParseInLocation("2006-01-02 15:04", tt.dtstart, loc)
+			if err != nil {
+				t.Fatalf("parse dtstart: %v", err)
+			}
+
+			schedule, err := parseRRule(tt.rule, dtstart, loc, tt.exdates, tt.rdates)
+			if err != nil {
+				t.Fatalf("parseRRule: %v", err)
+			}
+			got := occurrences(schedule, dtstart, 10)
+			if len(got) != len(tt.want) {
+				t.Fatalf("occurrences = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("occurrences = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRRuleRejectsInvalidRules(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+	}{
+		{"empty", ""},
+		{"missing FREQ", "COUNT=3"},
+		{"unknown FREQ", "FREQ=HOURLY"},
+		{"COUNT and UNTIL", "FREQ=DAILY;COUNT=3;UNTIL=20240110"},
+		{"zero COUNT", "FREQ=DAILY;COUNT=0"},
+		{"ordinal with weekly", "FREQ=WEEKLY;BYDAY=2TU"},
+		{"BYSETPOS out of range", "FREQ=MONTHLY;BYDAY=MO;BYSETPOS=0"},
+		{"unsupported part", "FREQ=DAILY;BYWEEKNO=3"},
+		{"malformed part", "FREQ=DAILY;COUNT"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseRRule(tt.rule, time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC), time.UTC, nil, nil)
+			if !errors.Is(err, ErrInvalidPattern) {
+				t.Fatalf("parseRRule(%q) error = %v, want %v", tt.rule, err, ErrInvalidPattern)
+			}
+		})
+	}
+
+	if _, err := parseRRule("FREQ=DAILY", time.Now(), time.UTC, []string{"tomorrow"}, nil); !errors.Is(err, ErrInvalidPattern) {
+		t.Errorf("invalid EXDATE error = %v, want %v", err, ErrInvalidPattern)
+	}
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/task-schedulart/models"
+	"gorm.io/gorm"
+)
+
+// Actor is the user on whose behalf a request is made. Role is its role in the
+// workspace: admin, user or viewer. TeamID is set for requests made with a team
+// API key, which act for the team only: they reach the tasks of the team with
+// the team role of the user that created the key.
+type Actor struct {
+	UserID   uint
+	Username string
+	Role     string
+	TeamID   *uint
+}
+
+// IsAdmin reports whether the actor may access every task
+func (a Actor) IsAdmin() bool {
+	return a.Role == "admin" && a.TeamID == nil
+}
+
+// visibleTasks limits a task query to the tasks an actor may read: tasks it
+// created, tasks assigned to it and tasks of its teams. Admins read every task,
+// team keys only the tasks of their team.
+func (a Actor) visibleTasks(db *gorm.DB) *gorm.DB {
+	if a.TeamID != nil {
+		return db.Where("team_id = ?", *a.TeamID)
+	}
+	if a.IsAdmin() {
+		return db
+	}
+
+	teams := db.Session(&gorm.Session{NewDB: true}).Model(&TeamMember{}).Select("team_id").Where("user_id = ?", a.UserID)
+	if a.Username == "" {
+		return db.Where("(created_by = ? OR team_id IN (?))", a.UserID, teams)
+	}
+	return db.Where("(created_by = ? OR assignee = ? OR team_id IN (?))", a.UserID, a.Username, teams)
+}
+
+// canReadTask reports whether an actor may read a task of its workspace, by the
+// rule visibleTasks applies to queries. teams holds the teams of the actor.
+func (a Actor) canReadTask(createdBy uint, assignee string, teamID *uint, teams map[uint]bool) bool {
+	if !grants(globalRoles, a.Role, PermTaskRead) {
+		return false
+	}
+	if a.TeamID != nil {
+		return teamID != nil && *teamID == *a.TeamID
+	}
+	if a.IsAdmin() {
+		return true
+	}
+	if createdBy != 0 && createdBy == a.UserID {
+		return true
+	}
+	if a.Username != "" && assignee == a.Username {
+		return true
+	}
+	return teamID != nil && teams[*teamID]
+}
+
+// memberTeams returns the teams a user is a member of
+func memberTeams(db *gorm.DB, userID uint) (map[uint]bool, error) {
+	var teamIDs []uint
+	if err := db.Model(&TeamMember{}).Where("user_id = ?", userID).Pluck("team_id", &teamIDs).Error; err != nil {
+		return nil, err
+	}
+	teams := make(map[uint]bool, len(teamIDs))
+	for _, id := range teamIDs {
+		teams[id] = true
+	}
+	return teams, nil
+}
+
+// AuthorizeTask loads a task and checks that an actor holds a permission on it.
+// Tasks the actor may not read are reported as gorm.ErrRecordNotFound, so their
+// existence is not revealed. The creator and the assignee act on a task with the
+// permissions of their role, team members with those of their team role.
+func (s *TaskService) AuthorizeTask(actor Actor, taskID uint, permission Permission) (*models.Task, error) {
+	var task models.Task
+	if err := s.db.Scopes(actor.visibleTasks).First(&task, taskID).Error; err != nil {
+		return nil, err
+	}
+
+	teamID := task.TeamID
+	if actor.TeamID == nil && (actor.IsAdmin() || (task.CreatedBy != 0 && task.CreatedBy == actor.UserID) ||
+		(actor.Username != "" && task.Assignee == actor.Username)) {
+		teamID = nil
+	}
+	if err := s.permissions().Authorize(actor, permission, teamID); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// AssignOwner makes an actor the creator of a new task and checks that it may
+// create the task, including for the team the task is shared with. Tasks created
+// with a team key belong to its team.
+func (s *TaskService) AssignOwner(actor Actor, task *models.Task) error {
+	if task.TeamID == nil && actor.TeamID != nil {
+		teamID := *actor.TeamID
+		task.TeamID = &teamID
+	}
+	if err := s.permissions().Authorize(actor, PermTaskCreate, task.TeamID); err != nil {
+		return err
+	}
+	task.CreatedBy = actor.UserID
+	return nil
+}
+
+// permissions returns a permission service on the database of the service
+func (s *TaskService) permissions() *PermissionService {
+	return &PermissionService{db: s.db}
+}
+
+// VisibleTaskIDs returns which of the given tasks an actor may read
+func (s *TaskService) VisibleTaskIDs(actor Actor, ids []uint) (map[uint]bool, error) {
+	var visible []uint
+	if err := s.db.Model(&models.Task{}).Scopes(actor.visibleTasks).
+		Where("id IN ?", ids).
+		Pluck("id", &visible).Error; err != nil {
+		return nil, err
+	}
+
+	result := make(map[uint]bool, len(visible))
+	for _, id := range visible {
+		result[id] = true
+	}
+	return result, nil
+}
+
+// CheckUpstreamVisible returns ErrUnknownUpstream unless an actor may read every
+// upstream task of a dependency, so tasks cannot be probed through dependencies
+func (s *TaskService) CheckUpstreamVisible(actor Actor, dependsOn []uint) error {
+	if len(dependsOn) == 0 {
+		return nil
+	}
+	visible, err := s.VisibleTaskIDs(actor, dependsOn)
+	if err != nil {
+		return err
+	}
+	for _, id := range dependsOn {
+		if !visible[id] {
+			return fmt.Errorf("%w: %d", ErrUnknownUpstream, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package services
+
+import "testing"
+
+func TestCanReadTask(t *testing.T) {
+	ops, infra := uint(1), uint(2)
+	user := Actor{UserID: 7, Username: "alice", Role: "user"}
+	opsTeams := map[uint]bool{ops: true}
+
+	tests := []struct {
+		name      string
+		actor     Actor
+		teams     map[uint]bool
+		createdBy uint
+		assignee  string
+		teamID    *uint
+		want      bool
+	}{
+		{"creator", user, nil, 7, "", nil, true},
+		{"assignee", user, nil, 8, "alice", nil, true},
+		{"member of the task's team", user, opsTeams, 8, "", &ops, true},
+		{"another team's task", user, opsTeams, 8, "", &infra, false},
+		{"another user's task", user, opsTeams, 8, "bob", nil, false},
+		{"unknown creator is nobody", Actor{Role: "user"}, nil, 0, "", nil, false},
+		{"empty assignee is nobody", Actor{UserID: 7, Role: "user"}, nil, 8, "", nil, false},
+		{"viewer reads its own tasks", Actor{UserID: 7, Role: "viewer"}, nil, 7, "", nil, true},
+		{"admin reads every task", Actor{UserID: 9, Role: "admin"}, nil, 8, "bob", &infra, true},
+		{"team key reads its team's tasks", Actor{UserID: 9, Role: "admin", TeamID: &ops}, nil, 8, "", &ops, true},
+		{"team key of an admin stays in its team", Actor{UserID: 9, Role: "admin", TeamID: &ops}, nil, 8, "", &infra, false},
+		{"team key skips tasks without a team", Actor{UserID: 7, Role: "user", TeamID: &ops}, nil, 7, "", nil, false},
+		{"unknown role", Actor{UserID: 7, Role: "guest"}, nil, 7, "", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.actor.canReadTask(tt.createdBy, tt.assignee, tt.teamID, tt.teams); got != tt.want {
+				t.Errorf("canReadTask() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
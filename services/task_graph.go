@@ -0,0 +1,274 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/task-schedulart/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrDependencyCycle is returned when a new edge would make the task graph cyclic
+	ErrDependencyCycle = errors.New("dependency would create a cycle")
+	// ErrUnknownUpstream is returned when a dependency points at a task that does not exist
+	ErrUnknownUpstream = errors.New("upstream task not found")
+)
+
+// upstreamPending matches tasks that still wait for at least one upstream task to complete.
+// Edges to deleted tasks are ignored. As raw SQL it is not scoped to a workspace,
+// so it only follows edges and tasks of the workspace of the task.
+const upstreamPending = `EXISTS (
+	SELECT 1 FROM task_dependencies d
+	JOIN tasks u ON u.id = d.depends_on_id AND u.workspace_id = d.workspace_id AND u.deleted_at IS NULL
+	WHERE d.task_id = tasks.id AND d.workspace_id = tasks.workspace_id AND u.status <> 'completed')`
+
+// TaskGraph is the part of the dependency graph connected to a task
+type TaskGraph struct {
+	Nodes []TaskGraphNode `json:"nodes"`
+	Edges []TaskGraphEdge `json:"edges"`
+}
+
+// TaskGraphNode is a task in a TaskGraph
+type TaskGraphNode struct {
+	ID     uint   `json:"id"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+// TaskGraphEdge points from an upstream task to the task that depends on it
+type TaskGraphEdge struct {
+	From uint `json:"from"`
+	To   uint `json:"to"`
+}
+
+// unsuccessfulStatuses are the final statuses of tasks that did not complete
+var unsuccessfulStatuses = []string{"failed", "dead_lettered", "cancelled", "skipped"}
+
+// AddDependencies makes taskID wait for each of the given upstream tasks.
+// Edges that would create a cycle are rejected with ErrDependencyCycle. If an
+// upstream task already ended without completing, the failure is propagated
+// right away and the affected tasks are returned.
+func (s *TaskService) AddDependencies(taskID uint, dependsOn []uint) ([]models.Task, error) {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		return addDependencies(tx, taskID, dependsOn)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var failed []models.Task
+	if err := s.db.Select("id").Where("id IN ? AND status IN ?", dependsOn, unsuccessfulStatuses).
+		Find(&failed).Error; err != nil {
+		return nil, err
+	}
+
+	var affected []models.Task
+	for _, upstream := range failed {
+		settled, err := s.PropagateUpstreamFailure(upstream.ID)
+		if err != nil {
+			return nil, err
+		}
+		affected = append(affected, settled...)
+	}
+	return affected, nil
+}
+
+// addDependencies inserts dependency edges inside a transaction. Upstream tasks
+// must belong to the workspace of the task, also for system sessions.
+func addDependencies(tx *gorm.DB, taskID uint, dependsOn []uint) error {
+	if len(dependsOn) == 0 {
+		return nil
+	}
+
+	// Serialize graph changes so two concurrent edges cannot close a cycle together
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('task_dependencies'))").Error; err != nil {
+		return err
+	}
+
+	var task models.Task
+	if err := tx.Select("id", "workspace_id").First(&task, taskID).Error; err != nil {
+		return err
+	}
+	var count int64
+	if err := tx.Model(&models.Task{}).Where("id IN ? AND workspace_id = ?", dependsOn, task.WorkspaceID).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if int(count) != len(uniqueIDs(dependsOn)) {
+		return ErrUnknownUpstream
+	}
+
+	for _, upstreamID := range dependsOn {
+		cyclic, err := reachesUpstream(tx, task.WorkspaceID, upstreamID, taskID)
+		if err != nil {
+			return err
+		}
+		if cyclic {
+			return fmt.Errorf("%w: task %d already depends on task %d", ErrDependencyCycle, upstreamID, taskID)
+		}
+
+		dependency := models.TaskDependency{TaskID: taskID, DependsOnID: upstreamID, WorkspaceID: task.WorkspaceID}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&dependency).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reachesUpstream reports whether target is fromID itself or one of its
+// transitive upstream tasks in a workspace
+func reachesUpstream(tx *gorm.DB, workspaceID, fromID, target uint) (bool, error) {
+	var found bool
+	err := tx.Raw(`WITH RECURSIVE upstream(id) AS (
+			SELECT CAST(? AS bigint)
+			UNION
+			SELECT d.depends_on_id FROM task_dependencies d JOIN upstream ON d.task_id = upstream.id
+			WHERE d.workspace_id = ?
+		)
+		SELECT EXISTS (SELECT 1 FROM upstream WHERE id = ?)`, fromID, workspaceID, target).
+		Scan(&found).Error
+	return found, err
+}
+
+// RemoveDependency deletes the edge between a task and one of its upstream tasks
+func (s *TaskService) RemoveDependency(taskID, dependsOnID uint) error {
+	result := s.db.Where("task_id = ? AND depends_on_id = ?", taskID, dependsOnID).
+		Delete(&models.TaskDependency{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetTaskGraph returns every task connected to taskID through dependency edges,
+// upstream and downstream, together with the edges between them. Tasks the
+// actor may not read only show their ID and status.
+func (s *TaskService) GetTaskGraph(actor Actor, taskID uint) (*TaskGraph, error) {
+	var task models.Task
+	if err := s.db.Select("id", "workspace_id").First(&task, taskID).Error; err != nil {
+		return nil, err
+	}
+
+	var ids []uint
+	err := s.db.Raw(`WITH RECURSIVE
+		upstream(id) AS (
+			SELECT CAST(? AS bigint)
+			UNION
+			SELECT d.depends_on_id FROM task_dependencies d JOIN upstream ON d.task_id = upstream.id
+			WHERE d.workspace_id = ?
+		),
+		downstream(id) AS (
+			SELECT CAST(? AS bigint)
+			UNION
+			SELECT d.task_id FROM task_dependencies d JOIN downstream ON d.depends_on_id = downstream.id
+			WHERE d.workspace_id = ?
+		)
+		SELECT id FROM upstream UNION SELECT id FROM downstream`, taskID, task.WorkspaceID, taskID, task.WorkspaceID).
+		Scan(&ids).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []models.Task
+	if err := s.db.Select("id", "name", "type", "status").Where("id IN ? AND workspace_id = ?", ids, task.WorkspaceID).
+		Order("id").Find(&tasks).Error; err != nil {
+		return nil, err
+	}
+	// Only tasks of the workspace and the edges between them are part of the graph
+	ids = ids[:0]
+	for _, task := range tasks {
+		ids = append(ids, task.ID)
+	}
+
+	visible, err := s.VisibleTaskIDs(actor, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var dependencies []models.TaskDependency
+	if err := s.db.Where("task_id IN ? AND depends_on_id IN ?", ids, ids).
+		Find(&dependencies).Error; err != nil {
+		return nil, err
+	}
+
+	graph := &TaskGraph{
+		Nodes: make([]TaskGraphNode, 0, len(tasks)),
+		Edges: make([]TaskGraphEdge, 0, len(dependencies)),
+	}
+	for _, task := range tasks {
+		node := TaskGraphNode{ID: task.ID, Status: task.Status}
+		if visible[task.ID] {
+			node.Name = task.Name
+			node.Type = task.Type
+		}
+		graph.Nodes = append(graph.Nodes, node)
+	}
+	for _, dependency := range dependencies {
+		graph.Edges = append(graph.Edges, TaskGraphEdge{From: dependency.DependsOnID, To: dependency.TaskID})
+	}
+
+	return graph, nil
+}
+
+// PropagateUpstreamFailure settles the pending downstream tasks of a task that
+// will not complete. Each downstream task is skipped or failed according to its
+// OnUpstreamFailure setting, and the same is applied to their own downstream tasks.
+// It returns the affected tasks with their new status.
+func (s *TaskService) PropagateUpstreamFailure(taskID uint) ([]models.Task, error) {
+	var affected []models.Task
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		frontier := []uint{taskID}
+		for len(frontier) > 0 {
+			var settled []models.Task
+			if err := tx.Model(&settled).
+				Clauses(clause.Returning{Columns: taskEventColumns}).
+				Where("status = ? AND id IN (?)", "pending",
+					tx.Model(&models.TaskDependency{}).Select("task_id").Where("depends_on_id IN ?", frontier)).
+				Updates(map[string]interface{}{
+					"status":     gorm.Expr("CASE WHEN on_upstream_failure = 'fail' THEN 'failed' ELSE 'skipped' END"),
+					"last_error": "an upstream task did not complete",
+					"updated_at": time.Now(),
+				}).Error; err != nil {
+				return err
+			}
+
+			frontier = make([]uint, 0, len(settled))
+			for _, task := range settled {
+				frontier = append(frontier, task.ID)
+			}
+			affected = append(affected, settled...)
+		}
+
+		ids := make([]uint, len(affected))
+		for i, task := range affected {
+			ids[i] = task.ID
+		}
+		return syncWorkflowRuns(tx, ids)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return affected, nil
+}
+
+// uniqueIDs returns ids without duplicates
+func uniqueIDs(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	result := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
+}
@@ -0,0 +1,135 @@
+package services_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/task-schedulart/internal/dbtest"
+	"github.com/task-schedulart/models"
+	"github.com/task-schedulart/services"
+)
+
+// createTask stores a pending task due now
+func createTask(t *testing.T, taskService *services.TaskService, name string) models.Task {
+	t.Helper()
+	task := models.Task{Name: name, ScheduleTime: time.Now(), Priority: "medium"}
+	if err := taskService.CreateTask(&task); err != nil {
+		t.Fatalf("create task %s: %v", name, err)
+	}
+	return task
+}
+
+// edge makes task depend on dependsOn
+type edge struct{ task, dependsOn string }
+
+func TestAddDependenciesRejectsCycles(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []edge
+		add      edge
+		wantErr  error
+	}{
+		{"independent tasks", nil, edge{"b", "a"}, nil},
+		{"self dependency", nil, edge{"a", "a"}, services.ErrDependencyCycle},
+		{"direct back edge", []edge{{"b", "a"}}, edge{"a", "b"}, services.ErrDependencyCycle},
+		{"transitive back edge", []edge{{"b", "a"}, {"c", "b"}, {"d", "c"}}, edge{"a", "d"}, services.ErrDependencyCycle},
+		{"chain extended downstream", []edge{{"b", "a"}, {"c", "b"}}, edge{"d", "c"}, nil},
+		{"diamond", []edge{{"b", "a"}, {"c", "a"}, {"d", "b"}}, edge{"d", "c"}, nil},
+		{"diamond closed into a cycle", []edge{{"b", "a"}, {"c", "a"}, {"d", "b"}, {"d", "c"}}, edge{"a", "d"}, services.ErrDependencyCycle},
+		{"shortcut over a chain", []edge{{"b", "a"}, {"c", "b"}}, edge{"c", "a"}, nil},
+		{"duplicate edge", []edge{{"b", "a"}}, edge{"b", "a"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taskService := services.NewTaskService(dbtest.Open(t)).ForWorkspace(services.DefaultWorkspaceID)
+
+			ids := map[string]uint{}
+			for _, name := range []string{"a", "b", "c", "d"} {
+				ids[name] = createTask(t, taskService, name).ID
+			}
+			for _, e := range tt.existing {
+				if _, err := taskService.AddDependencies(ids[e.task], []uint{ids[e.dependsOn]}); err != nil {
+					t.Fatalf("add existing edge %s -> %s: %v", e.task, e.dependsOn, err)
+				}
+			}
+
+			_, err := taskService.AddDependencies(ids[tt.add.task], []uint{ids[tt.add.dependsOn]})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("AddDependencies(%s -> %s) error = %v, want %v", tt.add.task, tt.add.dependsOn, err, tt.wantErr)
+			}
+
+			// A rejected edge must not have been stored
+			graph, err := taskService.GetTaskGraph(services.Actor{Role: "admin"}, ids["a"])
+			if err != nil {
+				t.Fatalf("GetTaskGraph: %v", err)
+			}
+			stored := append([]edge{}, tt.existing...)
+			if tt.wantErr == nil {
+				stored = append(stored, tt.add)
+			}
+			if wantEdges := len(uniqueEdges(stored)); len(graph.Edges) != wantEdges {
+				t.Errorf("graph has %d edges, want %d: %+v", len(graph.Edges), wantEdges, graph.Edges)
+			}
+		})
+	}
+}
+
+// uniqueEdges removes repeated edges
+func uniqueEdges(edges []edge) []edge {
+	seen := map[edge]bool{}
+	var result []edge
+	for _, e := range edges {
+		if !seen[e] {
+			seen[e] = true
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func TestAddDependenciesRejectsUnknownUpstream(t *testing.T) {
+	db := dbtest.Open(t)
+	taskService := services.NewTaskService(db).ForWorkspace(services.DefaultWorkspaceID)
+
+	other := services.Workspace{Name: "other"}
+	if err := services.NewWorkspaceService(db).CreateWorkspace(&other); err != nil {
+		t.Fatalf("create workspace: %v", err)
+	}
+	foreign := createTask(t, services.NewTaskService(db).ForWorkspace(other.ID), "foreign")
+	task := createTask(t, taskService, "task")
+
+	tests := []struct {
+		name      string
+		dependsOn []uint
+	}{
+		{"missing task", []uint{task.ID + 1000}},
+		{"task of another workspace", []uint{foreign.ID}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := taskService.AddDependencies(task.ID, tt.dependsOn); !errors.Is(err, services.ErrUnknownUpstream) {
+				t.Fatalf("AddDependencies error = %v, want %v", err, services.ErrUnknownUpstream)
+			}
+		})
+	}
+}
+
+func TestAddDependenciesOnFailedUpstreamSettlesTask(t *testing.T) {
+	taskService := services.NewTaskService(dbtest.Open(t)).ForWorkspace(services.DefaultWorkspaceID)
+
+	upstream := createTask(t, taskService, "upstream")
+	if err := taskService.UpdateTaskStatus(upstream.ID, "failed"); err != nil {
+		t.Fatalf("fail upstream: %v", err)
+	}
+	downstream := createTask(t, taskService, "downstream")
+
+	affected, err := taskService.AddDependencies(downstream.ID, []uint{upstream.ID})
+	if err != nil {
+		t.Fatalf("AddDependencies: %v", err)
+	}
+	if len(affected) != 1 || affected[0].ID != downstream.ID || affected[0].Status != "skipped" {
+		t.Fatalf("affected = %+v, want the downstream task skipped", affected)
+	}
+}
@@ -3,10 +3,13 @@ package services
 import (
 	"errors"
 	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/task-schedulart/models"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type TaskService struct {
@@ -17,9 +20,24 @@ func NewTaskService(db *gorm.DB) *TaskService {
 	return &TaskService{db: db}
 }
 
-// CreateTask creates a new task
+// ForWorkspace returns a copy of the service limited to the data of a workspace
+func (s *TaskService) ForWorkspace(workspaceID uint) *TaskService {
+	return &TaskService{db: WorkspaceDB(s.db, workspaceID)}
+}
+
+// CreateTask creates a new task together with the dependencies listed in DependsOn
 func (s *TaskService) CreateTask(task *models.Task) error {
-	return s.db.Create(task).Error
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if task.CalendarID != nil {
+			if err := checkCalendarExists(tx, *task.CalendarID); err != nil {
+				return err
+			}
+		}
+		if err := tx.Create(task).Error; err != nil {
+			return err
+		}
+		return addDependencies(tx, task.ID, task.DependsOn)
+	})
 }
 
 // GetTasks returns all tasks with optional filters
@@ -38,44 +56,420 @@ func (s *TaskService) GetTasks(status, priority string) ([]models.Task, error) {
 	return tasks, err
 }
 
-// UpdateTaskStatus updates the status of a task
+// UpdateTaskStatus sets the status of a task and drops its worker lease, so a
+// worker still holding the lease cannot overwrite the new status.
 func (s *TaskService) UpdateTaskStatus(taskID uint, status string) error {
-	return s.db.Model(&models.Task{}).Where("id = ?", taskID).
-		Updates(map[string]interface{}{
-			"status":     status,
-			"updated_at": time.Now(),
-		}).Error
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Task{}).Where("id = ?", taskID).Updates(map[string]interface{}{
+			"status":           status,
+			"lease_owner":      "",
+			"lease_expires_at": nil,
+			"updated_at":       time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+		return syncWorkflowRuns(tx, []uint{taskID})
+	})
 }
 
-// GetPendingTasks returns tasks that are scheduled to run and are pending
-func (s *TaskService) GetPendingTasks() ([]models.Task, error) {
+// priorityOrder sorts high priority tasks first; the column is a string so a plain DESC would be alphabetical
+const priorityOrder = "CASE priority WHEN 'high' THEN 0 WHEN 'medium' THEN 1 WHEN 'low' THEN 2 ELSE 3 END"
+
+// GetPendingTasks returns tasks that are scheduled to run and are pending.
+// Recurring templates are excluded since only their instances are executed,
+// as are tasks still waiting for upstream tasks.
+func (s *TaskService) GetPendingTasks(limit int) ([]models.Task, error) {
 	var tasks []models.Task
-	err := s.db.Where("status = ? AND schedule_time <= ?", "pending", time.Now()).
-		Order("priority desc, schedule_time asc").
-		Find(&tasks).Error
+	query := s.db.Where("status = ? AND schedule_time <= ? AND is_recurring = ?", "pending", time.Now(), false).
+		Where("NOT " + upstreamPending).
+		Order(priorityOrder).
+		Order("schedule_time asc")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	err := query.Find(&tasks).Error
 	return tasks, err
 }
 
-// RetryFailedTask attempts to retry a failed task
+// ErrTaskNotCancellable is returned when cancelling a task that already finished
+var ErrTaskNotCancellable = errors.New("only pending or running tasks can be cancelled")
+
+// CancelTask cancels a pending task right away. For a running task it sets a
+// flag that the worker holding the lease picks up on its next heartbeat.
+// It returns the status the task was in.
+func (s *TaskService) CancelTask(taskID uint) (string, error) {
+	var task models.Task
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&task, taskID).Error; err != nil {
+			return err
+		}
+
+		switch task.Status {
+		case "pending":
+			if err := tx.Model(&task).Updates(map[string]interface{}{
+				"status":     "cancelled",
+				"updated_at": time.Now(),
+			}).Error; err != nil {
+				return err
+			}
+			return syncWorkflowRuns(tx, []uint{taskID})
+		case "running":
+			return tx.Model(&task).Update("cancel_requested", true).Error
+		default:
+			return ErrTaskNotCancellable
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return task.Status, nil
+}
+
+// ErrLeaseLost is returned when a worker reports on a task it no longer holds the lease for
+var ErrLeaseLost = errors.New("task lease lost")
+
+// ClaimDueTasks atomically claims up to limit due tasks for a worker and moves them to running.
+// Tasks still waiting for upstream tasks are not due. Rows locked by another replica
+// are skipped so concurrent workers never claim the same task.
+func (s *TaskService) ClaimDueTasks(workerID string, limit int, lease time.Duration) ([]models.Task, error) {
+	var tasks []models.Task
+	now := time.Now()
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND schedule_time <= ? AND is_recurring = ?", "pending", now, false).
+			Where("NOT " + upstreamPending).
+			Order(priorityOrder).
+			Order("schedule_time asc").
+			Limit(limit).
+			Find(&tasks).Error; err != nil {
+			return err
+		}
+		if len(tasks) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, len(tasks))
+		for i := range tasks {
+			ids[i] = tasks[i].ID
+		}
+
+		expiresAt := now.Add(lease)
+		if err := tx.Model(&models.Task{}).Where("id IN ?", ids).
+			Updates(map[string]interface{}{
+				"status":           "running",
+				"cancel_requested": false,
+				"lease_owner":      workerID,
+				"lease_expires_at": expiresAt,
+				"updated_at":       now,
+			}).Error; err != nil {
+			return err
+		}
+		if err := syncWorkflowRuns(tx, ids); err != nil {
+			return err
+		}
+
+		for i := range tasks {
+			tasks[i].Status = "running"
+			tasks[i].LeaseOwner = workerID
+			tasks[i].LeaseExpiresAt = &expiresAt
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tasks, nil
+}
+
+// RenewLease extends the lease a worker holds on a running task. It reports
+// whether cancellation of the task has been requested in the meantime.
+func (s *TaskService) RenewLease(taskID uint, workerID string, lease time.Duration) (bool, error) {
+	var task models.Task
+	result := s.db.Model(&task).
+		Clauses(clause.Returning{Columns: []clause.Column{{Name: "cancel_requested"}}}).
+		Where("id = ? AND status = ? AND lease_owner = ?", taskID, "running", workerID).
+		Update("lease_expires_at", time.Now().Add(lease))
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, ErrLeaseLost
+	}
+	return task.CancelRequested, nil
+}
+
+// ReleaseTask hands a running task back to the queue without counting it as an attempt
+func (s *TaskService) ReleaseTask(taskID uint, workerID string) error {
+	return finishLeasedTask(s.db, taskID, workerID, map[string]interface{}{
+		"status": "pending",
+	})
+}
+
+// taskEventColumns are returned by updates of several tasks, so events can be
+// broadcast for the updated tasks
+var taskEventColumns = []clause.Column{
+	{Name: "id"}, {Name: "workspace_id"}, {Name: "status"},
+	{Name: "created_by"}, {Name: "assignee"}, {Name: "team_id"}, {Name: "tags"},
+}
+
+// errLeaseExpired is the error recorded for an attempt whose worker stopped renewing its lease
+var errLeaseExpired = NewTaskError(ErrorClassLeaseExpired, errors.New("worker lease expired"))
+
+// ReleaseExpiredLeases recovers running tasks whose lease has expired, which
+// happens when their worker crashed or lost its database connection. Tasks with
+// a cancellation request are cancelled. For the others the attempt counts as
+// failed, so a task that keeps crashing its worker ends in the dead-letter queue.
+// It returns the cancelled tasks and the failed attempts.
+func (s *TaskService) ReleaseExpiredLeases() ([]models.Task, []FailedAttempt, error) {
+	var cancelled []models.Task
+	var failed []FailedAttempt
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var expired []models.Task
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND lease_expires_at < ?", "running", time.Now()).
+			Find(&expired).Error; err != nil {
+			return err
+		}
+		if len(expired) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, len(expired))
+		for i := range expired {
+			ids[i] = expired[i].ID
+		}
+
+		// Close the execution records the crashed workers left open
+		if err := tx.Model(&models.TaskExecution{}).
+			Where("task_id IN ? AND outcome = ?", ids, ExecutionRunning).
+			Updates(map[string]interface{}{
+				"outcome":     ExecutionAbandoned,
+				"error":       errLeaseExpired.Error(),
+				"finished_at": time.Now(),
+			}).Error; err != nil {
+			return err
+		}
+
+		// The rows are locked, so the lease of the crashed worker is still on them
+		for _, task := range expired {
+			if task.CancelRequested {
+				if err := finishLeasedTask(tx, task.ID, task.LeaseOwner, map[string]interface{}{
+					"status":     "cancelled",
+					"last_error": "task cancelled",
+				}); err != nil {
+					return err
+				}
+				task.Status = "cancelled"
+				cancelled = append(cancelled, task)
+				continue
+			}
+
+			attempt, err := failAttempt(tx, task, task.LeaseOwner, errLeaseExpired)
+			if err != nil {
+				return err
+			}
+			failed = append(failed, *attempt)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return cancelled, failed, nil
+}
+
+// CompleteTask marks a leased task as completed and records how long it took
+func (s *TaskService) CompleteTask(taskID uint, workerID string, duration time.Duration) error {
+	return finishLeasedTask(s.db, taskID, workerID, map[string]interface{}{
+		"status":      "completed",
+		"last_error":  "",
+		"actual_time": int(math.Ceil(duration.Minutes())),
+	})
+}
+
+// CancelRunningTask records that a leased task stopped because it was cancelled
+func (s *TaskService) CancelRunningTask(taskID uint, workerID string) error {
+	return finishLeasedTask(s.db, taskID, workerID, map[string]interface{}{
+		"status":     "cancelled",
+		"last_error": "task cancelled",
+	})
+}
+
+// DeferTask puts a leased task back to pending until its calendar allows it to run,
+// without counting it as an attempt
+func (s *TaskService) DeferTask(taskID uint, workerID string, until time.Time) error {
+	return finishLeasedTask(s.db, taskID, workerID, map[string]interface{}{
+		"status":        "pending",
+		"schedule_time": until,
+	})
+}
+
+// FailedAttempt is the outcome of an attempt that failed: the task is either
+// retried at NextRun or moved to the dead-letter queue
+type FailedAttempt struct {
+	Task       models.Task
+	Err        error
+	NextRun    *time.Time         // Set when the task gets another attempt
+	DeadLetter *models.DeadLetter // Set when the retry policy gave up
+}
+
+// FailAttempt records a failed attempt of a leased task. The task is scheduled
+// for another attempt while its retry policy allows, otherwise it is moved to
+// the dead-letter queue.
+func (s *TaskService) FailAttempt(task models.Task, workerID string, cause error) (*FailedAttempt, error) {
+	var attempt *FailedAttempt
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		attempt, err = failAttempt(tx, task, workerID, cause)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attempt, nil
+}
+
+// failAttempt applies the retry policy of a task to a failed attempt
+func failAttempt(tx *gorm.DB, task models.Task, workerID string, cause error) (*FailedAttempt, error) {
+	history := append(models.AttemptErrors{}, task.ErrorHistory...)
+	history = append(history, models.AttemptError{
+		Attempt: task.RetryCount + 1,
+		Class:   ErrorClass(cause),
+		Error:   cause.Error(),
+		At:      time.Now(),
+	})
+	attempt := &FailedAttempt{Task: task, Err: cause}
+
+	if ShouldRetry(&task, cause) {
+		nextRun := time.Now().Add(RetryDelay(&task))
+		if err := finishLeasedTask(tx, task.ID, workerID, map[string]interface{}{
+			"status":        "pending",
+			"last_error":    cause.Error(),
+			"error_history": history,
+			"retry_count":   gorm.Expr("retry_count + 1"),
+			"schedule_time": nextRun,
+		}); err != nil {
+			return nil, err
+		}
+		attempt.Task.Status = "pending"
+		attempt.NextRun = &nextRun
+		return attempt, nil
+	}
+
+	deadLetter := models.DeadLetter{
+		WorkspaceID:  task.WorkspaceID,
+		TaskID:       task.ID,
+		TaskName:     task.Name,
+		TaskType:     task.Type,
+		Payload:      task.Metadata,
+		FinalError:   cause.Error(),
+		ErrorClass:   ErrorClass(cause),
+		ErrorHistory: history,
+		Attempts:     len(history),
+	}
+	if err := finishLeasedTask(tx, task.ID, workerID, map[string]interface{}{
+		"status":        "dead_lettered",
+		"last_error":    cause.Error(),
+		"error_history": history,
+	}); err != nil {
+		return nil, err
+	}
+	if err := tx.Create(&deadLetter).Error; err != nil {
+		return nil, err
+	}
+	attempt.Task.Status = "dead_lettered"
+	attempt.DeadLetter = &deadLetter
+	return attempt, nil
+}
+
+// finishLeasedTask applies updates to a running task and clears its lease,
+// provided the worker still owns it. The status of its workflow run follows.
+func finishLeasedTask(db *gorm.DB, taskID uint, workerID string, updates map[string]interface{}) error {
+	updates["lease_owner"] = ""
+	updates["lease_expires_at"] = nil
+	updates["cancel_requested"] = false
+	updates["updated_at"] = time.Now()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Task{}).
+			Where("id = ? AND status = ? AND lease_owner = ?", taskID, "running", workerID).
+			Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrLeaseLost
+		}
+		return syncWorkflowRuns(tx, []uint{taskID})
+	})
+}
+
+var (
+	// ErrTaskNotRetryable is returned when retrying a task that neither failed nor was dead-lettered
+	ErrTaskNotRetryable = errors.New("only failed or dead-lettered tasks can be retried")
+	// ErrRetriesExhausted is returned when retrying a failed task that used up its attempts
+	ErrRetriesExhausted = errors.New("maximum retry attempts reached")
+)
+
+// RetryFailedTask moves a failed task back to pending as its next attempt. A
+// dead-lettered task is requeued from the dead-letter queue with a fresh set of
+// attempts.
 func (s *TaskService) RetryFailedTask(taskID uint) error {
 	var task models.Task
 	if err := s.db.First(&task, taskID).Error; err != nil {
 		return err
 	}
 
-	if task.Status != "failed" {
-		return errors.New("only failed tasks can be retried")
+	switch task.Status {
+	case "failed":
+	case "dead_lettered":
+		return s.requeueDeadLettered(task.ID)
+	default:
+		return ErrTaskNotRetryable
 	}
 
-	if task.RetryCount >= 3 {
-		return errors.New("maximum retry attempts reached")
+	policy := effectiveRetryPolicy(task.RetryPolicy)
+	if task.RetryCount+1 >= policy.MaxAttempts {
+		return ErrRetriesExhausted
 	}
 
-	return s.db.Model(&task).Updates(map[string]interface{}{
-		"status":      "pending",
-		"retry_count": task.RetryCount + 1,
-		"last_error":  "",
-	}).Error
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&task).Where("status = ?", "failed").Updates(map[string]interface{}{
+			"status":      "pending",
+			"retry_count": task.RetryCount + 1,
+			"last_error":  "",
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrTaskNotRetryable
+		}
+		return syncWorkflowRuns(tx, []uint{task.ID})
+	})
+}
+
+// requeueDeadLettered requeues a dead-lettered task through its dead-letter entry
+func (s *TaskService) requeueDeadLettered(taskID uint) error {
+	var deadLetter models.DeadLetter
+	if err := s.db.Where("task_id = ?", taskID).Order("id DESC").First(&deadLetter).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrTaskNotRetryable
+		}
+		return err
+	}
+
+	deadLetters := &DeadLetterService{db: s.db}
+	if _, err := deadLetters.RequeueDeadLetter(deadLetter.ID, nil); err != nil {
+		if errors.Is(err, ErrNotDeadLettered) || errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrTaskNotRetryable
+		}
+		return err
+	}
+	return nil
 }
 
 // DeleteTask soft deletes a task
@@ -83,20 +477,40 @@ func (s *TaskService) DeleteTask(taskID uint) error {
 	return s.db.Delete(&models.Task{}, taskID).Error
 }
 
-// GetTasksByTags returns tasks with specific tags
-func (s *TaskService) GetTasksByTags(tags []string) ([]models.Task, error) {
+// GetTasksByTags returns the tasks with specific tags an actor may read
+func (s *TaskService) GetTasksByTags(actor Actor, tags []string) ([]models.Task, error) {
 	var tasks []models.Task
-	err := s.db.Where("tags && ?", tags).Find(&tasks).Error
+	err := s.db.Scopes(actor.visibleTasks).Where("tags && ?", tags).Find(&tasks).Error
 	return tasks, err
 }
 
-// GetTasksWithPagination returns paginated tasks with filters
-func (s *TaskService) GetTasksWithPagination(status, priority string, tags []string, search, sortBy, order string, page, pageSize int) ([]models.Task, int64, error) {
+// ErrInvalidSort is returned when tasks are sorted by an unknown field or order
+var ErrInvalidSort = errors.New("invalid sort")
+
+// taskSortColumns maps the fields tasks can be sorted by to their SQL expression.
+// Priority is ranked so that descending order lists high priority tasks first.
+var taskSortColumns = map[string]string{
+	"created_at":    "created_at",
+	"updated_at":    "updated_at",
+	"schedule_time": "schedule_time",
+	"due_date":      "due_date",
+	"name":          "name",
+	"status":        "status",
+	"priority":      "CASE priority WHEN 'low' THEN 0 WHEN 'medium' THEN 1 WHEN 'high' THEN 2 ELSE -1 END",
+}
+
+// GetTasksWithPagination returns paginated tasks an actor may read with filters
+func (s *TaskService) GetTasksWithPagination(actor Actor, status, priority string, tags []string, search, sortBy, order string, page, pageSize int) ([]models.Task, int64, error) {
 	var tasks []models.Task
 	var total int64
 	offset := (page - 1) * pageSize
 
-	query := s.db.Model(&models.Task{})
+	orderBy, err := taskOrder(sortBy, order)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := s.db.Model(&models.Task{}).Scopes(actor.visibleTasks)
 
 	// Apply filters
 	if status != "" {
@@ -117,16 +531,13 @@ func (s *TaskService) GetTasksWithPagination(status, priority string, tags []str
 		return nil, 0, err
 	}
 
-	// Apply sorting 
-	if sortBy != "" {
-		if order != "asc" {
-			order = "desc"
-		}
-		query = query.Order(fmt.Sprintf("%s %s", sortBy, order))
+	// Apply sorting
+	if orderBy != "" {
+		query = query.Order(orderBy)
 	}
 
 	// Apply pagination
-	err := query.Offset(offset).Limit(pageSize).Find(&tasks).Error
+	err = query.Offset(offset).Limit(pageSize).Find(&tasks).Error
 	if err != nil {
 		return nil, 0, err
 	}
@@ -134,6 +545,28 @@ func (s *TaskService) GetTasksWithPagination(status, priority string, tags []str
 	return tasks, total, nil
 }
 
+// taskOrder returns the ORDER BY clause for sorting tasks by a field in asc or
+// desc order, or an empty clause when sortBy is empty. Ties are broken by ID so
+// that pages do not overlap.
+func taskOrder(sortBy, order string) (string, error) {
+	if sortBy == "" {
+		return "", nil
+	}
+	column, ok := taskSortColumns[sortBy]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown sort field %q", ErrInvalidSort, sortBy)
+	}
+	order = strings.ToLower(order)
+	switch order {
+	case "asc", "desc":
+	case "":
+		order = "desc"
+	default:
+		return "", fmt.Errorf("%w: order must be asc or desc", ErrInvalidSort)
+	}
+	return column + " " + order + ", id " + order, nil
+}
+
 // GetTaskByID retrieves a task by its ID
 func (s *TaskService) GetTaskByID(taskID uint) (*models.Task, error) {
 	var task models.Task
@@ -143,8 +576,32 @@ func (s *TaskService) GetTaskByID(taskID uint) (*models.Task, error) {
 	return &task, nil
 }
 
-// UpdateTask updates an existing task
-func (s *TaskService) UpdateTask(task *models.Task) error {
+// editableTaskColumns maps the JSON fields of a task that clients may change to
+// their columns. Status, retries, leases, ownership and workflow links are left
+// to the scheduler.
+var editableTaskColumns = map[string]string{
+	"name":              "name",
+	"type":              "type",
+	"description":       "description",
+	"scheduleTime":      "schedule_time",
+	"priority":          "priority",
+	"retryPolicy":       "retry_policy",
+	"timeout":           "timeout",
+	"tags":              "tags",
+	"metadata":          "metadata",
+	"onUpstreamFailure": "on_upstream_failure",
+	"teamId":            "team_id",
+	"calendarId":        "calendar_id",
+	"assignee":          "assignee",
+	"dueDate":           "due_date",
+	"estimatedTime":     "estimated_time",
+	"labels":            "labels",
+}
+
+// UpdateTask sets the given fields of an existing task, named by their JSON
+// names, to their values in task, including empty values. Other fields, and
+// those clients may not change, keep their stored value.
+func (s *TaskService) UpdateTask(task *models.Task, fields []string) error {
 	if task.ID == 0 {
 		return errors.New("task ID is required")
 	}
@@ -154,8 +611,41 @@ func (s *TaskService) UpdateTask(task *models.Task) error {
 	if err := s.db.First(&existingTask, task.ID).Error; err != nil {
 		return err
 	}
+	if task.CalendarID != nil {
+		if err := checkCalendarExists(s.db, *task.CalendarID); err != nil {
+			return err
+		}
+	}
+
+	columns := []string{"updated_at"}
+	clearMetadata := false
+	for _, field := range fields {
+		column, ok := editableTaskColumns[field]
+		if !ok {
+			continue
+		}
+		// Empty metadata is stored as NULL, an empty string is no JSON document
+		if column == "metadata" && task.Metadata == "" {
+			clearMetadata = true
+			continue
+		}
+		columns = append(columns, column)
+	}
 
-	// Update the task
 	task.UpdatedAt = time.Now()
-	return s.db.Model(task).Updates(task).Error
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&existingTask).Select(columns).Updates(task).Error; err != nil {
+			return err
+		}
+		if clearMetadata {
+			return tx.Model(&existingTask).UpdateColumn("metadata", gorm.Expr("NULL")).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Fields left out of the update keep their values, return the stored task
+	return s.db.First(task, task.ID).Error
 }
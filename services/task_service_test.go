@@ -0,0 +1,41 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTaskOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		sortBy  string
+		order   string
+		want    string
+		wantErr bool
+	}{
+		{"unsorted", "", "", "", false},
+		{"default order", "created_at", "", "created_at desc, id desc", false},
+		{"ascending", "schedule_time", "asc", "schedule_time asc, id asc", false},
+		{"priority is ranked", "priority", "desc", taskSortColumns["priority"] + " desc, id desc", false},
+		{"unknown field", "password", "asc", "", true},
+		{"injected field", "name; DROP TABLE tasks", "asc", "", true},
+		{"expression as field", "(SELECT 1)", "desc", "", true},
+		{"injected order", "name", "asc; DELETE FROM tasks", "", true},
+		{"upper case order", "name", "DESC", "name desc, id desc", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := taskOrder(tt.sortBy, tt.order)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidSort) {
+					t.Fatalf("taskOrder() error = %v, want %v", err, ErrInvalidSort)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("taskOrder() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
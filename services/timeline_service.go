@@ -0,0 +1,220 @@
+package services
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/task-schedulart/models"
+	"gorm.io/gorm"
+)
+
+// Timeline item kinds
+const (
+	TimelineTask       = "task"       // A pending task with its own schedule time
+	TimelineOccurrence = "occurrence" // A future occurrence of a recurring task
+)
+
+const (
+	// MaxTimelineWindow is the longest period a timeline may cover
+	MaxTimelineWindow = 92 * 24 * time.Hour
+	// maxTimelineItems bounds the number of items in a timeline
+	maxTimelineItems = 5000
+)
+
+// TimelineItem is a task run the scheduler expects within a timeline
+type TimelineItem struct {
+	Kind          string     `json:"kind"`                 // task or occurrence
+	TaskID        uint       `json:"taskId,omitempty"`     // Set for tasks
+	TemplateID    uint       `json:"templateId,omitempty"` // Set for occurrences
+	WorkflowID    uint       `json:"workflowId,omitempty"` // Set for occurrences that start a workflow run
+	Name          string     `json:"name"`
+	Type          string     `json:"type"`
+	Priority      string     `json:"priority"`
+	EstimatedTime int        `json:"estimatedTime"`          // In minutes
+	ScheduledAt   time.Time  `json:"scheduledAt"`            // When the run is expected to start
+	OriginalTime  *time.Time `json:"originalTime,omitempty"` // Set when a calendar moved the run away from this time
+	CalendarID    *uint      `json:"calendarId,omitempty"`
+	BlockedBy     []uint     `json:"blockedBy,omitempty"` // Upstream tasks that have not completed yet
+}
+
+// Timeline is the expected schedule between two times, ordered by start time
+type Timeline struct {
+	From      time.Time      `json:"from"`
+	To        time.Time      `json:"to"`
+	Items     []TimelineItem `json:"items"`
+	Truncated bool           `json:"truncated"` // More items exist than were returned
+}
+
+type TimelineService struct {
+	db               *gorm.DB
+	recurringService *RecurringTaskService
+}
+
+func NewTimelineService(db *gorm.DB, recurringService *RecurringTaskService) *TimelineService {
+	return &TimelineService{db: db, recurringService: recurringService}
+}
+
+// ForWorkspace returns a copy of the service limited to the data of a workspace
+func (s *TimelineService) ForWorkspace(workspaceID uint) *TimelineService {
+	return &TimelineService{db: WorkspaceDB(s.db, workspaceID), recurringService: s.recurringService.ForWorkspace(workspaceID)}
+}
+
+// GetTimeline merges the pending tasks scheduled between from and to with the
+// occurrences of every active recurring task in that period, limited to the
+// tasks an actor may read
+func (s *TimelineService) GetTimeline(actor Actor, from, to time.Time) (*Timeline, error) {
+	timeline := &Timeline{From: from, To: to, Items: []TimelineItem{}}
+
+	tasks, err := s.taskItems(actor, from, to)
+	if err != nil {
+		return nil, err
+	}
+	occurrences, err := s.occurrenceItems(actor, from, to)
+	if err != nil {
+		return nil, err
+	}
+	timeline.Items = append(append(timeline.Items, tasks...), occurrences...)
+
+	sort.SliceStable(timeline.Items, func(i, j int) bool {
+		return timeline.Items[i].ScheduledAt.Before(timeline.Items[j].ScheduledAt)
+	})
+	if len(timeline.Items) > maxTimelineItems {
+		timeline.Items = timeline.Items[:maxTimelineItems]
+		timeline.Truncated = true
+	}
+	return timeline, nil
+}
+
+// taskItems returns the pending tasks scheduled between from and to, moved to
+// the time their calendar allows and with the upstream tasks they wait for
+func (s *TimelineService) taskItems(actor Actor, from, to time.Time) ([]TimelineItem, error) {
+	var tasks []models.Task
+	if err := s.db.Scopes(actor.visibleTasks).Where("status = ? AND is_recurring = ? AND schedule_time BETWEEN ? AND ?", "pending", false, from, to).
+		Order("schedule_time asc").
+		Limit(maxTimelineItems + 1).
+		Find(&tasks).Error; err != nil {
+		return nil, err
+	}
+	if len(tasks) == 0 {
+		return nil, nil
+	}
+
+	blockedBy, err := s.pendingUpstream(tasks)
+	if err != nil {
+		return nil, err
+	}
+
+	calendars := make(map[uint]*businessCalendar)
+	items := make([]TimelineItem, 0, len(tasks))
+	for _, task := range tasks {
+		item := TimelineItem{
+			Kind:          TimelineTask,
+			TaskID:        task.ID,
+			Name:          task.Name,
+			Type:          task.Type,
+			Priority:      task.Priority,
+			EstimatedTime: task.EstimatedTime,
+			ScheduledAt:   task.ScheduleTime,
+			CalendarID:    task.CalendarID,
+			BlockedBy:     blockedBy[task.ID],
+		}
+
+		if task.CalendarID != nil {
+			calendar, ok := calendars[*task.CalendarID]
+			if !ok {
+				if calendar, err = loadBusinessCalendar(s.db, *task.CalendarID); err != nil {
+					return nil, err
+				}
+				calendars[*task.CalendarID] = calendar
+			}
+			runAt, err := runTime(calendar, task.ScheduleTime)
+			if err != nil {
+				return nil, err
+			}
+			if !runAt.Equal(task.ScheduleTime) {
+				original := task.ScheduleTime
+				item.ScheduledAt = runAt
+				item.OriginalTime = &original
+			}
+		}
+
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// pendingUpstream returns, by task ID, the upstream tasks that have not completed yet
+func (s *TimelineService) pendingUpstream(tasks []models.Task) (map[uint][]uint, error) {
+	ids := make([]uint, len(tasks))
+	for i := range tasks {
+		ids[i] = tasks[i].ID
+	}
+
+	var edges []models.TaskDependency
+	if err := s.db.Table("task_dependencies d").
+		Select("d.task_id, d.depends_on_id").
+		Joins("JOIN tasks u ON u.id = d.depends_on_id AND u.deleted_at IS NULL").
+		Where("d.task_id IN ? AND u.status <> ?", ids, "completed").
+		Order("d.depends_on_id").
+		Scan(&edges).Error; err != nil {
+		return nil, err
+	}
+
+	blockedBy := make(map[uint][]uint)
+	for _, edge := range edges {
+		blockedBy[edge.TaskID] = append(blockedBy[edge.TaskID], edge.DependsOnID)
+	}
+	return blockedBy, nil
+}
+
+// occurrenceItems expands the occurrences of active recurring tasks between from
+// and to that have not been processed yet
+func (s *TimelineService) occurrenceItems(actor Actor, from, to time.Time) ([]TimelineItem, error) {
+	var templates []models.Task
+	if err := s.db.Scopes(actor.visibleTasks).Where("is_recurring = ? AND recurrence_paused = ?", true, false).Find(&templates).Error; err != nil {
+		return nil, err
+	}
+
+	var items []TimelineItem
+	for _, template := range templates {
+		// Occurrences up to the last processed one already have an instance
+		start := from
+		if template.LastOccurrenceAt != nil && !template.LastOccurrenceAt.Before(start) {
+			start = template.LastOccurrenceAt.Add(time.Nanosecond)
+		}
+
+		pattern, err := parsePattern(template.RecurringConfig)
+		if errors.Is(err, ErrInvalidPattern) {
+			// The scheduler logs and skips templates with an invalid pattern
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		planned, err := s.recurringService.planOccurrences(template, start, to, maxTimelineItems+1)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, occurrence := range planned {
+			item := TimelineItem{
+				Kind:          TimelineOccurrence,
+				TemplateID:    template.ID,
+				WorkflowID:    pattern.WorkflowID,
+				Name:          template.Name,
+				Type:          template.Type,
+				Priority:      template.Priority,
+				EstimatedTime: template.EstimatedTime,
+				ScheduledAt:   occurrence.runAt,
+				CalendarID:    occurrence.calendarID,
+			}
+			if !occurrence.runAt.Equal(occurrence.at) {
+				original := occurrence.at
+				item.OriginalTime = &original
+			}
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,163 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestWSSubscriptionsMatch(t *testing.T) {
+	ops := uint(1)
+	event := TaskEvent{Event: TaskStatusEvent, TaskID: 10, Assignee: "alice", TeamID: &ops, Tags: []string{"backup", "nightly"}}
+
+	tests := []struct {
+		name   string
+		topics wsTopics
+		want   bool
+	}{
+		{"no subscriptions", wsTopics{}, true},
+		{"subscribed task", wsTopics{TaskIDs: []uint{10}}, true},
+		{"other task", wsTopics{TaskIDs: []uint{11}}, false},
+		{"subscribed tag", wsTopics{Tags: []string{"nightly"}}, true},
+		{"other tag", wsTopics{Tags: []string{"billing"}}, false},
+		{"subscribed team", wsTopics{Teams: []uint{ops}}, true},
+		{"subscribed assignee", wsTopics{Assignees: []string{"alice"}}, true},
+		{"any topic matches", wsTopics{TaskIDs: []uint{11}, Tags: []string{"backup"}}, true},
+		{"subscribed status events", wsTopics{Events: []string{TaskStatusEvent}}, true},
+		{"other events", wsTopics{Events: []string{TaskDeletedEvent}}, false},
+		{"status events of a subscribed task", wsTopics{TaskIDs: []uint{10}, Events: []string{TaskStatusEvent}}, true},
+		{"status events of another task", wsTopics{TaskIDs: []uint{11}, Events: []string{TaskStatusEvent}}, false},
+		{"other events of a subscribed tag", wsTopics{Tags: []string{"backup"}, Events: []string{TaskCreatedEvent}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subscriptions := newWSSubscriptions()
+			subscriptions.add(tt.topics)
+			if got := subscriptions.matches(&event); got != tt.want {
+				t.Errorf("matches() with %+v = %v, want %v", tt.topics, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("unsubscribe", func(t *testing.T) {
+		subscriptions := newWSSubscriptions()
+		subscriptions.add(wsTopics{TaskIDs: []uint{11}, Tags: []string{"backup"}})
+		subscriptions.remove(wsTopics{Tags: []string{"backup"}})
+		if subscriptions.matches(&event) {
+			t.Error("event matches after unsubscribing from its tag")
+		}
+		subscriptions.remove(wsTopics{})
+		if !subscriptions.matches(&event) {
+			t.Error("event does not match after unsubscribing from everything")
+		}
+	})
+}
+
+func TestWebSocketDeliversReadableTasksOnly(t *testing.T) {
+	ops, infra := uint(1), uint(2)
+	s := &WebSocketService{
+		clients:    make(map[*wsClient]bool),
+		broadcast:  make(chan *encodedEvent),
+		register:   make(chan *wsClient),
+		unregister: make(chan *wsClient),
+		logger:     zap.NewNop(),
+	}
+	go s.Start()
+
+	// received publishes events to a client subscribed to topics and returns the
+	// IDs of the tasks it would be sent
+	received := func(t *testing.T, actor Actor, teams map[uint]bool, topics wsTopics, events ...TaskEvent) []uint {
+		t.Helper()
+		client := &wsClient{actor: actor, workspaceID: DefaultWorkspaceID, teams: teams,
+			send: make(chan *encodedEvent, len(events)+1), subscriptions: newWSSubscriptions()}
+		client.subscriptions.add(topics)
+		s.register <- client
+		defer func() { s.unregister <- client }()
+
+		for i := range events {
+			s.broadcast <- &encodedEvent{TaskEvent: events[i]}
+		}
+		// An event for the client's workspace marks the end of the queue
+		s.broadcast <- &encodedEvent{TaskEvent: TaskEvent{Event: "end", WorkspaceID: DefaultWorkspaceID}}
+
+		ids := []uint{}
+		for {
+			select {
+			case event := <-client.send:
+				if event.Event == "end" {
+					return ids
+				}
+				if client.wants(event) {
+					ids = append(ids, event.TaskID)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("events were not delivered")
+			}
+		}
+	}
+	same := func(got []uint, want ...uint) bool {
+		if len(got) != len(want) {
+			return false
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	user := Actor{UserID: 7, Username: "alice", Role: "user"}
+	opsTeams := map[uint]bool{ops: true}
+	own := TaskEvent{Event: TaskStatusEvent, WorkspaceID: DefaultWorkspaceID, TaskID: 1, CreatedBy: 7, Tags: []string{"backup"}}
+
+	t.Run("another team's task", func(t *testing.T) {
+		teamTask := TaskEvent{Event: TaskStatusEvent, WorkspaceID: DefaultWorkspaceID, TaskID: 2, CreatedBy: 8, TeamID: &ops}
+		otherTeamTask := TaskEvent{Event: TaskStatusEvent, WorkspaceID: DefaultWorkspaceID, TaskID: 3, CreatedBy: 8, TeamID: &infra}
+		if got := received(t, user, opsTeams, wsTopics{}, own, teamTask, otherTeamTask); !same(got, 1, 2) {
+			t.Errorf("client received tasks %v, want [1 2]", got)
+		}
+	})
+
+	t.Run("another workspace's task", func(t *testing.T) {
+		admin := Actor{UserID: 9, Role: "admin"}
+		otherWorkspace := TaskEvent{Event: TaskStatusEvent, WorkspaceID: DefaultWorkspaceID + 1, TaskID: 4, CreatedBy: 9}
+		if got := received(t, admin, nil, wsTopics{}, own, otherWorkspace); !same(got, 1) {
+			t.Errorf("admin received tasks %v, want [1]", got)
+		}
+	})
+
+	t.Run("deleted task", func(t *testing.T) {
+		// The task no longer exists, the event's attributes decide who learns of it
+		deletedOwn := TaskEvent{Event: TaskDeletedEvent, WorkspaceID: DefaultWorkspaceID, TaskID: 5, CreatedBy: 7}
+		deletedOther := TaskEvent{Event: TaskDeletedEvent, WorkspaceID: DefaultWorkspaceID, TaskID: 6, CreatedBy: 8, TeamID: &infra}
+		if got := received(t, user, opsTeams, wsTopics{}, deletedOwn, deletedOther); !same(got, 5) {
+			t.Errorf("client received tasks %v, want [5]", got)
+		}
+	})
+
+	t.Run("subscriptions", func(t *testing.T) {
+		tagged := TaskEvent{Event: TaskStatusEvent, WorkspaceID: DefaultWorkspaceID, TaskID: 7, CreatedBy: 7, Tags: []string{"nightly"}}
+		updated := TaskEvent{Event: TaskUpdatedEvent, WorkspaceID: DefaultWorkspaceID, TaskID: 1, CreatedBy: 7}
+		hidden := TaskEvent{Event: TaskStatusEvent, WorkspaceID: DefaultWorkspaceID, TaskID: 8, CreatedBy: 8, Tags: []string{"nightly"}}
+		events := []TaskEvent{own, tagged, updated, hidden}
+
+		tests := []struct {
+			name   string
+			topics wsTopics
+			want   []uint
+		}{
+			{"task", wsTopics{TaskIDs: []uint{1}}, []uint{1, 1}},
+			{"tag", wsTopics{Tags: []string{"nightly"}}, []uint{7}},
+			{"status", wsTopics{Events: []string{TaskStatusEvent}}, []uint{1, 7}},
+			{"task and status", wsTopics{TaskIDs: []uint{1}, Events: []string{TaskStatusEvent}}, []uint{1}},
+		}
+		for _, tt := range tests {
+			if got := received(t, user, nil, tt.topics, events...); !same(got, tt.want...) {
+				t.Errorf("client subscribed to %s received tasks %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	})
+}
@@ -2,85 +2,569 @@ package services
 
 import (
 	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/task-schedulart/models"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
 )
 
+const (
+	// wsWriteWait is how long a write to a client may take
+	wsWriteWait = 10 * time.Second
+	// wsSendBuffer is how many events may wait for a client before it is dropped as too slow
+	wsSendBuffer = 64
+	// wsMaxMessageSize limits the messages clients send
+	wsMaxMessageSize = 4096
+)
+
+// WebSocketConfig configures the WebSocket endpoint
+type WebSocketConfig struct {
+	AllowedOrigins []string      // Origins besides the server's own that browsers may connect from
+	PingInterval   time.Duration // How often clients are pinged; clients that miss a pong are dropped
+	AuthTimeout    time.Duration // How long a client has to send its auth message
+	// How often the token of a client is checked again and its team memberships
+	// are reloaded, so connections follow revoked credentials and changed access
+	RevalidateInterval time.Duration
+}
+
+// DefaultWebSocketConfig returns the settings used when none are configured
+func DefaultWebSocketConfig() WebSocketConfig {
+	return WebSocketConfig{
+		PingInterval:       30 * time.Second,
+		AuthTimeout:        10 * time.Second,
+		RevalidateInterval: time.Minute,
+	}
+}
+
+// WebSocketAuthenticator resolves the token a client authenticates with to the
+// actor and the workspace it acts for. Connections are authenticated again with
+// the same token while they are open, and closed once that fails or resolves to
+// another actor.
+type WebSocketAuthenticator func(token string) (Actor, uint, error)
+
+// WebSocketService pushes task events to the connected clients. Every client
+// belongs to a workspace and only receives the events of that workspace, about
+// tasks its user may read and matching its subscriptions.
 type WebSocketService struct {
-	clients    map[*websocket.Conn]bool
-	broadcast  chan []byte
-	register   chan *websocket.Conn
-	unregister chan *websocket.Conn
-	mu         sync.Mutex
+	db         *gorm.DB
+	bus        EventBus
+	clients    map[*wsClient]bool
+	broadcast  chan *encodedEvent
+	register   chan *wsClient
+	unregister chan *wsClient
+	upgrader   websocket.Upgrader
+	config     WebSocketConfig
 	logger     *zap.Logger
 }
 
-func NewWebSocketService(logger *zap.Logger) *WebSocketService {
-	return &WebSocketService{
-		clients:    make(map[*websocket.Conn]bool),
-		broadcast:  make(chan []byte),
-		register:   make(chan *websocket.Conn),
-		unregister: make(chan *websocket.Conn),
+// TaskEvent is an event about a task. Besides the data clients receive, it
+// carries the attributes of the task that subscriptions and authorization are
+// checked against. The ID tells the replicas an event reaches apart.
+type TaskEvent struct {
+	ID          string      `json:"id"`
+	Event       string      `json:"event"`
+	WorkspaceID uint        `json:"workspaceId"`
+	TaskID      uint        `json:"taskId"`
+	CreatedBy   uint        `json:"createdBy"`
+	Assignee    string      `json:"assignee,omitempty"`
+	TeamID      *uint       `json:"teamId,omitempty"`
+	Tags        []string    `json:"tags,omitempty"`
+	Data        interface{} `json:"data"`
+}
+
+// NewTaskEvent returns an event about a task with the data clients receive
+func NewTaskEvent(task models.Task, event string, data interface{}) TaskEvent {
+	return TaskEvent{
+		Event:       event,
+		WorkspaceID: task.WorkspaceID,
+		TaskID:      task.ID,
+		CreatedBy:   task.CreatedBy,
+		Assignee:    task.Assignee,
+		TeamID:      task.TeamID,
+		Tags:        task.Tags,
+		Data:        data,
+	}
+}
+
+// encodedEvent is an event and the message clients receive for it, encoded once
+// for all clients
+type encodedEvent struct {
+	TaskEvent
+	message []byte
+}
+
+// wsClient is a connection, the user and workspace it was authenticated for,
+// and the events waiting to be written to it. Replies to the client's own
+// messages have a queue of their own, which is never closed.
+type wsClient struct {
+	conn         *websocket.Conn
+	token        string
+	authenticate WebSocketAuthenticator
+	actor        Actor
+	workspaceID  uint
+	send         chan *encodedEvent
+	replies      chan []byte
+
+	mu            sync.Mutex
+	subscriptions wsSubscriptions // Guarded by mu, changed by the read goroutine
+	teams         map[uint]bool   // Only used by the write goroutine
+}
+
+// wsTopics are the tasks and events a client subscribes to or unsubscribes from
+type wsTopics struct {
+	TaskIDs   []uint   `json:"taskIds,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Teams     []uint   `json:"teams,omitempty"`
+	Assignees []string `json:"assignees,omitempty"`
+	Events    []string `json:"events,omitempty"`
+}
+
+// wsClientMessage is a message from a client: auth, subscribe or unsubscribe
+type wsClientMessage struct {
+	Type  string `json:"type"`
+	Token string `json:"token,omitempty"`
+	wsTopics
+}
+
+// NewWebSocketService returns a service delivering the events published on bus,
+// by any replica, to the clients connected to this one
+func NewWebSocketService(db *gorm.DB, bus EventBus, logger *zap.Logger, config WebSocketConfig) *WebSocketService {
+	s := &WebSocketService{
+		db:         db,
+		bus:        bus,
+		clients:    make(map[*wsClient]bool),
+		broadcast:  make(chan *encodedEvent),
+		register:   make(chan *wsClient),
+		unregister: make(chan *wsClient),
+		config:     config,
 		logger:     logger,
 	}
+	s.upgrader = websocket.Upgrader{CheckOrigin: s.checkOrigin}
+	bus.Subscribe("websocket", s.deliver)
+	return s
 }
 
+// Start hands events to the clients of their workspace until the process ends.
+// It never writes to a connection itself, so a slow client only fills its own
+// buffer and is dropped once the buffer is full. The write goroutine of each
+// client filters the events by subscription and authorization.
 func (s *WebSocketService) Start() {
 	for {
 		select {
 		case client := <-s.register:
-			s.mu.Lock()
 			s.clients[client] = true
-			s.mu.Unlock()
 
 		case client := <-s.unregister:
-			s.mu.Lock()
-			if _, ok := s.clients[client]; ok {
+			if s.clients[client] {
 				delete(s.clients, client)
-				client.Close()
+				close(client.send)
 			}
-			s.mu.Unlock()
 
-		case message := <-s.broadcast:
-			s.mu.Lock()
+		case update := <-s.broadcast:
 			for client := range s.clients {
-				if err := client.WriteMessage(websocket.TextMessage, message); err != nil {
-					s.logger.Error("Failed to send message", zap.Error(err))
-					client.Close()
+				if client.workspaceID != update.WorkspaceID {
+					continue
+				}
+				select {
+				case client.send <- update:
+				default:
+					s.logger.Warn("Dropping slow WebSocket client", zap.Uint("userId", client.actor.UserID))
 					delete(s.clients, client)
+					close(client.send)
 				}
 			}
-			s.mu.Unlock()
 		}
 	}
 }
 
-// BroadcastTaskUpdate sends task updates to all connected clients
-func (s *WebSocketService) BroadcastTaskUpdate(event string, data interface{}) {
-	update := struct {
-		Event string      `json:"event"`
-		Data  interface{} `json:"data"`
-	}{
-		Event: event,
-		Data:  data,
+// HandleConnection upgrades a request to a WebSocket connection and serves it
+// until it closes. Clients authenticate with {"type": "auth", "token": "..."} as
+// their first message. Tokens in the URL would end up in access logs, so a token
+// query parameter is rejected.
+func (s *WebSocketService) HandleConnection(w http.ResponseWriter, r *http.Request, authenticate WebSocketAuthenticator) {
+	if r.URL.Query().Has("token") {
+		http.Error(w, "Send the token in an auth message instead of the URL", http.StatusBadRequest)
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has responded with the reason
+		s.logger.Debug("WebSocket upgrade failed", zap.Error(err))
+		return
 	}
+	conn.SetReadLimit(wsMaxMessageSize)
 
-	message, err := json.Marshal(update)
+	token, actor, workspaceID, err := s.readAuthMessage(conn, authenticate)
 	if err != nil {
-		s.logger.Error("Failed to marshal update", zap.Error(err))
+		s.closeWith(conn, websocket.ClosePolicyViolation, "authentication failed")
 		return
 	}
 
-	s.broadcast <- message
+	teams, err := memberTeams(s.db, actor.UserID)
+	if err != nil {
+		s.logger.Error("Failed to load team memberships", zap.Error(err))
+		s.closeWith(conn, websocket.CloseInternalServerErr, "")
+		return
+	}
+
+	client := &wsClient{
+		conn:          conn,
+		token:         token,
+		authenticate:  authenticate,
+		actor:         actor,
+		workspaceID:   workspaceID,
+		send:          make(chan *encodedEvent, wsSendBuffer),
+		replies:       make(chan []byte, wsSendBuffer),
+		subscriptions: newWSSubscriptions(),
+		teams:         teams,
+	}
+	client.reply(AuthenticatedEvent, map[string]uint{"userId": actor.UserID, "workspaceId": workspaceID})
+
+	s.register <- client
+	go s.writePump(client)
+	s.readPump(client)
+}
+
+// readAuthMessage waits for the auth message of a client and authenticates its token
+func (s *WebSocketService) readAuthMessage(conn *websocket.Conn, authenticate WebSocketAuthenticator) (string, Actor, uint, error) {
+	conn.SetReadDeadline(time.Now().Add(s.config.AuthTimeout))
+	var message wsClientMessage
+	if err := conn.ReadJSON(&message); err != nil {
+		return "", Actor{}, 0, err
+	}
+	if message.Type != "auth" || message.Token == "" {
+		return "", Actor{}, 0, errors.New("first message must be an auth message")
+	}
+	actor, workspaceID, err := authenticate(message.Token)
+	return message.Token, actor, workspaceID, err
+}
+
+// readPump handles the subscriptions of a client until its connection fails or
+// it stops answering pings, then unregisters it
+func (s *WebSocketService) readPump(client *wsClient) {
+	defer func() {
+		s.unregister <- client
+	}()
+
+	pongWait := s.config.PingInterval + wsWriteWait
+	client.conn.SetReadDeadline(time.Now().Add(pongWait))
+	client.conn.SetPongHandler(func(string) error {
+		return client.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, data, err := client.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				s.logger.Debug("WebSocket client disconnected", zap.Error(err))
+			}
+			return
+		}
+
+		var message wsClientMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			client.reply(ErrorEvent, map[string]string{"message": "invalid message: " + err.Error()})
+			continue
+		}
+
+		client.mu.Lock()
+		switch message.Type {
+		case "subscribe":
+			client.subscriptions.add(message.wsTopics)
+		case "unsubscribe":
+			client.subscriptions.remove(message.wsTopics)
+		default:
+			client.mu.Unlock()
+			client.reply(ErrorEvent, map[string]string{"message": "message type must be subscribe or unsubscribe"})
+			continue
+		}
+		topics := client.subscriptions.topics()
+		client.mu.Unlock()
+		client.reply(SubscriptionsEvent, topics)
+	}
+}
+
+// writePump writes the events of a client, pings it and revalidates it. It
+// closes the connection when the client is unregistered, a write fails or its
+// credentials no longer hold.
+func (s *WebSocketService) writePump(client *wsClient) {
+	ticker := time.NewTicker(s.config.PingInterval)
+	revalidateTicker := time.NewTicker(s.config.RevalidateInterval)
+	defer func() {
+		ticker.Stop()
+		revalidateTicker.Stop()
+		client.conn.Close()
+	}()
+
+	for {
+		select {
+		case event, ok := <-client.send:
+			if !ok {
+				s.closeWith(client.conn, websocket.CloseNormalClosure, "")
+				return
+			}
+			if !client.wants(event) {
+				continue
+			}
+			client.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := client.conn.WriteMessage(websocket.TextMessage, event.message); err != nil {
+				s.logger.Debug("Failed to send message", zap.Error(err))
+				return
+			}
+
+		case message := <-client.replies:
+			client.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := client.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				s.logger.Debug("Failed to send message", zap.Error(err))
+				return
+			}
+
+		case <-revalidateTicker.C:
+			if err := client.revalidate(); err != nil {
+				s.logger.Debug("Closing WebSocket client", zap.Uint("userId", client.actor.UserID), zap.Error(err))
+				s.closeWith(client.conn, websocket.ClosePolicyViolation, "credentials revoked or changed")
+				return
+			}
+			teams, err := memberTeams(s.db, client.actor.UserID)
+			if err != nil {
+				s.logger.Error("Failed to reload team memberships", zap.Error(err))
+				continue
+			}
+			client.teams = teams
+
+		case <-ticker.C:
+			client.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// closeWith sends a close frame with a reason and closes the connection
+func (s *WebSocketService) closeWith(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteWait))
+	conn.Close()
+}
+
+// checkOrigin accepts browsers on the server's own origin and on the configured
+// origins. Clients that send no Origin header are not browsers and are accepted.
+func (s *WebSocketService) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range s.config.AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// wsEvent is the message clients receive for an event
+type wsEvent struct {
+	Event string      `json:"event"`
+	Data  interface{} `json:"data"`
+}
+
+// BroadcastTaskUpdate publishes an event about a task to every replica, which
+// send it to the clients of its workspace that may read the task and subscribed
+// to the event
+func (s *WebSocketService) BroadcastTaskUpdate(task models.Task, event string, data interface{}) {
+	if err := s.bus.Publish(NewTaskEvent(task, event, data)); err != nil {
+		s.logger.Error("Failed to publish update", zap.String("event", event), zap.Uint("task_id", task.ID), zap.Error(err))
+	}
+}
+
+// deliver encodes an event from the bus once and hands it to the clients
+func (s *WebSocketService) deliver(event TaskEvent) error {
+	message, err := json.Marshal(wsEvent{Event: event.Event, Data: event.Data})
+	if err != nil {
+		return err
+	}
+
+	s.broadcast <- &encodedEvent{TaskEvent: event, message: message}
+	return nil
+}
+
+// revalidate authenticates a client again with its token. It fails when the
+// session has ended, the API key was revoked or the token now resolves to
+// another actor or workspace, such as after a role change.
+func (c *wsClient) revalidate() error {
+	actor, workspaceID, err := c.authenticate(c.token)
+	if err != nil {
+		return err
+	}
+	if actor.UserID != c.actor.UserID || actor.Role != c.actor.Role || workspaceID != c.workspaceID ||
+		(actor.TeamID == nil) != (c.actor.TeamID == nil) || (actor.TeamID != nil && *actor.TeamID != *c.actor.TeamID) {
+		return errors.New("credentials resolve to another actor")
+	}
+	return nil
+}
+
+// wants reports whether a client receives an event: its user has to be allowed
+// to read the task and the event has to match the client's subscriptions
+func (c *wsClient) wants(event *encodedEvent) bool {
+	if !c.actor.canReadTask(event.CreatedBy, event.Assignee, event.TeamID, c.teams) {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.subscriptions.matches(&event.TaskEvent)
+}
+
+// reply queues a message for the client alone. Replies are dropped when the
+// client does not read them.
+func (c *wsClient) reply(event string, data interface{}) {
+	message, err := json.Marshal(wsEvent{Event: event, Data: data})
+	if err != nil {
+		return
+	}
+	select {
+	case c.replies <- message:
+	default:
+	}
+}
+
+// wsSubscriptions are the topics a client subscribed to. Events match when
+// their type is subscribed and their task matches any subscribed task ID, tag,
+// team or assignee. Without subscriptions of a kind, every event matches it.
+type wsSubscriptions struct {
+	taskIDs   map[uint]bool
+	tags      map[string]bool
+	teams     map[uint]bool
+	assignees map[string]bool
+	events    map[string]bool
+}
+
+func newWSSubscriptions() wsSubscriptions {
+	return wsSubscriptions{
+		taskIDs:   make(map[uint]bool),
+		tags:      make(map[string]bool),
+		teams:     make(map[uint]bool),
+		assignees: make(map[string]bool),
+		events:    make(map[string]bool),
+	}
+}
+
+// add subscribes to topics
+func (s *wsSubscriptions) add(topics wsTopics) {
+	for _, id := range topics.TaskIDs {
+		s.taskIDs[id] = true
+	}
+	for _, tag := range topics.Tags {
+		s.tags[tag] = true
+	}
+	for _, id := range topics.Teams {
+		s.teams[id] = true
+	}
+	for _, assignee := range topics.Assignees {
+		s.assignees[assignee] = true
+	}
+	for _, event := range topics.Events {
+		s.events[event] = true
+	}
+}
+
+// remove unsubscribes from topics, or from everything when topics is empty
+func (s *wsSubscriptions) remove(topics wsTopics) {
+	if len(topics.TaskIDs)+len(topics.Tags)+len(topics.Teams)+len(topics.Assignees)+len(topics.Events) == 0 {
+		*s = newWSSubscriptions()
+		return
+	}
+	for _, id := range topics.TaskIDs {
+		delete(s.taskIDs, id)
+	}
+	for _, tag := range topics.Tags {
+		delete(s.tags, tag)
+	}
+	for _, id := range topics.Teams {
+		delete(s.teams, id)
+	}
+	for _, assignee := range topics.Assignees {
+		delete(s.assignees, assignee)
+	}
+	for _, event := range topics.Events {
+		delete(s.events, event)
+	}
+}
+
+// matches reports whether an event matches the subscriptions
+func (s *wsSubscriptions) matches(event *TaskEvent) bool {
+	if len(s.events) > 0 && !s.events[event.Event] {
+		return false
+	}
+	if len(s.taskIDs)+len(s.tags)+len(s.teams)+len(s.assignees) == 0 {
+		return true
+	}
+
+	if s.taskIDs[event.TaskID] || (event.Assignee != "" && s.assignees[event.Assignee]) ||
+		(event.TeamID != nil && s.teams[*event.TeamID]) {
+		return true
+	}
+	for _, tag := range event.Tags {
+		if s.tags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// topics returns the subscriptions in a stable order
+func (s *wsSubscriptions) topics() wsTopics {
+	topics := wsTopics{}
+	for id := range s.taskIDs {
+		topics.TaskIDs = append(topics.TaskIDs, id)
+	}
+	for tag := range s.tags {
+		topics.Tags = append(topics.Tags, tag)
+	}
+	for id := range s.teams {
+		topics.Teams = append(topics.Teams, id)
+	}
+	for assignee := range s.assignees {
+		topics.Assignees = append(topics.Assignees, assignee)
+	}
+	for event := range s.events {
+		topics.Events = append(topics.Events, event)
+	}
+
+	sort.Slice(topics.TaskIDs, func(i, j int) bool { return topics.TaskIDs[i] < topics.TaskIDs[j] })
+	sort.Strings(topics.Tags)
+	sort.Slice(topics.Teams, func(i, j int) bool { return topics.Teams[i] < topics.Teams[j] })
+	sort.Strings(topics.Assignees)
+	sort.Strings(topics.Events)
+	return topics
 }
 
 // Events that can be broadcast
 const (
-	TaskCreatedEvent  = "task.created"
-	TaskUpdatedEvent  = "task.updated"
-	TaskDeletedEvent  = "task.deleted"
-	TaskStatusEvent   = "task.status"
-	TaskProgressEvent = "task.progress"
-) 
\ No newline at end of file
+	TaskCreatedEvent      = "task.created"
+	TaskUpdatedEvent      = "task.updated"
+	TaskDeletedEvent      = "task.deleted"
+	TaskStatusEvent       = "task.status"
+	TaskProgressEvent     = "task.progress"
+	TaskDeadLetteredEvent = "task.dead_lettered"
+)
+
+// Replies to a client about its connection
+const (
+	AuthenticatedEvent = "authenticated" // The client is authenticated
+	SubscriptionsEvent = "subscriptions" // The subscriptions of the client after a change
+	ErrorEvent         = "error"         // A message of the client was rejected
+)
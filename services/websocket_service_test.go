@@ -0,0 +1,170 @@
+package services_test
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/task-schedulart/internal/dbtest"
+	"github.com/task-schedulart/middleware"
+	"github.com/task-schedulart/services"
+	"go.uber.org/zap"
+)
+
+func TestWebSocketClosesRevokedConnections(t *testing.T) {
+	db := dbtest.Open(t)
+	authConfig := services.DefaultAuthConfig()
+	authConfig.JWTSecret = "test-secret-with-enough-entropy"
+	authService := services.NewAuthService(db, authConfig)
+	apiKeyService := services.NewAPIKeyService(db)
+
+	bus := services.NewInProcessEventBus(zap.NewNop())
+	t.Cleanup(func() { bus.Close() })
+	config := services.DefaultWebSocketConfig()
+	config.RevalidateInterval = 50 * time.Millisecond
+	wsService := services.NewWebSocketService(db, bus, zap.NewNop(), config)
+	go wsService.Start()
+
+	authenticate := middleware.SocketAuthenticator(authService, apiKeyService)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsService.HandleConnection(w, r, authenticate)
+	}))
+	t.Cleanup(server.Close)
+
+	user, err := authService.Register("alice", "alice@example.com", "secret-password")
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	endpoint := "ws" + strings.TrimPrefix(server.URL, "http")
+	// connect opens a connection authenticated with a token
+	connect := func(t *testing.T, token string) *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial(endpoint, nil)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if err := conn.WriteJSON(map[string]string{"type": "auth", "token": token}); err != nil {
+			t.Fatalf("send auth message: %v", err)
+		}
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatalf("read authenticated event: %v", err)
+		}
+		return conn
+	}
+	// closeCode waits up to timeout for the server to close a connection and
+	// returns the close code, or 0 when the connection stays open
+	closeCode := func(t *testing.T, conn *websocket.Conn, timeout time.Duration) int {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			_, _, err := conn.ReadMessage()
+			var closeErr *websocket.CloseError
+			var netErr net.Error
+			switch {
+			case err == nil:
+				continue
+			case errors.As(err, &closeErr):
+				return closeErr.Code
+			case errors.As(err, &netErr) && netErr.Timeout():
+				return 0
+			default:
+				t.Fatalf("read: %v", err)
+			}
+		}
+	}
+	// login starts a session and returns its access and refresh token
+	login := func(t *testing.T) (string, string) {
+		t.Helper()
+		accessToken, refreshToken, err := authService.Login("alice", "secret-password")
+		if err != nil {
+			t.Fatalf("Login: %v", err)
+		}
+		return accessToken, refreshToken
+	}
+
+	t.Run("token in the URL", func(t *testing.T) {
+		accessToken, _ := login(t)
+		conn, resp, err := websocket.DefaultDialer.Dial(endpoint+"?token="+accessToken, nil)
+		if err == nil {
+			conn.Close()
+		}
+		if resp == nil || resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Dial with a token in the URL = %v, %v, want status %d", resp, err, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("valid credentials", func(t *testing.T) {
+		accessToken, _ := login(t)
+		if code := closeCode(t, connect(t, accessToken), 10*config.RevalidateInterval); code != 0 {
+			t.Errorf("connection closed with code %d, want it open", code)
+		}
+	})
+
+	t.Run("logout", func(t *testing.T) {
+		accessToken, _ := login(t)
+		conn := connect(t, accessToken)
+		claims, err := authService.ValidateToken(accessToken)
+		if err != nil {
+			t.Fatalf("ValidateToken: %v", err)
+		}
+		if err := authService.Logout((*claims)["sid"].(string)); err != nil {
+			t.Fatalf("Logout: %v", err)
+		}
+		if code := closeCode(t, conn, 5*time.Second); code != websocket.ClosePolicyViolation {
+			t.Errorf("close code = %d, want %d", code, websocket.ClosePolicyViolation)
+		}
+	})
+
+	t.Run("reused refresh token", func(t *testing.T) {
+		accessToken, refreshToken := login(t)
+		conn := connect(t, accessToken)
+		if _, _, err := authService.RefreshToken(refreshToken); err != nil {
+			t.Fatalf("RefreshToken: %v", err)
+		}
+		if _, _, err := authService.RefreshToken(refreshToken); !errors.Is(err, services.ErrTokenReused) {
+			t.Fatalf("reused RefreshToken error = %v, want %v", err, services.ErrTokenReused)
+		}
+		if code := closeCode(t, conn, 5*time.Second); code != websocket.ClosePolicyViolation {
+			t.Errorf("close code = %d, want %d", code, websocket.ClosePolicyViolation)
+		}
+	})
+
+	t.Run("revoked API key", func(t *testing.T) {
+		key := services.APIKey{Name: "events", UserID: user.ID, WorkspaceID: services.DefaultWorkspaceID, Scopes: []string{"tasks:read"}}
+		plain, err := apiKeyService.CreateAPIKey(&key)
+		if err != nil {
+			t.Fatalf("CreateAPIKey: %v", err)
+		}
+		conn := connect(t, plain)
+		if _, err := apiKeyService.RevokeAPIKey(key.ID, user.ID); err != nil {
+			t.Fatalf("RevokeAPIKey: %v", err)
+		}
+		if code := closeCode(t, conn, 5*time.Second); code != websocket.ClosePolicyViolation {
+			t.Errorf("close code = %d, want %d", code, websocket.ClosePolicyViolation)
+		}
+	})
+
+	t.Run("role change", func(t *testing.T) {
+		accessToken, _ := login(t)
+		conn := connect(t, accessToken)
+		if err := db.Model(&services.User{}).Where("id = ?", user.ID).Update("role", "admin").Error; err != nil {
+			t.Fatalf("change role: %v", err)
+		}
+		if code := closeCode(t, conn, 5*time.Second); code != websocket.ClosePolicyViolation {
+			t.Errorf("close code = %d, want %d", code, websocket.ClosePolicyViolation)
+		}
+
+		// Reconnecting acts with the new role
+		actor, _, err := authenticate(accessToken)
+		if err != nil || actor.Role != "admin" {
+			t.Errorf("authenticate after the role change = %+v, %v, want the admin role", actor, err)
+		}
+	})
+}
@@ -0,0 +1,536 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/task-schedulart/models"
+	"go.uber.org/zap"
+)
+
+// WorkerConfig controls how the execution engine polls and runs tasks
+type WorkerConfig struct {
+	Concurrency   int           // Number of tasks executed in parallel
+	PollInterval  time.Duration // How often due tasks are looked up
+	BatchSize     int           // Maximum number of tasks fetched per poll
+	LeaseDuration time.Duration // How long a claimed task is reserved before another replica may take it over
+	TaskTimeout   time.Duration // Run time limit for tasks that do not set their own timeout
+}
+
+// handlerStopGracePeriod is how long a cancelled handler gets to return before it is abandoned
+const handlerStopGracePeriod = 10 * time.Second
+
+// ErrTaskCancelled is the cancellation cause seen by handlers of tasks cancelled through the API
+var ErrTaskCancelled = errors.New("task cancelled")
+
+// DefaultWorkerConfig returns the settings used when nothing is configured
+func DefaultWorkerConfig() WorkerConfig {
+	return WorkerConfig{
+		Concurrency:   4,
+		PollInterval:  5 * time.Second,
+		BatchSize:     20,
+		LeaseDuration: 30 * time.Second,
+		TaskTimeout:   time.Hour,
+	}
+}
+
+// WorkerService polls due tasks and runs them on a pool of goroutines
+type WorkerService struct {
+	taskService      *TaskService
+	executionService *ExecutionService
+	metricsService   *MetricsService
+	wsService        *WebSocketService
+	calendarService  *CalendarService
+	logger           *zap.Logger
+	config           WorkerConfig
+	workerID         string
+	registry         *HandlerRegistry
+
+	jobs    chan models.Task
+	active  int64 // Tasks currently executing
+	claimed int64 // Tasks claimed and not yet finished, including those waiting for a worker
+
+	running   map[uint]context.CancelCauseFunc
+	runningMu sync.Mutex
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	startMu   sync.Mutex
+}
+
+func NewWorkerService(taskService *TaskService, executionService *ExecutionService, metricsService *MetricsService, wsService *WebSocketService, calendarService *CalendarService, registry *HandlerRegistry, logger *zap.Logger, config WorkerConfig) *WorkerService {
+	defaults := DefaultWorkerConfig()
+	if config.Concurrency <= 0 {
+		config.Concurrency = defaults.Concurrency
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaults.PollInterval
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaults.BatchSize
+	}
+	if config.LeaseDuration <= 0 {
+		config.LeaseDuration = defaults.LeaseDuration
+	}
+	if config.TaskTimeout <= 0 {
+		config.TaskTimeout = defaults.TaskTimeout
+	}
+
+	return &WorkerService{
+		taskService:      taskService,
+		executionService: executionService,
+		metricsService:   metricsService,
+		wsService:        wsService,
+		calendarService:  calendarService,
+		logger:           logger,
+		config:           config,
+		workerID:         newWorkerID(),
+		registry:         registry,
+		jobs:             make(chan models.Task),
+		running:          make(map[uint]context.CancelCauseFunc),
+	}
+}
+
+// newWorkerID builds an identifier that is unique per process
+func newWorkerID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// WorkerID returns the identifier of this worker pool
+func (w *WorkerService) WorkerID() string {
+	return w.workerID
+}
+
+// Start launches the polling loop and the worker goroutines. It blocks until Stop is called.
+func (w *WorkerService) Start() {
+	w.startMu.Lock()
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	w.startMu.Unlock()
+
+	for i := 0; i < w.config.Concurrency; i++ {
+		w.wg.Add(1)
+		go w.work(ctx)
+	}
+
+	w.logger.Info("Worker pool started",
+		zap.String("worker_id", w.workerID),
+		zap.Int("concurrency", w.config.Concurrency))
+
+	ticker := time.NewTicker(w.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		w.poll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops polling, hands running tasks back to the queue and waits for the workers to exit
+func (w *WorkerService) Stop() {
+	w.startMu.Lock()
+	if w.cancel != nil {
+		w.cancel()
+	}
+	w.startMu.Unlock()
+	w.wg.Wait()
+}
+
+// poll recovers expired leases, then claims as many due tasks as there are free workers
+func (w *WorkerService) poll(ctx context.Context) {
+	cancelled, failed, err := w.taskService.ReleaseExpiredLeases()
+	if err != nil {
+		w.logger.Error("Failed to release expired leases", zap.Error(err))
+	} else if len(cancelled)+len(failed) > 0 {
+		w.logger.Warn("Released tasks with expired leases", zap.Int("count", len(cancelled)+len(failed)))
+		for _, task := range cancelled {
+			w.wsService.BroadcastTaskUpdate(task, TaskStatusEvent, map[string]interface{}{
+				"id":     task.ID,
+				"status": "cancelled",
+			})
+			w.propagateFailure(task)
+		}
+		for _, attempt := range failed {
+			w.reportFailure(attempt)
+		}
+	}
+
+	limit := w.config.Concurrency - int(atomic.LoadInt64(&w.claimed))
+	if limit > w.config.BatchSize {
+		limit = w.config.BatchSize
+	}
+	if limit <= 0 {
+		return
+	}
+
+	tasks, err := w.taskService.ClaimDueTasks(w.workerID, limit, w.config.LeaseDuration)
+	if err != nil {
+		w.logger.Error("Failed to claim due tasks", zap.Error(err))
+		return
+	}
+
+	atomic.AddInt64(&w.claimed, int64(len(tasks)))
+	for i, task := range tasks {
+		if w.deferToCalendar(task) {
+			continue
+		}
+
+		w.wsService.BroadcastTaskUpdate(task, TaskStatusEvent, map[string]interface{}{
+			"id":     task.ID,
+			"status": task.Status,
+		})
+
+		select {
+		case w.jobs <- task:
+		case <-ctx.Done():
+			// Give the remaining tasks back so another replica can pick them up
+			for _, pending := range tasks[i:] {
+				w.release(pending)
+			}
+			return
+		}
+	}
+}
+
+// deferToCalendar hands a claimed task back to the queue when its calendar does
+// not allow it to run now, and reports whether it did so
+func (w *WorkerService) deferToCalendar(task models.Task) bool {
+	if task.CalendarID == nil {
+		return false
+	}
+
+	now := time.Now()
+	next, err := w.calendarService.NextAllowed(*task.CalendarID, now)
+	if err != nil {
+		// Never run a task without knowing whether its calendar allows it
+		w.logger.Error("Failed to check task calendar", zap.Uint("task_id", task.ID), zap.Error(err))
+		w.release(task)
+		return true
+	}
+	if !next.After(now) {
+		return false
+	}
+
+	defer atomic.AddInt64(&w.claimed, -1)
+	if err := w.taskService.DeferTask(task.ID, w.workerID, next); err != nil {
+		w.logger.Error("Failed to defer task", zap.Uint("task_id", task.ID), zap.Error(err))
+		return true
+	}
+
+	w.logger.Info("Deferred task outside its calendar",
+		zap.Uint("task_id", task.ID), zap.Uint("calendar_id", *task.CalendarID), zap.Time("schedule_time", next))
+	w.wsService.BroadcastTaskUpdate(task, TaskStatusEvent, map[string]interface{}{
+		"id":           task.ID,
+		"status":       "pending",
+		"scheduleTime": next,
+	})
+	return true
+}
+
+// release hands a claimed task back to the queue
+func (w *WorkerService) release(task models.Task) {
+	defer atomic.AddInt64(&w.claimed, -1)
+
+	if err := w.taskService.ReleaseTask(task.ID, w.workerID); err != nil {
+		w.logger.Error("Failed to release task", zap.Uint("task_id", task.ID), zap.Error(err))
+	}
+}
+
+// work executes tasks received from the poller until the context is cancelled
+func (w *WorkerService) work(ctx context.Context) {
+	defer w.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case task := <-w.jobs:
+			w.execute(ctx, task)
+		}
+	}
+}
+
+// heartbeat renews the lease on a running task until done is closed. The task is
+// cancelled if the lease cannot be renewed or if cancellation was requested through the API.
+func (w *WorkerService) heartbeat(task models.Task, cancel context.CancelCauseFunc, done <-chan struct{}) {
+	ticker := time.NewTicker(w.config.LeaseDuration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			cancelRequested, err := w.taskService.RenewLease(task.ID, w.workerID, w.config.LeaseDuration)
+			if errors.Is(err, ErrLeaseLost) {
+				w.logger.Warn("Lost lease on running task", zap.Uint("task_id", task.ID))
+				cancel(ErrLeaseLost)
+				return
+			}
+			if err != nil {
+				w.logger.Error("Failed to renew task lease", zap.Uint("task_id", task.ID), zap.Error(err))
+				continue
+			}
+			if cancelRequested {
+				w.logger.Info("Cancelling running task", zap.Uint("task_id", task.ID))
+				cancel(ErrTaskCancelled)
+				return
+			}
+		}
+	}
+}
+
+// CancelTask cancels a task if it is running on this replica. It returns false
+// if the task is not running here.
+func (w *WorkerService) CancelTask(taskID uint) bool {
+	w.runningMu.Lock()
+	defer w.runningMu.Unlock()
+
+	cancel, ok := w.running[taskID]
+	if ok {
+		cancel(ErrTaskCancelled)
+	}
+	return ok
+}
+
+// track registers the cancel function of a running task
+func (w *WorkerService) track(taskID uint, cancel context.CancelCauseFunc) {
+	w.runningMu.Lock()
+	defer w.runningMu.Unlock()
+	w.running[taskID] = cancel
+}
+
+// untrack removes a task that finished running
+func (w *WorkerService) untrack(taskID uint) {
+	w.runningMu.Lock()
+	defer w.runningMu.Unlock()
+	delete(w.running, taskID)
+}
+
+// taskTimeout returns how long a task may run
+func (w *WorkerService) taskTimeout(task models.Task) time.Duration {
+	if task.Timeout > 0 {
+		return time.Duration(task.Timeout) * time.Second
+	}
+	return w.config.TaskTimeout
+}
+
+// execute runs a single claimed task and records its outcome
+func (w *WorkerService) execute(ctx context.Context, task models.Task) {
+	w.metricsService.UpdateTasksProcessing(float64(atomic.AddInt64(&w.active, 1)))
+	defer func() {
+		w.metricsService.UpdateTasksProcessing(float64(atomic.AddInt64(&w.active, -1)))
+	}()
+
+	timeout := w.taskTimeout(task)
+	runCtx, cancel := context.WithCancelCause(ctx)
+	taskCtx, cancelTimeout := context.WithTimeout(runCtx, timeout)
+	taskCtx, output := withOutputRecorder(taskCtx)
+	w.track(task.ID, cancel)
+	done := make(chan struct{})
+	go w.heartbeat(task, cancel, done)
+
+	execution, err := w.executionService.StartExecution(&task, w.workerID)
+	if err != nil {
+		w.logger.Error("Failed to record task execution", zap.Uint("task_id", task.ID), zap.Error(err))
+	}
+
+	start := time.Now()
+	err = w.runHandler(taskCtx, &task)
+	duration := time.Since(start)
+	close(done)
+	w.untrack(task.ID)
+	cause := context.Cause(runCtx)
+	timedOut := errors.Is(taskCtx.Err(), context.DeadlineExceeded)
+	cancelTimeout()
+	cancel(nil)
+	w.metricsService.ObserveTaskDuration(task.WorkspaceID, duration.Seconds())
+
+	// The pool is shutting down: hand the task back instead of recording a failure
+	if err != nil && ctx.Err() != nil {
+		w.finishExecution(execution, ExecutionReleased, err, output)
+		w.release(task)
+		return
+	}
+	defer atomic.AddInt64(&w.claimed, -1)
+
+	switch {
+	case errors.Is(cause, ErrTaskCancelled):
+		w.finishExecution(execution, ExecutionCancelled, nil, output)
+		w.recordCancellation(task)
+	case errors.Is(cause, ErrLeaseLost):
+		// Another replica may already be running the task, so leave its status alone
+		w.finishExecution(execution, ExecutionAbandoned, err, output)
+	case err != nil && timedOut:
+		err = NewTaskError(ErrorClassTimeout, fmt.Errorf("task timed out after %s: %v", timeout, err))
+		w.finishExecution(execution, ExecutionTimeout, err, output)
+		w.recordFailure(task, err)
+	case err != nil:
+		w.finishExecution(execution, ExecutionFailed, err, output)
+		w.recordFailure(task, err)
+	default:
+		w.finishExecution(execution, ExecutionCompleted, nil, output)
+		w.recordCompletion(task, duration)
+	}
+}
+
+// finishExecution stores the outcome of an attempt in its execution record
+func (w *WorkerService) finishExecution(execution *models.TaskExecution, outcome string, err error, output *outputRecorder) {
+	if execution == nil {
+		return
+	}
+	if finishErr := w.executionService.FinishExecution(execution, outcome, err, output.String()); finishErr != nil {
+		w.logger.Error("Failed to record task execution result",
+			zap.Uint("task_id", execution.TaskID), zap.Error(finishErr))
+	}
+}
+
+// recordCompletion marks a task as completed
+func (w *WorkerService) recordCompletion(task models.Task, duration time.Duration) {
+	if err := w.taskService.CompleteTask(task.ID, w.workerID, duration); err != nil {
+		w.logFinishError(task, err)
+		return
+	}
+	w.metricsService.RecordTaskCompletion(task.WorkspaceID)
+	w.wsService.BroadcastTaskUpdate(task, TaskStatusEvent, map[string]interface{}{
+		"id":     task.ID,
+		"status": "completed",
+	})
+}
+
+// recordCancellation marks a task that was stopped through the API as cancelled
+func (w *WorkerService) recordCancellation(task models.Task) {
+	if err := w.taskService.CancelRunningTask(task.ID, w.workerID); err != nil {
+		w.logFinishError(task, err)
+		return
+	}
+	w.wsService.BroadcastTaskUpdate(task, TaskStatusEvent, map[string]interface{}{
+		"id":     task.ID,
+		"status": "cancelled",
+	})
+	w.propagateFailure(task)
+}
+
+// propagateFailure skips or fails the downstream tasks of a task that did not complete
+func (w *WorkerService) propagateFailure(task models.Task) {
+	affected, err := w.taskService.PropagateUpstreamFailure(task.ID)
+	if err != nil {
+		w.logger.Error("Failed to update downstream tasks", zap.Uint("task_id", task.ID), zap.Error(err))
+		return
+	}
+	for _, downstream := range affected {
+		w.wsService.BroadcastTaskUpdate(downstream, TaskStatusEvent, map[string]interface{}{
+			"id":     downstream.ID,
+			"status": downstream.Status,
+		})
+	}
+}
+
+// recordFailure schedules a retry for a failed attempt, or moves the task to the
+// dead-letter queue once its retry policy gives up
+func (w *WorkerService) recordFailure(task models.Task, err error) {
+	attempt, finishErr := w.taskService.FailAttempt(task, w.workerID, err)
+	if finishErr != nil {
+		w.logFinishError(task, finishErr)
+		return
+	}
+	w.reportFailure(*attempt)
+}
+
+// reportFailure logs and broadcasts what became of a task after a failed attempt
+func (w *WorkerService) reportFailure(attempt FailedAttempt) {
+	task := attempt.Task
+	if attempt.NextRun != nil {
+		w.logger.Warn("Task failed, scheduling retry",
+			zap.Uint("task_id", task.ID),
+			zap.Int("attempt", task.RetryCount+1),
+			zap.Time("next_run", *attempt.NextRun),
+			zap.Error(attempt.Err))
+		w.wsService.BroadcastTaskUpdate(task, TaskStatusEvent, map[string]interface{}{
+			"id":      task.ID,
+			"status":  "pending",
+			"error":   attempt.Err.Error(),
+			"retryAt": *attempt.NextRun,
+		})
+		return
+	}
+
+	w.logger.Warn("Task failed, moving to dead-letter queue", zap.Uint("task_id", task.ID), zap.Error(attempt.Err))
+	w.metricsService.RecordTaskFailure(task.WorkspaceID)
+	w.metricsService.RecordTaskDeadLetter(task.WorkspaceID)
+	w.wsService.BroadcastTaskUpdate(task, TaskStatusEvent, map[string]interface{}{
+		"id":     task.ID,
+		"status": "dead_lettered",
+		"error":  attempt.Err.Error(),
+	})
+	w.wsService.BroadcastTaskUpdate(task, TaskDeadLetteredEvent, attempt.DeadLetter)
+	w.propagateFailure(task)
+}
+
+// logFinishError reports a failure to record the outcome of a task
+func (w *WorkerService) logFinishError(task models.Task, err error) {
+	if errors.Is(err, ErrLeaseLost) {
+		w.logger.Warn("Discarding task result, lease no longer held", zap.Uint("task_id", task.ID))
+		return
+	}
+	w.logger.Error("Failed to record task result", zap.Uint("task_id", task.ID), zap.Error(err))
+}
+
+// runHandler looks up the handler for the task type and calls it. If the handler
+// ignores cancellation of its context it is abandoned after a grace period.
+func (w *WorkerService) runHandler(ctx context.Context, task *models.Task) error {
+	handler, ok := w.registry.Get(task.Type)
+	if !ok {
+		return NewTaskError(ErrorClassUnknownType, fmt.Errorf("unknown task type %q: no handler registered", task.Type))
+	}
+
+	var payload json.RawMessage
+	if task.Metadata != "" {
+		payload = json.RawMessage(task.Metadata)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- callHandler(ctx, handler, task.Type, payload)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(handlerStopGracePeriod):
+		w.logger.Warn("Handler did not stop after its context was cancelled, abandoning it",
+			zap.Uint("task_id", task.ID), zap.String("type", task.Type))
+		return context.Cause(ctx)
+	}
+}
+
+// callHandler runs a handler and turns a panic into an error
+func callHandler(ctx context.Context, handler Handler, taskType string, payload json.RawMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = NewTaskError(ErrorClassPanic, fmt.Errorf("handler for task type %q panicked: %v", taskType, r))
+		}
+	}()
+
+	return handler.Handle(ctx, payload)
+}
@@ -0,0 +1,106 @@
+package services_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/task-schedulart/internal/dbtest"
+	"github.com/task-schedulart/models"
+	"github.com/task-schedulart/services"
+	"go.uber.org/zap"
+)
+
+func TestWorkerStopReleasesRunningTasks(t *testing.T) {
+	db := dbtest.Open(t)
+	systemDB := services.SystemDB(db)
+	taskService := services.NewTaskService(systemDB)
+	executionService := services.NewExecutionService(systemDB)
+	bus := services.NewInProcessEventBus(zap.NewNop())
+	t.Cleanup(func() { bus.Close() })
+
+	// The handler runs until the worker stops
+	started := make(chan struct{}, 1)
+	registry := services.NewHandlerRegistry()
+	registry.RegisterFunc("block", func(ctx context.Context, payload json.RawMessage) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	config := services.DefaultWorkerConfig()
+	config.PollInterval = 20 * time.Millisecond
+	worker := services.NewWorkerService(taskService, executionService, services.NewMetricsService(),
+		services.NewWebSocketService(db, bus, zap.NewNop(), services.DefaultWebSocketConfig()),
+		services.NewCalendarService(systemDB), registry, zap.NewNop(), config)
+
+	// reload returns a task as stored
+	reload := func(t *testing.T, id uint) models.Task {
+		t.Helper()
+		var task models.Task
+		if err := systemDB.First(&task, id).Error; err != nil {
+			t.Fatalf("load task: %v", err)
+		}
+		return task
+	}
+	create := func(t *testing.T, name string) models.Task {
+		t.Helper()
+		task := models.Task{Name: name, Type: "block", ScheduleTime: time.Now().Add(-time.Second), Priority: "medium",
+			WorkspaceID: services.DefaultWorkspaceID}
+		if err := systemDB.Create(&task).Error; err != nil {
+			t.Fatalf("create task: %v", err)
+		}
+		return task
+	}
+
+	t.Run("stopped worker", func(t *testing.T) {
+		task := create(t, "stopped")
+		go worker.Start()
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the task did not start")
+		}
+		worker.Stop()
+
+		released := reload(t, task.ID)
+		if released.Status != "pending" || released.RetryCount != 0 || released.LeaseOwner != "" {
+			t.Errorf("task after stopping = status %s, %d retries, lease owner %q, want pending without retries or lease",
+				released.Status, released.RetryCount, released.LeaseOwner)
+		}
+		executions, _, err := executionService.GetTaskExecutions(task.ID, 1, 10)
+		if err != nil {
+			t.Fatalf("GetTaskExecutions: %v", err)
+		}
+		if len(executions) != 1 || executions[0].Outcome != services.ExecutionReleased {
+			t.Errorf("executions = %+v, want one released attempt", executions)
+		}
+
+		// A released task is not recovered as an expired lease later on
+		_, failed, err := taskService.ReleaseExpiredLeases()
+		if err != nil {
+			t.Fatalf("ReleaseExpiredLeases: %v", err)
+		}
+		if len(failed) != 0 || reload(t, task.ID).RetryCount != 0 {
+			t.Errorf("released task counted as %d failed attempts, want none", len(failed))
+		}
+		systemDB.Delete(&models.Task{}, task.ID)
+	})
+
+	t.Run("expired lease", func(t *testing.T) {
+		// A worker that disappears without releasing its task uses up an attempt
+		task := create(t, "crashed")
+		claimed, err := taskService.ClaimDueTasks("crashed-worker", 1, -time.Second)
+		if err != nil || len(claimed) != 1 || claimed[0].ID != task.ID {
+			t.Fatalf("ClaimDueTasks() = %+v, %v, want the task", claimed, err)
+		}
+		_, failed, err := taskService.ReleaseExpiredLeases()
+		if err != nil {
+			t.Fatalf("ReleaseExpiredLeases: %v", err)
+		}
+		if len(failed) != 1 || reload(t, task.ID).RetryCount != 1 {
+			t.Errorf("expired lease counted as %d failed attempts, want 1", len(failed))
+		}
+	})
+}
@@ -0,0 +1,515 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/task-schedulart/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Workflow run statuses
+const (
+	WorkflowRunPending   = "pending"
+	WorkflowRunRunning   = "running"
+	WorkflowRunCompleted = "completed"
+	WorkflowRunFailed    = "failed"
+	WorkflowRunCancelled = "cancelled"
+)
+
+var (
+	// ErrInvalidWorkflow is returned when a workflow definition is rejected
+	ErrInvalidWorkflow = errors.New("invalid workflow")
+	// ErrInvalidParameters is returned when the parameters of a run do not match the workflow
+	ErrInvalidParameters = errors.New("invalid workflow parameters")
+)
+
+// placeholderPattern matches {{name}} parameter placeholders in step names, descriptions and payloads
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+type WorkflowService struct {
+	db *gorm.DB
+}
+
+func NewWorkflowService(db *gorm.DB) *WorkflowService {
+	return &WorkflowService{db: db}
+}
+
+// ForWorkspace returns a copy of the service limited to the data of a workspace
+func (s *WorkflowService) ForWorkspace(workspaceID uint) *WorkflowService {
+	return &WorkflowService{db: WorkspaceDB(s.db, workspaceID)}
+}
+
+// CreateWorkflow validates a workflow and stores it as the next version of its name
+func (s *WorkflowService) CreateWorkflow(workflow *models.Workflow) error {
+	if err := validateWorkflow(workflow); err != nil {
+		return err
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		// Concurrent versions of a name wait for each other instead of both
+		// taking the same number
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "workflows:"+workflow.Name).Error; err != nil {
+			return err
+		}
+
+		var latest int
+		if err := tx.Model(&models.Workflow{}).Where("name = ?", workflow.Name).
+			Select("COALESCE(MAX(version), 0)").Scan(&latest).Error; err != nil {
+			return err
+		}
+
+		workflow.ID = 0
+		workflow.Version = latest + 1
+		return tx.Create(workflow).Error
+	})
+}
+
+// ListWorkflows returns workflows ordered by name and newest version first,
+// optionally filtered by name
+func (s *WorkflowService) ListWorkflows(name string, page, pageSize int) ([]models.Workflow, int64, error) {
+	var workflows []models.Workflow
+	var total int64
+
+	query := s.db.Model(&models.Workflow{})
+	if name != "" {
+		query = query.Where("name = ?", name)
+	}
+
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	err := query.Order("name asc").Order("version desc").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&workflows).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return workflows, total, nil
+}
+
+// GetWorkflow retrieves a workflow version by its ID
+func (s *WorkflowService) GetWorkflow(id uint) (*models.Workflow, error) {
+	var workflow models.Workflow
+	if err := s.db.First(&workflow, id).Error; err != nil {
+		return nil, err
+	}
+	return &workflow, nil
+}
+
+// StartRun instantiates a workflow: a run and one task per step, linked by
+// dependencies, are created in a single transaction. The tasks belong to the
+// actor that started the run, and to its team when it uses a team API key.
+func (s *WorkflowService) StartRun(actor Actor, workflowID uint, params map[string]string, triggeredBy string) (*models.WorkflowRun, error) {
+	if err := s.permissions().Authorize(actor, PermWorkflowRun, nil); err != nil {
+		return nil, err
+	}
+	if err := s.permissions().Authorize(actor, PermTaskCreate, actor.TeamID); err != nil {
+		return nil, err
+	}
+	return s.startRun(workflowID, params, triggeredBy, "", nil, actor.UserID, actor.TeamID)
+}
+
+// startRun instantiates a workflow. A run with a non-empty occurrence key is only
+// created once; if it already exists nil is returned. The tasks of the run are
+// created by createdBy for teamID and follow calendarID when it is set.
+func (s *WorkflowService) startRun(workflowID uint, params map[string]string, triggeredBy, occurrenceKey string, calendarID *uint, createdBy uint, teamID *uint) (*models.WorkflowRun, error) {
+	workflow, err := s.GetWorkflow(workflowID)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := resolveParameters(workflow.Parameters, params)
+	if err != nil {
+		return nil, err
+	}
+
+	steps, err := orderSteps(workflow.Steps)
+	if err != nil {
+		return nil, err
+	}
+
+	run := models.WorkflowRun{
+		WorkflowID:      workflow.ID,
+		WorkflowName:    workflow.Name,
+		WorkflowVersion: workflow.Version,
+		Status:          WorkflowRunPending,
+		Parameters:      values,
+		TriggeredBy:     triggeredBy,
+	}
+	if occurrenceKey != "" {
+		run.OccurrenceKey = &occurrenceKey
+	}
+
+	created := true
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&run)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			created = false
+			return nil
+		}
+
+		now := time.Now()
+		taskIDs := make(map[string]uint, len(steps))
+		for _, step := range steps {
+			task, err := stepTask(step, values)
+			if err != nil {
+				return err
+			}
+			task.ScheduleTime = now
+			task.CalendarID = calendarID
+			task.WorkflowRunID = &run.ID
+			task.CreatedBy = createdBy
+			task.TeamID = teamID
+
+			if err := tx.Create(task).Error; err != nil {
+				return err
+			}
+			taskIDs[step.Key] = task.ID
+
+			upstream := make([]uint, len(step.DependsOn))
+			for i, key := range step.DependsOn {
+				upstream[i] = taskIDs[key]
+			}
+			if err := addDependencies(tx, task.ID, upstream); err != nil {
+				return err
+			}
+			run.Tasks = append(run.Tasks, *task)
+		}
+		return nil
+	})
+	if err != nil || !created {
+		return nil, err
+	}
+
+	return &run, nil
+}
+
+// ListRuns returns the runs of a workflow, newest first
+func (s *WorkflowService) ListRuns(workflowID uint, page, pageSize int) ([]models.WorkflowRun, int64, error) {
+	var runs []models.WorkflowRun
+	var total int64
+
+	query := s.db.Model(&models.WorkflowRun{}).Where("workflow_id = ?", workflowID)
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	err := query.Order("created_at desc").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&runs).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return runs, total, nil
+}
+
+// GetRun retrieves a run together with those of its tasks an actor may read
+func (s *WorkflowService) GetRun(actor Actor, id uint) (*models.WorkflowRun, error) {
+	var run models.WorkflowRun
+	err := s.db.Preload("Tasks", func(db *gorm.DB) *gorm.DB {
+		return db.Scopes(actor.visibleTasks).Order("id asc")
+	}).First(&run, id).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
+
+// permissions returns a permission service on the database of the service
+func (s *WorkflowService) permissions() *PermissionService {
+	return &PermissionService{db: s.db}
+}
+
+// syncWorkflowRuns derives the status of the workflow runs the given tasks belong
+// to and stores the ones that changed. It runs in the transaction that changed the
+// tasks; the runs are locked so that concurrent changes to tasks of the same run
+// are counted one after the other.
+func syncWorkflowRuns(tx *gorm.DB, taskIDs []uint) error {
+	if len(taskIDs) == 0 {
+		return nil
+	}
+
+	var runIDs []uint
+	if err := tx.Model(&models.Task{}).
+		Where("id IN ? AND workflow_run_id IS NOT NULL", taskIDs).
+		Distinct().Pluck("workflow_run_id", &runIDs).Error; err != nil {
+		return err
+	}
+	if len(runIDs) == 0 {
+		return nil
+	}
+
+	var runs []models.WorkflowRun
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id IN ?", runIDs).Order("id asc").Find(&runs).Error; err != nil {
+		return err
+	}
+
+	var rows []struct {
+		WorkflowRunID uint
+		Status        string
+		Count         int
+	}
+	if err := tx.Model(&models.Task{}).
+		Select("workflow_run_id, status, COUNT(*) AS count").
+		Where("workflow_run_id IN ?", runIDs).
+		Group("workflow_run_id, status").
+		Scan(&rows).Error; err != nil {
+		return err
+	}
+
+	counts := make(map[uint]map[string]int, len(runs))
+	for _, row := range rows {
+		if counts[row.WorkflowRunID] == nil {
+			counts[row.WorkflowRunID] = make(map[string]int)
+		}
+		counts[row.WorkflowRunID][row.Status] = row.Count
+	}
+
+	for _, run := range runs {
+		status := runStatus(counts[run.ID])
+		if status == run.Status {
+			continue
+		}
+
+		var finishedAt *time.Time
+		if status != WorkflowRunPending && status != WorkflowRunRunning {
+			now := time.Now()
+			finishedAt = &now
+		}
+		if err := tx.Model(&run).Updates(map[string]interface{}{
+			"status":      status,
+			"finished_at": finishedAt,
+		}).Error; err != nil {
+			return fmt.Errorf("failed to update workflow run %d: %v", run.ID, err)
+		}
+	}
+	return nil
+}
+
+// runStatus derives the status of a run from the number of its tasks in each status
+func runStatus(counts map[string]int) string {
+	total, unfinished := 0, 0
+	for status, count := range counts {
+		total += count
+		if status == "pending" || status == "running" {
+			unfinished += count
+		}
+	}
+
+	switch {
+	case total == 0 || counts["pending"] == total:
+		return WorkflowRunPending
+	case unfinished > 0:
+		return WorkflowRunRunning
+	case counts["failed"] > 0 || counts["dead_lettered"] > 0:
+		return WorkflowRunFailed
+	case counts["cancelled"] > 0:
+		return WorkflowRunCancelled
+	default:
+		return WorkflowRunCompleted
+	}
+}
+
+// validateWorkflow checks the steps and parameters of a workflow definition
+func validateWorkflow(workflow *models.Workflow) error {
+	if strings.TrimSpace(workflow.Name) == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidWorkflow)
+	}
+	if len(workflow.Steps) == 0 {
+		return fmt.Errorf("%w: at least one step is required", ErrInvalidWorkflow)
+	}
+
+	params := make(map[string]bool, len(workflow.Parameters))
+	for _, param := range workflow.Parameters {
+		if !placeholderPattern.MatchString("{{" + param.Name + "}}") {
+			return fmt.Errorf("%w: invalid parameter name %q", ErrInvalidWorkflow, param.Name)
+		}
+		if params[param.Name] {
+			return fmt.Errorf("%w: duplicate parameter %q", ErrInvalidWorkflow, param.Name)
+		}
+		params[param.Name] = true
+	}
+
+	for _, step := range workflow.Steps {
+		if step.Key == "" || len(step.Key) > 100 {
+			return fmt.Errorf("%w: step keys must be between 1 and 100 characters", ErrInvalidWorkflow)
+		}
+		switch step.Priority {
+		case "", "low", "medium", "high":
+		default:
+			return fmt.Errorf("%w: step %q has invalid priority %q", ErrInvalidWorkflow, step.Key, step.Priority)
+		}
+		switch step.OnUpstreamFailure {
+		case "", "skip", "fail":
+		default:
+			return fmt.Errorf("%w: step %q: onUpstreamFailure must be skip or fail", ErrInvalidWorkflow, step.Key)
+		}
+		if step.Timeout < 0 {
+			return fmt.Errorf("%w: step %q: timeout must not be negative", ErrInvalidWorkflow, step.Key)
+		}
+		if err := ValidateRetryPolicy(step.RetryPolicy); err != nil {
+			return fmt.Errorf("%w: step %q: %v", ErrInvalidWorkflow, step.Key, err)
+		}
+
+		text := step.Name + step.Description + string(step.Payload)
+		for _, match := range placeholderPattern.FindAllStringSubmatch(text, -1) {
+			if !params[match[1]] {
+				return fmt.Errorf("%w: step %q uses undeclared parameter %q", ErrInvalidWorkflow, step.Key, match[1])
+			}
+		}
+	}
+
+	_, err := orderSteps(workflow.Steps)
+	return err
+}
+
+// orderSteps returns the steps so that every step comes after its upstream steps
+func orderSteps(steps []models.WorkflowStep) ([]models.WorkflowStep, error) {
+	byKey := make(map[string]models.WorkflowStep, len(steps))
+	for _, step := range steps {
+		if _, exists := byKey[step.Key]; exists {
+			return nil, fmt.Errorf("%w: duplicate step key %q", ErrInvalidWorkflow, step.Key)
+		}
+		byKey[step.Key] = step
+	}
+
+	waiting := make(map[string]int, len(steps))
+	downstream := make(map[string][]string, len(steps))
+	for _, step := range steps {
+		for _, key := range step.DependsOn {
+			if _, exists := byKey[key]; !exists || key == step.Key {
+				return nil, fmt.Errorf("%w: step %q depends on unknown step %q", ErrInvalidWorkflow, step.Key, key)
+			}
+		}
+		upstream := uniqueStrings(step.DependsOn)
+		waiting[step.Key] = len(upstream)
+		for _, key := range upstream {
+			downstream[key] = append(downstream[key], step.Key)
+		}
+	}
+
+	ordered := make([]models.WorkflowStep, 0, len(steps))
+	var ready []string
+	for _, step := range steps {
+		if waiting[step.Key] == 0 {
+			ready = append(ready, step.Key)
+		}
+	}
+	for len(ready) > 0 {
+		key := ready[0]
+		ready = ready[1:]
+		ordered = append(ordered, byKey[key])
+		for _, next := range downstream[key] {
+			waiting[next]--
+			if waiting[next] == 0 {
+				ready = append(ready, next)
+			}
+		}
+	}
+
+	if len(ordered) != len(steps) {
+		return nil, fmt.Errorf("%w: steps contain a dependency cycle", ErrInvalidWorkflow)
+	}
+	return ordered, nil
+}
+
+// resolveParameters applies defaults to the supplied parameters and checks them against the declaration
+func resolveParameters(declared []models.WorkflowParameter, supplied map[string]string) (map[string]string, error) {
+	values := make(map[string]string, len(declared))
+	known := make(map[string]bool, len(declared))
+	for _, param := range declared {
+		known[param.Name] = true
+		value, ok := supplied[param.Name]
+		if !ok {
+			if param.Required {
+				return nil, fmt.Errorf("%w: %q is required", ErrInvalidParameters, param.Name)
+			}
+			value = param.Default
+		}
+		values[param.Name] = value
+	}
+
+	for name := range supplied {
+		if !known[name] {
+			return nil, fmt.Errorf("%w: unknown parameter %q", ErrInvalidParameters, name)
+		}
+	}
+	return values, nil
+}
+
+// stepTask builds the task for a workflow step with the parameters filled in
+func stepTask(step models.WorkflowStep, values map[string]string) (*models.Task, error) {
+	name := step.Name
+	if name == "" {
+		name = step.Key
+	}
+	priority := step.Priority
+	if priority == "" {
+		priority = "medium"
+	}
+
+	task := &models.Task{
+		Name:              substitute(name, values, false),
+		Type:              step.Type,
+		Description:       substitute(step.Description, values, false),
+		Priority:          priority,
+		Status:            "pending",
+		OnUpstreamFailure: step.OnUpstreamFailure,
+		RetryPolicy:       step.RetryPolicy,
+		Timeout:           step.Timeout,
+		Tags:              step.Tags,
+		StepKey:           step.Key,
+	}
+
+	if len(step.Payload) > 0 && string(step.Payload) != "null" {
+		payload := substitute(string(step.Payload), values, true)
+		if !json.Valid([]byte(payload)) {
+			return nil, fmt.Errorf("%w: payload of step %q is not valid JSON after substitution", ErrInvalidParameters, step.Key)
+		}
+		task.Metadata = payload
+	}
+	return task, nil
+}
+
+// substitute replaces {{name}} placeholders with parameter values. Inside JSON the
+// values are escaped so that placeholders can be used within string literals.
+func substitute(text string, values map[string]string, escapeJSON bool) string {
+	return placeholderPattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+		value := values[placeholderPattern.FindStringSubmatch(placeholder)[1]]
+		if escapeJSON {
+			encoded, _ := json.Marshal(value)
+			return string(encoded[1 : len(encoded)-1])
+		}
+		return value
+	})
+}
+
+// uniqueStrings returns values without duplicates
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+	return result
+}
@@ -0,0 +1,192 @@
+package services_test
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/task-schedulart/internal/dbtest"
+	"github.com/task-schedulart/models"
+	"github.com/task-schedulart/services"
+)
+
+// admin may read and run everything in its workspace
+var admin = services.Actor{UserID: 1, Username: "admin", Role: "admin"}
+
+// pipeline is a workflow of two steps, the second depending on the first
+func pipeline(name string) *models.Workflow {
+	return &models.Workflow{
+		Name: name,
+		Steps: []models.WorkflowStep{
+			{Key: "extract", Type: "noop"},
+			{Key: "load", Type: "noop", DependsOn: []string{"extract"}},
+		},
+	}
+}
+
+func TestCreateWorkflowNumbersConcurrentVersions(t *testing.T) {
+	workflowService := services.NewWorkflowService(dbtest.Open(t)).ForWorkspace(services.DefaultWorkspaceID)
+
+	const creates = 8
+	versions := make([]int, creates)
+	errs := make([]error, creates)
+	var wg sync.WaitGroup
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			workflow := pipeline("etl")
+			errs[i] = workflowService.CreateWorkflow(workflow)
+			versions[i] = workflow.Version
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("create %d: %v", i, err)
+		}
+	}
+	sort.Ints(versions)
+	for i, version := range versions {
+		if version != i+1 {
+			t.Fatalf("versions = %v, want 1 to %d", versions, creates)
+		}
+	}
+}
+
+func TestWorkflowRunStatusFollowsTasks(t *testing.T) {
+	db := dbtest.Open(t)
+	workflowService := services.NewWorkflowService(db).ForWorkspace(services.DefaultWorkspaceID)
+	taskService := services.NewTaskService(db).ForWorkspace(services.DefaultWorkspaceID)
+
+	workflow := pipeline("etl")
+	if err := workflowService.CreateWorkflow(workflow); err != nil {
+		t.Fatalf("CreateWorkflow: %v", err)
+	}
+
+	// wantStatus checks the stored status of a run
+	wantStatus := func(t *testing.T, runID uint, want string) {
+		t.Helper()
+		run, err := workflowService.GetRun(admin, runID)
+		if err != nil {
+			t.Fatalf("GetRun: %v", err)
+		}
+		if run.Status != want {
+			t.Fatalf("run status = %q, want %q", run.Status, want)
+		}
+		if finished := run.FinishedAt != nil; finished != (want != services.WorkflowRunPending && want != services.WorkflowRunRunning) {
+			t.Errorf("run finishedAt = %v with status %q", run.FinishedAt, want)
+		}
+	}
+	// claim runs the next due task of the run on a worker
+	claim := func(t *testing.T) models.Task {
+		t.Helper()
+		tasks, err := taskService.ClaimDueTasks("worker", 1, time.Minute)
+		if err != nil || len(tasks) != 1 {
+			t.Fatalf("ClaimDueTasks = %v, %v, want one task", tasks, err)
+		}
+		return tasks[0]
+	}
+
+	t.Run("completed", func(t *testing.T) {
+		run, err := workflowService.StartRun(admin, workflow.ID, nil, "api")
+		if err != nil {
+			t.Fatalf("StartRun: %v", err)
+		}
+		wantStatus(t, run.ID, services.WorkflowRunPending)
+
+		extract := claim(t)
+		wantStatus(t, run.ID, services.WorkflowRunRunning)
+		if err := taskService.CompleteTask(extract.ID, "worker", time.Second); err != nil {
+			t.Fatalf("CompleteTask: %v", err)
+		}
+		wantStatus(t, run.ID, services.WorkflowRunRunning)
+
+		load := claim(t)
+		if err := taskService.CompleteTask(load.ID, "worker", time.Second); err != nil {
+			t.Fatalf("CompleteTask: %v", err)
+		}
+		wantStatus(t, run.ID, services.WorkflowRunCompleted)
+	})
+
+	t.Run("failed upstream", func(t *testing.T) {
+		run, err := workflowService.StartRun(admin, workflow.ID, nil, "api")
+		if err != nil {
+			t.Fatalf("StartRun: %v", err)
+		}
+
+		extract := claim(t)
+		if _, err := taskService.FailAttempt(extract, "worker", services.Permanent(errors.New("boom"))); err != nil {
+			t.Fatalf("FailAttempt: %v", err)
+		}
+		wantStatus(t, run.ID, services.WorkflowRunRunning)
+		if _, err := taskService.PropagateUpstreamFailure(extract.ID); err != nil {
+			t.Fatalf("PropagateUpstreamFailure: %v", err)
+		}
+		wantStatus(t, run.ID, services.WorkflowRunFailed)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		run, err := workflowService.StartRun(admin, workflow.ID, nil, "api")
+		if err != nil {
+			t.Fatalf("StartRun: %v", err)
+		}
+
+		for _, task := range run.Tasks {
+			if _, err := taskService.CancelTask(task.ID); err != nil {
+				t.Fatalf("CancelTask: %v", err)
+			}
+		}
+		wantStatus(t, run.ID, services.WorkflowRunCancelled)
+	})
+}
+
+func TestWorkflowRunTasksBelongToTheActor(t *testing.T) {
+	workflowService := services.NewWorkflowService(dbtest.Open(t)).ForWorkspace(services.DefaultWorkspaceID)
+
+	workflow := pipeline("etl")
+	if err := workflowService.CreateWorkflow(workflow); err != nil {
+		t.Fatalf("CreateWorkflow: %v", err)
+	}
+
+	alice := services.Actor{UserID: 10, Username: "alice", Role: "user"}
+	bob := services.Actor{UserID: 11, Username: "bob", Role: "user"}
+	run, err := workflowService.StartRun(alice, workflow.ID, nil, "api")
+	if err != nil {
+		t.Fatalf("StartRun: %v", err)
+	}
+	for _, task := range run.Tasks {
+		if task.CreatedBy != alice.UserID {
+			t.Errorf("task %d createdBy = %d, want %d", task.ID, task.CreatedBy, alice.UserID)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		actor services.Actor
+		tasks int
+	}{
+		{"starter", alice, 2},
+		{"admin", admin, 2},
+		{"other user", bob, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := workflowService.GetRun(tt.actor, run.ID)
+			if err != nil {
+				t.Fatalf("GetRun: %v", err)
+			}
+			if len(got.Tasks) != tt.tasks {
+				t.Errorf("GetRun returned %d tasks, want %d", len(got.Tasks), tt.tasks)
+			}
+		})
+	}
+
+	viewer := services.Actor{UserID: 12, Username: "carol", Role: "viewer"}
+	if _, err := workflowService.StartRun(viewer, workflow.ID, nil, "api"); !errors.Is(err, services.ErrPermissionDenied) {
+		t.Errorf("StartRun as viewer error = %v, want %v", err, services.ErrPermissionDenied)
+	}
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrNoWorkspace is returned for queries on workspace data through a session
+// that is neither limited to a workspace nor a system session
+var ErrNoWorkspace = errors.New("query on workspace data without a workspace")
+
+// workspaceTables are the tables whose rows belong to a workspace
+var workspaceTables = map[string]bool{
+	"tasks":                  true,
+	"task_executions":        true,
+	"task_dependencies":      true,
+	"dead_letters":           true,
+	"workflows":              true,
+	"workflow_runs":          true,
+	"calendars":              true,
+	"teams":                  true,
+	"notification_templates": true,
+	"notification_channels":  true,
+}
+
+type workspaceKey struct{}
+type systemKey struct{}
+
+// WorkspaceDB returns a session of db limited to the rows of a workspace. Queries
+// only see the rows of the workspace and new rows are created in it.
+func WorkspaceDB(db *gorm.DB, workspaceID uint) *gorm.DB {
+	return db.WithContext(context.WithValue(db.Statement.Context, workspaceKey{}, workspaceID))
+}
+
+// SystemDB returns a session of db for background processing, such as the worker
+// and the recurring scheduler, that sees the rows of every workspace. Rows it
+// creates must have their workspace set.
+func SystemDB(db *gorm.DB) *gorm.DB {
+	return db.WithContext(context.WithValue(db.Statement.Context, systemKey{}, true))
+}
+
+// sessionWorkspace returns the workspace a session is limited to, if any, and
+// whether it is a system session
+func sessionWorkspace(db *gorm.DB) (uint, bool, bool) {
+	ctx := db.Statement.Context
+	if ctx == nil {
+		return 0, false, false
+	}
+	if id, ok := ctx.Value(workspaceKey{}).(uint); ok {
+		return id, true, false
+	}
+	system, _ := ctx.Value(systemKey{}).(bool)
+	return 0, false, system
+}
+
+// RegisterWorkspaceScope installs the callbacks that enforce workspace isolation:
+// queries, updates and deletes on workspace tables get a condition on the
+// workspace of the session and new rows are created in it. Sessions that are
+// neither limited to a workspace nor system sessions fail with ErrNoWorkspace.
+// Raw SQL is not rewritten; it must only follow rows that were already scoped.
+func RegisterWorkspaceScope(db *gorm.DB) error {
+	callbacks := db.Callback()
+	if err := callbacks.Query().Before("gorm:query").Register("workspace:query", scopeWorkspace); err != nil {
+		return err
+	}
+	if err := callbacks.Row().Before("gorm:row").Register("workspace:row", scopeWorkspace); err != nil {
+		return err
+	}
+	if err := callbacks.Update().Before("gorm:update").Register("workspace:update", scopeWorkspace); err != nil {
+		return err
+	}
+	if err := callbacks.Delete().Before("gorm:delete").Register("workspace:delete", scopeWorkspace); err != nil {
+		return err
+	}
+	return callbacks.Create().Before("gorm:create").Register("workspace:create", assignWorkspace)
+}
+
+// scopeWorkspace limits a statement on a workspace table to the workspace of its session
+func scopeWorkspace(db *gorm.DB) {
+	if db.Error != nil || db.Statement.SQL.Len() > 0 || !workspaceTables[db.Statement.Table] {
+		return
+	}
+
+	workspaceID, scoped, system := sessionWorkspace(db)
+	if !scoped {
+		if !system {
+			db.AddError(fmt.Errorf("%w: %s", ErrNoWorkspace, db.Statement.Table))
+		}
+		return
+	}
+
+	db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: "workspace_id"}, Value: workspaceID},
+	}})
+}
+
+// assignWorkspace creates new rows of workspace tables in the workspace of the
+// session, whatever workspace they were given. System sessions keep the
+// workspace of the rows, which must be set.
+func assignWorkspace(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Schema == nil || !workspaceTables[db.Statement.Table] {
+		return
+	}
+	field := db.Statement.Schema.LookUpField("WorkspaceID")
+	if field == nil {
+		return
+	}
+
+	workspaceID, scoped, system := sessionWorkspace(db)
+	if !scoped && !system {
+		db.AddError(fmt.Errorf("%w: %s", ErrNoWorkspace, db.Statement.Table))
+		return
+	}
+
+	assign := func(row reflect.Value) {
+		if scoped {
+			db.AddError(field.Set(db.Statement.Context, row, workspaceID))
+			return
+		}
+		if _, zero := field.ValueOf(db.Statement.Context, row); zero {
+			db.AddError(fmt.Errorf("%w: %s row created without a workspace", ErrNoWorkspace, db.Statement.Table))
+		}
+	}
+
+	switch rows := db.Statement.ReflectValue; rows.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rows.Len(); i++ {
+			assign(reflect.Indirect(rows.Index(i)))
+		}
+	case reflect.Struct:
+		assign(rows)
+	}
+}
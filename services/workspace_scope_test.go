@@ -0,0 +1,181 @@
+package services_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/task-schedulart/internal/dbtest"
+	"github.com/task-schedulart/models"
+	"github.com/task-schedulart/services"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+func TestWorkspaceScope(t *testing.T) {
+	db := dbtest.Open(t)
+	other := services.Workspace{Name: "other"}
+	if err := services.NewWorkspaceService(db).CreateWorkspace(&other); err != nil {
+		t.Fatalf("CreateWorkspace: %v", err)
+	}
+	home := services.WorkspaceDB(db, services.DefaultWorkspaceID)
+	away := services.WorkspaceDB(db, other.ID)
+
+	// Rows are created in the workspace of the session, whatever they say
+	homeTask := models.Task{Name: "home", ScheduleTime: time.Now(), Priority: "medium", WorkspaceID: other.ID}
+	if err := home.Create(&homeTask).Error; err != nil {
+		t.Fatalf("create in workspace: %v", err)
+	}
+	if homeTask.WorkspaceID != services.DefaultWorkspaceID {
+		t.Errorf("task created in workspace %d, want %d", homeTask.WorkspaceID, services.DefaultWorkspaceID)
+	}
+	awayTask := models.Task{Name: "away", ScheduleTime: time.Now(), Priority: "medium"}
+	if err := away.Create(&awayTask).Error; err != nil {
+		t.Fatalf("create in other workspace: %v", err)
+	}
+
+	t.Run("queries see their workspace", func(t *testing.T) {
+		var tasks []models.Task
+		if err := home.Find(&tasks).Error; err != nil {
+			t.Fatalf("Find: %v", err)
+		}
+		if len(tasks) != 1 || tasks[0].ID != homeTask.ID {
+			t.Errorf("workspace sees %+v, want only its own task", tasks)
+		}
+		if err := home.First(&models.Task{}, awayTask.ID).Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Errorf("First(task of other workspace) error = %v, want %v", err, gorm.ErrRecordNotFound)
+		}
+		var count int64
+		if err := away.Model(&models.Task{}).Count(&count).Error; err != nil || count != 1 {
+			t.Errorf("Count() = %d, %v, want 1", count, err)
+		}
+	})
+
+	t.Run("updates and deletes stay in their workspace", func(t *testing.T) {
+		result := home.Model(&models.Task{}).Where("id = ?", awayTask.ID).Update("name", "renamed")
+		if result.Error != nil || result.RowsAffected != 0 {
+			t.Errorf("Update(task of other workspace) = %d rows, %v, want none", result.RowsAffected, result.Error)
+		}
+		result = home.Delete(&models.Task{}, awayTask.ID)
+		if result.Error != nil || result.RowsAffected != 0 {
+			t.Errorf("Delete(task of other workspace) = %d rows, %v, want none", result.RowsAffected, result.Error)
+		}
+		var task models.Task
+		if err := away.First(&task, awayTask.ID).Error; err != nil || task.Name != "away" || task.DeletedAt.Valid {
+			t.Errorf("task of other workspace = %+v, %v, want it untouched", task, err)
+		}
+	})
+
+	t.Run("dependencies stay in their workspace", func(t *testing.T) {
+		system := services.SystemDB(db)
+		if _, err := services.NewTaskService(system).AddDependencies(homeTask.ID, []uint{awayTask.ID}); !errors.Is(err, services.ErrUnknownUpstream) {
+			t.Errorf("AddDependencies(task of other workspace) error = %v, want %v", err, services.ErrUnknownUpstream)
+		}
+
+		// The graph queries are raw SQL and must not follow an edge across workspaces
+		cross := models.TaskDependency{TaskID: homeTask.ID, DependsOnID: awayTask.ID, WorkspaceID: services.DefaultWorkspaceID}
+		if err := system.Create(&cross).Error; err != nil {
+			t.Fatalf("create dependency: %v", err)
+		}
+		defer system.Delete(&cross)
+		graph, err := services.NewTaskService(home).GetTaskGraph(services.Actor{Role: "admin"}, homeTask.ID)
+		if err != nil {
+			t.Fatalf("GetTaskGraph: %v", err)
+		}
+		if len(graph.Nodes) != 1 || graph.Nodes[0].ID != homeTask.ID || len(graph.Edges) != 0 {
+			t.Errorf("graph = %+v, want only the task of the workspace", graph)
+		}
+		var edges int64
+		if err := away.Model(&models.TaskDependency{}).Count(&edges).Error; err != nil || edges != 0 {
+			t.Errorf("other workspace sees %d dependencies, %v, want none", edges, err)
+		}
+	})
+
+	t.Run("notification settings stay in their workspace", func(t *testing.T) {
+		notifications := services.NewNotificationService(db, zap.NewNop())
+		awayChannel := services.NotificationChannel{Type: "webhook", Config: json.RawMessage(`{"url": "https://example.com/hook"}`), Enabled: true}
+		if err := notifications.ForWorkspace(other.ID).ConfigureChannel(&awayChannel); err != nil {
+			t.Fatalf("ConfigureChannel: %v", err)
+		}
+		awayTemplate := services.NotificationTemplate{Type: services.TaskStatusEvent, Template: "{{.event}}"}
+		if err := notifications.ForWorkspace(other.ID).CreateNotificationTemplate(&awayTemplate); err != nil {
+			t.Fatalf("CreateNotificationTemplate: %v", err)
+		}
+
+		for _, model := range []interface{}{&services.NotificationChannel{}, &services.NotificationTemplate{}} {
+			var count int64
+			if err := home.Model(model).Count(&count).Error; err != nil || count != 0 {
+				t.Errorf("workspace sees %d %T rows of another workspace, %v, want none", count, model, err)
+			}
+		}
+
+		homeNotifications := notifications.ForWorkspace(services.DefaultWorkspaceID)
+		disabled := awayChannel
+		disabled.Enabled = false
+		if err := homeNotifications.ConfigureChannel(&disabled); !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Errorf("ConfigureChannel(channel of other workspace) error = %v, want %v", err, gorm.ErrRecordNotFound)
+		}
+		renamed := awayTemplate
+		renamed.Template = "changed"
+		if err := homeNotifications.UpdateNotificationTemplate(&renamed); !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Errorf("UpdateNotificationTemplate(template of other workspace) error = %v, want %v", err, gorm.ErrRecordNotFound)
+		}
+
+		var channel services.NotificationChannel
+		if err := away.First(&channel, awayChannel.ID).Error; err != nil || !channel.Enabled {
+			t.Errorf("channel of other workspace = %+v, %v, want it untouched", channel, err)
+		}
+		var template services.NotificationTemplate
+		if err := away.First(&template, awayTemplate.ID).Error; err != nil || template.Template != "{{.event}}" {
+			t.Errorf("template of other workspace = %+v, %v, want it untouched", template, err)
+		}
+	})
+
+	t.Run("sessions without a workspace fail", func(t *testing.T) {
+		tests := []struct {
+			name string
+			run  func(db *gorm.DB) error
+		}{
+			{"find", func(db *gorm.DB) error { return db.Find(&[]models.Task{}).Error }},
+			{"count", func(db *gorm.DB) error { var n int64; return db.Model(&models.Task{}).Count(&n).Error }},
+			{"updates", func(db *gorm.DB) error {
+				return db.Model(&models.Task{}).Where("id = ?", homeTask.ID).Updates(map[string]interface{}{"name": "x"}).Error
+			}},
+			{"delete", func(db *gorm.DB) error { return db.Delete(&models.Task{}, homeTask.ID).Error }},
+			{"create", func(db *gorm.DB) error {
+				return db.Create(&models.Task{Name: "x", ScheduleTime: time.Now(), Priority: "medium", WorkspaceID: services.DefaultWorkspaceID}).Error
+			}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if err := tt.run(db); !errors.Is(err, services.ErrNoWorkspace) {
+					t.Fatalf("error = %v, want %v", err, services.ErrNoWorkspace)
+				}
+			})
+		}
+
+		var task models.Task
+		if err := home.First(&task, homeTask.ID).Error; err != nil || task.Name != "home" {
+			t.Errorf("task after rejected writes = %+v, %v, want it untouched", task, err)
+		}
+	})
+
+	t.Run("system sessions see every workspace", func(t *testing.T) {
+		system := services.SystemDB(db)
+		var count int64
+		if err := system.Model(&models.Task{}).Count(&count).Error; err != nil || count != 2 {
+			t.Errorf("Count() = %d, %v, want 2", count, err)
+		}
+		if err := system.Create(&models.Task{Name: "orphan", ScheduleTime: time.Now(), Priority: "medium"}).Error; !errors.Is(err, services.ErrNoWorkspace) {
+			t.Errorf("Create(task without workspace) error = %v, want %v", err, services.ErrNoWorkspace)
+		}
+		created := models.Task{Name: "system", ScheduleTime: time.Now(), Priority: "medium", WorkspaceID: other.ID}
+		if err := system.Create(&created).Error; err != nil || created.WorkspaceID != other.ID {
+			t.Errorf("Create(task with workspace) = workspace %d, %v, want %d", created.WorkspaceID, err, other.ID)
+		}
+		if err := system.Model(&models.Task{}).Where("id = ?", awayTask.ID).Update("name", "moved").Error; err != nil {
+			t.Errorf("Update: %v", err)
+		}
+	})
+}
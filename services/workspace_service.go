@@ -0,0 +1,101 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DefaultWorkspaceID is the workspace of data that existed before workspaces and
+// of users that register themselves. Its admins manage the other workspaces.
+const DefaultWorkspaceID uint = 1
+
+var (
+	// ErrInvalidWorkspace is returned when a new workspace is rejected
+	ErrInvalidWorkspace = errors.New("invalid workspace")
+	// ErrWorkspaceExists is returned when creating a workspace under a name that is taken
+	ErrWorkspaceExists = errors.New("workspace name already taken")
+	// ErrUnknownWorkspace is returned when a workspace that does not exist is referenced
+	ErrUnknownWorkspace = errors.New("unknown workspace")
+)
+
+// Workspace is a tenant of the deployment. Tasks, workflows, calendars, teams and
+// their history belong to one workspace and are invisible from every other.
+// Each user belongs to one workspace.
+type Workspace struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Name      string    `json:"name" gorm:"type:varchar(100);not null;uniqueIndex"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type WorkspaceService struct {
+	db *gorm.DB
+}
+
+func NewWorkspaceService(db *gorm.DB) *WorkspaceService {
+	return &WorkspaceService{db: db}
+}
+
+// CreateWorkspace stores a new workspace
+func (s *WorkspaceService) CreateWorkspace(workspace *Workspace) error {
+	workspace.Name = strings.TrimSpace(workspace.Name)
+	if workspace.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidWorkspace)
+	}
+
+	var taken int64
+	if err := s.db.Model(&Workspace{}).Where("name = ?", workspace.Name).Count(&taken).Error; err != nil {
+		return err
+	}
+	if taken > 0 {
+		return ErrWorkspaceExists
+	}
+
+	workspace.ID = 0
+	return s.db.Create(workspace).Error
+}
+
+// ListWorkspaces returns every workspace ordered by ID
+func (s *WorkspaceService) ListWorkspaces() ([]Workspace, error) {
+	var workspaces []Workspace
+	err := s.db.Order("id").Find(&workspaces).Error
+	return workspaces, err
+}
+
+// MoveUser makes a user a member of another workspace. Its sessions and API keys
+// carry the old workspace, so they are revoked and the user has to log in again.
+func (s *WorkspaceService) MoveUser(userID, workspaceID uint) (*User, error) {
+	var user User
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&Workspace{}, workspaceID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("%w: %d", ErrUnknownWorkspace, workspaceID)
+			}
+			return err
+		}
+		if err := tx.First(&user, userID).Error; err != nil {
+			return err
+		}
+		if user.WorkspaceID == workspaceID {
+			return nil
+		}
+
+		now := time.Now()
+		if err := tx.Model(&user).Update("workspace_id", workspaceID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&Session{}).Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&APIKey{}).Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
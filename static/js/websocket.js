@@ -11,9 +11,8 @@ function connectWebSocket() {
     ws = new WebSocket(wsUrl);
 
     ws.onopen = () => {
-        console.log('WebSocket connected');
-        reconnectAttempts = 0;
-        updateConnectionStatus('connected');
+        // Authenticate with the first message, keeping the token out of the URL
+        ws.send(JSON.stringify({ type: 'auth', token: localStorage.getItem('accessToken') }));
     };
 
     ws.onclose = () => {
@@ -54,6 +53,11 @@ function updateConnectionStatus(status) {
 
 function handleWebSocketMessage(data) {
     switch (data.event) {
+        case 'authenticated':
+            console.log('WebSocket connected');
+            reconnectAttempts = 0;
+            updateConnectionStatus('connected');
+            break;
         case 'task.created':
             addTaskToList(data.data);
             showNotification('New task created', 'success');
@@ -71,6 +75,9 @@ function handleWebSocketMessage(data) {
         case 'task.progress':
             updateTaskProgress(data.data);
             break;
+        case 'task.dead_lettered':
+            showNotification(`Task ${data.data.taskId} moved to dead-letter queue: ${data.data.finalError}`, 'error');
+            break;
         default:
             console.log('Unknown event:', data.event);
     }